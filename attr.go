@@ -0,0 +1,95 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"sync"
+)
+
+// Conn attributes.
+//
+// Session()/SetSession() used to be shared by the user and the library:
+// nbhttp stored the *nbhttp.Parser and extension/tls stored the *tls.Conn in it.
+// The library now keeps its per-conn state in the attribute store, keyed by
+// unexported key types, and Session is left for users only.
+//
+// Migration for the code that got the library's state by Session():
+//
+//	c.Session().(*nbhttp.Parser) -> nbhttp.ConnParser(c)
+//	c.Session().(*tls.Conn)      -> tls.GetConn(c), extension/tls
+//
+// The websocket Conn upgraded from a conn can be got by websocket.GetConn(c).
+//
+// Applications should define their own key types the same way as context keys,
+// to avoid collisions between packages:
+//
+//	type userKey struct{}
+//	c.SetAttr(userKey{}, user)
+//	user, _ := c.Attr(userKey{}).(*User)
+
+// attrs is a small concurrency-safe key/value store,
+// a conn usually holds only a few attributes, a slice is cheaper than a map.
+type attrs struct {
+	mux    sync.Mutex
+	keys   []interface{}
+	values []interface{}
+}
+
+// Attr returns the attribute of key, or nil if not set.
+func (c *Conn) Attr(key interface{}) interface{} {
+	c.attrs.mux.Lock()
+	defer c.attrs.mux.Unlock()
+	for i, k := range c.attrs.keys {
+		if k == key {
+			return c.attrs.values[i]
+		}
+	}
+	return nil
+}
+
+// SetAttr sets the attribute of key, key must be comparable.
+func (c *Conn) SetAttr(key interface{}, value interface{}) {
+	c.attrs.mux.Lock()
+	defer c.attrs.mux.Unlock()
+	for i, k := range c.attrs.keys {
+		if k == key {
+			c.attrs.values[i] = value
+			return
+		}
+	}
+	c.attrs.keys = append(c.attrs.keys, key)
+	c.attrs.values = append(c.attrs.values, value)
+}
+
+// DeleteAttr deletes the attribute of key.
+func (c *Conn) DeleteAttr(key interface{}) {
+	c.attrs.mux.Lock()
+	defer c.attrs.mux.Unlock()
+	for i, k := range c.attrs.keys {
+		if k == key {
+			last := len(c.attrs.keys) - 1
+			c.attrs.keys[i], c.attrs.values[i] = c.attrs.keys[last], c.attrs.values[last]
+			c.attrs.keys[last], c.attrs.values[last] = nil, nil
+			c.attrs.keys = c.attrs.keys[:last]
+			c.attrs.values = c.attrs.values[:last]
+			return
+		}
+	}
+}
+
+// LoadOrStoreAttr returns the existing attribute of key if present,
+// otherwise it stores and returns value, loaded reports whether the value was present.
+func (c *Conn) LoadOrStoreAttr(key interface{}, value interface{}) (actual interface{}, loaded bool) {
+	c.attrs.mux.Lock()
+	defer c.attrs.mux.Unlock()
+	for i, k := range c.attrs.keys {
+		if k == key {
+			return c.attrs.values[i], true
+		}
+	}
+	c.attrs.keys = append(c.attrs.keys, key)
+	c.attrs.values = append(c.attrs.values, value)
+	return value, false
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"time"
+)
+
+// Clock provides the time source of a Gopher's timers and deadlines.
+// It's set to the system clock by default, tests can replace it with a virtual clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) ClockTimer
+}
+
+// ClockTimer is the timer created by Clock, used as time.Timer.
+type ClockTimer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// SystemClock implements Clock by package time.
+type SystemClock struct{}
+
+// Now .
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer .
+func (SystemClock) NewTimer(d time.Duration) ClockTimer {
+	return &systemTimer{Timer: time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t *systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
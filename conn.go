@@ -6,9 +6,7 @@ package nbio
 
 import (
 	"net"
-	"runtime"
 	"time"
-	"unsafe"
 
 	"github.com/lesismal/nbio/logging"
 )
@@ -72,32 +70,85 @@ func (c *Conn) Execute(f func()) {
 	c.mux.Unlock()
 
 	if isHead {
-		c.g.Execute(func() {
-			i := 0
-			for {
-				func() {
-					defer func() {
-						if err := recover(); err != nil {
-							const size = 64 << 10
-							buf := make([]byte, size)
-							buf = buf[:runtime.Stack(buf, false)]
-							logging.Error("conn execute failed: %v\n%v\n", err, *(*string)(unsafe.Pointer(&buf)))
-						}
-					}()
-					f()
+		c.g.Execute(c.execLoop(f))
+	}
+}
+
+// TryExecute is like Execute, but if f would start a new run of the conn's tasks and the
+// Gopher's TryExecute rejects it, f is removed without being called and the error is returned.
+func (c *Conn) TryExecute(f func()) error {
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return errClosed
+	}
+
+	isHead := (len(c.execList) == 0)
+	c.execList = append(c.execList, f)
+	c.mux.Unlock()
+
+	if !isHead {
+		return nil
+	}
+	if c.g.TryExecute == nil {
+		c.g.Execute(c.execLoop(f))
+		return nil
+	}
+	err := c.g.TryExecute(c.execLoop(f))
+	if err != nil {
+		c.mux.Lock()
+		c.execList = c.execList[:copy(c.execList, c.execList[1:])]
+		if len(c.execList) > 0 {
+			// the tasks pushed after f are still waiting for a run.
+			next := c.execList[0]
+			c.mux.Unlock()
+			c.g.Execute(c.execLoop(next))
+			return err
+		}
+		c.mux.Unlock()
+	}
+	return err
+}
+
+// Logger returns the logger of the Gopher with the fields conn and remote of c.
+func (c *Conn) Logger() logging.FieldLogger {
+	var logger logging.FieldLogger
+	if c.g != nil {
+		logger = c.g.logger
+	} else {
+		logger = logging.Adapt(nil)
+	}
+	remote := ""
+	if addr := c.RemoteAddr(); addr != nil {
+		remote = addr.String()
+	}
+	return logger.With(logging.Any("conn", c.Hash()), logging.Any("remote", remote))
+}
+
+// execLoop returns the func that runs f and the tasks pushed after it one by one.
+func (c *Conn) execLoop(f func()) func() {
+	return func() {
+		i := 0
+		for {
+			func() {
+				defer func() {
+					if err := recover(); err != nil {
+						c.g.logSampler.LogPanic(c.Logger(), "conn execute failed", err)
+					}
 				}()
+				f()
+			}()
 
-				c.mux.Lock()
-				i++
-				if len(c.execList) == i {
-					c.execList = c.execList[0:0]
-					c.mux.Unlock()
-					return
-				}
-				f = c.execList[i]
+			c.mux.Lock()
+			i++
+			if len(c.execList) == i {
+				c.execList = c.execList[0:0]
 				c.mux.Unlock()
+				return
 			}
-		})
+			f = c.execList[i]
+			c.mux.Unlock()
+		}
 	}
 }
 
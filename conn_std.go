@@ -29,11 +29,27 @@ type Conn struct {
 	closed   bool
 	closeErr error
 
+	rLimiters []*RateLimiter
+	wLimiters []*RateLimiter
+
+	// rHeld is closed by ResumeRead or Close to wake the reading goroutine up.
+	rHeld chan struct{}
+
+	idle idleTimer
+
+	dataRead bool
+
 	ReadBuffer []byte
 
 	// user session
 	session interface{}
 
+	// ctxMux guards ctx, so the close paths cancel it without mux.
+	ctxMux sync.Mutex
+	ctx    *connContext
+
+	attrs attrs
+
 	execList []func()
 
 	cache *bytes.Buffer
@@ -65,10 +81,28 @@ func (c *Conn) Read(b []byte) (int, error) {
 
 func (c *Conn) read(b []byte) (int, error) {
 	c.g.beforeRead(c)
-	nread, err := c.conn.Read(b)
+	c.mux.Lock()
+	held := c.rHeld
+	limiters := c.rLimiters
+	c.mux.Unlock()
+	if held != nil {
+		<-held
+	}
+	quota := c.waitQuota(limiters, len(b))
+	nread, err := c.conn.Read(b[:quota])
+	if nread > 0 {
+		refundTokens(limiters, quota-nread)
+	}
 	if c.closeErr == nil {
 		c.closeErr = err
 	}
+	if nread > 0 {
+		c.touch()
+	}
+	if nread > 0 && !c.dataRead {
+		c.dataRead = true
+		c.g.tracer.OnFirstByte(c)
+	}
 	if c.g.onRead != nil {
 		if nread > 0 {
 			if c.cache == nil {
@@ -88,7 +122,10 @@ func (c *Conn) read(b []byte) (int, error) {
 func (c *Conn) Write(b []byte) (int, error) {
 	c.g.beforeWrite(c)
 
-	nwrite, err := c.conn.Write(b)
+	nwrite, err := c.writeLimited(b)
+	if nwrite > 0 {
+		c.touch()
+	}
 	if err != nil {
 		if c.closeErr == nil {
 			c.closeErr = err
@@ -102,8 +139,24 @@ func (c *Conn) Write(b []byte) (int, error) {
 
 // Writev wraps buffers.WriteTo/syscall.Writev
 func (c *Conn) Writev(in [][]byte) (int, error) {
-	buffers := net.Buffers(in)
-	nwrite, err := buffers.WriteTo(c.conn)
+	var nwrite int64
+	var err error
+	if len(c.wLimiters) > 0 {
+		for _, b := range in {
+			n, e := c.writeLimited(b)
+			nwrite += int64(n)
+			if e != nil {
+				err = e
+				break
+			}
+		}
+	} else {
+		buffers := net.Buffers(in)
+		nwrite, err = buffers.WriteTo(c.conn)
+	}
+	if nwrite > 0 {
+		c.touch()
+	}
 	if err != nil {
 		if c.closeErr == nil {
 			c.closeErr = err
@@ -122,16 +175,59 @@ func (c *Conn) Close() error {
 	if !c.closed {
 		c.closed = true
 		err := c.conn.Close()
+		c.stopIdleTimer()
+		if c.rHeld != nil {
+			close(c.rHeld)
+			c.rHeld = nil
+		}
 		c.mux.Unlock()
 		if c.g != nil {
 			c.g.pollers[c.Hash()%len(c.g.pollers)].deleteConn(c)
 		}
+		c.cancelContext(c.closeErr)
 		return err
 	}
 	c.mux.Unlock()
 	return nil
 }
 
+// PauseRead stops reading the conn until ResumeRead is called, the data not read is held
+// by the kernel, so the peer is throttled by TCP flow control.
+func (c *Conn) PauseRead() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.closed && c.rHeld == nil {
+		c.rHeld = make(chan struct{})
+	}
+}
+
+// ResumeRead resumes reading the conn paused by PauseRead.
+func (c *Conn) ResumeRead() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.rHeld != nil {
+		close(c.rHeld)
+		c.rHeld = nil
+	}
+}
+
+// ReadPaused reports whether reading the conn is paused by PauseRead.
+func (c *Conn) ReadPaused() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.rHeld != nil
+}
+
+// WriteBuffered returns 0 since the data is written to the net.Conn synchronously.
+func (c *Conn) WriteBuffered() int {
+	return 0
+}
+
+// WriteOffsets returns 0, 0 since the data is written to the net.Conn synchronously.
+func (c *Conn) WriteOffsets() (written, sent int64) {
+	return 0, 0
+}
+
 // CloseWithError .
 func (c *Conn) CloseWithError(err error) error {
 	if c.closeErr == nil {
@@ -229,6 +325,7 @@ func (c *Conn) SetLinger(onoff int32, linger int32) error {
 }
 
 // Session returns user session
+// It's reserved for users, the library keeps its own state by Attr, see attr.go.
 func (c *Conn) Session() interface{} {
 	return c.session
 }
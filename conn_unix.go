@@ -13,8 +13,6 @@ import (
 	"sync"
 	"syscall"
 	"time"
-
-	"github.com/lesismal/nbio/mempool"
 )
 
 // Conn implements net.Conn.
@@ -27,13 +25,25 @@ type Conn struct {
 
 	rTimer *htimer
 	wTimer *htimer
+	idle   idleTimer
 
 	writeBuffer []byte
+	// written is the total size of the data written, including writeBuffer.
+	written int64
+
+	rLimiters   []*RateLimiter
+	wLimiters   []*RateLimiter
+	rLimitTimer *htimer
+	wLimitTimer *htimer
+	rPaused     bool
+	rHeld       bool
 
 	closed   bool
 	isWAdded bool
 	closeErr error
 
+	dataRead bool
+
 	lAddr net.Addr
 	rAddr net.Addr
 
@@ -41,6 +51,12 @@ type Conn struct {
 
 	session interface{}
 
+	// ctxMux guards ctx, so the close paths cancel it without mux.
+	ctxMux sync.Mutex
+	ctx    *connContext
+
+	attrs attrs
+
 	chWaitWrite chan struct{}
 
 	execList []func()
@@ -61,10 +77,43 @@ func (c *Conn) Read(b []byte) (int, error) {
 		c.mux.Unlock()
 		return 0, errClosed
 	}
-	
-	n, err := syscall.Read(c.fd, b)
+	if c.rHeld {
+		c.mux.Unlock()
+		return 0, syscall.EAGAIN
+	}
+
+	quota := len(b)
+	if len(c.rLimiters) > 0 {
+		var wait time.Duration
+		quota, wait = takeTokens(c.rLimiters, c.g.clock.Now(), len(b))
+		if quota == 0 {
+			c.pauseRead(wait)
+			c.mux.Unlock()
+			return 0, syscall.EAGAIN
+		}
+	}
+
+	n, err := syscall.Read(c.fd, b[:quota])
+	if quota < len(b) {
+		if n > 0 {
+			refundTokens(c.rLimiters, quota-n)
+		} else {
+			refundTokens(c.rLimiters, quota)
+		}
+		// the poller stops reading after a short read, pause until the next budget.
+		if n == quota {
+			c.pauseRead(limitDelay(c.rLimiters, c.g.clock.Now(), len(b)))
+		}
+	}
 	c.mux.Unlock()
 	if err == nil {
+		if n > 0 {
+			c.touch()
+		}
+		if n > 0 && !c.dataRead {
+			c.dataRead = true
+			c.g.tracer.OnFirstByte(c)
+		}
 		c.g.afterRead(c)
 	}
 
@@ -91,12 +140,16 @@ func (c *Conn) Write(b []byte) (int, error) {
 		return n, err
 	}
 
+	if n > 0 {
+		c.written += int64(n)
+		c.touch()
+	}
 	if len(c.writeBuffer) == 0 {
 		if c.wTimer != nil {
 			c.wTimer.Stop()
 			c.wTimer = nil
 		}
-	} else {
+	} else if c.wLimitTimer == nil {
 		c.modWrite()
 	}
 
@@ -134,12 +187,16 @@ func (c *Conn) Writev(in [][]byte) (int, error) {
 		c.closeWithErrorWithoutLock(err)
 		return n, err
 	}
+	if n > 0 {
+		c.written += int64(n)
+		c.touch()
+	}
 	if len(c.writeBuffer) == 0 {
 		if c.wTimer != nil {
 			c.wTimer.Stop()
 			c.wTimer = nil
 		}
-	} else {
+	} else if c.wLimitTimer == nil {
 		c.modWrite()
 	}
 
@@ -172,7 +229,7 @@ func (c *Conn) SetDeadline(t time.Time) error {
 	c.mux.Lock()
 	if !c.closed {
 		if !t.IsZero() {
-			now := time.Now()
+			now := c.g.clock.Now()
 			if c.rTimer == nil {
 				c.rTimer = c.g.afterFunc(t.Sub(now), func() { c.closeWithError(errReadTimeout) })
 			} else {
@@ -205,7 +262,7 @@ func (c *Conn) setDeadline(timer **htimer, returnErr error, t time.Time) error {
 		return nil
 	}
 	if !t.IsZero() {
-		now := time.Now()
+		now := c.g.clock.Now()
 		if *timer == nil {
 			*timer = c.g.afterFunc(t.Sub(now), func() { c.closeWithError(returnErr) })
 		} else {
@@ -274,6 +331,7 @@ func (c *Conn) SetLinger(onoff int32, linger int32) error {
 }
 
 // Session returns user session.
+// It's reserved for users, the library keeps its own state by Attr, see attr.go.
 func (c *Conn) Session() interface{} {
 	return c.session
 }
@@ -283,10 +341,63 @@ func (c *Conn) SetSession(session interface{}) {
 	c.session = session
 }
 
+// PauseRead stops reading the conn until ResumeRead is called, the data not read is held
+// by the kernel, so the peer is throttled by TCP flow control.
+func (c *Conn) PauseRead() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed || c.rHeld {
+		return
+	}
+	c.rHeld = true
+	if !c.rPaused {
+		c.g.pollers[c.Hash()%len(c.g.pollers)].pauseRead(c)
+	}
+}
+
+// ResumeRead resumes reading the conn paused by PauseRead.
+func (c *Conn) ResumeRead() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed || !c.rHeld {
+		return
+	}
+	c.rHeld = false
+	if !c.rPaused {
+		c.g.pollers[c.Hash()%len(c.g.pollers)].resumeRead(c)
+	}
+}
+
+// ReadPaused reports whether reading the conn is paused by PauseRead or the read limiters.
+func (c *Conn) ReadPaused() bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.rPaused || c.rHeld
+}
+
+// WriteBuffered returns the size of the data written but not sent to the socket yet.
+func (c *Conn) WriteBuffered() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return len(c.writeBuffer)
+}
+
+// WriteOffsets returns the total size of the data written and of the part sent to the socket,
+// the data written by now is sent once sent reaches written.
+func (c *Conn) WriteOffsets() (written, sent int64) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.written, c.written - int64(len(c.writeBuffer))
+}
+
 func (c *Conn) modWrite() {
 	if !c.closed && !c.isWAdded {
 		c.isWAdded = true
-		c.g.pollers[c.Hash()%len(c.g.pollers)].modWrite(c.fd)
+		p := c.g.pollers[c.Hash()%len(c.g.pollers)]
+		p.modWrite(c.fd)
+		if c.rPaused || c.rHeld {
+			p.pauseRead(c)
+		}
 	}
 }
 
@@ -296,6 +407,9 @@ func (c *Conn) resetRead() {
 		p := c.g.pollers[c.Hash()%len(c.g.pollers)]
 		p.deleteEvent(c.fd)
 		p.addRead(c.fd)
+		if c.rPaused || c.rHeld {
+			p.pauseRead(c)
+		}
 	}
 }
 
@@ -309,6 +423,11 @@ func (c *Conn) write(b []byte) (int, error) {
 	}
 
 	if len(c.writeBuffer) == 0 {
+		if len(c.wLimiters) > 0 {
+			c.writeBuffer = c.g.writeBufferAllocator.Malloc(len(b))
+			copy(c.writeBuffer, b)
+			return len(b), c.flushWithoutLock()
+		}
 		n, err := syscall.Write(c.fd, b)
 		if err != nil && !errors.Is(err, syscall.EINTR) && !errors.Is(err, syscall.EAGAIN) {
 			return n, err
@@ -318,17 +437,25 @@ func (c *Conn) write(b []byte) (int, error) {
 		}
 		left := len(b) - n
 		if left > 0 {
-			c.writeBuffer = mempool.Malloc(left)
+			c.writeBuffer = c.g.writeBufferAllocator.Malloc(left)
 			copy(c.writeBuffer, b[n:])
 			c.modWrite()
 		}
 		return len(b), nil
 	}
-	c.writeBuffer = append(c.writeBuffer, b...)
+	c.appendWriteBuffer(b)
 
 	return len(b), nil
 }
 
+// appendWriteBuffer grows the write buffer by the allocator, the allocator may not
+// own a buffer grown by append.
+func (c *Conn) appendWriteBuffer(b []byte) {
+	l := len(c.writeBuffer)
+	c.writeBuffer = c.g.writeBufferAllocator.Realloc(c.writeBuffer, l+len(b))
+	copy(c.writeBuffer[l:], b)
+}
+
 func (c *Conn) flush() error {
 	c.mux.Lock()
 	if c.closed {
@@ -341,27 +468,63 @@ func (c *Conn) flush() error {
 		return nil
 	}
 
-	old := c.writeBuffer
-
-	n, err := syscall.Write(c.fd, old)
-	if err != nil && !errors.Is(err, syscall.EINTR) && !errors.Is(err, syscall.EAGAIN) {
+	err := c.flushWithoutLock()
+	if err != nil {
 		c.closed = true
 		c.mux.Unlock()
 		c.closeWithErrorWithoutLock(err)
 		return err
 	}
-	if n < 0 {
-		n = 0
+
+	c.mux.Unlock()
+	return nil
+}
+
+func (c *Conn) flushWithoutLock() error {
+	old := c.writeBuffer
+
+	size := len(old)
+	throttled := false
+	if len(c.wLimiters) > 0 {
+		size, _ = takeTokens(c.wLimiters, c.g.clock.Now(), size)
+		throttled = size < len(old)
 	}
+
+	n := 0
+	if size > 0 {
+		var err error
+		n, err = syscall.Write(c.fd, old[:size])
+		if err != nil && !errors.Is(err, syscall.EINTR) && !errors.Is(err, syscall.EAGAIN) {
+			return err
+		}
+		if n < 0 {
+			n = 0
+		}
+		if n < size {
+			// the kernel buffer is full, wait for the writable event.
+			refundTokens(c.wLimiters, size-n)
+			throttled = false
+		}
+	}
+
 	left := len(old) - n
 	if left > 0 {
 		if n > 0 {
-			c.writeBuffer = mempool.Malloc(left)
+			c.writeBuffer = c.g.writeBufferAllocator.Malloc(left)
 			copy(c.writeBuffer, old[n:])
-			mempool.Free(old)
+			c.g.writeBufferAllocator.Free(old)
+		}
+		if throttled {
+			// hold the data until the next budget, the writable event would spin.
+			c.resetRead()
+			if c.wLimitTimer == nil {
+				c.wLimitTimer = c.g.afterFunc(limitDelay(c.wLimiters, c.g.clock.Now(), left), c.flushLimited)
+			}
+		} else {
+			c.modWrite()
 		}
-		// c.modWrite()
 	} else {
+		c.g.writeBufferAllocator.Free(old)
 		c.writeBuffer = nil
 		if c.wTimer != nil {
 			c.wTimer.Stop()
@@ -376,7 +539,6 @@ func (c *Conn) flush() error {
 		}
 	}
 
-	c.mux.Unlock()
 	return nil
 }
 
@@ -390,19 +552,21 @@ func (c *Conn) writev(in [][]byte) (int, error) {
 	}
 	if len(c.writeBuffer) > 0 {
 		for _, v := range in {
-			c.writeBuffer = append(c.writeBuffer, v...)
+			c.appendWriteBuffer(v)
 		}
 		return size, nil
 	}
 
 	if len(in) > 1 && size <= 65536 {
-		b := mempool.Malloc(size)
+		b := c.g.writeBufferAllocator.Malloc(size)
 		copied := 0
 		for _, v := range in {
 			copy(b[copied:], v)
 			copied += len(v)
 		}
-		return c.write(b)
+		n, err := c.write(b)
+		c.g.writeBufferAllocator.Free(b)
+		return n, err
 	}
 
 	nwrite := 0
@@ -444,8 +608,12 @@ func (c *Conn) closeWithErrorWithoutLock(err error) error {
 		c.rTimer.Stop()
 		c.rTimer = nil
 	}
+	c.stopLimitTimers()
+	c.stopIdleTimer()
 
-	mempool.Free(c.writeBuffer)
+	if c.g != nil {
+		c.g.writeBufferAllocator.Free(c.writeBuffer)
+	}
 	c.writeBuffer = nil
 
 	if c.chWaitWrite != nil {
@@ -459,6 +627,8 @@ func (c *Conn) closeWithErrorWithoutLock(err error) error {
 		c.g.pollers[c.Hash()%len(c.g.pollers)].deleteConn(c)
 	}
 
+	c.cancelContext(err)
+
 	return syscall.Close(c.fd)
 }
 
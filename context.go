@@ -0,0 +1,92 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"context"
+	"sync"
+)
+
+// connContext is cancelled when the Conn is closed,
+// its Err wraps the close error of the Conn.
+type connContext struct {
+	context.Context
+	cancel context.CancelFunc
+
+	mux sync.Mutex
+	err error
+}
+
+// Err returns nil until the Conn is closed or the parent is done.
+// After the Conn is closed, errors.Is(err, context.Canceled) is true
+// and errors.Unwrap(err) returns the close error.
+func (ctx *connContext) Err() error {
+	err := ctx.Context.Err()
+	if err == context.Canceled {
+		ctx.mux.Lock()
+		closeErr := ctx.err
+		ctx.mux.Unlock()
+		if closeErr != nil {
+			return &CloseError{Err: closeErr}
+		}
+	}
+	return err
+}
+
+// CloseError is the Err of a Conn's context after the Conn is closed.
+type CloseError struct {
+	Err error
+}
+
+// Error .
+func (e *CloseError) Error() string {
+	return "conn closed: " + e.Err.Error()
+}
+
+// Unwrap returns the close error.
+func (e *CloseError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is context.Canceled.
+func (e *CloseError) Is(target error) bool {
+	return target == context.Canceled
+}
+
+// Context returns the Conn's context, it's cancelled when the Conn is closed
+// or the Gopher's Config.Context is done.
+// The context is created on the first call, Conns that never call it don't pay for it.
+func (c *Conn) Context() context.Context {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.ctxMux.Lock()
+	defer c.ctxMux.Unlock()
+	if c.ctx == nil {
+		parent := context.Background()
+		if c.g != nil && c.g.ctx != nil {
+			parent = c.g.ctx
+		}
+		ctx, cancel := context.WithCancel(parent)
+		c.ctx = &connContext{Context: ctx, cancel: cancel}
+		if c.closed {
+			c.ctx.err = c.closeErr
+			cancel()
+		}
+	}
+	return c.ctx
+}
+
+// cancelContext should be called after the Conn is closed.
+func (c *Conn) cancelContext(err error) {
+	c.ctxMux.Lock()
+	ctx := c.ctx
+	c.ctxMux.Unlock()
+	if ctx != nil {
+		ctx.mux.Lock()
+		ctx.err = err
+		ctx.mux.Unlock()
+		ctx.cancel()
+	}
+}
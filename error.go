@@ -12,4 +12,5 @@ var (
 	errClosed       = errors.New("conn closed")
 	errReadTimeout  = errors.New("read timeout")
 	errWriteTimeout = errors.New("write timeout")
+	errIdleTimeout  = errors.New("idle timeout")
 )
@@ -22,17 +22,21 @@ func Dial(network, addr string, config *Config) (*tls.Conn, error) {
 	return tlsConn, nil
 }
 
+type connKey struct{}
+
+// GetConn returns the tls Conn of an nbio.Conn set by WrapOpen.
+func GetConn(c *nbio.Conn) (*Conn, bool) {
+	tlsConn, ok := c.Attr(connKey{}).(*Conn)
+	return tlsConn, ok
+}
+
 // WrapOpen returns an opening handler of nbio.Gopher.
 func WrapOpen(tlsConfig *Config, isClient bool, h func(c *nbio.Conn, tlsConn *Conn)) func(c *nbio.Conn) {
 	return func(c *nbio.Conn) {
-		var tlsConn *tls.Conn
-		sesseion := c.Session()
-		if sesseion != nil {
-			tlsConn = sesseion.(*tls.Conn)
-		}
+		tlsConn, _ := GetConn(c)
 		if tlsConn == nil && !isClient {
 			tlsConn = tls.NewConn(c, tlsConfig, isClient, true, mempool.DefaultMemPool)
-			c.SetSession(tlsConn)
+			c.SetAttr(connKey{}, tlsConn)
 		}
 		if h != nil {
 			h(c, tlsConn)
@@ -44,10 +48,8 @@ func WrapOpen(tlsConfig *Config, isClient bool, h func(c *nbio.Conn, tlsConn *Co
 func WrapClose(h func(c *nbio.Conn, tlsConn *Conn, err error)) func(c *nbio.Conn, err error) {
 	return func(c *nbio.Conn, err error) {
 		if h != nil && c != nil {
-			if session := c.Session(); session != nil {
-				if tlsConn, ok := session.(*Conn); ok {
-					h(c, tlsConn, err)
-				}
+			if tlsConn, ok := GetConn(c); ok {
+				h(c, tlsConn, err)
 			}
 		}
 	}
@@ -64,22 +66,20 @@ func WrapData(h func(c *nbio.Conn, tlsConn *Conn, data []byte), args ...interfac
 		}
 	}
 	return func(c *nbio.Conn, data []byte) {
-		if session := c.Session(); session != nil {
-			if tlsConn, ok := session.(*Conn); ok {
-				tlsConn.Append(data)
-				buffer := getBuffer()
-				for {
-					n, err := tlsConn.Read(buffer)
-					if err != nil {
-						c.Close()
-						return
-					}
-					if h != nil && n > 0 {
-						h(c, tlsConn, buffer[:n])
-					}
-					if n == 0 {
-						return
-					}
+		if tlsConn, ok := GetConn(c); ok {
+			tlsConn.Append(data)
+			buffer := getBuffer()
+			for {
+				n, err := tlsConn.Read(buffer)
+				if err != nil {
+					c.Close()
+					return
+				}
+				if h != nil && n > 0 {
+					h(c, tlsConn, buffer[:n])
+				}
+				if n == 0 {
+					return
 				}
 			}
 		}
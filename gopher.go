@@ -6,13 +6,14 @@ package nbio
 
 import (
 	"container/heap"
+	"context"
+	"fmt"
 	"net"
-	"runtime"
 	"sync"
 	"time"
-	"unsafe"
 
 	"github.com/lesismal/nbio/logging"
+	"github.com/lesismal/nbio/mempool"
 )
 
 const (
@@ -79,6 +80,40 @@ type Config struct {
 
 	// EpollMod sets the epoll mod, EPOLLLT by default.
 	EpollMod int
+
+	// Tracer receives conns' lifecycle events, it's set to EmptyTracer by default.
+	Tracer Tracer
+
+	// Clock is the time source of timers and deadlines, it's set to SystemClock by default.
+	Clock Clock
+
+	// Context is the parent of the Conns' contexts, it's set to context.Background() by default.
+	Context context.Context
+
+	// ConnReadRate limits bytes per second read from each conn, 0 means no limit.
+	ConnReadRate int
+
+	// ConnWriteRate limits bytes per second written to each conn, 0 means no limit.
+	ConnWriteRate int
+
+	// ReadLimiter is the read budget shared by all conns of the Gopher, nil means no limit.
+	ReadLimiter *RateLimiter
+
+	// WriteLimiter is the write budget shared by all conns of the Gopher, nil means no limit.
+	WriteLimiter *RateLimiter
+
+	// WriteBufferAllocator allocates the buffers of the data not written yet,
+	// it's set to mempool.DefaultMemPool by default.
+	WriteBufferAllocator mempool.Allocator
+
+	// Logger is used by the Gopher, its pollers and conns, the messages carry the fields
+	// gopher, poller, conn and remote. It's set to logging.DefaultLogger by default,
+	// which is loaded at the time of logging, so logging.SetLogger still works.
+	Logger logging.Logger
+
+	// LogSampler samples the logs of the hot error paths, such as the temporary accept failures
+	// and the panics of the tasks, it's set to logging.NewSampler(10, 100, time.Second) by default.
+	LogSampler *logging.Sampler
 }
 
 // Gopher is a manager of poller.
@@ -121,13 +156,46 @@ type Gopher struct {
 	beforeWrite       func(c *Conn)
 	onStop            func()
 
+	tracer Tracer
+
+	ctx context.Context
+
+	connReadRate  int
+	connWriteRate int
+	readLimiter   *RateLimiter
+	writeLimiter  *RateLimiter
+
+	writeBufferAllocator mempool.Allocator
+
+	logger     logging.FieldLogger
+	logSampler *logging.Sampler
+
 	callings  []func()
 	chCalling chan struct{}
 	timers    timerHeap
-	trigger   *time.Timer
+	clock     Clock
+	trigger   ClockTimer
 	chTimer   chan struct{}
 
 	Execute func(f func())
+
+	// TryExecute is used by Conn.TryExecute, it returns an error if f is rejected,
+	// Execute is used instead if it's nil.
+	TryExecute func(f func()) error
+}
+
+// Logger returns the logger of the Gopher, the messages carry the field gopher.
+func (g *Gopher) Logger() logging.FieldLogger {
+	return g.logger
+}
+
+// LogSampler returns the sampler of the logs of the hot error paths.
+func (g *Gopher) LogSampler() *logging.Sampler {
+	return g.logSampler
+}
+
+func (g *Gopher) pollerLogger(pollType string, index int) logging.FieldLogger {
+	return g.logger.With(logging.Any("poller", fmt.Sprintf("%v_%v", pollType, index)))
 }
 
 // Stop pollers.
@@ -161,7 +229,7 @@ func (g *Gopher) Stop() {
 	}
 
 	g.Wait()
-	logging.Info("Gopher[%v] stop", g.Name)
+	g.logger.Log(logging.LevelInfo, "stop")
 }
 
 // AddConn adds conn to a poller.
@@ -270,7 +338,7 @@ func (g *Gopher) OnStop(h func()) {
 func (g *Gopher) After(timeout time.Duration) <-chan time.Time {
 	c := make(chan time.Time, 1)
 	g.afterFunc(timeout, func() {
-		c <- time.Now()
+		c <- g.clock.Now()
 	})
 	return c
 }
@@ -294,22 +362,25 @@ func (g *Gopher) atOnce(f func()) {
 }
 
 func (g *Gopher) afterFunc(timeout time.Duration, f func()) *htimer {
-	g.tmux.Lock()
-	defer g.tmux.Unlock()
-
-	now := time.Now()
 	it := &htimer{
-		index:  len(g.timers),
-		expire: now.Add(timeout),
 		f:      f,
 		parent: g,
 	}
+	g.pushTimer(it, timeout)
+	return it
+}
+
+// pushTimer pushes it to the heap, it could be a timer fired or stopped before.
+func (g *Gopher) pushTimer(it *htimer, timeout time.Duration) {
+	g.tmux.Lock()
+	defer g.tmux.Unlock()
+
+	it.index = len(g.timers)
+	it.expire = g.clock.Now().Add(timeout)
 	heap.Push(&g.timers, it)
 	if g.timers[0] == it {
 		g.trigger.Reset(timeout)
 	}
-
-	return it
 }
 
 func (g *Gopher) removeTimer(it *htimer) {
@@ -325,7 +396,7 @@ func (g *Gopher) removeTimer(it *htimer) {
 		heap.Remove(&g.timers, index)
 		if len(g.timers) > 0 {
 			if index == 0 {
-				g.trigger.Reset(time.Until(g.timers[0].expire))
+				g.trigger.Reset(g.timers[0].expire.Sub(g.clock.Now()))
 
 			}
 		} else {
@@ -347,15 +418,15 @@ func (g *Gopher) resetTimer(it *htimer) {
 	if g.timers[index] == it {
 		heap.Fix(&g.timers, index)
 		if index == 0 || it.index == 0 {
-			g.trigger.Reset(time.Until(g.timers[0].expire))
+			g.trigger.Reset(g.timers[0].expire.Sub(g.clock.Now()))
 		}
 	}
 }
 
 func (g *Gopher) timerLoop() {
 	defer g.Done()
-	logging.Debug("Gopher[%v] timer start", g.Name)
-	defer logging.Debug("Gopher[%v] timer stopped", g.Name)
+	g.logger.Log(logging.LevelDebug, "timer start")
+	defer g.logger.Log(logging.LevelDebug, "timer stopped")
 	for {
 		select {
 		case <-g.chCalling:
@@ -373,16 +444,13 @@ func (g *Gopher) timerLoop() {
 					defer func() {
 						err := recover()
 						if err != nil {
-							const size = 64 << 10
-							buf := make([]byte, size)
-							buf = buf[:runtime.Stack(buf, false)]
-							logging.Error("Gopher[%v] exec call failed: %v\n%v\n", g.Name, err, *(*string)(unsafe.Pointer(&buf)))
+							g.logSampler.LogPanic(g.logger, "exec call failed", err)
 						}
 					}()
 					f()
 				}()
 			}
-		case <-g.trigger.C:
+		case <-g.trigger.C():
 			for {
 				g.tmux.Lock()
 				if g.timers.Len() == 0 {
@@ -390,19 +458,16 @@ func (g *Gopher) timerLoop() {
 					g.tmux.Unlock()
 					break
 				}
-				now := time.Now()
+				now := g.clock.Now()
 				it := g.timers[0]
-				if now.After(it.expire) {
+				if !now.Before(it.expire) {
 					heap.Remove(&g.timers, it.index)
 					g.tmux.Unlock()
 					func() {
 						defer func() {
 							err := recover()
 							if err != nil {
-								const size = 64 << 10
-								buf := make([]byte, size)
-								buf = buf[:runtime.Stack(buf, false)]
-								logging.Error("Gopher[%v] exec timer failed: %v\n%v\n", g.Name, err, *(*string)(unsafe.Pointer(&buf)))
+								g.logSampler.LogPanic(g.logger, "exec timer failed", err)
 							}
 						}()
 						it.f()
@@ -443,6 +508,10 @@ func (g *Gopher) initHandlers() {
 	g.BeforeWrite(func(c *Conn) {})
 	g.OnStop(func() {})
 
+	if g.tracer == nil {
+		g.tracer = EmptyTracer{}
+	}
+
 	if g.Execute == nil {
 		g.Execute = func(f func()) {
 			f()
@@ -8,11 +8,13 @@
 package nbio
 
 import (
+	"context"
 	"runtime"
 	"strings"
 	"time"
 
 	"github.com/lesismal/nbio/logging"
+	"github.com/lesismal/nbio/mempool"
 )
 
 // Start init and start pollers
@@ -59,9 +61,9 @@ func (g *Gopher) Start() error {
 	go g.timerLoop()
 
 	if len(g.addrs) == 0 {
-		logging.Info("Gopher[%v] start", g.Name)
+		g.logger.Log(logging.LevelInfo, "start")
 	} else {
-		logging.Info("Gopher[%v] start listen on: [\"%v\"]", g.Name, strings.Join(g.addrs, `", "`))
+		g.logger.Log(logging.LevelInfo, "start", logging.Any("addrs", strings.Join(g.addrs, ",")))
 	}
 	return nil
 }
@@ -81,24 +83,46 @@ func NewGopher(conf Config) *Gopher {
 	if conf.MinConnCacheSize == 0 {
 		conf.MinConnCacheSize = DefaultMinConnCacheSize
 	}
+	if conf.Clock == nil {
+		conf.Clock = SystemClock{}
+	}
+	if conf.Context == nil {
+		conf.Context = context.Background()
+	}
+	if conf.WriteBufferAllocator == nil {
+		conf.WriteBufferAllocator = mempool.DefaultMemPool
+	}
+	if conf.LogSampler == nil {
+		conf.LogSampler = logging.NewSampler(10, 100, time.Second)
+	}
 
 	g := &Gopher{
-		Name:               conf.Name,
-		network:            conf.Network,
-		addrs:              conf.Addrs,
-		pollerNum:          conf.NPoller,
-		readBufferSize:     conf.ReadBufferSize,
-		maxWriteBufferSize: conf.MaxWriteBufferSize,
-		minConnCacheSize:   conf.MinConnCacheSize,
-		lockListener:       conf.LockListener,
-		lockPoller:         conf.LockPoller,
-		listeners:          make([]*poller, len(conf.Addrs)),
-		pollers:            make([]*poller, conf.NPoller),
-		connsStd:           map[*Conn]struct{}{},
-		callings:           []func(){},
-		chCalling:          make(chan struct{}, 1),
-		trigger:            time.NewTimer(timeForever),
-		chTimer:            make(chan struct{}),
+		Name:                 conf.Name,
+		network:              conf.Network,
+		addrs:                conf.Addrs,
+		pollerNum:            conf.NPoller,
+		readBufferSize:       conf.ReadBufferSize,
+		maxWriteBufferSize:   conf.MaxWriteBufferSize,
+		minConnCacheSize:     conf.MinConnCacheSize,
+		lockListener:         conf.LockListener,
+		lockPoller:           conf.LockPoller,
+		listeners:            make([]*poller, len(conf.Addrs)),
+		pollers:              make([]*poller, conf.NPoller),
+		connsStd:             map[*Conn]struct{}{},
+		callings:             []func(){},
+		chCalling:            make(chan struct{}, 1),
+		clock:                conf.Clock,
+		trigger:              conf.Clock.NewTimer(timeForever),
+		chTimer:              make(chan struct{}),
+		tracer:               conf.Tracer,
+		ctx:                  conf.Context,
+		connReadRate:         conf.ConnReadRate,
+		connWriteRate:        conf.ConnWriteRate,
+		readLimiter:          conf.ReadLimiter,
+		writeLimiter:         conf.WriteLimiter,
+		writeBufferAllocator: conf.WriteBufferAllocator,
+		logger:               logging.Adapt(conf.Logger).With(logging.Any("gopher", conf.Name)),
+		logSampler:           conf.LogSampler,
 	}
 
 	g.initHandlers()
@@ -8,12 +8,14 @@
 package nbio
 
 import (
+	"context"
 	"runtime"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/lesismal/nbio/logging"
+	"github.com/lesismal/nbio/mempool"
 )
 
 // Start init and start pollers.
@@ -62,9 +64,9 @@ func (g *Gopher) Start() error {
 	go g.timerLoop()
 
 	if len(g.addrs) == 0 {
-		logging.Info("Gopher[%v] start", g.Name)
+		g.logger.Log(logging.LevelInfo, "start")
 	} else {
-		logging.Info("Gopher[%v] start listen on: [\"%v\"]", g.Name, strings.Join(g.addrs, `", "`))
+		g.logger.Log(logging.LevelInfo, "start", logging.Any("addrs", strings.Join(g.addrs, ",")))
 	}
 	return nil
 }
@@ -93,6 +95,18 @@ func NewGopher(conf Config) *Gopher {
 	if conf.MaxReadTimesPerEventLoop <= 0 {
 		conf.MaxReadTimesPerEventLoop = DefaultMaxReadTimesPerEventLoop
 	}
+	if conf.Clock == nil {
+		conf.Clock = SystemClock{}
+	}
+	if conf.Context == nil {
+		conf.Context = context.Background()
+	}
+	if conf.WriteBufferAllocator == nil {
+		conf.WriteBufferAllocator = mempool.DefaultMemPool
+	}
+	if conf.LogSampler == nil {
+		conf.LogSampler = logging.NewSampler(10, 100, time.Second)
+	}
 
 	g := &Gopher{
 		Name:                     conf.Name,
@@ -112,8 +126,18 @@ func NewGopher(conf Config) *Gopher {
 		connsUnix:                make([]*Conn, MaxOpenFiles),
 		callings:                 []func(){},
 		chCalling:                make(chan struct{}, 1),
-		trigger:                  time.NewTimer(timeForever),
+		clock:                    conf.Clock,
+		trigger:                  conf.Clock.NewTimer(timeForever),
 		chTimer:                  make(chan struct{}),
+		tracer:                   conf.Tracer,
+		ctx:                      conf.Context,
+		connReadRate:             conf.ConnReadRate,
+		connWriteRate:            conf.ConnWriteRate,
+		readLimiter:              conf.ReadLimiter,
+		writeLimiter:             conf.WriteLimiter,
+		writeBufferAllocator:     conf.WriteBufferAllocator,
+		logger:                   logging.Adapt(conf.Logger).With(logging.Any("gopher", conf.Name)),
+		logSampler:               conf.LogSampler,
 	}
 
 	g.initHandlers()
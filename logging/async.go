@@ -0,0 +1,128 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package logging
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultAsyncBufferSize is the buffer size of an AsyncWriter by default.
+const DefaultAsyncBufferSize = 1024 * 1024
+
+// ErrWriterClosed .
+var ErrWriterClosed = errors.New("writer closed")
+
+// AsyncWriter buffers the logs and writes them to the underlying writer on its own goroutine,
+// Write never blocks, the logs are dropped and counted when the buffer is full.
+type AsyncWriter struct {
+	w io.Writer
+
+	mux     sync.Mutex
+	buffer  []byte
+	maxSize int
+	closed  bool
+	dropped uint64
+
+	chWrite chan struct{}
+	chFlush chan chan struct{}
+	chDone  chan struct{}
+}
+
+// NewAsyncWriter returns an AsyncWriter that holds bufferSize bytes at most, 0 means DefaultAsyncBufferSize.
+func NewAsyncWriter(w io.Writer, bufferSize int) *AsyncWriter {
+	if bufferSize <= 0 {
+		bufferSize = DefaultAsyncBufferSize
+	}
+	aw := &AsyncWriter{
+		w:       w,
+		maxSize: bufferSize,
+		chWrite: make(chan struct{}, 1),
+		chFlush: make(chan chan struct{}),
+		chDone:  make(chan struct{}),
+	}
+	go aw.writeLoop()
+	return aw
+}
+
+// Write copies p to the buffer, p is dropped if the buffer is full.
+func (aw *AsyncWriter) Write(p []byte) (int, error) {
+	aw.mux.Lock()
+	if aw.closed {
+		aw.mux.Unlock()
+		return 0, ErrWriterClosed
+	}
+	if len(aw.buffer)+len(p) > aw.maxSize {
+		aw.mux.Unlock()
+		atomic.AddUint64(&aw.dropped, 1)
+		return len(p), nil
+	}
+	aw.buffer = append(aw.buffer, p...)
+	// notify with the lock held, Close closes chWrite after it.
+	select {
+	case aw.chWrite <- struct{}{}:
+	default:
+	}
+	aw.mux.Unlock()
+	return len(p), nil
+}
+
+// Dropped returns the number of the writes dropped because the buffer was full.
+func (aw *AsyncWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&aw.dropped)
+}
+
+// Flush blocks until the data buffered before it is written.
+func (aw *AsyncWriter) Flush() {
+	done := make(chan struct{})
+	select {
+	case aw.chFlush <- done:
+		<-done
+	case <-aw.chDone:
+	}
+}
+
+// Close writes the data buffered and stops the writer goroutine.
+func (aw *AsyncWriter) Close() error {
+	aw.mux.Lock()
+	if aw.closed {
+		aw.mux.Unlock()
+		return nil
+	}
+	aw.closed = true
+	aw.mux.Unlock()
+	close(aw.chWrite)
+	<-aw.chDone
+	return nil
+}
+
+func (aw *AsyncWriter) writeLoop() {
+	defer close(aw.chDone)
+
+	var buffer []byte
+	write := func() {
+		aw.mux.Lock()
+		// swap the buffers, the writers append to the one written last time.
+		buffer, aw.buffer = aw.buffer, buffer[:0]
+		aw.mux.Unlock()
+		if len(buffer) > 0 {
+			aw.w.Write(buffer)
+		}
+	}
+	for {
+		select {
+		case _, ok := <-aw.chWrite:
+			write()
+			if !ok {
+				return
+			}
+		case done := <-aw.chFlush:
+			write()
+			close(done)
+		}
+	}
+}
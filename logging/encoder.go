@@ -0,0 +1,148 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// EncoderTimeFormat is used to format the time of JSONEncoder and LogfmtEncoder.
+var EncoderTimeFormat = time.RFC3339Nano
+
+// JSONEncoder encodes an entry as a JSON object with the keys "time", "level" and "msg" before the fields.
+func JSONEncoder(buf []byte, t time.Time, lvl int, msg string, fields []Field) []byte {
+	buf = append(buf, `{"time":"`...)
+	buf = t.AppendFormat(buf, EncoderTimeFormat)
+	buf = append(buf, `","level":"`...)
+	buf = append(buf, LevelString(lvl)...)
+	buf = append(buf, `","msg":`...)
+	buf = appendJSONString(buf, msg)
+	for _, f := range fields {
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, f.Key)
+		buf = append(buf, ':')
+		buf = appendJSONValue(buf, f.Value)
+	}
+	return append(buf, '}')
+}
+
+// LogfmtEncoder encodes an entry as logfmt with the keys "time", "level" and "msg" before the fields.
+func LogfmtEncoder(buf []byte, t time.Time, lvl int, msg string, fields []Field) []byte {
+	buf = append(buf, "time="...)
+	buf = t.AppendFormat(buf, EncoderTimeFormat)
+	buf = append(buf, " level="...)
+	buf = append(buf, LevelString(lvl)...)
+	buf = append(buf, " msg="...)
+	buf = appendLogfmtString(buf, msg)
+	return appendLogfmtFields(buf, fields)
+}
+
+func appendLogfmtFields(buf []byte, fields []Field) []byte {
+	for _, f := range fields {
+		buf = append(buf, ' ')
+		buf = appendLogfmtString(buf, f.Key)
+		buf = append(buf, '=')
+		buf = appendLogfmtString(buf, valueString(f.Value))
+	}
+	return buf
+}
+
+func valueString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "<nil>"
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func appendLogfmtString(buf []byte, s string) []byte {
+	if s == "" {
+		return append(buf, `""`...)
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || r == 0x7f {
+			return strconv.AppendQuote(buf, s)
+		}
+	}
+	return append(buf, s...)
+}
+
+func appendJSONValue(buf []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, "null"...)
+	case string:
+		return appendJSONString(buf, v)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int32:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case uint:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case uint32:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case uint64:
+		return strconv.AppendUint(buf, v, 10)
+	case error:
+		return appendJSONString(buf, v.Error())
+	case fmt.Stringer:
+		return appendJSONString(buf, v.String())
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return appendJSONString(buf, fmt.Sprint(v))
+	}
+	return append(buf, b...)
+}
+
+const hex = "0123456789abcdef"
+
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				buf = append(buf, '\\', c)
+			case c == '\n':
+				buf = append(buf, '\\', 'n')
+			case c == '\r':
+				buf = append(buf, '\\', 'r')
+			case c == '\t':
+				buf = append(buf, '\\', 't')
+			case c < ' ':
+				buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+			default:
+				buf = append(buf, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, "\ufffd"...)
+		} else {
+			buf = append(buf, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(buf, '"')
+}
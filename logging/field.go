@@ -0,0 +1,239 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package logging
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Field is a key/value pair of a structured log.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Any returns a Field.
+func Any(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Err returns a Field with the key "error".
+func Err(err error) Field {
+	return Field{Key: "error", Value: err}
+}
+
+// FieldLogger is a Logger that also logs messages with key/value fields,
+// and returns the child loggers that add their fields to every message.
+type FieldLogger interface {
+	Logger
+	Log(lvl int, msg string, fields ...Field)
+	With(fields ...Field) FieldLogger
+}
+
+// LevelString returns the name of lvl used by the encoders.
+func LevelString(lvl int) string {
+	switch lvl {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Encoder appends a log entry to buf and returns the extended buffer.
+type Encoder func(buf []byte, t time.Time, lvl int, msg string, fields []Field) []byte
+
+// StructuredLogger implements FieldLogger and writes the entries encoded by an Encoder.
+type StructuredLogger struct {
+	level  *int32
+	mux    *sync.Mutex
+	out    io.Writer
+	encode Encoder
+	fields []Field
+}
+
+// NewStructuredLogger returns a StructuredLogger at LevelInfo, out is set to Writer or Output
+// and encode is set to LogfmtEncoder if they are nil.
+func NewStructuredLogger(out io.Writer, encode Encoder) *StructuredLogger {
+	if out == nil {
+		out = output()
+	}
+	if encode == nil {
+		encode = LogfmtEncoder
+	}
+	level := int32(LevelInfo)
+	return &StructuredLogger{
+		level:  &level,
+		mux:    &sync.Mutex{},
+		out:    out,
+		encode: encode,
+	}
+}
+
+// SetLevel sets the priority of l and all its children.
+func (l *StructuredLogger) SetLevel(lvl int) {
+	switch lvl {
+	case LevelAll, LevelDebug, LevelInfo, LevelWarn, LevelError, LevelNone:
+		atomic.StoreInt32(l.level, int32(lvl))
+	default:
+		fmt.Fprintf(output(), "invalid log level: %v", lvl)
+	}
+}
+
+// Enabled returns whether the messages at lvl are logged.
+func (l *StructuredLogger) Enabled(lvl int) bool {
+	return lvl >= int(atomic.LoadInt32(l.level))
+}
+
+// With returns a child logger that shares the level and the output with l.
+func (l *StructuredLogger) With(fields ...Field) FieldLogger {
+	child := *l
+	child.fields = appendFields(l.fields, fields)
+	return &child
+}
+
+// Log .
+func (l *StructuredLogger) Log(lvl int, msg string, fields ...Field) {
+	if !l.Enabled(lvl) {
+		return
+	}
+	if len(l.fields) > 0 {
+		fields = appendFields(l.fields, fields)
+	}
+	buf := l.encode(nil, time.Now(), lvl, msg, fields)
+	buf = append(buf, '\n')
+	l.mux.Lock()
+	l.out.Write(buf)
+	l.mux.Unlock()
+}
+
+// Debug logs a message formatted by fmt.Sprintf at LevelDebug.
+func (l *StructuredLogger) Debug(format string, v ...interface{}) {
+	if l.Enabled(LevelDebug) {
+		l.Log(LevelDebug, fmt.Sprintf(format, v...))
+	}
+}
+
+// Info logs a message formatted by fmt.Sprintf at LevelInfo.
+func (l *StructuredLogger) Info(format string, v ...interface{}) {
+	if l.Enabled(LevelInfo) {
+		l.Log(LevelInfo, fmt.Sprintf(format, v...))
+	}
+}
+
+// Warn logs a message formatted by fmt.Sprintf at LevelWarn.
+func (l *StructuredLogger) Warn(format string, v ...interface{}) {
+	if l.Enabled(LevelWarn) {
+		l.Log(LevelWarn, fmt.Sprintf(format, v...))
+	}
+}
+
+// Error logs a message formatted by fmt.Sprintf at LevelError.
+func (l *StructuredLogger) Error(format string, v ...interface{}) {
+	if l.Enabled(LevelError) {
+		l.Log(LevelError, fmt.Sprintf(format, v...))
+	}
+}
+
+// adapter makes a printf Logger a FieldLogger, the fields are appended to the message in logfmt.
+type adapter struct {
+	// logger is nil for DefaultLogger, which is loaded at the time of logging to follow SetLogger.
+	logger Logger
+	fields []Field
+}
+
+// Adapt returns l as a FieldLogger, the fields are appended to the messages if l is a printf only Logger.
+// If l is nil, the returned logger logs by DefaultLogger, even if it's set after Adapt.
+func Adapt(l Logger) FieldLogger {
+	if fl, ok := l.(FieldLogger); ok {
+		return fl
+	}
+	return &adapter{logger: l}
+}
+
+func (a *adapter) base() Logger {
+	if a.logger != nil {
+		return a.logger
+	}
+	return DefaultLogger
+}
+
+// SetLevel .
+func (a *adapter) SetLevel(lvl int) {
+	if l := a.base(); l != nil {
+		l.SetLevel(lvl)
+	}
+}
+
+// With .
+func (a *adapter) With(fields ...Field) FieldLogger {
+	return &adapter{logger: a.logger, fields: appendFields(a.fields, fields)}
+}
+
+// Log .
+func (a *adapter) Log(lvl int, msg string, fields ...Field) {
+	l := a.base()
+	if l == nil {
+		return
+	}
+	if len(a.fields) > 0 {
+		fields = appendFields(a.fields, fields)
+	}
+	if fl, ok := l.(FieldLogger); ok {
+		fl.Log(lvl, msg, fields...)
+		return
+	}
+	line := msg
+	if len(fields) > 0 {
+		line = string(appendLogfmtFields([]byte(msg), fields))
+	}
+	switch lvl {
+	case LevelDebug:
+		l.Debug("%s", line)
+	case LevelInfo:
+		l.Info("%s", line)
+	case LevelWarn:
+		l.Warn("%s", line)
+	default:
+		l.Error("%s", line)
+	}
+}
+
+// Debug .
+func (a *adapter) Debug(format string, v ...interface{}) {
+	a.Log(LevelDebug, fmt.Sprintf(format, v...))
+}
+
+// Info .
+func (a *adapter) Info(format string, v ...interface{}) {
+	a.Log(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+// Warn .
+func (a *adapter) Warn(format string, v ...interface{}) {
+	a.Log(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+// Error .
+func (a *adapter) Error(format string, v ...interface{}) {
+	a.Log(LevelError, fmt.Sprintf(format, v...))
+}
+
+// appendFields returns a new slice, the children must not share the array of their parent.
+func appendFields(a []Field, b []Field) []Field {
+	fields := make([]Field, 0, len(a)+len(b))
+	fields = append(fields, a...)
+	return append(fields, b...)
+}
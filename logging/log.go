@@ -6,6 +6,7 @@ package logging
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"time"
 )
@@ -17,6 +18,10 @@ var (
 	// Output is used to receive log output.
 	Output = os.Stdout
 
+	// Writer receives the log output instead of Output if it's set,
+	// set it to an AsyncWriter to avoid blocking the pollers on a slow output.
+	Writer io.Writer
+
 	// DefaultLogger is the default logger and is used by arpc.
 	DefaultLogger Logger = &logger{level: LevelInfo}
 )
@@ -56,8 +61,16 @@ func SetLevel(lvl int) {
 	case LevelAll, LevelDebug, LevelInfo, LevelWarn, LevelError, LevelNone:
 		DefaultLogger.SetLevel(lvl)
 	default:
-		fmt.Fprintf(Output, "invalid log level: %v", lvl)
+		fmt.Fprintf(output(), "invalid log level: %v", lvl)
+	}
+}
+
+// output returns Writer if it's set, or Output.
+func output() io.Writer {
+	if Writer != nil {
+		return Writer
 	}
+	return Output
 }
 
 // logger implements Logger and is used in arpc by default.
@@ -71,35 +84,35 @@ func (l *logger) SetLevel(lvl int) {
 	case LevelAll, LevelDebug, LevelInfo, LevelWarn, LevelError, LevelNone:
 		l.level = lvl
 	default:
-		fmt.Fprintf(Output, "invalid log level: %v", lvl)
+		fmt.Fprintf(output(), "invalid log level: %v", lvl)
 	}
 }
 
 // Debug uses fmt.Printf to log a message at LevelDebug.
 func (l *logger) Debug(format string, v ...interface{}) {
 	if LevelDebug >= l.level {
-		fmt.Fprintf(Output, time.Now().Format(TimeFormat)+" [DBG] "+format+"\n", v...)
+		fmt.Fprintf(output(), time.Now().Format(TimeFormat)+" [DBG] "+format+"\n", v...)
 	}
 }
 
 // Info uses fmt.Printf to log a message at LevelInfo.
 func (l *logger) Info(format string, v ...interface{}) {
 	if LevelInfo >= l.level {
-		fmt.Fprintf(Output, time.Now().Format(TimeFormat)+" [INF] "+format+"\n", v...)
+		fmt.Fprintf(output(), time.Now().Format(TimeFormat)+" [INF] "+format+"\n", v...)
 	}
 }
 
 // Warn uses fmt.Printf to log a message at LevelWarn.
 func (l *logger) Warn(format string, v ...interface{}) {
 	if LevelWarn >= l.level {
-		fmt.Fprintf(Output, time.Now().Format(TimeFormat)+" [WRN] "+format+"\n", v...)
+		fmt.Fprintf(output(), time.Now().Format(TimeFormat)+" [WRN] "+format+"\n", v...)
 	}
 }
 
 // Error uses fmt.Printf to log a message at LevelError.
 func (l *logger) Error(format string, v ...interface{}) {
 	if LevelError >= l.level {
-		fmt.Fprintf(Output, time.Now().Format(TimeFormat)+" [ERR] "+format+"\n", v...)
+		fmt.Fprintf(output(), time.Now().Format(TimeFormat)+" [ERR] "+format+"\n", v...)
 	}
 }
 
@@ -1,6 +1,15 @@
 package logging
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestSetLogger(t *testing.T) {
 	l := &logger{level: LevelDebug}
@@ -60,3 +69,170 @@ func Test_Warn(t *testing.T) {
 func Test_Error(t *testing.T) {
 	Error("log.Error")
 }
+
+func TestStructuredLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewStructuredLogger(buf, JSONEncoder)
+	child := l.With(Any("gopher", "NB"), Any("conn", 3))
+	child.Log(LevelDebug, "dropped")
+	child.Log(LevelInfo, "start", Err(errors.New("a \"quoted\"\nerror")), Any("ok", true))
+	child.Info("printf %v", 1)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("invalid lines: %q", buf.String())
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatalf("invalid json %q: %v", lines[0], err)
+	}
+	if m["level"] != "info" || m["msg"] != "start" || m["gopher"] != "NB" || m["conn"] != float64(3) ||
+		m["error"] != "a \"quoted\"\nerror" || m["ok"] != true {
+		t.Fatalf("invalid entry: %v", m)
+	}
+	if !strings.Contains(lines[1], `"msg":"printf 1"`) {
+		t.Fatalf("invalid printf entry: %v", lines[1])
+	}
+
+	// the children share the level of their parent.
+	l.SetLevel(LevelError)
+	buf.Reset()
+	child.Log(LevelWarn, "dropped")
+	if buf.Len() != 0 {
+		t.Fatalf("invalid level: %q", buf.String())
+	}
+
+	buf.Reset()
+	l = NewStructuredLogger(buf, LogfmtEncoder)
+	l.With(Any("remote", "127.0.0.1:80")).Log(LevelWarn, "read failed", Any("empty", ""), Any("n", 1))
+	if !strings.Contains(buf.String(), ` level=warn msg="read failed" remote=127.0.0.1:80 empty="" n=1`) {
+		t.Fatalf("invalid logfmt: %q", buf.String())
+	}
+}
+
+type testPrintfLogger struct {
+	logger
+	lines []string
+}
+
+func (l *testPrintfLogger) Warn(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestAdapt(t *testing.T) {
+	pl := &testPrintfLogger{}
+	l := Adapt(pl).With(Any("gopher", "NB"))
+	l.Log(LevelWarn, "stop", Any("poller", "POLLER_0"))
+	l.Warn("printf %v", 1)
+	if len(pl.lines) != 2 || pl.lines[0] != "stop gopher=NB poller=POLLER_0" || pl.lines[1] != "printf 1 gopher=NB" {
+		t.Fatalf("invalid lines: %q", pl.lines)
+	}
+
+	sl := NewStructuredLogger(&bytes.Buffer{}, nil)
+	if Adapt(sl) != FieldLogger(sl) {
+		t.Fatalf("FieldLogger adapted")
+	}
+
+	// nil follows DefaultLogger.
+	old := DefaultLogger
+	defer SetLogger(old)
+	l = Adapt(nil).With(Any("gopher", "NB"))
+	SetLogger(pl)
+	l.Log(LevelWarn, "default")
+	if pl.lines[2] != "default gopher=NB" {
+		t.Fatalf("invalid DefaultLogger line: %q", pl.lines[2])
+	}
+}
+
+func TestSampler(t *testing.T) {
+	s := NewSampler(2, 3, time.Hour)
+	allowed := []bool{}
+	suppressed := []uint64{}
+	for i := 0; i < 8; i++ {
+		ok, n := s.Allow("key")
+		allowed = append(allowed, ok)
+		if ok {
+			suppressed = append(suppressed, n)
+		}
+	}
+	if fmt.Sprint(allowed) != "[true true false false true false false true]" {
+		t.Fatalf("invalid allowed: %v", allowed)
+	}
+	if fmt.Sprint(suppressed) != "[0 0 2 2]" {
+		t.Fatalf("invalid suppressed: %v", suppressed)
+	}
+	if ok, _ := s.Allow("other"); !ok {
+		t.Fatalf("other key not allowed")
+	}
+
+	buf := &bytes.Buffer{}
+	l := NewSampler(1, 0, time.Hour).Wrap(NewStructuredLogger(buf, LogfmtEncoder))
+	for i := 0; i < 10; i++ {
+		l.With(Any("conn", i)).Log(LevelError, "accept failed")
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Fatalf("invalid lines: %v", n)
+	}
+
+	buf.Reset()
+	s = NewSampler(1, 0, time.Millisecond*10)
+	sl := NewStructuredLogger(buf, LogfmtEncoder)
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() {
+				s.LogPanic(sl, "conn execute failed", recover())
+			}()
+			panic("test")
+		}()
+	}
+	time.Sleep(time.Millisecond * 20)
+	s.Log(sl, LevelError, "conn execute failed")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "stack=") || !strings.HasSuffix(lines[1], "suppressed=1") {
+		t.Fatalf("invalid lines: %q", lines)
+	}
+}
+
+type slowWriter struct {
+	mux    sync.Mutex
+	buf    bytes.Buffer
+	chStep chan struct{}
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	<-w.chStep
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.buf.Write(p)
+}
+
+func TestAsyncWriter(t *testing.T) {
+	w := &slowWriter{chStep: make(chan struct{})}
+	aw := NewAsyncWriter(w, 8)
+	aw.Write([]byte("1234"))
+	// wait for the writer goroutine to take the first write, then fill the buffer.
+	for i := 0; i < 100; i++ {
+		aw.mux.Lock()
+		n := len(aw.buffer)
+		aw.mux.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	aw.Write([]byte("5678"))
+	aw.Write([]byte("abcd"))
+	aw.Write([]byte("efgh"))
+	if n := aw.Dropped(); n != 1 {
+		t.Fatalf("invalid Dropped: %v", n)
+	}
+	close(w.chStep)
+	aw.Flush()
+	if w.buf.String() != "12345678abcd" {
+		t.Fatalf("invalid output: %q", w.buf.String())
+	}
+	aw.Close()
+	if _, err := aw.Write([]byte("x")); err != ErrWriterClosed {
+		t.Fatalf("invalid error after Close: %v", err)
+	}
+}
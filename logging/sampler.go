@@ -0,0 +1,163 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package logging
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// maxSampleKeys bounds the counters of a Sampler, they are reset when there are more keys.
+const maxSampleKeys = 4096
+
+// PanicStackSize is the max size of the stack logged by Sampler.LogPanic.
+var PanicStackSize = 64 << 10
+
+type sampleCounter struct {
+	start      time.Time
+	n          uint64
+	suppressed uint64
+}
+
+// Sampler limits the logs of the same key, in every interval it allows the first N logs
+// and then every Mth, the number of the logs suppressed is reported by the next allowed one.
+type Sampler struct {
+	first      uint64
+	thereafter uint64
+	interval   time.Duration
+
+	mux      sync.Mutex
+	counters map[string]*sampleCounter
+}
+
+// NewSampler returns a Sampler that allows the first logs of a key in every interval, and then every thereafter one.
+// It allows all the logs if first <= 0, and none after the first ones if thereafter <= 0.
+func NewSampler(first, thereafter int, interval time.Duration) *Sampler {
+	if first < 0 {
+		first = 0
+	}
+	if thereafter < 0 {
+		thereafter = 0
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &Sampler{
+		first:      uint64(first),
+		thereafter: uint64(thereafter),
+		interval:   interval,
+		counters:   map[string]*sampleCounter{},
+	}
+}
+
+// Allow returns whether a log of key should be written, and the number of the logs of key
+// suppressed since the last allowed one. A nil Sampler allows all the logs.
+func (s *Sampler) Allow(key string) (bool, uint64) {
+	if s == nil || s.first == 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	c, ok := s.counters[key]
+	if !ok {
+		if len(s.counters) >= maxSampleKeys {
+			s.counters = map[string]*sampleCounter{}
+		}
+		c = &sampleCounter{start: now}
+		s.counters[key] = c
+	}
+	if now.Sub(c.start) >= s.interval {
+		c.start = now
+		c.n = 0
+	}
+	c.n++
+	if c.n <= s.first || (s.thereafter > 0 && (c.n-s.first)%s.thereafter == 0) {
+		suppressed := c.suppressed
+		c.suppressed = 0
+		return true, suppressed
+	}
+	c.suppressed++
+	return false, 0
+}
+
+// Log logs msg by l if msg is allowed, the suppressed logs are counted by the field "suppressed".
+func (s *Sampler) Log(l FieldLogger, lvl int, msg string, fields ...Field) {
+	ok, suppressed := s.Allow(msg)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		fields = append(fields, Any("suppressed", suppressed))
+	}
+	l.Log(lvl, msg, fields...)
+}
+
+// LogPanic logs a recovered panic with the stack at LevelError if msg is allowed,
+// the stack is not collected for the suppressed ones.
+func (s *Sampler) LogPanic(l FieldLogger, msg string, err interface{}) {
+	ok, suppressed := s.Allow(msg)
+	if !ok {
+		return
+	}
+	buf := make([]byte, PanicStackSize)
+	buf = buf[:runtime.Stack(buf, false)]
+	fields := []Field{Any("error", err), Any("stack", *(*string)(unsafe.Pointer(&buf)))}
+	if suppressed > 0 {
+		fields = append(fields, Any("suppressed", suppressed))
+	}
+	l.Log(LevelError, msg, fields...)
+}
+
+// Wrap returns a FieldLogger that samples the logs of l, the key of a log is the message,
+// or the format for the printf methods.
+func (s *Sampler) Wrap(l Logger) FieldLogger {
+	return &sampledLogger{FieldLogger: Adapt(l), sampler: s}
+}
+
+type sampledLogger struct {
+	FieldLogger
+	sampler *Sampler
+}
+
+func (l *sampledLogger) With(fields ...Field) FieldLogger {
+	return &sampledLogger{FieldLogger: l.FieldLogger.With(fields...), sampler: l.sampler}
+}
+
+func (l *sampledLogger) Log(lvl int, msg string, fields ...Field) {
+	l.sampler.Log(l.FieldLogger, lvl, msg, fields...)
+}
+
+func (l *sampledLogger) logf(lvl int, format string, v ...interface{}) {
+	ok, suppressed := l.sampler.Allow(format)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		l.FieldLogger.Log(lvl, fmt.Sprintf(format, v...), Any("suppressed", suppressed))
+		return
+	}
+	l.FieldLogger.Log(lvl, fmt.Sprintf(format, v...))
+}
+
+func (l *sampledLogger) Debug(format string, v ...interface{}) {
+	l.logf(LevelDebug, format, v...)
+}
+
+func (l *sampledLogger) Info(format string, v ...interface{}) {
+	l.logf(LevelInfo, format, v...)
+}
+
+func (l *sampledLogger) Warn(format string, v ...interface{}) {
+	l.logf(LevelWarn, format, v...)
+}
+
+func (l *sampledLogger) Error(format string, v ...interface{}) {
+	l.logf(LevelError, format, v...)
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package mempool
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// poisonByte fills the freed buffers in debug mode,
+// a buffer that is not filled with it when reused has been written after free.
+const poisonByte = 0xA5
+
+// DebugAllocator is an Allocator that supports the debug mode.
+type DebugAllocator interface {
+	Allocator
+
+	// SetDebug enables or disables the debug mode at runtime.
+	SetDebug(enable bool)
+
+	// Report returns the live allocations made in debug mode.
+	Report() Report
+}
+
+// ReportEntry is the live allocations from the same stack.
+type ReportEntry struct {
+	Stack string
+	Count int
+	Bytes int
+}
+
+// Report is the live allocations grouped by stack, sorted by bytes.
+type Report []ReportEntry
+
+// Bytes returns the total bytes of the live allocations.
+func (r Report) Bytes() int {
+	n := 0
+	for _, e := range r {
+		n += e.Bytes
+	}
+	return n
+}
+
+// String .
+func (r Report) String() string {
+	sb := &strings.Builder{}
+	for _, e := range r {
+		fmt.Fprintf(sb, "%v buffers, %v bytes, allocated at:\n%v\n", e.Count, e.Bytes, e.Stack)
+	}
+	return sb.String()
+}
+
+type allocInfo struct {
+	stack string
+	size  int
+}
+
+// debugger records the alloc and free stacks of an allocator in debug mode.
+type debugger struct {
+	enabled     int32
+	mux         sync.Mutex
+	allocStacks map[*byte]allocInfo
+	freeStacks  map[*byte]string
+}
+
+// SetDebug .
+func (d *debugger) SetDebug(enable bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if enable {
+		if d.allocStacks == nil {
+			d.allocStacks = map[*byte]allocInfo{}
+			d.freeStacks = map[*byte]string{}
+		}
+		atomic.StoreInt32(&d.enabled, 1)
+	} else {
+		atomic.StoreInt32(&d.enabled, 0)
+		d.allocStacks = nil
+		d.freeStacks = nil
+	}
+}
+
+func (d *debugger) isDebug() bool {
+	return atomic.LoadInt32(&d.enabled) == 1
+}
+
+// reuse forgets the free record of a buffer got from the pool,
+// it panics if the buffer has been written after free.
+func (d *debugger) reuse(buf []byte) {
+	if cap(buf) == 0 {
+		return
+	}
+	p := &(buf[:1][0])
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	freeStack, ok := d.freeStacks[p]
+	if !ok {
+		return
+	}
+	delete(d.freeStacks, p)
+	for i, b := range buf[:cap(buf)] {
+		if b != poisonByte {
+			err := fmt.Errorf("\nbuffer written after free: %p, offset: %v\nprevious free:\n%v\ncurrent allocation:\n%v", p, i, freeStack, getStack())
+			panic(err)
+		}
+	}
+}
+
+// forgetAlloc forgets the alloc record of a buffer that is grown by Realloc.
+func (d *debugger) forgetAlloc(buf []byte) {
+	if cap(buf) == 0 {
+		return
+	}
+	p := &(buf[:1][0])
+	d.mux.Lock()
+	if d.allocStacks != nil {
+		delete(d.allocStacks, p)
+	}
+	d.mux.Unlock()
+}
+
+func (d *debugger) saveAllocStack(buf []byte) {
+	if cap(buf) == 0 {
+		return
+	}
+	p := &(buf[:1][0])
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.allocStacks == nil {
+		return
+	}
+	delete(d.freeStacks, p)
+	d.allocStacks[p] = allocInfo{stack: getStack(), size: cap(buf)}
+}
+
+func (d *debugger) saveFreeStack(buf []byte) {
+	if cap(buf) == 0 {
+		return
+	}
+	p := &(buf[:1][0])
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.freeStacks == nil {
+		return
+	}
+	s, ok := d.freeStacks[p]
+	if ok {
+		allocStack := d.allocStacks[p].stack
+		err := fmt.Errorf("\nbuffer exists: %p\nprevious allocation:\n%v\nprevious free:\n%v\ncurrent free:\n%v", p, allocStack, s, getStack())
+		panic(err)
+	}
+	d.freeStacks[p] = getStack()
+	delete(d.allocStacks, p)
+
+	buf = buf[:cap(buf)]
+	for i := range buf {
+		buf[i] = poisonByte
+	}
+}
+
+// Report .
+func (d *debugger) Report() Report {
+	d.mux.Lock()
+	groups := map[string]*ReportEntry{}
+	for _, info := range d.allocStacks {
+		e, ok := groups[info.stack]
+		if !ok {
+			e = &ReportEntry{Stack: info.stack}
+			groups[info.stack] = e
+		}
+		e.Count++
+		e.Bytes += info.size
+	}
+	d.mux.Unlock()
+
+	report := make(Report, 0, len(groups))
+	for _, e := range groups {
+		report = append(report, *e)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Bytes != report[j].Bytes {
+			return report[i].Bytes > report[j].Bytes
+		}
+		return report[i].Stack < report[j].Stack
+	})
+	return report
+}
+
+// SetDebug enables or disables the debug mode of DefaultMemPool if it supports.
+func SetDebug(enable bool) {
+	if da, ok := DefaultMemPool.(DebugAllocator); ok {
+		da.SetDebug(enable)
+	}
+}
+
+// DebugReport returns the live allocations of DefaultMemPool made in debug mode.
+func DebugReport() Report {
+	if da, ok := DefaultMemPool.(DebugAllocator); ok {
+		return da.Report()
+	}
+	return nil
+}
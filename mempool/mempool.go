@@ -19,6 +19,7 @@ type Allocator interface {
 }
 
 // DefaultMemPool .
+// It can be replaced with another Allocator such as NewTiered before the Gophers start.
 var DefaultMemPool = New(64)
 
 // MemPool .
@@ -26,10 +27,11 @@ type MemPool struct {
 	minSize int
 	pool    sync.Pool
 
-	Debug       bool
-	mux         sync.Mutex
-	allocStacks map[*byte]string
-	freeStacks  map[*byte]string
+	// Debug is kept for compatibility, it enables the debug mode once on the first use of the pool
+	// unless SetDebug has been called, use SetDebug to toggle the debug mode at runtime.
+	Debug     bool
+	debugOnce sync.Once
+	debugger
 }
 
 // New .
@@ -38,10 +40,7 @@ func New(minSize int) Allocator {
 		minSize = 64
 	}
 	mp := &MemPool{
-		minSize:     minSize,
-		allocStacks: map[*byte]string{},
-		freeStacks:  map[*byte]string{},
-		// Debug:       true,
+		minSize: minSize,
 	}
 	mp.pool.New = func() interface{} {
 		buf := make([]byte, minSize)
@@ -52,7 +51,11 @@ func New(minSize int) Allocator {
 
 // Malloc .
 func (mp *MemPool) Malloc(size int) []byte {
+	debug := mp.debugging()
 	pbuf := mp.pool.Get().(*[]byte)
+	if debug {
+		mp.reuse(*pbuf)
+	}
 	need := size - cap(*pbuf)
 	if need > 0 {
 		if need <= maxAppendSize {
@@ -65,7 +68,7 @@ func (mp *MemPool) Malloc(size int) []byte {
 		}
 	}
 
-	if mp.Debug {
+	if debug {
 		mp.saveAllocStack(*pbuf)
 	}
 
@@ -82,6 +85,10 @@ func (mp *MemPool) Realloc(buf []byte, size int) []byte {
 		copy(newBuf[:len(buf)], buf)
 		return newBuf
 	}
+	debug := mp.debugging()
+	if debug {
+		mp.forgetAlloc(buf)
+	}
 	pbuf := &buf
 	need := size - cap(buf)
 	if need <= maxAppendSize {
@@ -94,7 +101,7 @@ func (mp *MemPool) Realloc(buf []byte, size int) []byte {
 	}
 	copy((*pbuf)[:len(buf)], buf)
 
-	if mp.Debug {
+	if debug {
 		mp.saveAllocStack(*pbuf)
 	}
 	return (*pbuf)[:size]
@@ -105,32 +112,25 @@ func (mp *MemPool) Free(buf []byte) {
 	if cap(buf) < mp.minSize {
 		return
 	}
-	if mp.Debug {
+	if mp.debugging() {
 		mp.saveFreeStack(buf)
 	}
 	mp.pool.Put(&buf)
 }
 
-func (mp *MemPool) saveFreeStack(buf []byte) {
-	p := &(buf[:1][0])
-	mp.mux.Lock()
-	defer mp.mux.Unlock()
-	s, ok := mp.freeStacks[p]
-	if ok {
-		allocStack := mp.allocStacks[p]
-		err := fmt.Errorf("\nbuffer exists: %p\nprevious allocation:\n%v\nprevious free:\n%v\ncurrent free:\n%v", p, allocStack, s, getStack())
-		panic(err)
-	}
-	mp.freeStacks[p] = getStack()
-	delete(mp.allocStacks, p)
+// SetDebug enables or disables the debug mode at runtime, the Debug field is not applied after it.
+func (mp *MemPool) SetDebug(enable bool) {
+	mp.debugOnce.Do(func() {})
+	mp.debugger.SetDebug(enable)
 }
 
-func (mp *MemPool) saveAllocStack(buf []byte) {
-	p := &(buf[:1][0])
-	mp.mux.Lock()
-	defer mp.mux.Unlock()
-	delete(mp.freeStacks, p)
-	mp.allocStacks[p] = getStack()
+func (mp *MemPool) debugging() bool {
+	mp.debugOnce.Do(func() {
+		if mp.Debug {
+			mp.debugger.SetDebug(true)
+		}
+	})
+	return mp.isDebug()
 }
 
 // NativeAllocator definition.
@@ -1,6 +1,7 @@
 package mempool
 
 import (
+	"runtime"
 	"testing"
 )
 
@@ -31,3 +32,269 @@ func TestMemPool(t *testing.T) {
 	}
 	pool.Free(buf)
 }
+
+func TestTieredPool(t *testing.T) {
+	pool := NewTiered(64, 1024*64)
+	sizes := pool.(*TieredPool).Sizes()
+	if sizes[0] != 64 || sizes[len(sizes)-1] != 1024*64 {
+		t.Fatalf("invalid sizes: %v", sizes)
+	}
+	for i := 0; i < 1024*128; i++ {
+		buf := pool.Malloc(i)
+		if len(buf) != i {
+			t.Fatalf("invalid length: %v != %v", len(buf), i)
+		}
+		if i <= 1024*64 && i > 64 && cap(buf) >= i*2 {
+			t.Fatalf("invalid capacity: %v for %v", cap(buf), i)
+		}
+		pool.Free(buf)
+	}
+
+	buf := pool.Malloc(0)
+	for i := 1; i < 1024*128; i++ {
+		buf = pool.Realloc(buf, i)
+		if len(buf) != i {
+			t.Fatalf("invalid length: %v != %v", len(buf), i)
+		}
+	}
+	pool.Free(buf)
+
+	custom := NewTieredWithSizes(1000, 100, 100, 10)
+	if sizes := custom.(*TieredPool).Sizes(); len(sizes) != 3 || sizes[0] != 10 || sizes[2] != 1000 {
+		t.Fatalf("invalid custom sizes: %v", sizes)
+	}
+	if buf := custom.Malloc(101); cap(buf) != 1000 {
+		t.Fatalf("invalid custom capacity: %v", cap(buf))
+	}
+}
+
+func TestTieredPoolRealloc(t *testing.T) {
+	pool := NewTiered(64, 1024*64)
+	buf := pool.Malloc(0)
+	copied, grows := 0, 0
+	for size := 1024; size <= 1024*1024*16; size += 1024 {
+		if size > cap(buf) {
+			copied += len(buf)
+			grows++
+		}
+		buf = pool.Realloc(buf, size)
+		if len(buf) != size {
+			t.Fatalf("invalid length: %v != %v", len(buf), size)
+		}
+	}
+	pool.Free(buf)
+	// the growth over the max cached size is amortized, the bytes copied are linear to the final size.
+	if copied > 2*len(buf) || grows > 32 {
+		t.Fatalf("growth not amortized: %v bytes copied by %v grows for %v", copied, grows, len(buf))
+	}
+}
+
+// httpSizes simulates the nbhttp path: read buffers, parser caches, response headers and bodies.
+var httpSizes = []int{32 * 1024, 300, 1024, 64, 2 * 1024, 16 * 1024, 200, 1024, 128 * 1024, 512}
+
+// websocketSizes simulates the websocket path: small frames, control frames and reassembled messages.
+var websocketSizes = []int{125, 2, 1024, 60, 4 * 1024, 256, 64 * 1024, 90, 125, 1024 * 1024}
+
+func benchmarkAllocator(b *testing.B, pool Allocator, sizes []int) {
+	runtime.GC()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		bufs := make([][]byte, 0, len(sizes))
+		i := 0
+		for pb.Next() {
+			bufs = append(bufs, pool.Malloc(sizes[i%len(sizes)]))
+			i++
+			if len(bufs) == cap(bufs) {
+				// grow one of the buffers like a parser cache does.
+				bufs[0] = pool.Realloc(bufs[0], len(bufs[0])+4096)
+				for _, buf := range bufs {
+					pool.Free(buf)
+				}
+				bufs = bufs[:0]
+			}
+		}
+	})
+	b.StopTimer()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	b.ReportMetric(float64(ms.HeapInuse)/1024/1024, "MB-heap-inuse")
+}
+
+func BenchmarkMemPoolHTTP(b *testing.B) {
+	benchmarkAllocator(b, New(64), httpSizes)
+}
+
+func BenchmarkTieredPoolHTTP(b *testing.B) {
+	benchmarkAllocator(b, NewTiered(DefaultTieredMinSize, DefaultTieredMaxSize), httpSizes)
+}
+
+func BenchmarkMemPoolWebsocket(b *testing.B) {
+	benchmarkAllocator(b, New(64), websocketSizes)
+}
+
+func BenchmarkTieredPoolWebsocket(b *testing.B) {
+	benchmarkAllocator(b, NewTiered(DefaultTieredMinSize, DefaultTieredMaxSize), websocketSizes)
+}
+
+func TestMemPoolDebug(t *testing.T) {
+	for _, pool := range []DebugAllocator{New(64).(*MemPool), NewTiered(64, 1024).(*TieredPool)} {
+		pool.SetDebug(true)
+
+		bufs := [][]byte{}
+		for i := 0; i < 3; i++ {
+			bufs = append(bufs, pool.Malloc(100))
+		}
+		other := pool.Malloc(1000)
+		report := pool.Report()
+		if len(report) != 2 || report.Bytes() != cap(bufs[0])*3+cap(other) {
+			t.Fatalf("invalid report: %v", report)
+		}
+		for _, e := range report {
+			if e.Count != 1 && e.Count != 3 {
+				t.Fatalf("invalid report entry count: %v", e.Count)
+			}
+		}
+
+		for _, buf := range bufs {
+			pool.Free(buf)
+		}
+		if report = pool.Report(); len(report) != 1 || report[0].Count != 1 {
+			t.Fatalf("invalid report after free: %v", report)
+		}
+		for _, b := range bufs[0][:cap(bufs[0])] {
+			if b != poisonByte {
+				t.Fatalf("freed buffer not poisoned")
+			}
+		}
+
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("double free not detected")
+				}
+			}()
+			pool.Free(bufs[0])
+		}()
+
+		pool.Free(other)
+		other[10] = 1
+		func() {
+			defer func() { recover() }()
+			for i := 0; i < 8; i++ {
+				buf := pool.Malloc(1000)
+				if &buf[0] == &other[0] {
+					t.Fatalf("use after free not detected")
+				}
+			}
+		}()
+
+		pool.SetDebug(false)
+		if report = pool.Report(); len(report) != 0 {
+			t.Fatalf("invalid report after debug disabled: %v", report)
+		}
+	}
+}
+
+func TestMemPoolDebugField(t *testing.T) {
+	mp := New(64).(*MemPool)
+	mp.Debug = true
+	mp.Free(mp.Malloc(100))
+	if !mp.isDebug() {
+		t.Fatalf("debug mode not enabled by the Debug field")
+	}
+	mp.SetDebug(false)
+	mp.Free(mp.Malloc(100))
+	if mp.isDebug() {
+		t.Fatalf("debug mode enabled again after SetDebug(false)")
+	}
+}
+
+func TestSlab(t *testing.T) {
+	sa := NewSlab(64, 4096).(*SlabAllocator)
+	for _, size := range []int{0, 1, 64, 65, 1000, 4096} {
+		buf := sa.Malloc(size)
+		if len(buf) != size {
+			t.Fatalf("invalid length: %v != %v", len(buf), size)
+		}
+		if s, _ := sa.chunkOf(buf); s == nil || cap(buf) != s.class.size {
+			t.Fatalf("buffer not from the slabs: %v", size)
+		}
+		sa.Free(buf)
+		if again := sa.Malloc(size); &again[:1][0] != &buf[:1][0] {
+			t.Fatalf("freed chunk not reused: %v", size)
+		}
+	}
+
+	buf := sa.Malloc(10)
+	copy(buf, "0123456789")
+	buf = sa.Realloc(buf, 1000)
+	if string(buf[:10]) != "0123456789" || cap(buf) != 1024 {
+		t.Fatalf("invalid realloc: %v, %v", string(buf[:10]), cap(buf))
+	}
+	sa.Free(buf)
+
+	large := sa.Malloc(8192)
+	if s, _ := sa.chunkOf(large); s != nil || len(large) != 8192 {
+		t.Fatalf("large buffer allocated from the slabs")
+	}
+	sa.Free(large)
+	sa.Free(make([]byte, 100))
+
+	sa.SetDebug(true)
+	buf = sa.Malloc(100)
+	sa.Free(buf)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("double free not detected")
+			}
+		}()
+		sa.Free(buf)
+	}()
+
+	buf = sa.Malloc(100)
+	s, index := sa.chunkOf(buf)
+	s.mem[index*s.class.stride+s.class.size] = 0
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("overflow not detected")
+			}
+		}()
+		sa.Free(buf)
+	}()
+}
+
+// benchmarkGC holds buffers like a large number of idle conns and measures the GC cycles.
+func benchmarkGC(b *testing.B, pool Allocator) {
+	const conns = 32 * 1024
+	bufs := make([][]byte, conns)
+	for i := range bufs {
+		bufs[i] = pool.Malloc(4096)
+	}
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	if n := after.NumGC - before.NumGC; n > 0 {
+		b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(n), "pause-ns/gc")
+	}
+	b.ReportMetric(float64(after.HeapInuse)/1024/1024, "MB-heap-inuse")
+	for _, buf := range bufs {
+		pool.Free(buf)
+	}
+}
+
+func BenchmarkMemPoolGC(b *testing.B) {
+	benchmarkGC(b, New(64))
+}
+
+func BenchmarkSlabGC(b *testing.B) {
+	benchmarkGC(b, NewSlab(DefaultTieredMinSize, 64*1024))
+}
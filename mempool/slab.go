@@ -0,0 +1,232 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package mempool
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+const (
+	// DefaultSlabSize is the size of each mmap'd slab.
+	DefaultSlabSize = 1024 * 1024
+
+	// slabGuardSize is reserved after each chunk, it's filled with slabGuard in debug mode.
+	slabGuardSize = 8
+	slabGuard     = 0xDEADBEEFCAFEBABE
+)
+
+const (
+	chunkFree byte = iota
+	chunkUsed
+	chunkGuarded
+)
+
+// SlabAllocator allocates fixed size chunks from mmap'd slabs outside the Go heap,
+// so the buffers held by a large number of conns don't grow the heap the GC manages.
+// The slabs are never returned to the OS, every buffer must be freed explicitly by Free,
+// a buffer used after Free may be given to another user.
+// A buffer must be grown by Realloc, its chunk is lost if it's grown by append.
+// Sizes larger than the largest chunk are allocated by make.
+type SlabAllocator struct {
+	slabSize int
+	sizes    []int
+	classes  []*slabClass
+
+	mux   sync.RWMutex
+	slabs []*slab
+
+	debug int32
+}
+
+type slabClass struct {
+	size   int
+	stride int
+	mux    sync.Mutex
+	free   [][]byte
+}
+
+type slab struct {
+	base   uintptr
+	end    uintptr
+	mem    []byte
+	class  *slabClass
+	states []byte
+}
+
+// NewSlab returns a SlabAllocator with power-of-two chunk sizes from minSize to maxSize.
+func NewSlab(minSize, maxSize int) Allocator {
+	if minSize <= 0 {
+		minSize = DefaultTieredMinSize
+	}
+	if maxSize < minSize {
+		maxSize = minSize
+	}
+	sizes := []int{}
+	size := 1
+	for size < minSize {
+		size <<= 1
+	}
+	for ; size < maxSize; size <<= 1 {
+		sizes = append(sizes, size)
+	}
+	sizes = append(sizes, maxSize)
+	return NewSlabWithSizes(DefaultSlabSize, sizes...)
+}
+
+// NewSlabWithSizes returns a SlabAllocator with the chunk sizes, each slab is slabSize bytes at least.
+func NewSlabWithSizes(slabSize int, sizes ...int) Allocator {
+	if slabSize <= 0 {
+		slabSize = DefaultSlabSize
+	}
+	tp := NewTieredWithSizes(sizes...).(*TieredPool)
+	sa := &SlabAllocator{
+		slabSize: slabSize,
+		sizes:    tp.sizes,
+		classes:  make([]*slabClass, len(tp.sizes)),
+	}
+	for i, size := range sa.sizes {
+		sa.classes[i] = &slabClass{size: size, stride: size + slabGuardSize}
+	}
+	return sa
+}
+
+// SetDebug enables or disables the guard checks at runtime,
+// a chunk allocated in debug mode is checked for overflow and double free when it's freed.
+func (sa *SlabAllocator) SetDebug(enable bool) {
+	if enable {
+		atomic.StoreInt32(&sa.debug, 1)
+	} else {
+		atomic.StoreInt32(&sa.debug, 0)
+	}
+}
+
+// Malloc .
+func (sa *SlabAllocator) Malloc(size int) []byte {
+	i := sort.SearchInts(sa.sizes, size)
+	if i == len(sa.sizes) {
+		return make([]byte, size)
+	}
+	class := sa.classes[i]
+
+	class.mux.Lock()
+	if len(class.free) == 0 {
+		if err := sa.grow(class); err != nil {
+			class.mux.Unlock()
+			return make([]byte, size)
+		}
+	}
+	last := len(class.free) - 1
+	chunk := class.free[last]
+	class.free[last] = nil
+	class.free = class.free[:last]
+	s, index := sa.chunkOf(chunk)
+	if atomic.LoadInt32(&sa.debug) == 1 {
+		binary.LittleEndian.PutUint64(chunk[class.size:class.stride], slabGuard)
+		s.states[index] = chunkGuarded
+	} else {
+		s.states[index] = chunkUsed
+	}
+	class.mux.Unlock()
+
+	return chunk[:size:class.size]
+}
+
+// Realloc .
+func (sa *SlabAllocator) Realloc(buf []byte, size int) []byte {
+	if size <= cap(buf) {
+		return buf[:size]
+	}
+	newBuf := sa.Malloc(size)
+	copy(newBuf, buf)
+	sa.Free(buf)
+	return newBuf
+}
+
+// Free returns a chunk to its slab, buffers not allocated from the slabs are ignored.
+func (sa *SlabAllocator) Free(buf []byte) {
+	if cap(buf) == 0 {
+		return
+	}
+	s, index := sa.chunkOf(buf)
+	if s == nil {
+		return
+	}
+	class := s.class
+	debug := atomic.LoadInt32(&sa.debug) == 1
+	off := index * class.stride
+	chunk := s.mem[off : off+class.stride]
+
+	class.mux.Lock()
+	defer class.mux.Unlock()
+	switch s.states[index] {
+	case chunkFree:
+		if debug {
+			panic(fmt.Errorf("slab chunk double free: %p", &chunk[0]))
+		}
+		return
+	case chunkGuarded:
+		if binary.LittleEndian.Uint64(chunk[class.size:]) != slabGuard {
+			panic(fmt.Errorf("slab chunk overflow: %p, size: %v", &chunk[0], class.size))
+		}
+	}
+	if debug && uintptr(unsafe.Pointer(&buf[:1][0])) != s.base+uintptr(off) {
+		panic(fmt.Errorf("slab chunk freed by a resliced buffer: %p", &buf[:1][0]))
+	}
+	s.states[index] = chunkFree
+	class.free = append(class.free, chunk)
+}
+
+// grow maps a new slab for class, class.mux must be held.
+func (sa *SlabAllocator) grow(class *slabClass) error {
+	n := sa.slabSize / class.stride
+	if n == 0 {
+		n = 1
+	}
+	mem, err := mmap(n * class.stride)
+	if err != nil {
+		return err
+	}
+	s := &slab{
+		base:   uintptr(unsafe.Pointer(&mem[0])),
+		mem:    mem,
+		class:  class,
+		states: make([]byte, n),
+	}
+	s.end = s.base + uintptr(len(mem))
+
+	sa.mux.Lock()
+	i := sort.Search(len(sa.slabs), func(i int) bool { return sa.slabs[i].base > s.base })
+	sa.slabs = append(sa.slabs, nil)
+	copy(sa.slabs[i+1:], sa.slabs[i:])
+	sa.slabs[i] = s
+	sa.mux.Unlock()
+
+	for i := n - 1; i >= 0; i-- {
+		off := i * class.stride
+		class.free = append(class.free, mem[off:off+class.stride:off+class.stride])
+	}
+	return nil
+}
+
+// chunkOf returns the slab and chunk index of buf, or nil if buf is not from the slabs.
+func (sa *SlabAllocator) chunkOf(buf []byte) (*slab, int) {
+	p := uintptr(unsafe.Pointer(&buf[:1][0]))
+	sa.mux.RLock()
+	i := sort.Search(len(sa.slabs), func(i int) bool { return sa.slabs[i].end > p })
+	var s *slab
+	if i < len(sa.slabs) && sa.slabs[i].base <= p {
+		s = sa.slabs[i]
+	}
+	sa.mux.RUnlock()
+	if s == nil {
+		return nil, 0
+	}
+	return s, int(p-s.base) / s.class.stride
+}
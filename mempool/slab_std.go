@@ -0,0 +1,14 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package mempool
+
+// mmap allocates the slabs from the heap on windows, they are still long-lived
+// and never freed, so the GC scans them but the chunks are not reallocated.
+func mmap(size int) ([]byte, error) {
+	return make([]byte, size), nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package mempool
+
+import (
+	"sort"
+	"sync"
+)
+
+const (
+	// DefaultTieredMinSize is the smallest size class of NewTiered.
+	DefaultTieredMinSize = 64
+
+	// DefaultTieredMaxSize is the max cached size of NewTiered,
+	// larger buffers are allocated by make and dropped by Free.
+	DefaultTieredMaxSize = 1024 * 1024 * 4
+)
+
+// TieredPool is an Allocator with size classes, each class has its own pool,
+// a Malloc gets a buffer from the smallest class that fits the size,
+// so small requests never hold the large buffers.
+type TieredPool struct {
+	sizes   []int
+	classes []sync.Pool
+
+	debugger
+}
+
+// NewTiered returns a TieredPool with power-of-two size classes from minSize to maxSize,
+// buffers larger than maxSize are not cached.
+func NewTiered(minSize, maxSize int) Allocator {
+	if minSize <= 0 {
+		minSize = DefaultTieredMinSize
+	}
+	if maxSize < minSize {
+		maxSize = DefaultTieredMaxSize
+		if maxSize < minSize {
+			maxSize = minSize
+		}
+	}
+	sizes := []int{}
+	size := 1
+	for size < minSize {
+		size <<= 1
+	}
+	for ; size < maxSize; size <<= 1 {
+		sizes = append(sizes, size)
+	}
+	sizes = append(sizes, maxSize)
+	return NewTieredWithSizes(sizes...)
+}
+
+// NewTieredWithSizes returns a TieredPool with the size classes,
+// the largest class is the max cached size.
+func NewTieredWithSizes(sizes ...int) Allocator {
+	classSizes := make([]int, 0, len(sizes))
+	for _, size := range sizes {
+		if size > 0 {
+			classSizes = append(classSizes, size)
+		}
+	}
+	if len(classSizes) == 0 {
+		classSizes = append(classSizes, DefaultTieredMinSize)
+	}
+	sort.Ints(classSizes)
+	n := 1
+	for i := 1; i < len(classSizes); i++ {
+		if classSizes[i] != classSizes[n-1] {
+			classSizes[n] = classSizes[i]
+			n++
+		}
+	}
+	classSizes = classSizes[:n]
+
+	tp := &TieredPool{
+		sizes:   classSizes,
+		classes: make([]sync.Pool, len(classSizes)),
+	}
+	for i := range tp.classes {
+		size := classSizes[i]
+		tp.classes[i].New = func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		}
+	}
+	return tp
+}
+
+// Sizes returns the size classes.
+func (tp *TieredPool) Sizes() []int {
+	return append([]int{}, tp.sizes...)
+}
+
+// Malloc .
+func (tp *TieredPool) Malloc(size int) []byte {
+	debug := tp.isDebug()
+	i := sort.SearchInts(tp.sizes, size)
+	if i == len(tp.sizes) {
+		buf := make([]byte, size)
+		if debug {
+			tp.saveAllocStack(buf)
+		}
+		return buf
+	}
+	pbuf := tp.classes[i].Get().(*[]byte)
+	if debug {
+		tp.reuse(*pbuf)
+		tp.saveAllocStack(*pbuf)
+	}
+	return (*pbuf)[:size]
+}
+
+// Realloc .
+func (tp *TieredPool) Realloc(buf []byte, size int) []byte {
+	if size <= cap(buf) {
+		return buf[:size]
+	}
+	var newBuf []byte
+	if size > tp.sizes[len(tp.sizes)-1] {
+		// the buffers over the max cached size grow geometrically as append does,
+		// or a growing body would be copied entirely on every Realloc.
+		newCap := 2 * cap(buf)
+		if newCap < size {
+			newCap = size
+		}
+		newBuf = make([]byte, size, newCap)
+		if tp.isDebug() {
+			tp.saveAllocStack(newBuf)
+		}
+	} else {
+		newBuf = tp.Malloc(size)
+	}
+	copy(newBuf, buf)
+	tp.Free(buf)
+	return newBuf
+}
+
+// Free puts buf to the largest class that it can fill,
+// buffers smaller than the smallest class or larger than the max cached size are dropped.
+func (tp *TieredPool) Free(buf []byte) {
+	size := cap(buf)
+	if size < tp.sizes[0] || size > tp.sizes[len(tp.sizes)-1] {
+		if tp.isDebug() {
+			tp.forgetAlloc(buf)
+		}
+		return
+	}
+	i := sort.SearchInts(tp.sizes, size)
+	if tp.sizes[i] != size {
+		i--
+		size = tp.sizes[i]
+	}
+	buf = buf[:size:size]
+	if tp.isDebug() {
+		tp.saveFreeStack(buf)
+	}
+	tp.classes[i].Put(&buf)
+}
@@ -6,6 +6,8 @@ package nbhttp
 
 import (
 	"io"
+	"io/ioutil"
+	"os"
 	"sync"
 
 	"github.com/lesismal/nbio/mempool"
@@ -21,15 +23,37 @@ var (
 
 // BodyReader .
 type BodyReader struct {
-	index  int
-	buffer []byte
+	index     int
+	buffer    []byte
+	allocator mempool.Allocator
+
+	// the body is moved to file after it exceeds spoolThreshold, then it's read at offset of file.
+	spoolThreshold int
+	spoolLimit     int64
+	spoolDir       string
+	file           *os.File
+	size           int64
+	offset         int64
+	err            error
 }
 
 // Read implements io.Reader.
 func (br *BodyReader) Read(p []byte) (int, error) {
+	if br.file != nil {
+		n, err := br.file.ReadAt(p, br.offset)
+		br.offset += int64(n)
+		if err == io.EOF && br.err != nil {
+			err = br.err
+		}
+		return n, err
+	}
+
 	need := len(p)
 	available := len(br.buffer) - br.index
 	if available <= 0 {
+		if br.err != nil {
+			return 0, br.err
+		}
 		return 0, io.EOF
 	}
 	if available >= need {
@@ -47,26 +71,77 @@ func (br *BodyReader) Read(p []byte) (int, error) {
 
 // Append .
 func (br *BodyReader) Append(data []byte) {
+	if br.err == nil && br.file == nil && br.spoolThreshold > 0 && len(br.buffer)+len(data) > br.spoolThreshold {
+		br.spool()
+	}
+	if br.err != nil {
+		return
+	}
+	if br.file != nil {
+		br.writeFile(data)
+		return
+	}
 	if len(data) > 0 {
+		if br.allocator == nil {
+			br.allocator = mempool.DefaultMemPool
+		}
 		if br.buffer == nil {
-			br.buffer = mempool.Malloc(len(data))
+			br.buffer = br.allocator.Malloc(len(data))
 			copy(br.buffer, data)
 		} else {
-			br.buffer = append(br.buffer, data...)
+			l := len(br.buffer)
+			br.buffer = br.allocator.Realloc(br.buffer, l+len(data))
+			copy(br.buffer[l:], data)
 		}
 	}
 }
 
+// spool moves the buffer to a temp file in spoolDir.
+func (br *BodyReader) spool() {
+	file, err := ioutil.TempFile(br.spoolDir, "nbhttp-body-")
+	if err != nil {
+		br.err = err
+		return
+	}
+	br.file = file
+	if br.buffer != nil {
+		br.writeFile(br.buffer)
+		br.offset = int64(br.index)
+		br.allocator.Free(br.buffer)
+		br.buffer = nil
+		br.index = 0
+	}
+}
+
+func (br *BodyReader) writeFile(data []byte) {
+	if br.err != nil {
+		return
+	}
+	if br.spoolLimit > 0 && br.size+int64(len(data)) > br.spoolLimit {
+		br.err = ErrTooLong
+		return
+	}
+	n, err := br.file.Write(data)
+	br.size += int64(n)
+	if err != nil {
+		br.err = err
+	}
+}
+
 // RawBody returns BodyReader's buffer directly,
-// the buffer returned would be released to the mempool after http handler func,
+// the buffer returned would be released to the allocator after http handler func,
 // the application layer should not hold it any longer after the http handler func.
+// It's nil if the body is spooled to a file, see TakeOverFile.
 func (br *BodyReader) RawBody() []byte {
 	return br.buffer
 }
 
 // TakeOver returns BodyReader's buffer,
 // the buffer returned would not be released to the mempool after http handler func,
-// the application layer could hold it longer and should manage when to release the buffer to the mempool.
+// the application layer could hold it longer and should manage when to release the buffer to the allocator,
+// which is the Engine's BodyAllocator for the requests received by the Engine, it's mempool.DefaultMemPool
+// by default so mempool.Free is still right unless Config.BodyAllocator is set.
+// It's nil if the body is spooled to a file, see TakeOverFile.
 func (br *BodyReader) TakeOver() []byte {
 	b := br.buffer
 	br.buffer = nil
@@ -74,24 +149,60 @@ func (br *BodyReader) TakeOver() []byte {
 	return b
 }
 
+// TakeOverFile returns the temp file of a body spooled to disk, or nil if the body is in memory,
+// the file is positioned at the beginning of the body.
+// The file returned would not be removed after http handler func,
+// the application layer should close and remove it.
+func (br *BodyReader) TakeOverFile() *os.File {
+	file := br.file
+	if file != nil {
+		file.Seek(0, io.SeekStart)
+		br.file = nil
+		br.size = 0
+		br.offset = 0
+	}
+	return file
+}
+
 // Close implements io. Closer.
 func (br *BodyReader) Close() error {
 	return nil
 }
 
+func (br *BodyReader) removeFile() {
+	if br.file != nil {
+		br.file.Close()
+		os.Remove(br.file.Name())
+		br.file = nil
+		br.size = 0
+		br.offset = 0
+	}
+}
+
 func (br *BodyReader) close() {
 	if br.buffer != nil {
-		mempool.Free(br.buffer)
+		br.allocator.Free(br.buffer)
 		br.buffer = nil
 		br.index = 0
 	}
+	br.removeFile()
+	br.allocator = nil
+	br.spoolThreshold = 0
+	br.spoolLimit = 0
+	br.spoolDir = ""
+	br.err = nil
 }
 
 // NewBodyReader creates a BodyReader.
 func NewBodyReader(data []byte) *BodyReader {
+	return newBodyReader(mempool.DefaultMemPool, data)
+}
+
+func newBodyReader(allocator mempool.Allocator, data []byte) *BodyReader {
 	br := bodyReaderPool.Get().(*BodyReader)
+	br.allocator = allocator
 	if len(data) > 0 {
-		br.buffer = mempool.Malloc(len(data))
+		br.buffer = allocator.Malloc(len(data))
 		copy(br.buffer, data)
 	}
 	br.index = 0
@@ -0,0 +1,213 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbhttp
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/lesismal/nbio"
+	"github.com/lesismal/nbio/mempool"
+)
+
+// streamBody is the body of a request whose handler is dispatched once the headers are parsed,
+// it's fed by the parser while the handler reads it.
+// The conn stops reading when the data not read reaches the limit and resumes after half of it
+// is read, an http2 stream has no conn to pause and returns the data read to its window by onRead.
+type streamBody struct {
+	mux sync.Mutex
+	// chSignal wakes up the reader waiting for the data, it's used instead of a sync.Cond
+	// so the reader also returns when the context of the request is done.
+	chSignal  chan struct{}
+	allocator mempool.Allocator
+	buffer    []byte
+	index     int
+	request   *http.Request
+	trailer   http.Header
+	done      bool
+	closed    bool
+	err       error
+
+	// pauseMux serializes pausing and resuming the conn, mux is acquired with it held, never the reverse.
+	pauseMux sync.Mutex
+	paused   bool
+	conn     *nbio.Conn
+	limit    int
+
+	onRead func(n int)
+}
+
+func newStreamBody(allocator mempool.Allocator, request *http.Request, conn *nbio.Conn, limit int) *streamBody {
+	b := &streamBody{
+		allocator: allocator,
+		request:   request,
+		conn:      conn,
+		limit:     limit,
+		chSignal:  make(chan struct{}, 1),
+	}
+	return b
+}
+
+// signal wakes up the reader, it must be called with b.mux held.
+func (b *streamBody) signal() {
+	select {
+	case b.chSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Read implements io.Reader, it blocks until some data is received, the body ends or
+// the context of the request is done.
+func (b *streamBody) Read(p []byte) (int, error) {
+	ctxDone := b.request.Context().Done()
+	b.mux.Lock()
+	for b.index == len(b.buffer) && !b.done && !b.closed && b.err == nil {
+		b.mux.Unlock()
+		select {
+		case <-b.chSignal:
+		case <-ctxDone:
+			b.fail(b.request.Context().Err())
+		}
+		b.mux.Lock()
+	}
+	if b.closed {
+		b.mux.Unlock()
+		return 0, http.ErrBodyReadAfterClose
+	}
+	n := copy(p, b.buffer[b.index:])
+	b.index += n
+	var err error
+	if b.index == len(b.buffer) {
+		b.buffer = b.buffer[:0]
+		b.index = 0
+		if b.done {
+			err = io.EOF
+		} else {
+			err = b.err
+		}
+	}
+	b.mux.Unlock()
+
+	if n > 0 {
+		if b.onRead != nil {
+			b.onRead(n)
+		} else {
+			b.updateRead()
+		}
+	}
+	return n, err
+}
+
+// Close implements io.Closer, the data not read and the data received later are discarded.
+func (b *streamBody) Close() error {
+	b.mux.Lock()
+	if b.closed {
+		b.mux.Unlock()
+		return nil
+	}
+	b.closed = true
+	if b.buffer != nil {
+		b.allocator.Free(b.buffer)
+		b.buffer = nil
+		b.index = 0
+	}
+	b.signal()
+	b.mux.Unlock()
+
+	b.updateRead()
+	return nil
+}
+
+// write appends the data received, it's called by the parser.
+func (b *streamBody) write(data []byte) {
+	b.mux.Lock()
+	if len(data) == 0 || b.closed || b.done || b.err != nil {
+		b.mux.Unlock()
+		return
+	}
+	if b.index > 0 {
+		b.buffer = b.buffer[:copy(b.buffer, b.buffer[b.index:])]
+		b.index = 0
+	}
+	l := len(b.buffer)
+	if b.buffer == nil {
+		b.buffer = b.allocator.Malloc(len(data))
+	} else {
+		b.buffer = b.allocator.Realloc(b.buffer, l+len(data))
+	}
+	copy(b.buffer[l:], data)
+	full := len(b.buffer)-b.index >= b.limit
+	b.signal()
+	b.mux.Unlock()
+
+	if full {
+		b.updateRead()
+	}
+}
+
+// addTrailer adds a trailer field, the trailer is set to the request when the body ends.
+func (b *streamBody) addTrailer(key, value string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.trailer == nil {
+		b.trailer = http.Header{}
+	}
+	b.trailer.Add(key, value)
+}
+
+// finish is called after the whole body is received.
+func (b *streamBody) finish() {
+	b.mux.Lock()
+	if b.closed || b.err != nil {
+		b.mux.Unlock()
+		return
+	}
+	b.done = true
+	if b.trailer != nil {
+		// the handler reads the trailer after io.EOF, which is returned with b.mux held.
+		b.request.Trailer = b.trailer
+	}
+	b.signal()
+	b.mux.Unlock()
+
+	b.updateRead()
+}
+
+// fail ends the body with err before it's received entirely.
+// It may be called with the conn's mutex held, so it never pauses or resumes the conn.
+func (b *streamBody) fail(err error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.done || b.err != nil {
+		return
+	}
+	b.err = err
+	b.signal()
+}
+
+// updateRead pauses or resumes the conn by the data not read yet.
+func (b *streamBody) updateRead() {
+	if b.conn == nil {
+		return
+	}
+	b.pauseMux.Lock()
+	defer b.pauseMux.Unlock()
+
+	b.mux.Lock()
+	n := len(b.buffer) - b.index
+	pause := !b.closed && !b.done && b.err == nil && (n >= b.limit || (b.paused && n > b.limit/2))
+	b.mux.Unlock()
+
+	if pause == b.paused {
+		return
+	}
+	b.paused = pause
+	if pause {
+		b.conn.PauseRead()
+	} else {
+		b.conn.ResumeRead()
+	}
+}
@@ -5,15 +5,12 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
-	"unsafe"
 
 	"github.com/lesismal/llib/std/crypto/tls"
 	"github.com/lesismal/nbio"
-	"github.com/lesismal/nbio/logging"
 	"github.com/lesismal/nbio/mempool"
 )
 
@@ -138,10 +135,7 @@ func (c *ClientConn) Do(req *http.Request, handler func(res *http.Response, conn
 	defer func() {
 		c.mux.Unlock()
 		if err := recover(); err != nil {
-			const size = 64 << 10
-			buf := make([]byte, size)
-			buf = buf[:runtime.Stack(buf, false)]
-			logging.Error("ClientConn Do failed: %v\n%v\n", err, *(*string)(unsafe.Pointer(&buf)))
+			c.Engine.LogSampler().LogPanic(c.Engine.ConnLogger(c.conn), "ClientConn Do failed", err)
 		}
 	}()
 
@@ -150,6 +144,12 @@ func (c *ClientConn) Do(req *http.Request, handler func(res *http.Response, conn
 		return
 	}
 
+	// the request may be derived from a server request whose client has gone.
+	if err := req.Context().Err(); err != nil {
+		handler(nil, nil, err)
+		return
+	}
+
 	var engine = c.Engine
 	var confTimeout = c.Timeout
 
@@ -245,7 +245,7 @@ func (c *ClientConn) Do(req *http.Request, handler func(res *http.Response, conn
 			parser.OnClose(func(p *Parser, err error) {
 				c.CloseWithError(err)
 			})
-			nbc.SetSession(parser)
+			setConnParser(nbc, parser)
 
 			nbc.OnData(engine.DataHandler)
 			engine.AddConn(nbc)
@@ -287,7 +287,7 @@ func (c *ClientConn) Do(req *http.Request, handler func(res *http.Response, conn
 			parser.OnClose(func(p *Parser, err error) {
 				c.CloseWithError(err)
 			})
-			nbc.SetSession(parser)
+			setConnParser(nbc, parser)
 
 			nbc.OnData(engine.TLSDataHandler)
 			_, err = engine.AddConn(nbc)
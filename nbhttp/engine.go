@@ -7,14 +7,15 @@ package nbhttp
 import (
 	"context"
 	"errors"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 	"unicode/utf8"
-	"unsafe"
 
 	"github.com/lesismal/llib/std/crypto/tls"
 	"github.com/lesismal/nbio"
@@ -50,6 +51,15 @@ var (
 
 	// DefaultTLSHandshakeTimeout .
 	DefaultTLSHandshakeTimeout = time.Second * 10
+
+	// DefaultStreamRequestBodyBufferSize .
+	DefaultStreamRequestBodyBufferSize = 1024 * 64
+
+	// DefaultMaxBodySpoolSize .
+	DefaultMaxBodySpoolSize int64 = 1024 * 1024 * 1024
+
+	// DefaultMinBodyRateInterval .
+	DefaultMinBodyRateInterval = time.Second * 5
 )
 
 const defaultNetwork = "tcp"
@@ -117,12 +127,69 @@ type Config struct {
 	// MessageHandlerPoolSize represents max http server's task pool goroutine num, it's set to runtime.NumCPU() * 256 by default.
 	MessageHandlerPoolSize int
 
+	// MessageHandlerQueueSize is the number of the requests waiting for the default task pool
+	// when all of its goroutines are busy, it's set to 1024 * 1024 by default.
+	MessageHandlerQueueSize int
+
+	// MessageHandlerRejectPolicy decides what to do with a request when the default task pool is full.
+	// The poller is blocked until the pool has room by default, taskpool.RejectCallerRuns runs
+	// the handler on the poller, and the others reply 503 Service Unavailable without calling the handler,
+	// a request can't be dropped silently since its conn would be stalled.
+	MessageHandlerRejectPolicy taskpool.RejectPolicy
+
 	// MessageHandlerTaskIdleTime represents idle time for task pool's goroutine, it's set to 60s by default.
 	// MessageHandlerTaskIdleTime time.Duration
 
 	// KeepaliveTime represents Conn's ReadDeadline when waiting for a new request, it's set to 120s by default.
 	KeepaliveTime time.Duration
 
+	// MaxHeaderBytes is the max size of the request line and the headers of a request, 0 means they're
+	// only limited by ReadLimit. The request is replied 431 if it's exceeded. For HTTP/2 it's the
+	// SETTINGS_MAX_HEADER_LIST_SIZE, the size of the decoded header fields with 32 bytes of overhead each.
+	MaxHeaderBytes int
+
+	// MaxHeaderCount is the max number of the header lines of a request, or of the regular header fields
+	// of an HTTP/2 request, 0 means no limit. The request is replied 431 if it's exceeded.
+	MaxHeaderCount int
+
+	// MaxURILength is the max length of the request URI, 0 means no limit. The request is replied 414 if it's exceeded.
+	MaxURILength int
+
+	// ReadHeaderTimeout is the time allowed to receive the request line and the headers from the first byte
+	// of a request, 0 means no limit. The request is replied 408 and the conn is closed if it's exceeded.
+	// For HTTP/2 it's the time allowed to receive a HEADERS and its CONTINUATIONs, the conn is sent a
+	// GOAWAY with ENHANCE_YOUR_CALM and closed if it's exceeded.
+	ReadHeaderTimeout time.Duration
+
+	// MinBodyRate is the min bytes per second of receiving a request body, a conn receiving less than
+	// MinBodyRate*MinBodyRateInterval of the body in a MinBodyRateInterval is closed, 0 means no limit.
+	// The time the conn is paused, such as by a streamed body not read or the read limiters, is not counted.
+	// An HTTP/2 conn is checked while a stream is receiving its body and the windows allow the client to
+	// send it, all the frames received are counted, and it's sent a GOAWAY with ENHANCE_YOUR_CALM before closed.
+	MinBodyRate int
+
+	// MinBodyRateInterval is the interval of checking MinBodyRate, it's set to 5s by default.
+	MinBodyRateInterval time.Duration
+
+	// HandlerTimeout is the time allowed to run the handler of a request, 0 means no limit.
+	// When it's exceeded, r.Context() is cancelled, the request is replied 503 if the head of the response
+	// hasn't been written, and the conn is closed. For HTTP/2 the stream is reset if the head has been
+	// sent, and the other streams of the conn are still served. The writes of the handler after it return
+	// http.ErrHandlerTimeout, the handler still holds its executor until it returns.
+	HandlerTimeout time.Duration
+
+	// WriteTimeout is the time allowed to send a response from the handler's return, 0 means no limit.
+	// The conn is closed if the data written isn't sent to the socket in time, such as to a slow reader.
+	WriteTimeout time.Duration
+
+	// StrictParsing rejects the ambiguous requests which may be parsed differently by the intermediaries,
+	// such as the request smuggling, by RFC 9112: Content-Length with Transfer-Encoding, conflicting
+	// or malformed Content-Length, Transfer-Encoding in HTTP/1.0, obs-fold, the whitespace before
+	// the colon of a header, the control characters in the field values, a bare LF in the request line
+	// and the chunk size lines, the extra whitespaces in the request line, and an HTTP/1.1 request
+	// without exactly one Host. They are replied 400.
+	StrictParsing bool
+
 	// LockListener represents listener's goroutine to lock thread or not, it's set to false by default.
 	LockListener bool
 
@@ -142,16 +209,91 @@ type Config struct {
 
 	ServerExecutor func(f func())
 
+	// ServerTryExecutor runs the handlers if it's set, a request is replied 503 Service Unavailable
+	// if it returns an error, ServerExecutor is still used to run the other tasks of the conns.
+	ServerTryExecutor func(f func()) error
+
 	ClientExecutor func(f func())
 
+	// TLSAllocator allocates the tls conns' buffers, they're allocated by make if it's nil.
+	// It's used by the tls conns only, the tls conn grows some of the buffers by append,
+	// so it should be a pool backed by the heap such as mempool.NewTiered.
 	TLSAllocator tls.Allocator
 
+	// BodyAllocator allocates the parsers' caches, the request bodies and the websocket messages,
+	// it's set to mempool.DefaultMemPool by default, it could be a mempool.SlabAllocator.
+	// If it's set, the buffers returned by BodyReader.TakeOver must be freed to it instead of mempool.Free.
 	BodyAllocator mempool.Allocator
 
+	// WriteBufferAllocator allocates the conns' buffers of the data not written yet,
+	// it's set to mempool.DefaultMemPool by default, it could be a mempool.SlabAllocator.
+	WriteBufferAllocator mempool.Allocator
+
 	Context context.Context
 	Cancel  func()
 
 	SupportServerOnly bool
+
+	// Tracer receives conns' and requests' lifecycle events, it's set to EmptyTracer by default.
+	Tracer Tracer
+
+	// ConnReadRate limits bytes per second read from each conn, 0 means no limit.
+	ConnReadRate int
+
+	// ConnWriteRate limits bytes per second written to each conn, 0 means no limit.
+	// Responses and websocket messages are held in the conn's write buffer until the budget allows.
+	ConnWriteRate int
+
+	// ReadLimiter is the read budget shared by all conns of the Engine, nil means no limit.
+	ReadLimiter *nbio.RateLimiter
+
+	// WriteLimiter is the write budget shared by all conns of the Engine, nil means no limit.
+	WriteLimiter *nbio.RateLimiter
+
+	// Logger is used by the Engine and its Gopher, it's set to logging.DefaultLogger by default.
+	Logger logging.Logger
+
+	// LogSampler samples the logs of the hot error paths, it's passed to the Gopher.
+	LogSampler *logging.Sampler
+
+	// EnableHTTP2 enables HTTP/2, which is served on the tls conns that select "h2" by ALPN,
+	// and on the non-tls conns by h2c with prior knowledge or the upgrade of HTTP/1.1.
+	// "h2" is added to the NextProtos of the tls configs only if it's enabled.
+	EnableHTTP2 bool
+
+	// StreamRequestBody dispatches the handlers once the headers of the requests with a body are parsed,
+	// r.Body is then fed by the parser while the handler reads it instead of being received entirely
+	// before the handler, and it's not limited by ReadLimit. The handlers must not run on the pollers,
+	// which feed the bodies, so it can't be used with taskpool.RejectCallerRuns or a synchronous ServerExecutor.
+	StreamRequestBody bool
+
+	// StreamRequestBodyFunc decides whether the body of a request is streamed by its headers,
+	// StreamRequestBody is ignored if it's set.
+	StreamRequestBodyFunc func(r *http.Request) bool
+
+	// StreamRequestBodyBufferSize is the size of a streamed body not read by the handler yet that pauses
+	// reading the conn, it's set to 64k by default. The HTTP/2 streams are limited by their windows instead.
+	StreamRequestBodyBufferSize int
+
+	// BodySpoolThreshold is the size of a request body kept in memory, the larger body is moved to
+	// a temp file in BodySpoolDir and received by the file, 0 means the bodies are always kept in memory.
+	// The bodies are not limited by ReadLimit but by MaxBodySpoolSize if it's set, and the files are
+	// written on the pollers.
+	BodySpoolThreshold int
+
+	// BodySpoolDir is the directory of the temp files of the spooled bodies, os.TempDir() is used if it's empty.
+	BodySpoolDir string
+
+	// MaxBodySpoolSize is the max size of a spooled body, the handler gets ErrTooLong reading the body after
+	// that and the rest is discarded, it's set to 1G by default.
+	MaxBodySpoolSize int64
+
+	// ExpectContinueFunc decides the reply of an HTTP/1.1 request with "Expect: 100-continue" and a body
+	// by its headers, 100 Continue is sent before the body is received if it's nil or returns
+	// http.StatusContinue. Any other status, such as http.StatusExpectationFailed or
+	// http.StatusRequestEntityTooLarge, is replied without reading the body and the conn is closed.
+	// It's called on the pollers, so it should not block.
+	ExpectContinueFunc func(r *http.Request) int
 }
 
 // Engine .
@@ -167,9 +309,10 @@ type Engine struct {
 
 	listeners []net.Listener
 
-	_onOpen  func(c *nbio.Conn)
-	_onClose func(c *nbio.Conn, err error)
-	_onStop  func()
+	_onOpen       func(c *nbio.Conn)
+	_onClose      func(c *nbio.Conn, err error)
+	_onStop       func()
+	_onParseError func(c *nbio.Conn, err *ParseError) []byte
 
 	mux   sync.Mutex
 	conns map[*nbio.Conn]struct{}
@@ -182,6 +325,10 @@ type Engine struct {
 	Cancel       func()
 
 	ExecuteClient func(f func())
+
+	handlerPool *taskpool.MixedPool
+
+	http2TLSConfigs map[*tls.Config]*tls.Config
 }
 
 // OnOpen registers callback for new connection.
@@ -194,6 +341,13 @@ func (e *Engine) OnClose(h func(c *nbio.Conn, err error)) {
 	e._onClose = h
 }
 
+// OnParseError registers callback for a malformed or too large request, it returns the body of the
+// response replied with err.StatusCode, which it may change, before the conn is closed.
+// It's called on the pollers.
+func (e *Engine) OnParseError(h func(c *nbio.Conn, err *ParseError) []byte) {
+	e._onParseError = h
+}
+
 // OnStop registers callback before Gopher is stopped.
 func (e *Engine) OnStop(h func()) {
 	e._onStop = h
@@ -204,22 +358,163 @@ func (e *Engine) Online() int {
 	return len(e.conns)
 }
 
+// Logger returns the logger of the Gopher, Config.Logger is the logger passed to the Gopher.
+func (e *Engine) Logger() logging.FieldLogger {
+	return e.Gopher.Logger()
+}
+
+// LogSampler returns the sampler of the logs of the hot error paths, e could be nil.
+func (e *Engine) LogSampler() *logging.Sampler {
+	if e == nil || e.Gopher == nil {
+		return nil
+	}
+	return e.Gopher.LogSampler()
+}
+
+// ConnLogger returns the logger with the fields of c, e could be nil.
+func (e *Engine) ConnLogger(c net.Conn) logging.FieldLogger {
+	if nbc, ok := c.(*nbio.Conn); ok {
+		return nbc.Logger()
+	}
+	var logger logging.FieldLogger
+	if e != nil && e.Gopher != nil {
+		logger = e.Logger()
+	} else {
+		logger = logging.Adapt(nil)
+	}
+	if c == nil || c.RemoteAddr() == nil {
+		return logger
+	}
+	return logger.With(logging.Any("remote", c.RemoteAddr().String()))
+}
+
+// HandlerPool returns the default task pool that runs the handlers for Stats and Resize,
+// it's a MixedPool so Resize works, it returns nil if Config.ServerExecutor is set.
+func (e *Engine) HandlerPool() taskpool.Pool {
+	if e.handlerPool == nil {
+		return nil
+	}
+	return e.handlerPool
+}
+
 func (e *Engine) closeIdleConns(chCloseQueue chan *nbio.Conn) {
 	e.mux.Lock()
 	defer e.mux.Unlock()
 	for c := range e.conns {
-		sess := c.Session()
-		if sess != nil {
-			if c.ExecuteLen() == 0 {
-				select {
-				case chCloseQueue <- c:
-				default:
+		if parser, ok := ConnParser(c); ok {
+			parser.mux.Lock()
+			h2, isHTTP2 := parser.ConnState.(*http2Conn)
+			parser.mux.Unlock()
+			// the HTTP/2 conns are told to open no more streams and closed after the streams are done.
+			if isHTTP2 {
+				h2.goAway()
+				if h2.activeStreams() > 0 {
+					continue
 				}
+			} else if c.ExecuteLen() > 0 {
+				continue
+			}
+			select {
+			case chCloseQueue <- c:
+			default:
 			}
 		}
 	}
 }
 
+func (e *Engine) http2Enabled() bool {
+	return e != nil && e.Config != nil && e.EnableHTTP2
+}
+
+// spoolBody reports whether the request bodies larger than BodySpoolThreshold are spooled to disk.
+func (e *Engine) spoolBody() bool {
+	return e != nil && e.Config != nil && e.BodySpoolThreshold > 0
+}
+
+// strictParsing reports whether the requests are parsed by StrictParsing.
+func (e *Engine) strictParsing() bool {
+	return e != nil && e.Config != nil && e.StrictParsing
+}
+
+// handlerTimeout returns the HandlerTimeout.
+func (e *Engine) handlerTimeout() time.Duration {
+	if e == nil || e.Config == nil {
+		return 0
+	}
+	return e.HandlerTimeout
+}
+
+// writeTimeout returns the WriteTimeout.
+func (e *Engine) writeTimeout() time.Duration {
+	if e == nil || e.Config == nil {
+		return 0
+	}
+	return e.WriteTimeout
+}
+
+// headerLimits returns the limits of the request line and the headers checked by the parsers.
+func (e *Engine) headerLimits() (maxHeaderBytes, maxHeaderCount, maxURILength int) {
+	if e == nil || e.Config == nil {
+		return 0, 0, 0
+	}
+	return e.MaxHeaderBytes, e.MaxHeaderCount, e.MaxURILength
+}
+
+// expectContinue returns the status replied to r before its body.
+func (e *Engine) expectContinue(r *http.Request) int {
+	if e == nil || e.Config == nil || e.ExpectContinueFunc == nil {
+		return http.StatusContinue
+	}
+	if status := e.ExpectContinueFunc(r); status > 0 {
+		return status
+	}
+	return http.StatusContinue
+}
+
+// streamRequestBody reports whether the handler of r is dispatched before its body is received.
+func (e *Engine) streamRequestBody(r *http.Request) bool {
+	if e == nil || e.Config == nil {
+		return false
+	}
+	if e.StreamRequestBodyFunc != nil {
+		return e.StreamRequestBodyFunc(r)
+	}
+	return e.StreamRequestBody
+}
+
+// http2TLSConfig returns a copy of conf with "h2" added to NextProtos for ALPN,
+// the copies are cached by conf, conf is returned if it has "h2" or HTTP/2 is not enabled.
+func (e *Engine) http2TLSConfig(conf *tls.Config) *tls.Config {
+	if !e.http2Enabled() || conf == nil {
+		return conf
+	}
+	hasHTTP1 := false
+	for _, proto := range conf.NextProtos {
+		switch proto {
+		case "h2":
+			return conf
+		case "http/1.1":
+			hasHTTP1 = true
+		}
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if c, ok := e.http2TLSConfigs[conf]; ok {
+		return c
+	}
+	c := conf.Clone()
+	c.NextProtos = append([]string{"h2"}, conf.NextProtos...)
+	if !hasHTTP1 {
+		c.NextProtos = append(c.NextProtos, "http/1.1")
+	}
+	if e.http2TLSConfigs == nil {
+		e.http2TLSConfigs = map[*tls.Config]*tls.Config{}
+	}
+	e.http2TLSConfigs[conf] = c
+	return c
+}
+
 func (e *Engine) startListeners() error {
 	for _, conf := range e.AddrConfigsTLS {
 		if conf.Addr != "" {
@@ -239,7 +534,8 @@ func (e *Engine) startListeners() error {
 			}
 			e.listeners = append(e.listeners, ln)
 
-			logging.Info("Serve     TLS On: [%v]", conf.Addr)
+			logger := e.Logger().With(logging.Any("addr", conf.Addr))
+			logger.Log(logging.LevelInfo, "serve TLS")
 			e.WaitGroup.Add(1)
 
 			tlsConfig := conf.TLSConfig
@@ -262,10 +558,10 @@ func (e *Engine) startListeners() error {
 					} else {
 						var ne net.Error
 						if ok := errors.As(err, &ne); ok && ne.Temporary() {
-							logging.Error("Accept failed: temporary error, retrying...")
+							e.LogSampler().Log(logger, logging.LevelError, "accept failed: temporary error, retrying...", logging.Err(err))
 							time.Sleep(time.Second / 20)
 						} else {
-							logging.Error("Accept failed: %v, exit...", err)
+							logger.Log(logging.LevelError, "accept failed, exit...", logging.Err(err))
 							break
 						}
 					}
@@ -292,7 +588,8 @@ func (e *Engine) startListeners() error {
 			}
 			e.listeners = append(e.listeners, ln)
 
-			logging.Info("Serve  NonTLS On: [%v]", conf.Addr)
+			logger := e.Logger().With(logging.Any("addr", conf.Addr))
+			logger.Log(logging.LevelInfo, "serve NonTLS")
 			e.WaitGroup.Add(1)
 			go func() {
 				defer func() {
@@ -306,10 +603,10 @@ func (e *Engine) startListeners() error {
 					} else {
 						var ne net.Error
 						if ok := errors.As(err, &ne); ok && ne.Temporary() {
-							logging.Error("Accept failed: temporary error, retrying...")
+							e.LogSampler().Log(logger, logging.LevelError, "accept failed: temporary error, retrying...", logging.Err(err))
 							time.Sleep(time.Second / 20)
 						} else {
-							logging.Error("Accept failed: %v, exit...", err)
+							logger.Log(logging.LevelError, "accept failed, exit...", logging.Err(err))
 							break
 						}
 					}
@@ -392,7 +689,7 @@ func (e *Engine) Shutdown(ctx context.Context) error {
 
 Exit:
 	e.Stop()
-	logging.Info("Gopher[%v] shutdown", e.Gopher.Name)
+	e.Logger().Log(logging.LevelInfo, "shutdown")
 	return nil
 }
 
@@ -426,6 +723,18 @@ func (e *Engine) InitTLSBuffers() {
 	}
 }
 
+type parserKey struct{}
+
+// ConnParser returns the Parser of a conn added to an Engine or a Client.
+func ConnParser(c *nbio.Conn) (*Parser, bool) {
+	parser, ok := c.Attr(parserKey{}).(*Parser)
+	return parser, ok
+}
+
+func setConnParser(c *nbio.Conn, parser *Parser) {
+	c.SetAttr(parserKey{}, parser)
+}
+
 // TLSBuffer .
 func (e *Engine) TLSBuffer(c *nbio.Conn) []byte {
 	return e.getTLSBuffer(c)
@@ -435,38 +744,67 @@ func (e *Engine) TLSBuffer(c *nbio.Conn) []byte {
 func (e *Engine) DataHandler(c *nbio.Conn, data []byte) {
 	defer func() {
 		if err := recover(); err != nil {
-			const size = 64 << 10
-			buf := make([]byte, size)
-			buf = buf[:runtime.Stack(buf, false)]
-			logging.Error("execute parser failed: %v\n%v\n", err, *(*string)(unsafe.Pointer(&buf)))
+			e.LogSampler().LogPanic(c.Logger(), "execute parser failed", err)
 		}
 	}()
-	parser := c.Session().(*Parser)
+	parser, _ := ConnParser(c)
 	if parser == nil {
-		logging.Error("nil parser")
+		c.Logger().Log(logging.LevelError, "nil parser")
 		return
 	}
 	err := parser.Read(data)
 	if err != nil {
-		logging.Debug("parser.Read failed: %v", err)
+		e.LogSampler().Log(c.Logger(), logging.LevelDebug, "parser.Read failed", logging.Err(err))
+		e.closeWithParseError(c, parser, err)
+	}
+}
+
+// closeWithParseError closes c after replying the status of a ParseError, the reply is sent by
+// the parser's executor after the responses of the requests before.
+func (e *Engine) closeWithParseError(c *nbio.Conn, parser *Parser, err error) {
+	perr, ok := err.(*ParseError)
+	if !ok || parser.Processor == nil || parser.Processor.Conn() == nil {
 		c.CloseWithError(err)
+		return
+	}
+	var body []byte
+	if e._onParseError != nil {
+		body = e._onParseError(c, perr)
+	}
+	statusCode := perr.StatusCode
+	conn := parser.Processor.Conn()
+	if proc, ok := parser.Processor.(*ServerProcessor); ok {
+		proc.failStream(err)
 	}
+	parser.Execute(func() {
+		data := mempool.Malloc(128 + len(body))[0:0]
+		data = append(data, "HTTP/1.1 "...)
+		data = strconv.AppendInt(data, int64(statusCode), 10)
+		data = append(data, ' ')
+		data = append(data, http.StatusText(statusCode)...)
+		data = append(data, "\r\nConnection: close\r\nContent-Length: "...)
+		data = strconv.AppendInt(data, int64(len(body)), 10)
+		if len(body) > 0 {
+			data = append(data, "\r\nContent-Type: text/plain; charset=utf-8"...)
+		}
+		data = append(data, "\r\n\r\n"...)
+		data = append(data, body...)
+		conn.Write(data)
+		c.CloseWithError(err)
+	})
 }
 
 // TLSDataHandler .
 func (e *Engine) TLSDataHandler(c *nbio.Conn, data []byte) {
 	defer func() {
 		if err := recover(); err != nil {
-			const size = 64 << 10
-			buf := make([]byte, size)
-			buf = buf[:runtime.Stack(buf, false)]
-			logging.Error("execute parser failed: %v\n%v\n", err, *(*string)(unsafe.Pointer(&buf)))
+			e.LogSampler().LogPanic(c.Logger(), "execute parser failed", err)
 		}
 	}()
 
-	parser := c.Session().(*Parser)
+	parser, _ := ConnParser(c)
 	if parser == nil {
-		logging.Error("nil parser")
+		c.Logger().Log(logging.LevelError, "nil parser")
 		c.Close()
 		return
 	}
@@ -477,6 +815,20 @@ func (e *Engine) TLSDataHandler(c *nbio.Conn, data []byte) {
 		for {
 			_, nread, err := tlsConn.AppendAndRead(data, buffer)
 			data = nil
+			if !parser.tlsHandshaked {
+				if err != nil {
+					parser.tlsHandshaked = true
+					e.Tracer.OnTLSHandshake(c, err)
+				} else if state := tlsConn.ConnectionState(); state.HandshakeComplete {
+					parser.tlsHandshaked = true
+					e.Tracer.OnTLSHandshake(c, nil)
+					if state.NegotiatedProtocol == "h2" && e.http2Enabled() {
+						parser.mux.Lock()
+						upgradeHTTP2(parser, http2ClientPreface, "")
+						parser.mux.Unlock()
+					}
+				}
+			}
 			if err != nil {
 				c.CloseWithError(err)
 				return
@@ -484,8 +836,8 @@ func (e *Engine) TLSDataHandler(c *nbio.Conn, data []byte) {
 			if nread > 0 {
 				err := parser.Read(buffer[:nread])
 				if err != nil {
-					logging.Debug("parser.Read failed: %v", err)
-					c.CloseWithError(err)
+					e.LogSampler().Log(c.Logger(), logging.LevelDebug, "parser.Read failed", logging.Err(err))
+					e.closeWithParseError(c, parser, err)
 					return
 				}
 			}
@@ -504,7 +856,7 @@ func (engine *Engine) AddConnNonTLS(c net.Conn) {
 		c.Close()
 		return
 	}
-	if nbc.Session() != nil {
+	if _, ok := ConnParser(nbc); ok {
 		return
 	}
 	engine.mux.Lock()
@@ -518,9 +870,11 @@ func (engine *Engine) AddConnNonTLS(c net.Conn) {
 	engine._onOpen(nbc)
 	processor := NewServerProcessor(nbc, engine.Handler, engine.KeepaliveTime, !engine.DisableSendfile)
 	parser := NewParser(processor, false, engine.ReadLimit, nbc.Execute)
+	parser.TryExecute = nbc.TryExecute
 	parser.Engine = engine
 	processor.(*ServerProcessor).parser = parser
-	nbc.SetSession(parser)
+	processor.(*ServerProcessor).tracer = engine.Tracer
+	setConnParser(nbc, parser)
 	nbc.OnData(engine.DataHandler)
 	engine.AddConn(nbc)
 	nbc.SetReadDeadline(time.Now().Add(engine.KeepaliveTime))
@@ -533,7 +887,7 @@ func (engine *Engine) AddConnTLS(conn net.Conn, tlsConfig *tls.Config) {
 		conn.Close()
 		return
 	}
-	if nbc.Session() != nil {
+	if _, ok := ConnParser(nbc); ok {
 		return
 	}
 	engine.mux.Lock()
@@ -548,13 +902,15 @@ func (engine *Engine) AddConnTLS(conn net.Conn, tlsConfig *tls.Config) {
 
 	isClient := false
 	isNonBlock := true
-	tlsConn := tls.NewConn(nbc, tlsConfig, isClient, isNonBlock, engine.TLSAllocator)
+	tlsConn := tls.NewConn(nbc, engine.http2TLSConfig(tlsConfig), isClient, isNonBlock, engine.TLSAllocator)
 	processor := NewServerProcessor(tlsConn, engine.Handler, engine.KeepaliveTime, !engine.DisableSendfile)
 	parser := NewParser(processor, false, engine.ReadLimit, nbc.Execute)
+	parser.TryExecute = nbc.TryExecute
 	parser.Conn = tlsConn
 	parser.Engine = engine
 	processor.(*ServerProcessor).parser = parser
-	nbc.SetSession(parser)
+	processor.(*ServerProcessor).tracer = engine.Tracer
+	setConnParser(nbc, parser)
 
 	nbc.OnData(engine.TLSDataHandler)
 	engine.AddConn(nbc)
@@ -587,6 +943,18 @@ func NewEngine(conf Config) *Engine {
 	if conf.BodyAllocator == nil {
 		conf.BodyAllocator = mempool.DefaultMemPool
 	}
+	if conf.StreamRequestBodyBufferSize <= 0 {
+		conf.StreamRequestBodyBufferSize = DefaultStreamRequestBodyBufferSize
+	}
+	if conf.MaxBodySpoolSize <= 0 {
+		conf.MaxBodySpoolSize = DefaultMaxBodySpoolSize
+	}
+	if conf.MinBodyRateInterval <= 0 {
+		conf.MinBodyRateInterval = DefaultMinBodyRateInterval
+	}
+	if conf.Tracer == nil {
+		conf.Tracer = EmptyTracer{}
+	}
 
 	var handler = conf.Handler
 	if handler == nil {
@@ -595,26 +963,44 @@ func NewEngine(conf Config) *Engine {
 	conf.Handler = handler
 
 	var serverExecutor = conf.ServerExecutor
+	var serverTryExecutor = conf.ServerTryExecutor
 	var messageHandlerExecutePool *taskpool.MixedPool
 	if serverExecutor == nil {
 		if conf.MessageHandlerPoolSize <= 0 {
 			conf.MessageHandlerPoolSize = runtime.NumCPU() * 1024
 		}
+		if conf.MessageHandlerQueueSize <= 0 {
+			conf.MessageHandlerQueueSize = 1024 * 1024
+		}
 		nativeSize := conf.MessageHandlerPoolSize - 1
-		messageHandlerExecutePool = taskpool.NewMixedPool(nativeSize, 1, 1024*1024, true)
+		messageHandlerExecutePool = taskpool.NewMixedPool(nativeSize, 1, conf.MessageHandlerQueueSize, true)
 		serverExecutor = messageHandlerExecutePool.Go
+		if serverTryExecutor == nil {
+			pool := messageHandlerExecutePool
+			switch conf.MessageHandlerRejectPolicy {
+			case taskpool.RejectBlock:
+			case taskpool.RejectCallerRuns:
+				serverTryExecutor = func(f func()) error {
+					if err := pool.TryGo(f); err != nil {
+						f()
+					}
+					return nil
+				}
+			default:
+				serverTryExecutor = pool.TryGo
+			}
+		}
 	}
 
 	var clientExecutor = conf.ClientExecutor
 	var clientExecutePool *taskpool.MixedPool
+	// g is created after the executors, it's used by goExecutor for logging only.
+	var g *nbio.Gopher
 	var goExecutor = func(f func()) {
 		go func() { // avoid deadlock
 			defer func() {
 				if err := recover(); err != nil {
-					const size = 64 << 10
-					buf := make([]byte, size)
-					buf = buf[:runtime.Stack(buf, false)]
-					logging.Error("clientExecutor call failed: %v\n%v\n", err, *(*string)(unsafe.Pointer(&buf)))
+					g.LogSampler().LogPanic(g.Logger(), "clientExecutor call failed", err)
 				}
 			}()
 			f()
@@ -644,9 +1030,19 @@ func NewEngine(conf Config) *Engine {
 		MaxReadTimesPerEventLoop: conf.MaxReadTimesPerEventLoop,
 		LockPoller:               conf.LockPoller,
 		LockListener:             conf.LockListener,
+		Tracer:                   conf.Tracer,
+		Context:                  baseCtx,
+		ConnReadRate:             conf.ConnReadRate,
+		ConnWriteRate:            conf.ConnWriteRate,
+		ReadLimiter:              conf.ReadLimiter,
+		WriteLimiter:             conf.WriteLimiter,
+		WriteBufferAllocator:     conf.WriteBufferAllocator,
+		Logger:                   conf.Logger,
+		LogSampler:               conf.LogSampler,
 	}
-	g := nbio.NewGopher(gopherConf)
+	g = nbio.NewGopher(gopherConf)
 	g.Execute = serverExecutor
+	g.TryExecute = serverTryExecutor
 
 	for _, addr := range conf.Addrs {
 		conf.AddrConfigs = append(conf.AddrConfigs, ConfAddr{Addr: addr})
@@ -673,6 +1069,8 @@ func NewEngine(conf Config) *Engine {
 		Cancel:       cancel,
 
 		BodyAllocator: conf.BodyAllocator,
+
+		handlerPool: messageHandlerExecutePool,
 	}
 
 	shouldSupportTLS := !conf.SupportServerOnly || len(conf.AddrsTLS) > 0
@@ -682,10 +1080,16 @@ func NewEngine(conf Config) *Engine {
 
 	// g.OnOpen(engine.ServerOnOpen)
 	g.OnClose(func(c *nbio.Conn, err error) {
+		// the body streamed to a running handler is failed at once, parser.Close runs after the handler.
+		if parser, ok := ConnParser(c); ok {
+			if proc, ok := parser.Processor.(*ServerProcessor); ok {
+				proc.failStream(io.ErrUnexpectedEOF)
+			}
+		}
 		c.MustExecute(func() {
-			parser := c.Session().(*Parser)
+			parser, _ := ConnParser(c)
 			if parser == nil {
-				logging.Error("nil parser")
+				c.Logger().Log(logging.LevelError, "nil parser")
 			}
 			parser.Close(err)
 			engine._onClose(c, err)
@@ -705,12 +1109,14 @@ func NewEngine(conf Config) *Engine {
 	g.OnStop(func() {
 		engine._onStop()
 		g.Execute = func(f func()) {}
+		g.TryExecute = nil
+		// the queued handlers are still run in the background as they were before Stop.
 		if messageHandlerExecutePool != nil {
-			messageHandlerExecutePool.Stop()
+			go messageHandlerExecutePool.Stop(context.Background())
 		}
 		engine.ExecuteClient = goExecutor
 		if clientExecutePool != nil {
-			clientExecutePool.Stop()
+			go clientExecutePool.Stop(context.Background())
 		}
 	})
 	return engine
@@ -0,0 +1,817 @@
+package nbhttp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/nbio"
+	"github.com/lesismal/nbio/mempool"
+	"github.com/lesismal/nbio/niotest"
+	"github.com/lesismal/nbio/taskpool"
+)
+
+func TestRequestContextCancel(t *testing.T) {
+	chStart := make(chan struct{}, 1)
+	chErr := make(chan error, 1)
+	engine := NewEngine(Config{
+		NPoller: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			chStart <- struct{}{}
+			<-r.Context().Done()
+			chErr <- r.Context().Err()
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	engine.AddConnNonTLS(local)
+
+	if _, err = remote.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case <-chStart:
+	case <-time.After(time.Second):
+		t.Fatalf("handler not called")
+	}
+	remote.Close()
+
+	select {
+	case err := <-chErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("invalid context error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request context not cancelled")
+	}
+}
+
+func TestServerExecutorReject(t *testing.T) {
+	engine := NewEngine(Config{
+		NPoller: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Fatalf("rejected request handled")
+		}),
+		ServerTryExecutor: func(f func()) error {
+			return taskpool.ErrPoolFull
+		},
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+
+	if _, err = remote.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(remote), nil)
+	if err != nil {
+		t.Fatalf("ReadResponse failed: %v", err)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("invalid status code: %v", res.StatusCode)
+	}
+}
+
+func TestStreamRequestBody(t *testing.T) {
+	chStart := make(chan struct{}, 1)
+	engine := NewEngine(Config{
+		NPoller: 1,
+		StreamRequestBodyFunc: func(r *http.Request) bool {
+			return r.URL.Path == "/stream"
+		},
+		StreamRequestBodyBufferSize: 1024,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/stream" {
+				chStart <- struct{}{}
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "%s %d %s", r.URL.Path, len(body), r.Trailer.Get("X-Sum"))
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+
+	if _, err = remote.Write([]byte("POST /stream HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// the handler is called before the body is sent.
+	select {
+	case <-chStart:
+	case <-time.After(time.Second):
+		t.Fatalf("handler not called")
+	}
+
+	// the conn is paused while the body is larger than the buffer, so write it on another goroutine.
+	chErr := make(chan error, 1)
+	go func() {
+		chunk := fmt.Sprintf("%x\r\n%s\r\n", 1024*64, strings.Repeat("x", 1024*64))
+		for i := 0; i < 16; i++ {
+			if _, err := remote.Write([]byte(chunk)); err != nil {
+				chErr <- err
+				return
+			}
+		}
+		_, err := remote.Write([]byte("0\r\nX-Sum: ok\r\n\r\nPOST /buffered HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"))
+		chErr <- err
+	}()
+
+	remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+	r := bufio.NewReader(remote)
+	for _, want := range []string{"/stream 1048576 ok", "/buffered 5 "} {
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("ReadResponse failed: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if string(body) != want {
+			t.Fatalf("invalid body: %q, want %q", body, want)
+		}
+	}
+	if err := <-chErr; err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func TestStreamRequestBodyAbort(t *testing.T) {
+	chStart := make(chan struct{}, 1)
+	chErr := make(chan error, 1)
+	engine := NewEngine(Config{
+		NPoller:           1,
+		StreamRequestBody: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			chStart <- struct{}{}
+			_, err := ioutil.ReadAll(r.Body)
+			chErr <- err
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	// the handler waiting for the body returns when the client disconnects or sends a malformed body mid-body.
+	for _, v := range []struct {
+		name  string
+		abort func(remote *niotest.Conn)
+	}{
+		{"disconnect", func(remote *niotest.Conn) {
+			remote.Close()
+		}},
+		{"parse error", func(remote *niotest.Conn) {
+			remote.Write([]byte("zz\r\n"))
+		}},
+	} {
+		local, remote, err := niotest.Pipe(niotest.Faults{})
+		if err != nil {
+			t.Fatalf("Pipe failed: %v", err)
+		}
+		engine.AddConnNonTLS(local)
+		remote.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"))
+		select {
+		case <-chStart:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: handler not called", v.name)
+		}
+		v.abort(remote)
+		select {
+		case err := <-chErr:
+			if err == nil {
+				t.Fatalf("%s: body ended without error", v.name)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("%s: handler not returned", v.name)
+		}
+		remote.Close()
+	}
+}
+
+func TestStreamBodyContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := newStreamBody(mempool.DefaultMemPool, (&http.Request{}).WithContext(ctx), nil, 1024)
+	b.write([]byte("hello"))
+	buf := make([]byte, 16)
+	if n, err := b.Read(buf); n != 5 || err != nil {
+		t.Fatalf("Read failed: %v, %v", n, err)
+	}
+	// the reader waiting for the data returns when the context of the request is done.
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		cancel()
+	}()
+	if _, err := b.Read(buf); err != context.Canceled {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestBodySpool(t *testing.T) {
+	dir := t.TempDir()
+	spooled := func() int {
+		files, _ := ioutil.ReadDir(dir)
+		return len(files)
+	}
+	engine := NewEngine(Config{
+		NPoller:            1,
+		ReadLimit:          1024 * 64,
+		BodySpoolThreshold: 1024,
+		BodySpoolDir:       dir,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := spooled()
+			var body []byte
+			if r.URL.Path == "/takeover" {
+				if r.Body.(*BodyReader).TakeOver() != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				file := r.Body.(*BodyReader).TakeOverFile()
+				if file == nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				defer os.Remove(file.Name())
+				defer file.Close()
+				body, _ = ioutil.ReadAll(file)
+			} else {
+				body, _ = ioutil.ReadAll(r.Body)
+			}
+			fmt.Fprintf(w, "%d %d", n, len(body))
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+
+	// the bodies larger than ReadLimit are accepted since they are not cached by the parser.
+	body := strings.Repeat("x", 1024*256)
+	r := bufio.NewReader(remote)
+	for _, v := range []struct {
+		path string
+		size int
+		want string
+	}{
+		{"/small", 1024, "0 1024"},
+		{"/large", len(body), "1 262144"},
+		{"/takeover", len(body), "1 262144"},
+	} {
+		chErr := make(chan error, 1)
+		go func() {
+			_, err := remote.Write([]byte(fmt.Sprintf("POST %s HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\n\r\n%s", v.path, v.size, body[:v.size])))
+			chErr <- err
+		}()
+		remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("ReadResponse failed: %v", err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		if string(b) != v.want {
+			t.Fatalf("%s: invalid body: %q, want %q", v.path, b, v.want)
+		}
+		if err := <-chErr; err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	// the files are removed after the handlers.
+	time.Sleep(time.Second / 10)
+	if n := spooled(); n != 0 {
+		t.Fatalf("%d files not removed", n)
+	}
+}
+
+func TestBodySpoolAbort(t *testing.T) {
+	dir := t.TempDir()
+	// waitSpooled waits until n files are in dir.
+	waitSpooled := func(n int) bool {
+		for i := 0; i < 300; i++ {
+			if files, _ := ioutil.ReadDir(dir); len(files) == n {
+				return true
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		return false
+	}
+	engine := NewEngine(Config{
+		NPoller:            1,
+		EnableHTTP2:        true,
+		BodySpoolThreshold: 1024,
+		BodySpoolDir:       dir,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("aborted request handled")
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	// the temp file of a body is removed after the client disconnects before the body ends.
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	engine.AddConnNonTLS(local)
+	remote.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4096\r\n\r\n" + strings.Repeat("x", 2048)))
+	if !waitSpooled(1) {
+		t.Fatalf("body not spooled")
+	}
+	remote.Close()
+	if !waitSpooled(0) {
+		t.Fatalf("file not removed after disconnect")
+	}
+
+	// and after the client resets the HTTP/2 stream before the body ends.
+	c := newHTTP2TestConn(t, engine)
+	buf := appendHTTP2Headers(nil, 1, c.headers(":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost"), false, http2DefaultMaxFrameSize)
+	buf = appendHTTP2Data(buf, 1, make([]byte, 2048), false)
+	c.write(buf)
+	if !waitSpooled(1) {
+		t.Fatalf("http2 body not spooled")
+	}
+	c.write(appendHTTP2RSTStream(nil, 1, http2ErrCodeCancel))
+	if !waitSpooled(0) {
+		t.Fatalf("file not removed after RST_STREAM")
+	}
+}
+
+func TestResponseFlush(t *testing.T) {
+	chNext := make(chan struct{}, 1)
+	engine := NewEngine(Config{
+		NPoller: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Sum")
+			w.Write([]byte("hello"))
+			w.(http.Flusher).Flush()
+			<-chNext
+			w.Write([]byte(" world"))
+			w.Header().Set("X-Sum", "ok")
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	for _, proto := range []string{"HTTP/1.1", "HTTP/1.0"} {
+		local, remote, err := niotest.Pipe(niotest.Faults{})
+		if err != nil {
+			t.Fatalf("Pipe failed: %v", err)
+		}
+		engine.AddConnNonTLS(local)
+
+		if _, err = remote.Write([]byte("GET / " + proto + "\r\nHost: localhost\r\n\r\n")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+		res, err := http.ReadResponse(bufio.NewReader(remote), nil)
+		if err != nil {
+			t.Fatalf("ReadResponse failed: %v", err)
+		}
+		// the body flushed is received before the handler returns.
+		head := make([]byte, 5)
+		if _, err = io.ReadFull(res.Body, head); err != nil || string(head) != "hello" {
+			t.Fatalf("%s: invalid body flushed: %q, %v", proto, head, err)
+		}
+		chNext <- struct{}{}
+		tail, err := ioutil.ReadAll(res.Body)
+		if err != nil || string(tail) != " world" {
+			t.Fatalf("%s: invalid body: %q, %v", proto, tail, err)
+		}
+		if proto == "HTTP/1.1" {
+			if len(res.TransferEncoding) == 0 || res.Trailer.Get("X-Sum") != "ok" {
+				t.Fatalf("invalid chunked response: %v, %v", res.TransferEncoding, res.Trailer)
+			}
+		} else if !res.Close {
+			t.Fatalf("HTTP/1.0 response not delimited by closing the conn")
+		}
+		remote.Close()
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	engine := NewEngine(Config{
+		NPoller: 1,
+		ExpectContinueFunc: func(r *http.Request) int {
+			if r.ContentLength > 10 {
+				return http.StatusRequestEntityTooLarge
+			}
+			return http.StatusContinue
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write(body)
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	newConn := func() (*niotest.Conn, *bufio.Reader) {
+		local, remote, err := niotest.Pipe(niotest.Faults{})
+		if err != nil {
+			t.Fatalf("Pipe failed: %v", err)
+		}
+		engine.AddConnNonTLS(local)
+		remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+		return remote, bufio.NewReader(remote)
+	}
+
+	// the body is sent after 100 Continue.
+	remote, r := newConn()
+	defer remote.Close()
+	if _, err := remote.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	res, err := http.ReadResponse(r, nil)
+	if err != nil || res.StatusCode != http.StatusContinue {
+		t.Fatalf("invalid interim response: %v, %v", res, err)
+	}
+	if _, err := remote.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	res, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse failed: %v", err)
+	}
+	if body, _ := ioutil.ReadAll(res.Body); res.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("invalid response: %v %q", res.StatusCode, body)
+	}
+
+	// the large body is rejected without being read.
+	remote, r = newConn()
+	defer remote.Close()
+	if _, err := remote.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 100\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	res, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse failed: %v", err)
+	}
+	if res.StatusCode != http.StatusRequestEntityTooLarge || !res.Close {
+		t.Fatalf("invalid response: %v %v", res.StatusCode, res.Header)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("conn not closed: %v", err)
+	}
+}
+
+func TestParseErrorResponse(t *testing.T) {
+	chErr := make(chan *ParseError, 1)
+	engine := NewEngine(Config{
+		NPoller:   1,
+		ReadLimit: 1024,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+	})
+	engine.OnParseError(func(c *nbio.Conn, err *ParseError) []byte {
+		chErr <- err
+		return []byte(http.StatusText(err.StatusCode))
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	long := strings.Repeat("x", 1000)
+	for _, v := range []struct {
+		parts  []string
+		status int
+		err    error
+	}{
+		{[]string{"GET / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n"}, http.StatusBadRequest, ErrInvalidChunkSize},
+		{[]string{"GET / HTTP/3.0\r\nHost: localhost\r\n\r\n"}, http.StatusHTTPVersionNotSupported, ErrHTTPVersionNotSupported},
+		{[]string{"GET /" + long, long}, http.StatusRequestURITooLong, ErrURITooLong},
+		{[]string{"GET / HTTP/1.1\r\nX-Long: " + long, long}, http.StatusRequestHeaderFieldsTooLarge, ErrHeaderTooLarge},
+		{[]string{"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4096\r\n\r\n" + long, long}, http.StatusRequestEntityTooLarge, ErrBodyTooLarge},
+	} {
+		local, remote, err := niotest.Pipe(niotest.Faults{})
+		if err != nil {
+			t.Fatalf("Pipe failed: %v", err)
+		}
+		engine.AddConnNonTLS(local)
+		// the request before the malformed one is replied first.
+		parts := append([]string{"GET /first HTTP/1.1\r\nHost: localhost\r\n\r\n"}, v.parts...)
+		for _, part := range parts {
+			if _, err := remote.Write([]byte(part)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			// the parts are read separately, so the data cached is checked with ReadLimit.
+			time.Sleep(time.Millisecond * 20)
+		}
+
+		remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+		r := bufio.NewReader(remote)
+		res, err := http.ReadResponse(r, nil)
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("invalid first response: %v, %v", res, err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res, err = http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("ReadResponse failed: %v", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != v.status || !res.Close || string(body) != http.StatusText(v.status) {
+			t.Fatalf("invalid response: %v %v %q, want %v", res.StatusCode, res.Header, body, v.status)
+		}
+		if perr := <-chErr; !errors.Is(perr, v.err) {
+			t.Fatalf("invalid error: %v, want %v", perr, v.err)
+		}
+		if _, err := r.ReadByte(); err != io.EOF {
+			t.Fatalf("conn not closed: %v", err)
+		}
+		remote.Close()
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	engine := NewEngine(Config{
+		NPoller:             1,
+		MaxHeaderBytes:      256,
+		MaxHeaderCount:      4,
+		MaxURILength:        64,
+		ReadHeaderTimeout:   time.Millisecond * 100,
+		MinBodyRate:         1024,
+		MinBodyRateInterval: time.Millisecond * 100,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+			w.Write([]byte("ok"))
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	for _, v := range []struct {
+		request string
+		status  int
+	}{
+		{"GET / HTTP/1.1\r\nHost: localhost\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", http.StatusOK},
+		{"GET / HTTP/1.1\r\nHost: localhost\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"GET /" + strings.Repeat("x", 64) + " HTTP/1.1\r\nHost: localhost\r\n\r\n", http.StatusRequestURITooLong},
+		{"GET / HTTP/1.1\r\nHost: localhost\r\nX-Long: " + strings.Repeat("x", 256) + "\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		// the headers are not completed in time.
+		{"GET / HTTP/1.1\r\nHost: localhost\r\n", http.StatusRequestTimeout},
+	} {
+		local, remote, err := niotest.Pipe(niotest.Faults{})
+		if err != nil {
+			t.Fatalf("Pipe failed: %v", err)
+		}
+		engine.AddConnNonTLS(local)
+		if _, err := remote.Write([]byte(v.request)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+		res, err := http.ReadResponse(bufio.NewReader(remote), nil)
+		if err != nil {
+			t.Fatalf("ReadResponse failed: %v", err)
+		}
+		if res.StatusCode != v.status {
+			t.Fatalf("invalid status: %v, want %v", res.StatusCode, v.status)
+		}
+		remote.Close()
+	}
+
+	// the conn sending the body slower than MinBodyRate is closed.
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+	if _, err := remote.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4096\r\n\r\nx")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("conn not closed: %v", err)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	chErr := make(chan error, 1)
+	engine := NewEngine(Config{
+		NPoller:        1,
+		HandlerTimeout: time.Millisecond * 100,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/slow":
+				<-r.Context().Done()
+				_, err := w.Write([]byte("late"))
+				chErr <- err
+			case "/flushed":
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			default:
+				w.Write([]byte("ok"))
+			}
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+	remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+	r := bufio.NewReader(remote)
+
+	if _, err := remote.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	res, err := http.ReadResponse(r, nil)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("ReadResponse failed: %v, %v", res, err)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+
+	// the conn is kept alive after the handler returns in time.
+	time.Sleep(time.Millisecond * 200)
+	if _, err := remote.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	res, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse failed: %v", err)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable || !res.Close {
+		t.Fatalf("invalid response: %v, close: %v", res.StatusCode, res.Close)
+	}
+	select {
+	case err := <-chErr:
+		if err != http.ErrHandlerTimeout {
+			t.Fatalf("invalid error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("handler not returned")
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("conn not closed: %v", err)
+	}
+
+	// the conn is closed without a reply after the head has been written.
+	local, remote, err = niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+	remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+	if _, err := remote.Write([]byte("GET /flushed HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	res, err = http.ReadResponse(bufio.NewReader(remote), nil)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("ReadResponse failed: %v, %v", res, err)
+	}
+	if _, err := io.Copy(ioutil.Discard, res.Body); err != io.ErrUnexpectedEOF {
+		t.Fatalf("response not truncated: %v", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	const size = 1024 * 1024
+	engine := NewEngine(Config{
+		NPoller:      1,
+		WriteTimeout: time.Millisecond * 100,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/large" {
+				w.Write(make([]byte, size))
+				return
+			}
+			w.Write([]byte("ok"))
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	local, remote, err := niotest.Pipe(niotest.Faults{BufferSize: 4096})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+	remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+	r := bufio.NewReader(remote)
+
+	// the timer is not armed for a response sent at once.
+	if _, err := remote.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	res, err := http.ReadResponse(r, nil)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("ReadResponse failed: %v, %v", res, err)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	time.Sleep(time.Millisecond * 200)
+
+	// the response is not read by the client in time.
+	if _, err := remote.Write([]byte("GET /large HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	time.Sleep(time.Millisecond * 300)
+	n, _ := io.Copy(ioutil.Discard, r)
+	if n >= size {
+		t.Fatalf("response not truncated: %v", n)
+	}
+}
+
+func TestWriteTimeoutOffsets(t *testing.T) {
+	const size = 256 * 1024
+	engine := NewEngine(Config{
+		NPoller:      1,
+		WriteTimeout: time.Millisecond * 300,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(make([]byte, size))
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	local, remote, err := niotest.Pipe(niotest.Faults{BufferSize: 4096})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+	remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+	r := bufio.NewReader(remote)
+
+	readResponse := func() {
+		res, err := http.ReadResponse(r, nil)
+		if err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("ReadResponse failed: %v, %v", res, err)
+		}
+		if n, err := io.Copy(ioutil.Discard, res.Body); n != size || err != nil {
+			t.Fatalf("response truncated: %v, %v", n, err)
+		}
+	}
+
+	// the first response is sent in time, the second one written before the timer of the first one fires
+	// is checked by its own offset, instead of the data buffered by then.
+	if _, err := remote.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	readResponse()
+	time.Sleep(time.Millisecond * 200)
+	if _, err := remote.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	time.Sleep(time.Millisecond * 200)
+	readResponse()
+}
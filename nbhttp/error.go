@@ -6,6 +6,7 @@ package nbhttp
 
 import (
 	"errors"
+	"net/http"
 )
 
 var (
@@ -67,8 +68,66 @@ var (
 
 	// ErrTooLong .
 	ErrTooLong = errors.New("invalid http message: too long")
+
+	// ErrURITooLong is returned by a server parser instead of ErrTooLong for a request line over the ReadLimit.
+	ErrURITooLong = errors.New("invalid http message: request line too long")
+
+	// ErrHeaderTooLarge is returned by a server parser instead of ErrTooLong for headers over the ReadLimit.
+	ErrHeaderTooLarge = errors.New("invalid http message: header too large")
+
+	// ErrBodyTooLarge is returned by a server parser instead of ErrTooLong for a body over the ReadLimit.
+	ErrBodyTooLarge = errors.New("invalid http message: body too large")
+
+	// ErrTooManyHeaders .
+	ErrTooManyHeaders = errors.New("invalid http message: too many headers")
+
+	// ErrReadHeaderTimeout .
+	ErrReadHeaderTimeout = errors.New("read header timeout")
+
+	// ErrBodyTooSlow is the error closing a conn receiving a body slower than the MinBodyRate.
+	ErrBodyTooSlow = errors.New("body received too slow")
+
+	// ErrWriteTimeout is the error closing a conn whose response isn't sent within the WriteTimeout.
+	ErrWriteTimeout = errors.New("response write timeout")
+
+	// ErrHTTPVersionNotSupported .
+	ErrHTTPVersionNotSupported = errors.New("HTTP version not supported")
 )
 
+// ParseError is the error of a server parsing a malformed or too large request,
+// the Engine replies StatusCode with "Connection: close" before closing the conn.
+type ParseError struct {
+	StatusCode int
+	Err        error
+}
+
+func newParseError(err error) *ParseError {
+	statusCode := http.StatusBadRequest
+	switch {
+	case errors.Is(err, ErrURITooLong):
+		statusCode = http.StatusRequestURITooLong
+	case errors.Is(err, ErrHeaderTooLarge), errors.Is(err, ErrTooManyHeaders):
+		statusCode = http.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, ErrBodyTooLarge):
+		statusCode = http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrReadHeaderTimeout):
+		statusCode = http.StatusRequestTimeout
+	case errors.Is(err, ErrHTTPVersionNotSupported):
+		statusCode = http.StatusHTTPVersionNotSupported
+	}
+	return &ParseError{StatusCode: statusCode, Err: err}
+}
+
+// Error .
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap .
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
 var (
 	// ErrInvalidH2SM .
 	ErrInvalidH2SM = errors.New("invalid http2 SM characters")
@@ -77,6 +136,11 @@ var (
 	ErrInvalidH2HeaderR = errors.New("invalid http2 SM characters")
 )
 
+var (
+	// ErrInvalidTraceParent .
+	ErrInvalidTraceParent = errors.New("invalid traceparent")
+)
+
 var (
 	// ErrNilConn .
 	ErrNilConn = errors.New("nil Conn")
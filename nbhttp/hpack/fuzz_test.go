@@ -0,0 +1,47 @@
+//go:build go1.18
+// +build go1.18
+
+package hpack
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func FuzzDecoderDecode(f *testing.F) {
+	for _, s := range []string{
+		"828684410f7777772e6578616d706c652e636f6d",
+		"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+		"3fe11f",
+		"ff80808080808080808001",
+	} {
+		block, _ := hex.DecodeString(s)
+		f.Add(block)
+	}
+	f.Fuzz(func(t *testing.T, block []byte) {
+		// the decoder must not panic on any block, and the fields decoded must survive a round trip.
+		fields, err := decodeAll(NewDecoder(DefaultTableSize, 1<<16), block)
+		if err != nil {
+			return
+		}
+		var size uint32
+		e := NewEncoder()
+		var encoded []byte
+		for _, f := range fields {
+			size += f.Size()
+			encoded = e.AppendField(encoded, f)
+		}
+		if size > 1<<16 {
+			t.Fatalf("header list of %d bytes decoded without error", size)
+		}
+		decoded, err := decodeAll(NewDecoder(DefaultTableSize, 0), encoded)
+		if err != nil {
+			t.Fatalf("decode the encoded fields failed: %v", err)
+		}
+		if len(fields) > 0 && !reflect.DeepEqual(decoded, fields) {
+			t.Fatalf("got %v, want %v", decoded, fields)
+		}
+	})
+}
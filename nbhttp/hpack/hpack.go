@@ -0,0 +1,315 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package hpack implements the header compression of HTTP/2, RFC 7541.
+package hpack
+
+import (
+	"errors"
+)
+
+// DefaultTableSize is the initial size of the dynamic table.
+const DefaultTableSize = 4096
+
+var (
+	// ErrInvalidIndex .
+	ErrInvalidIndex = errors.New("hpack: invalid index")
+	// ErrIntegerOverflow .
+	ErrIntegerOverflow = errors.New("hpack: integer overflow")
+	// ErrTruncated .
+	ErrTruncated = errors.New("hpack: truncated header block")
+	// ErrInvalidHuffman .
+	ErrInvalidHuffman = errors.New("hpack: invalid huffman code")
+	// ErrStringTooLong .
+	ErrStringTooLong = errors.New("hpack: string too long")
+	// ErrTableSizeUpdate .
+	ErrTableSizeUpdate = errors.New("hpack: invalid dynamic table size update")
+	// ErrHeaderListTooLarge is returned after the whole block is decoded, so the decoder
+	// is still usable, the fields after the limit are not emitted.
+	ErrHeaderListTooLarge = errors.New("hpack: header list too large")
+)
+
+// HeaderField .
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Size returns the size of f counted by the dynamic table and SETTINGS_MAX_HEADER_LIST_SIZE.
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+var (
+	staticIndexByField = map[HeaderField]uint64{}
+	staticIndexByName  = map[string]uint64{}
+)
+
+func init() {
+	for i, f := range staticTable {
+		if _, ok := staticIndexByField[f]; !ok {
+			staticIndexByField[f] = uint64(i + 1)
+		}
+		if _, ok := staticIndexByName[f.Name]; !ok {
+			staticIndexByName[f.Name] = uint64(i + 1)
+		}
+	}
+}
+
+// dynamicTable is a FIFO of the fields, the newest is the last one.
+type dynamicTable struct {
+	ents    []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.ents = append(t.ents, f)
+	t.size += f.Size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	i := 0
+	for ; t.size > t.maxSize && i < len(t.ents); i++ {
+		t.size -= t.ents[i].Size()
+	}
+	if i > 0 {
+		n := copy(t.ents, t.ents[i:])
+		for j := n; j < len(t.ents); j++ {
+			t.ents[j] = HeaderField{}
+		}
+		t.ents = t.ents[:n]
+	}
+}
+
+// Decoder decodes the header blocks of a connection, it must not be used concurrently.
+type Decoder struct {
+	table             dynamicTable
+	maxTableSize      uint32
+	maxHeaderListSize uint32
+	buf               []byte
+}
+
+// NewDecoder returns a Decoder, maxTableSize is the SETTINGS_HEADER_TABLE_SIZE sent to the peer,
+// maxHeaderListSize is the SETTINGS_MAX_HEADER_LIST_SIZE and 0 means no limit.
+func NewDecoder(maxTableSize, maxHeaderListSize uint32) *Decoder {
+	return &Decoder{
+		table:             dynamicTable{maxSize: maxTableSize},
+		maxTableSize:      maxTableSize,
+		maxHeaderListSize: maxHeaderListSize,
+	}
+}
+
+// Decode decodes a complete header block and calls emit for every field.
+func (d *Decoder) Decode(block []byte, emit func(f HeaderField)) error {
+	var (
+		err       error
+		f         HeaderField
+		n         uint64
+		listSize  uint64
+		fieldSeen bool
+		tooLarge  bool
+	)
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0:
+			n, block, err = readInt(block, 7)
+			if err != nil {
+				return err
+			}
+			var ok bool
+			f, ok = d.at(n)
+			if !ok {
+				return ErrInvalidIndex
+			}
+		case b&0xc0 == 0x40:
+			f, block, err = d.readLiteral(block, 6)
+			if err != nil {
+				return err
+			}
+			d.table.add(f)
+		case b&0xe0 == 0x20:
+			// the size updates must be at the beginning of a block.
+			if fieldSeen {
+				return ErrTableSizeUpdate
+			}
+			n, block, err = readInt(block, 5)
+			if err != nil {
+				return err
+			}
+			if n > uint64(d.maxTableSize) {
+				return ErrTableSizeUpdate
+			}
+			d.table.setMaxSize(uint32(n))
+			continue
+		default:
+			f, block, err = d.readLiteral(block, 4)
+			if err != nil {
+				return err
+			}
+		}
+		fieldSeen = true
+		if tooLarge {
+			continue
+		}
+		listSize += uint64(f.Size())
+		if d.maxHeaderListSize > 0 && listSize > uint64(d.maxHeaderListSize) {
+			tooLarge = true
+			continue
+		}
+		emit(f)
+	}
+	if tooLarge {
+		return ErrHeaderListTooLarge
+	}
+	return nil
+}
+
+func (d *Decoder) at(i uint64) (HeaderField, bool) {
+	if i == 0 {
+		return HeaderField{}, false
+	}
+	if i <= uint64(len(staticTable)) {
+		return staticTable[i-1], true
+	}
+	i -= uint64(len(staticTable))
+	if i > uint64(len(d.table.ents)) {
+		return HeaderField{}, false
+	}
+	return d.table.ents[len(d.table.ents)-int(i)], true
+}
+
+func (d *Decoder) readLiteral(p []byte, prefix uint) (HeaderField, []byte, error) {
+	var f HeaderField
+	i, p, err := readInt(p, prefix)
+	if err != nil {
+		return f, p, err
+	}
+	if i == 0 {
+		f.Name, p, err = d.readString(p)
+		if err != nil {
+			return f, p, err
+		}
+	} else {
+		nf, ok := d.at(i)
+		if !ok {
+			return f, p, ErrInvalidIndex
+		}
+		f.Name = nf.Name
+	}
+	f.Value, p, err = d.readString(p)
+	return f, p, err
+}
+
+func (d *Decoder) readString(p []byte) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", p, ErrTruncated
+	}
+	huffman := p[0]&0x80 != 0
+	n, p, err := readInt(p, 7)
+	if err != nil {
+		return "", p, err
+	}
+	if d.maxHeaderListSize > 0 && n > uint64(d.maxHeaderListSize) {
+		return "", p, ErrStringTooLong
+	}
+	if uint64(len(p)) < n {
+		return "", p, ErrTruncated
+	}
+	if !huffman {
+		return string(p[:n]), p[n:], nil
+	}
+	d.buf, err = appendHuffmanDecoded(d.buf[:0], p[:n])
+	if err != nil {
+		return "", p, err
+	}
+	return string(d.buf), p[n:], nil
+}
+
+// readInt reads an integer with an n-bit prefix.
+func readInt(p []byte, n uint) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, p, ErrTruncated
+	}
+	mask := uint64(1)<<n - 1
+	v := uint64(p[0]) & mask
+	p = p[1:]
+	if v < mask {
+		return v, p, nil
+	}
+	var m uint
+	for i, b := range p {
+		v += uint64(b&0x7f) << m
+		if b&0x80 == 0 {
+			return v, p[i+1:], nil
+		}
+		m += 7
+		if m > 28 {
+			return 0, p, ErrIntegerOverflow
+		}
+	}
+	return 0, p, ErrTruncated
+}
+
+// Encoder encodes the header blocks of a connection, it must not be used concurrently.
+// It never adds a field to the dynamic table and sets the table size to 0 by the first block,
+// so the SETTINGS_HEADER_TABLE_SIZE of the peer never matters.
+type Encoder struct {
+	sizeUpdated bool
+}
+
+// NewEncoder .
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+// AppendField appends f to the header block dst.
+func (e *Encoder) AppendField(dst []byte, f HeaderField) []byte {
+	if !e.sizeUpdated {
+		e.sizeUpdated = true
+		dst = append(dst, 0x20)
+	}
+	if i, ok := staticIndexByField[f]; ok {
+		return appendInt(dst, 0x80, 7, i)
+	}
+	// literal without indexing.
+	if i, ok := staticIndexByName[f.Name]; ok {
+		dst = appendInt(dst, 0, 4, i)
+	} else {
+		dst = append(dst, 0)
+		dst = appendString(dst, f.Name)
+	}
+	return appendString(dst, f.Value)
+}
+
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return appendHuffman(dst, s)
+	}
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// appendInt appends v with an n-bit prefix, flags are the bits before the prefix.
+func appendInt(dst []byte, flags byte, n uint, v uint64) []byte {
+	mask := uint64(1)<<n - 1
+	if v < mask {
+		return append(dst, flags|byte(v))
+	}
+	dst = append(dst, flags|byte(mask))
+	v -= mask
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
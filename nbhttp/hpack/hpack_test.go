@@ -0,0 +1,112 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func decodeAll(d *Decoder, block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	err := d.Decode(block, func(f HeaderField) {
+		fields = append(fields, f)
+	})
+	return fields, err
+}
+
+func TestDecoderRFCExamples(t *testing.T) {
+	// RFC 7541 C.3 and C.4, the requests without and with huffman coding.
+	for _, blocks := range [][]string{
+		{
+			"828684410f7777772e6578616d706c652e636f6d",
+			"828684be58086e6f2d6361636865",
+			"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
+		},
+		{
+			"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+			"828684be5886a8eb10649cbf",
+			"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+		},
+	} {
+		want := [][]HeaderField{
+			{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}},
+			{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}, {"cache-control", "no-cache"}},
+			{{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"}, {"custom-key", "custom-value"}},
+		}
+		d := NewDecoder(DefaultTableSize, 0)
+		for i, s := range blocks {
+			block, _ := hex.DecodeString(s)
+			fields, err := decodeAll(d, block)
+			if err != nil {
+				t.Fatalf("block %d: %v", i, err)
+			}
+			if !reflect.DeepEqual(fields, want[i]) {
+				t.Fatalf("block %d: got %v, want %v", i, fields, want[i])
+			}
+		}
+		if len(d.table.ents) != 3 || d.table.size != 164 {
+			t.Fatalf("invalid dynamic table: %v, size %d", d.table.ents, d.table.size)
+		}
+	}
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	fields := []HeaderField{
+		{":status", "200"},
+		{":status", "418"},
+		{"content-type", "text/plain; charset=utf-8"},
+		{"x-empty", ""},
+		{"x-binary", "\x00\x01\xfe\xff"},
+	}
+	for i := 0; i < 100; i++ {
+		b := make([]byte, rand.Intn(64))
+		rand.Read(b)
+		fields = append(fields, HeaderField{"x-random", string(b)})
+	}
+
+	e := NewEncoder()
+	d := NewDecoder(DefaultTableSize, 0)
+	for i := 0; i < 2; i++ {
+		var block []byte
+		for _, f := range fields {
+			block = e.AppendField(block, f)
+		}
+		got, err := decodeAll(d, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, fields) {
+			t.Fatalf("got %v, want %v", got, fields)
+		}
+	}
+	if d.table.maxSize != 0 {
+		t.Fatalf("table size not updated: %d", d.table.maxSize)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	for _, s := range []string{
+		"80",               // index 0
+		"be",               // index 62 with an empty dynamic table
+		"410f7777",         // truncated string
+		"418cf1e3c2e5f23a", // truncated huffman string
+		"4181ff",           // huffman padding longer than 7 bits
+		"823f",             // size update after a field
+		"3fe21f",           // size update larger than the limit
+		"ffffffffff0f",     // integer overflow
+	} {
+		block, _ := hex.DecodeString(s)
+		if _, err := decodeAll(NewDecoder(DefaultTableSize, 0), block); err == nil {
+			t.Fatalf("%s: decoded without error", s)
+		}
+	}
+
+	e := NewEncoder()
+	block := e.AppendField(nil, HeaderField{"x-large", string(make([]byte, 100))})
+	block = e.AppendField(block, HeaderField{"x-small", ""})
+	fields, err := decodeAll(NewDecoder(DefaultTableSize, 100), block)
+	if err != ErrHeaderListTooLarge || len(fields) != 0 {
+		t.Fatalf("invalid result of a large header list: %v, %v", fields, err)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package hpack
+
+// huffmanNode is a node of the decoding tree, next is the index of the children
+// by the next bit and 0 means there's no child, sym is -1 for the internal nodes.
+type huffmanNode struct {
+	next [2]uint16
+	sym  int16
+}
+
+var huffmanTree []huffmanNode
+
+func init() {
+	huffmanTree = []huffmanNode{{sym: -1}}
+	for sym, code := range huffmanCodes {
+		n := 0
+		for i := int(huffmanCodeLen[sym]) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if huffmanTree[n].next[bit] == 0 {
+				huffmanTree = append(huffmanTree, huffmanNode{sym: -1})
+				huffmanTree[n].next[bit] = uint16(len(huffmanTree) - 1)
+			}
+			n = int(huffmanTree[n].next[bit])
+		}
+		huffmanTree[n].sym = int16(sym)
+	}
+}
+
+// huffmanEncodedLen returns the size of s encoded.
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLen[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+// appendHuffman appends s encoded to dst, the last byte is padded by the most significant bits of EOS.
+func appendHuffman(dst []byte, s string) []byte {
+	var x uint64
+	var n uint
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		x = x<<huffmanCodeLen[c] | uint64(huffmanCodes[c])
+		n += uint(huffmanCodeLen[c])
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(x>>n))
+		}
+	}
+	if n > 0 {
+		dst = append(dst, byte(x<<(8-n))|byte(0xff>>n))
+	}
+	return dst
+}
+
+// appendHuffmanDecoded appends src decoded to dst, the padding must be the EOS prefix shorter than 8 bits.
+func appendHuffmanDecoded(dst, src []byte) ([]byte, error) {
+	n, depth, ones := 0, 0, true
+	for _, b := range src {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			next := huffmanTree[n].next[bit]
+			if next == 0 {
+				return dst, ErrInvalidHuffman
+			}
+			n = int(next)
+			depth++
+			ones = ones && bit == 1
+			if sym := huffmanTree[n].sym; sym >= 0 {
+				dst = append(dst, byte(sym))
+				n, depth, ones = 0, 0, true
+			}
+		}
+	}
+	if depth > 7 || !ones {
+		return dst, ErrInvalidHuffman
+	}
+	return dst, nil
+}
@@ -0,0 +1,1298 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbhttp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/lesismal/nbio"
+	"github.com/lesismal/nbio/logging"
+	"github.com/lesismal/nbio/mempool"
+	"github.com/lesismal/nbio/nbhttp/hpack"
+)
+
+const (
+	http2MaxConcurrentStreams = 250
+	http2InitialWindowSize    = 1 << 20
+	http2MaxHeaderListSize    = 1 << 20
+
+	http2UpgradeResponse = "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"
+)
+
+var (
+	errHTTP2StreamClosed = errors.New("http2: stream closed")
+	errHTTP2Malformed    = errors.New("http2: malformed request")
+)
+
+// http2ConnHeaders are the connection-specific headers not allowed in HTTP/2.
+var http2ConnHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+func http2ProtocolError(reason string) error {
+	return http2ConnError{code: http2ErrCodeProtocol, reason: reason}
+}
+
+// http2Conn serves an HTTP/2 conn as the ConnState of its Parser, the frames are read on the
+// goroutine of the Parser and the handlers of the streams run concurrently on the Engine's executor.
+type http2Conn struct {
+	parser        *Parser
+	processor     *ServerProcessor
+	conn          net.Conn
+	nbc           *nbio.Conn
+	handler       http.Handler
+	tracer        Tracer
+	execute       func(f func())
+	tryExecute    func(f func()) error
+	baseCtx       context.Context
+	remoteAddr    string
+	keepaliveTime time.Duration
+	readLimit     int
+
+	// the header limits of the Engine, maxHeaderListSize is the MaxHeaderBytes advertised by SETTINGS.
+	maxHeaderListSize uint32
+	maxHeaderCount    int
+	maxURILength      int
+
+	// the fields below are used on the goroutine of the Parser only.
+	preface      string
+	buffer       []byte
+	decoder      *hpack.Decoder
+	headerBlock  []byte
+	headerStream uint32
+	headerEnd    bool
+	recvWindow   int64
+	recvUnacked  uint32
+	out          []byte
+
+	mux           sync.Mutex
+	encoder       *hpack.Encoder
+	streams       map[uint32]*http2Stream
+	lastStreamID  uint32
+	sendWindow    int64
+	initialWindow int64
+	maxFrameSize  int
+	goingAway     bool
+	closed        bool
+}
+
+type http2Stream struct {
+	// recvWindow is decreased on the goroutine of the Parser and increased by the handler reading
+	// a streamed body, it's the first field to be 64-bit aligned for the atomic operations.
+	recvWindow int64
+
+	id       uint32
+	request  *http.Request
+	response *http2Response
+	body     *streamBody
+	cancel   func()
+
+	// the fields below are used on the goroutine of the Parser only.
+	bodySize      int
+	contentLength int64
+	remoteClosed  bool
+
+	// the fields below are guarded by the mux of the http2Conn.
+	sendWindow  int64
+	recvUnacked uint32
+	pending     []byte
+	trailers    []byte
+	endPending  bool
+	dispatched  bool
+	done        bool
+}
+
+// upgradeHTTP2 makes the conn of p serve HTTP/2, preface is the part of the client preface
+// not read yet, head is written before the SETTINGS of the server. It must be called with p.mux held.
+func upgradeHTTP2(p *Parser, preface, head string) *http2Conn {
+	h := newHTTP2Conn(p, preface)
+	p.ConnState = h
+	h.start(head)
+	return h
+}
+
+func newHTTP2Conn(p *Parser, preface string) *http2Conn {
+	proc := p.Processor.(*ServerProcessor)
+	if proc.emptyRequest == nil {
+		proc.emptyRequest = proc.newEmptyRequest()
+	}
+	h := &http2Conn{
+		parser:        p,
+		processor:     proc,
+		conn:          proc.conn,
+		nbc:           underlyingConn(proc.conn),
+		handler:       proc.handler,
+		tracer:        proc.tracer,
+		execute:       p.Execute,
+		tryExecute:    p.TryExecute,
+		baseCtx:       proc.emptyRequest.Context(),
+		remoteAddr:    proc.remoteAddr,
+		keepaliveTime: proc.keepaliveTime,
+		readLimit:     p.readLimit,
+		preface:       preface,
+		recvWindow:    http2InitialWindowSize,
+		encoder:       hpack.NewEncoder(),
+		streams:       map[uint32]*http2Stream{},
+		sendWindow:    http2DefaultWindowSize,
+		initialWindow: http2DefaultWindowSize,
+		maxFrameSize:  http2DefaultMaxFrameSize,
+	}
+	maxHeaderBytes, maxHeaderCount, maxURILength := p.Engine.headerLimits()
+	h.maxHeaderListSize = http2MaxHeaderListSize
+	if maxHeaderBytes > 0 && maxHeaderBytes < http2MaxHeaderListSize {
+		h.maxHeaderListSize = uint32(maxHeaderBytes)
+	}
+	h.maxHeaderCount, h.maxURILength = maxHeaderCount, maxURILength
+	h.decoder = hpack.NewDecoder(http2DefaultHeaderTableSize, h.maxHeaderListSize)
+	// the streams of a conn are handled concurrently.
+	if p.Engine != nil && p.Engine.Gopher != nil {
+		h.execute = p.Engine.Execute
+		h.tryExecute = p.Engine.TryExecute
+	}
+	return h
+}
+
+// start sends head, the SETTINGS of the server and the WINDOW_UPDATE of the conn.
+func (h *http2Conn) start(head string) {
+	buf := mempool.Malloc(len(head) + 64)[0:0]
+	buf = append(buf, head...)
+	buf = appendHTTP2Settings(buf,
+		http2Setting{http2SettingMaxConcurrentStreams, http2MaxConcurrentStreams},
+		http2Setting{http2SettingInitialWindowSize, http2InitialWindowSize},
+		http2Setting{http2SettingMaxHeaderListSize, h.maxHeaderListSize},
+	)
+	buf = appendHTTP2WindowUpdate(buf, 0, http2InitialWindowSize-http2DefaultWindowSize)
+	h.mux.Lock()
+	h.write(buf)
+	// the conn is closed after KeepaliveTime without a stream instead of the read deadline.
+	if h.nbc != nil {
+		h.nbc.SetReadDeadline(time.Time{})
+		h.nbc.SetIdleTimeout(h.keepaliveTime)
+	}
+	h.mux.Unlock()
+}
+
+func (h *http2Conn) logger() logging.FieldLogger {
+	return h.parser.Engine.ConnLogger(h.conn)
+}
+
+// write writes buf to the conn, it must be called with h.mux held.
+func (h *http2Conn) write(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	if h.closed {
+		mempool.Free(buf)
+		return
+	}
+	if _, err := h.conn.Write(buf); err != nil {
+		h.closed = true
+	}
+}
+
+// Read implements ReadCloser.
+func (h *http2Conn) Read(p *Parser, data []byte) error {
+	if len(h.preface) > 0 {
+		n := len(data)
+		if n > len(h.preface) {
+			n = len(h.preface)
+		}
+		if string(data[:n]) != h.preface[:n] {
+			return http2ProtocolError("invalid preface")
+		}
+		h.preface = h.preface[n:]
+		data = data[n:]
+	}
+
+	if len(h.buffer) > 0 {
+		h.buffer = append(h.buffer, data...)
+		data = h.buffer
+	}
+	var err error
+	for len(data) >= http2FrameHeaderLen {
+		fh := parseHTTP2FrameHeader(data)
+		if fh.length > http2DefaultMaxFrameSize {
+			err = http2ConnError{code: http2ErrCodeFrameSize, reason: "frame too large"}
+			break
+		}
+		end := http2FrameHeaderLen + int(fh.length)
+		if len(data) < end {
+			break
+		}
+		err = h.handleFrame(fh, data[http2FrameHeaderLen:end])
+		data = data[end:]
+		if err != nil {
+			break
+		}
+	}
+	h.buffer = append(h.buffer[:0], data...)
+
+	var connErr http2ConnError
+	if errors.As(err, &connErr) {
+		h.out = appendHTTP2GoAway(h.out, h.lastStreamID, connErr.code)
+	} else if h.recvUnacked > 0 {
+		h.out = appendHTTP2WindowUpdate(h.out, 0, h.recvUnacked)
+		h.recvWindow += int64(h.recvUnacked)
+		h.recvUnacked = 0
+	}
+	if len(h.out) > 0 {
+		h.mux.Lock()
+		h.write(h.out)
+		h.mux.Unlock()
+		h.out = nil
+	}
+	if err == nil {
+		h.armTimers(p)
+	}
+	return err
+}
+
+// armTimers arms the timers of the Parser by the frames not received entirely, ReadHeaderTimeout for
+// a header block and MinBodyRate for the request bodies. It must be called with p.mux held.
+func (h *http2Conn) armTimers(p *Parser) {
+	e := p.Engine
+	if e == nil || e.Config == nil {
+		return
+	}
+	if e.ReadHeaderTimeout > 0 {
+		// the type of a partial frame is its 4th byte.
+		inHeaders := h.headerStream != 0 ||
+			(len(h.buffer) > 3 && (h.buffer[3] == http2FrameHeaders || h.buffer[3] == http2FrameContinuation))
+		if inHeaders && p.headerTimer == nil {
+			p.headerTimer = e.AfterFunc(e.ReadHeaderTimeout, p.onReadHeaderTimeout)
+		} else if !inHeaders && p.headerTimer != nil {
+			p.headerTimer.Stop()
+			p.headerTimer = nil
+		}
+	}
+	if e.MinBodyRate > 0 {
+		receiving := h.receiving()
+		if receiving && p.bodyTimer == nil {
+			p.bodyReceived = 0
+			p.bodyTimer = e.Every(e.MinBodyRateInterval, 0, p.checkBodyRate)
+		} else if !receiving && p.bodyTimer != nil {
+			p.bodyTimer.Stop()
+			p.bodyTimer = nil
+		}
+	}
+}
+
+// receiving reports whether a stream is receiving its request body and the windows allow the client
+// to send it, it must be called with the mux of the Parser held.
+func (h *http2Conn) receiving() bool {
+	if h.recvWindow <= 0 {
+		return false
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for _, s := range h.streams {
+		if !s.remoteClosed && atomic.LoadInt64(&s.recvWindow) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// fail sends a GOAWAY with code and closes the conn with err, it's called by the timers of the Parser.
+func (h *http2Conn) fail(code http2ErrCode, err error) {
+	h.mux.Lock()
+	h.write(appendHTTP2GoAway(mempool.Malloc(17)[0:0], h.lastStreamID, code))
+	h.mux.Unlock()
+	if h.nbc != nil {
+		h.nbc.CloseWithError(err)
+		return
+	}
+	h.conn.Close()
+}
+
+// Close implements ReadCloser.
+func (h *http2Conn) Close(p *Parser, err error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.closed = true
+	for _, s := range h.streams {
+		h.closeStream(s)
+	}
+}
+
+// goAway tells the peer not to open new streams, the streams opened are still served.
+func (h *http2Conn) goAway() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.goingAway || h.closed {
+		return
+	}
+	h.goingAway = true
+	h.write(appendHTTP2GoAway(mempool.Malloc(17)[0:0], h.lastStreamID, http2ErrCodeNo))
+}
+
+func (h *http2Conn) activeStreams() int {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return len(h.streams)
+}
+
+func (h *http2Conn) stream(id uint32) *http2Stream {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.streams[id]
+}
+
+func (h *http2Conn) handleFrame(fh http2FrameHeader, payload []byte) error {
+	if h.headerStream != 0 && (fh.typ != http2FrameContinuation || fh.streamID != h.headerStream) {
+		return http2ProtocolError("CONTINUATION expected")
+	}
+	switch fh.typ {
+	case http2FrameData:
+		return h.handleData(fh, payload)
+	case http2FrameHeaders:
+		return h.handleHeaders(fh, payload)
+	case http2FrameContinuation:
+		if h.headerStream == 0 {
+			return http2ProtocolError("unexpected CONTINUATION")
+		}
+		h.headerBlock = append(h.headerBlock, payload...)
+		if len(h.headerBlock) > http2MaxHeaderListSize {
+			return http2ConnError{code: http2ErrCodeEnhanceYourCalm, reason: "header block too large"}
+		}
+		if fh.has(http2FlagEndHeaders) {
+			h.headerStream = 0
+			return h.handleHeaderBlock(fh.streamID, h.headerBlock, h.headerEnd)
+		}
+	case http2FramePriority:
+		if fh.streamID == 0 {
+			return http2ProtocolError("PRIORITY on stream 0")
+		}
+	case http2FrameRSTStream:
+		return h.handleRSTStream(fh, payload)
+	case http2FrameSettings:
+		return h.handleSettings(fh, payload)
+	case http2FramePushPromise:
+		return http2ProtocolError("PUSH_PROMISE from client")
+	case http2FramePing:
+		if fh.streamID != 0 {
+			return http2ProtocolError("PING on a stream")
+		}
+		if len(payload) != 8 {
+			return http2ConnError{code: http2ErrCodeFrameSize, reason: "invalid PING"}
+		}
+		if !fh.has(http2FlagAck) {
+			h.out = appendHTTP2Ping(h.out, http2FlagAck, payload)
+		}
+	case http2FrameGoAway:
+		if fh.streamID != 0 {
+			return http2ProtocolError("GOAWAY on a stream")
+		}
+	case http2FrameWindowUpdate:
+		return h.handleWindowUpdate(fh, payload)
+	default:
+		// the unknown frames are ignored.
+	}
+	return nil
+}
+
+func http2Unpad(fh http2FrameHeader, payload []byte) ([]byte, error) {
+	if !fh.has(http2FlagPadded) {
+		return payload, nil
+	}
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, http2ProtocolError("invalid padding")
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+func (h *http2Conn) handleData(fh http2FrameHeader, payload []byte) error {
+	if fh.streamID == 0 {
+		return http2ProtocolError("DATA on stream 0")
+	}
+	n := int64(fh.length)
+	if n > h.recvWindow {
+		return http2ConnError{code: http2ErrCodeFlowControl, reason: "conn window exceeded"}
+	}
+	h.recvWindow -= n
+	h.recvUnacked += fh.length
+	data, err := http2Unpad(fh, payload)
+	if err != nil {
+		return err
+	}
+
+	s := h.stream(fh.streamID)
+	if s == nil || s.remoteClosed {
+		if fh.streamID > h.lastStreamID {
+			return http2ProtocolError("DATA on an idle stream")
+		}
+		h.out = appendHTTP2RSTStream(h.out, fh.streamID, http2ErrCodeStreamClosed)
+		return nil
+	}
+	if n > atomic.LoadInt64(&s.recvWindow) {
+		h.resetStream(s, http2ErrCodeFlowControl)
+		return nil
+	}
+	atomic.AddInt64(&s.recvWindow, -n)
+	s.bodySize += len(data)
+	if s.body == nil && !h.parser.Engine.spoolBody() && s.bodySize > h.readLimit {
+		h.resetStream(s, http2ErrCodeCancel)
+		return nil
+	}
+	// the data of a streamed body is returned to the window after the handler reads it.
+	ack := n
+	if s.body != nil {
+		s.body.write(data)
+		ack -= int64(len(data))
+	} else if len(data) > 0 {
+		if s.request.Body == nil {
+			s.request.Body = h.parser.newBodyReader(data)
+		} else {
+			s.request.Body.(*BodyReader).Append(data)
+		}
+	}
+	if fh.has(http2FlagEndStream) {
+		h.endStream(s)
+	} else if ack > 0 {
+		h.out = appendHTTP2WindowUpdate(h.out, s.id, uint32(ack))
+		atomic.AddInt64(&s.recvWindow, ack)
+	}
+	return nil
+}
+
+// windowUpdate returns n bytes of the streamed body read by the handler of s to the window,
+// the WINDOW_UPDATE is sent after a frame's worth of bytes is read.
+func (h *http2Conn) windowUpdate(s *http2Stream, n int) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if s.done {
+		return
+	}
+	s.recvUnacked += uint32(n)
+	if s.recvUnacked < http2DefaultMaxFrameSize {
+		return
+	}
+	atomic.AddInt64(&s.recvWindow, int64(s.recvUnacked))
+	h.write(appendHTTP2WindowUpdate(mempool.Malloc(13)[0:0], s.id, s.recvUnacked))
+	s.recvUnacked = 0
+}
+
+func (h *http2Conn) handleHeaders(fh http2FrameHeader, payload []byte) error {
+	if fh.streamID == 0 || fh.streamID%2 == 0 {
+		return http2ProtocolError("invalid stream id")
+	}
+	block, err := http2Unpad(fh, payload)
+	if err != nil {
+		return err
+	}
+	if fh.has(http2FlagPriority) {
+		if len(block) < 5 {
+			return http2ProtocolError("invalid priority")
+		}
+		block = block[5:]
+	}
+	endStream := fh.has(http2FlagEndStream)
+	if fh.streamID <= h.lastStreamID {
+		// trailers, they're decoded to keep the HPACK state and ignored on a stream the server has
+		// reset or refused, as the client could send them before it gets the RST_STREAM.
+		s := h.stream(fh.streamID)
+		if s != nil && s.remoteClosed {
+			return http2ConnError{code: http2ErrCodeStreamClosed, reason: "HEADERS on a closed stream"}
+		}
+		if s != nil && !endStream {
+			return http2ProtocolError("trailers without END_STREAM")
+		}
+	}
+	if fh.has(http2FlagEndHeaders) {
+		return h.handleHeaderBlock(fh.streamID, block, endStream)
+	}
+	h.headerStream = fh.streamID
+	h.headerEnd = endStream
+	h.headerBlock = append(h.headerBlock[:0], block...)
+	return nil
+}
+
+func (h *http2Conn) handleHeaderBlock(id uint32, block []byte, endStream bool) error {
+	if id <= h.lastStreamID {
+		s := h.stream(id)
+		err := h.decoder.Decode(block, func(f hpack.HeaderField) {
+			if s == nil || strings.HasPrefix(f.Name, ":") {
+				return
+			}
+			if s.body != nil {
+				s.body.addTrailer(f.Name, f.Value)
+				return
+			}
+			if s.request.Trailer == nil {
+				s.request.Trailer = http.Header{}
+			}
+			s.request.Trailer.Add(f.Name, f.Value)
+		})
+		if err != nil && err != hpack.ErrHeaderListTooLarge {
+			return http2ConnError{code: http2ErrCodeCompression, reason: err.Error()}
+		}
+		if s != nil {
+			h.endStream(s)
+		}
+		return nil
+	}
+
+	h.mux.Lock()
+	h.lastStreamID = id
+	refused := h.goingAway || len(h.streams) >= http2MaxConcurrentStreams
+	h.mux.Unlock()
+
+	ctx, cancel := context.WithCancel(h.baseCtx)
+	req, err := h.newRequest(ctx, block, endStream)
+	var connErr http2ConnError
+	if errors.As(err, &connErr) {
+		cancel()
+		return err
+	}
+	if refused || errors.Is(err, errHTTP2Malformed) {
+		cancel()
+		code := http2ErrCodeRefusedStream
+		if !refused {
+			code = http2ErrCodeProtocol
+		}
+		h.out = appendHTTP2RSTStream(h.out, id, code)
+		return nil
+	}
+
+	s := &http2Stream{
+		id:           id,
+		request:      req,
+		cancel:       cancel,
+		recvWindow:   http2InitialWindowSize,
+		remoteClosed: endStream,
+	}
+	s.response = newHTTP2Response(h, s)
+	if err == nil && !endStream && h.parser.Engine.streamRequestBody(req) {
+		s.contentLength = req.ContentLength
+		s.body = newStreamBody(h.parser.allocator(), req, nil, 0)
+		s.body.onRead = func(n int) {
+			h.windowUpdate(s, n)
+		}
+		req.Body = s.body
+	}
+	h.addStream(s)
+	h.tracer.OnRequestHeaders(req)
+	if err != nil {
+		s.response.WriteHeader(newParseError(err).StatusCode)
+		s.response.finish()
+		return nil
+	}
+	if endStream || s.body != nil {
+		h.dispatch(s)
+	}
+	return nil
+}
+
+func (h *http2Conn) addStream(s *http2Stream) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	s.sendWindow = h.initialWindow
+	h.streams[s.id] = s
+	if len(h.streams) == 1 && h.nbc != nil {
+		h.nbc.SetIdleTimeout(0)
+	}
+}
+
+// closeStream removes s, it must be called with h.mux held.
+func (h *http2Conn) closeStream(s *http2Stream) {
+	if s.done {
+		return
+	}
+	s.done = true
+	s.pending = nil
+	s.trailers = nil
+	s.cancel()
+	if s.body != nil {
+		s.body.fail(errHTTP2StreamClosed)
+	}
+	// the request of a stream never dispatched is released here, or its spooled body would leak.
+	if !s.dispatched {
+		releaseRequest(s.request)
+	}
+	delete(h.streams, s.id)
+	if len(h.streams) == 0 && h.nbc != nil && !h.closed {
+		h.nbc.SetIdleTimeout(h.keepaliveTime)
+	}
+}
+
+func (h *http2Conn) resetStream(s *http2Stream, code http2ErrCode) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if s.done {
+		return
+	}
+	h.closeStream(s)
+	h.write(appendHTTP2RSTStream(mempool.Malloc(13)[0:0], s.id, code))
+}
+
+// newRequest decodes the header block of a new stream, the error is an http2ConnError if the decoder
+// is broken, errHTTP2Malformed if the request is malformed, or the error of a header limit exceeded
+// with the request returned: ErrHeaderTooLarge, ErrTooManyHeaders or ErrURITooLong.
+func (h *http2Conn) newRequest(ctx context.Context, block []byte, endStream bool) (*http.Request, error) {
+	var (
+		method, scheme, path, authority string
+		malformed                       string
+		regular                         bool
+		count                           int
+		header                          = http.Header{}
+	)
+	err := h.decoder.Decode(block, func(f hpack.HeaderField) {
+		if malformed != "" {
+			return
+		}
+		if strings.HasPrefix(f.Name, ":") {
+			var dst *string
+			switch f.Name {
+			case ":method":
+				dst = &method
+			case ":scheme":
+				dst = &scheme
+			case ":path":
+				dst = &path
+			case ":authority":
+				dst = &authority
+			default:
+				malformed = "invalid pseudo header " + f.Name
+				return
+			}
+			if regular || *dst != "" {
+				malformed = "invalid pseudo header " + f.Name
+				return
+			}
+			*dst = f.Value
+			return
+		}
+		regular = true
+		count++
+		if strings.ToLower(f.Name) != f.Name {
+			malformed = "uppercase header " + f.Name
+			return
+		}
+		key := http.CanonicalHeaderKey(f.Name)
+		if http2ConnHeaders[key] || (key == "Te" && f.Value != "trailers") {
+			malformed = "connection-specific header " + f.Name
+			return
+		}
+		// the cookies are concatenated as they're in a single header in HTTP/1.x.
+		if key == "Cookie" && len(header[key]) > 0 {
+			header[key][0] += "; " + f.Value
+			return
+		}
+		header[key] = append(header[key], f.Value)
+	})
+	if err != nil && err != hpack.ErrHeaderListTooLarge {
+		return nil, http2ConnError{code: http2ErrCodeCompression, reason: err.Error()}
+	}
+	if malformed != "" {
+		return nil, fmt.Errorf("%w: %s", errHTTP2Malformed, malformed)
+	}
+	if err == hpack.ErrHeaderListTooLarge {
+		err = ErrHeaderTooLarge
+	} else if h.maxHeaderCount > 0 && count > h.maxHeaderCount {
+		err = ErrTooManyHeaders
+	}
+
+	req := (&http.Request{}).WithContext(ctx)
+	req.Method = method
+	req.Proto = "HTTP/2.0"
+	req.ProtoMajor = 2
+	req.Header = header
+	req.RemoteAddr = h.remoteAddr
+	if method == http.MethodConnect {
+		if authority == "" || scheme != "" || path != "" {
+			return nil, fmt.Errorf("%w: invalid CONNECT", errHTTP2Malformed)
+		}
+		req.URL = &url.URL{Host: authority}
+		req.RequestURI = authority
+	} else {
+		if method == "" || scheme == "" || path == "" {
+			return nil, fmt.Errorf("%w: missing pseudo header", errHTTP2Malformed)
+		}
+		u, uerr := url.ParseRequestURI(path)
+		if uerr != nil {
+			return nil, fmt.Errorf("%w: %v", errHTTP2Malformed, uerr)
+		}
+		req.URL = u
+		req.RequestURI = path
+	}
+	if err == nil && h.maxURILength > 0 && len(req.RequestURI) > h.maxURILength {
+		err = ErrURITooLong
+	}
+	req.Host = authority
+	if req.Host == "" {
+		req.Host = header.Get("Host")
+	}
+	if req.URL.Host == "" {
+		req.URL.Host = req.Host
+	}
+
+	req.ContentLength = -1
+	if endStream {
+		req.ContentLength = 0
+	} else if cl := header.Get(contentLengthHeader); cl != "" {
+		n, perr := strconv.ParseInt(cl, 10, 64)
+		if perr != nil || n < 0 {
+			return nil, fmt.Errorf("%w: invalid Content-Length %q", errHTTP2Malformed, cl)
+		}
+		req.ContentLength = n
+	}
+	return req, err
+}
+
+// endStream is called after the request of s is received entirely.
+func (h *http2Conn) endStream(s *http2Stream) {
+	s.remoteClosed = true
+	if s.body == nil {
+		h.dispatch(s)
+		return
+	}
+	if s.contentLength >= 0 && s.contentLength != int64(s.bodySize) {
+		s.body.fail(io.ErrUnexpectedEOF)
+		h.resetStream(s, http2ErrCodeProtocol)
+		return
+	}
+	s.body.finish()
+}
+
+// dispatch runs the handler of s after its request is received, or after its headers are
+// received if its body is streamed.
+func (h *http2Conn) dispatch(s *http2Stream) {
+	req := s.request
+	if s.body == nil {
+		if req.ContentLength >= 0 && req.ContentLength != int64(s.bodySize) {
+			h.resetStream(s, http2ErrCodeProtocol)
+			return
+		}
+		req.ContentLength = int64(s.bodySize)
+		if req.Body == nil {
+			req.Body = newBodyReader(h.parser.allocator(), nil)
+		}
+	}
+	h.mux.Lock()
+	if s.done {
+		h.mux.Unlock()
+		return
+	}
+	s.dispatched = true
+	h.mux.Unlock()
+
+	handle := func() {
+		h.serve(s)
+	}
+	if h.tryExecute == nil {
+		h.execute(handle)
+		return
+	}
+	if err := h.tryExecute(handle); err != nil {
+		s.response.WriteHeader(http.StatusServiceUnavailable)
+		s.response.finish()
+		releaseRequest(req)
+	}
+}
+
+func (h *http2Conn) serve(s *http2Stream) {
+	req, res := s.request, s.response
+	defer func() {
+		if err := recover(); err != nil {
+			h.parser.Engine.LogSampler().LogPanic(h.logger(), "execute http2 handler failed", err)
+			h.resetStream(s, http2ErrCodeInternal)
+		}
+		releaseRequest(req)
+	}()
+	h.tracer.OnHandlerStart(req)
+	timedOut := h.serveHTTP(s)
+	h.tracer.OnHandlerEnd(req)
+	if timedOut {
+		// the stream has been replied or reset by the timeout.
+		return
+	}
+	err := res.finish()
+	h.tracer.OnResponseFlushed(req, err)
+	h.processor.armWriteTimeout()
+}
+
+// serveHTTP runs the handler of s bounded by the HandlerTimeout, it reports whether the timeout has been exceeded.
+func (h *http2Conn) serveHTTP(s *http2Stream) (timedOut bool) {
+	engine := h.parser.Engine
+	timeout := engine.handlerTimeout()
+	if timeout <= 0 {
+		h.handler.ServeHTTP(s.response, s.request)
+		return false
+	}
+
+	t := &handlerTimeout{cancel: s.cancel}
+	s.response.timeout = t
+	t.timer = engine.AfterFunc(timeout, func() {
+		h.onHandlerTimeout(s)
+	})
+	defer func() {
+		timedOut = t.stop()
+	}()
+	h.handler.ServeHTTP(s.response, s.request)
+	return
+}
+
+// onHandlerTimeout replies 503 if the head of the response of s hasn't been sent, or resets s,
+// the other streams of the conn are still served.
+func (h *http2Conn) onHandlerTimeout(s *http2Stream) {
+	w := s.response
+	t := w.timeout
+	t.mux.Lock()
+	if t.done {
+		t.mux.Unlock()
+		return
+	}
+	t.timedOut = true
+	t.mux.Unlock()
+
+	t.cancel()
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if s.done {
+		return
+	}
+	h.closeStream(s)
+	if w.headerSent {
+		h.write(appendHTTP2RSTStream(mempool.Malloc(13)[0:0], s.id, http2ErrCodeCancel))
+		return
+	}
+	block := h.encoder.AppendField(nil, hpack.HeaderField{Name: ":status", Value: "503"})
+	block = h.encoder.AppendField(block, hpack.HeaderField{Name: "content-length", Value: "0"})
+	h.write(appendHTTP2Headers(mempool.Malloc(len(block) + 64)[0:0], s.id, block, true, h.maxFrameSize))
+}
+
+func (h *http2Conn) handleRSTStream(fh http2FrameHeader, payload []byte) error {
+	if len(payload) != 4 {
+		return http2ConnError{code: http2ErrCodeFrameSize, reason: "invalid RST_STREAM"}
+	}
+	if fh.streamID == 0 || fh.streamID > h.lastStreamID {
+		return http2ProtocolError("RST_STREAM on an idle stream")
+	}
+	h.mux.Lock()
+	if s, ok := h.streams[fh.streamID]; ok {
+		h.closeStream(s)
+	}
+	h.mux.Unlock()
+	return nil
+}
+
+func (h *http2Conn) handleSettings(fh http2FrameHeader, payload []byte) error {
+	if fh.streamID != 0 {
+		return http2ProtocolError("SETTINGS on a stream")
+	}
+	if fh.has(http2FlagAck) {
+		if len(payload) != 0 {
+			return http2ConnError{code: http2ErrCodeFrameSize, reason: "invalid SETTINGS ack"}
+		}
+		return nil
+	}
+	if len(payload)%6 != 0 {
+		return http2ConnError{code: http2ErrCodeFrameSize, reason: "invalid SETTINGS"}
+	}
+	if err := h.applySettings(payload); err != nil {
+		return err
+	}
+	h.out = appendHTTP2SettingsAck(h.out)
+	return nil
+}
+
+func (h *http2Conn) applySettings(payload []byte) error {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for ; len(payload) >= 6; payload = payload[6:] {
+		val := binary.BigEndian.Uint32(payload[2:])
+		switch binary.BigEndian.Uint16(payload) {
+		case http2SettingEnablePush:
+			if val > 1 {
+				return http2ProtocolError("invalid SETTINGS_ENABLE_PUSH")
+			}
+		case http2SettingInitialWindowSize:
+			if val > http2MaxWindowSize {
+				return http2ConnError{code: http2ErrCodeFlowControl, reason: "invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+			}
+			delta := int64(val) - h.initialWindow
+			h.initialWindow = int64(val)
+			for _, s := range h.streams {
+				s.sendWindow += delta
+				if s.sendWindow > http2MaxWindowSize {
+					return http2ConnError{code: http2ErrCodeFlowControl, reason: "stream window overflow"}
+				}
+			}
+		case http2SettingMaxFrameSize:
+			if val < http2DefaultMaxFrameSize || val > http2MaxFrameSize {
+				return http2ProtocolError("invalid SETTINGS_MAX_FRAME_SIZE")
+			}
+			h.maxFrameSize = int(val)
+		default:
+			// the encoder never uses the dynamic table, so SETTINGS_HEADER_TABLE_SIZE doesn't matter.
+		}
+	}
+	h.flushStreams()
+	return nil
+}
+
+func (h *http2Conn) handleWindowUpdate(fh http2FrameHeader, payload []byte) error {
+	if len(payload) != 4 {
+		return http2ConnError{code: http2ErrCodeFrameSize, reason: "invalid WINDOW_UPDATE"}
+	}
+	incr := int64(binary.BigEndian.Uint32(payload) & (1<<31 - 1))
+	if fh.streamID == 0 {
+		if incr == 0 {
+			return http2ProtocolError("WINDOW_UPDATE of 0")
+		}
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		h.sendWindow += incr
+		if h.sendWindow > http2MaxWindowSize {
+			return http2ConnError{code: http2ErrCodeFlowControl, reason: "conn window overflow"}
+		}
+		h.flushStreams()
+		return nil
+	}
+
+	if fh.streamID > h.lastStreamID {
+		return http2ProtocolError("WINDOW_UPDATE on an idle stream")
+	}
+	s := h.stream(fh.streamID)
+	if s == nil {
+		return nil
+	}
+	if incr == 0 {
+		h.resetStream(s, http2ErrCodeProtocol)
+		return nil
+	}
+	h.mux.Lock()
+	s.sendWindow += incr
+	if s.sendWindow > http2MaxWindowSize {
+		h.mux.Unlock()
+		h.resetStream(s, http2ErrCodeFlowControl)
+		return nil
+	}
+	h.write(h.appendPending(nil, s))
+	h.mux.Unlock()
+	return nil
+}
+
+// flushStreams sends the data of the streams allowed by the windows, it must be called with h.mux held.
+func (h *http2Conn) flushStreams() {
+	var buf []byte
+	for _, s := range h.streams {
+		if len(s.pending) > 0 || s.endPending {
+			buf = h.appendPending(buf, s)
+		}
+	}
+	h.write(buf)
+}
+
+// appendPending appends the DATA frames of s allowed by the windows and the end of s after
+// all the data is sent, it must be called with h.mux held.
+func (h *http2Conn) appendPending(buf []byte, s *http2Stream) []byte {
+	for len(s.pending) > 0 {
+		n := len(s.pending)
+		if n > h.maxFrameSize {
+			n = h.maxFrameSize
+		}
+		if int64(n) > s.sendWindow {
+			n = int(s.sendWindow)
+		}
+		if int64(n) > h.sendWindow {
+			n = int(h.sendWindow)
+		}
+		if n <= 0 {
+			return buf
+		}
+		end := s.endPending && n == len(s.pending) && s.trailers == nil
+		buf = appendHTTP2Data(buf, s.id, s.pending[:n], end)
+		s.pending = s.pending[n:]
+		s.sendWindow -= int64(n)
+		h.sendWindow -= int64(n)
+		if end {
+			h.closeStream(s)
+			return buf
+		}
+	}
+	s.pending = nil
+	if s.endPending {
+		if s.trailers != nil {
+			buf = appendHTTP2Headers(buf, s.id, s.trailers, true, h.maxFrameSize)
+		} else {
+			buf = appendHTTP2Data(buf, s.id, nil, true)
+		}
+		h.closeStream(s)
+	}
+	return buf
+}
+
+// h2cSettings returns the payload of HTTP2-Settings if r is an h2c upgrade without a body.
+func h2cSettings(r *http.Request) ([]byte, bool) {
+	if r.ProtoMajor != 1 || r.ProtoMinor != 1 || r.Body != nil || len(r.TransferEncoding) > 0 {
+		return nil, false
+	}
+	if !headerHasToken(r.Header["Upgrade"], "h2c") ||
+		!headerHasToken(r.Header["Connection"], "upgrade") ||
+		!headerHasToken(r.Header["Connection"], "http2-settings") {
+		return nil, false
+	}
+	values := r.Header["Http2-Settings"]
+	if len(values) != 1 {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+	if err != nil || len(settings)%6 != 0 {
+		return nil, false
+	}
+	return settings, true
+}
+
+func headerHasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveUpgrade applies the HTTP2-Settings of an h2c upgrade and serves r as stream 1.
+func (h *http2Conn) serveUpgrade(r *http.Request, settings []byte) {
+	if err := h.applySettings(settings); err != nil {
+		h.conn.Close()
+		return
+	}
+	ctx, cancel := context.WithCancel(h.baseCtx)
+	req := r.WithContext(ctx)
+	req.Proto = "HTTP/2.0"
+	req.ProtoMajor = 2
+	req.ProtoMinor = 0
+	req.Close = false
+	for _, k := range []string{"Connection", "Upgrade", "Http2-Settings", "Keep-Alive"} {
+		delete(req.Header, k)
+	}
+	s := &http2Stream{
+		id:           1,
+		request:      req,
+		cancel:       cancel,
+		recvWindow:   http2InitialWindowSize,
+		remoteClosed: true,
+	}
+	s.response = newHTTP2Response(h, s)
+	h.mux.Lock()
+	h.lastStreamID = 1
+	h.mux.Unlock()
+	h.addStream(s)
+	h.dispatch(s)
+}
+
+// http2Response implements http.ResponseWriter and http.Flusher for a stream.
+// The body is buffered until the handler returns, so the Content-Length is set as
+// the Response of HTTP/1.x does, unless it's flushed or larger than maxPacketSize.
+type http2Response struct {
+	h *http2Conn
+	s *http2Stream
+
+	header     http.Header
+	statusCode int
+	hasBody    bool
+	headerSent bool
+	finished   bool
+	buffer     []byte
+
+	timeout *handlerTimeout
+}
+
+func newHTTP2Response(h *http2Conn, s *http2Stream) *http2Response {
+	return &http2Response{h: h, s: s, header: http.Header{}}
+}
+
+// Header .
+func (w *http2Response) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader .
+func (w *http2Response) WriteHeader(statusCode int) {
+	if w.timeout.lock() != nil {
+		return
+	}
+	defer w.timeout.unlock()
+	w.writeHeader(statusCode)
+}
+
+func (w *http2Response) writeHeader(statusCode int) {
+	if w.statusCode == 0 && http.StatusText(statusCode) != "" {
+		w.statusCode = statusCode
+	}
+}
+
+// WriteString .
+func (w *http2Response) WriteString(s string) (int, error) {
+	x := (*[2]uintptr)(unsafe.Pointer(&s))
+	h := [3]uintptr{x[0], x[1], x[1]}
+	return w.Write(*(*[]byte)(unsafe.Pointer(&h)))
+}
+
+// Write .
+func (w *http2Response) Write(data []byte) (int, error) {
+	if err := w.timeout.lock(); err != nil {
+		return 0, err
+	}
+	defer w.timeout.unlock()
+	w.writeHeader(http.StatusOK)
+	if !http2BodyAllowed(w.statusCode) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	w.hasBody = true
+	w.buffer = append(w.buffer, data...)
+	if len(w.buffer) >= maxPacketSize {
+		if err := w.flush(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Flush implements http.Flusher.
+func (w *http2Response) Flush() {
+	if w.timeout.lock() != nil {
+		return
+	}
+	defer w.timeout.unlock()
+	w.writeHeader(http.StatusOK)
+	w.flush(false)
+}
+
+func (w *http2Response) finish() error {
+	if w.finished {
+		return nil
+	}
+	w.finished = true
+	w.writeHeader(http.StatusOK)
+	return w.flush(true)
+}
+
+func http2BodyAllowed(statusCode int) bool {
+	return statusCode >= 200 && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
+
+func (w *http2Response) flush(end bool) error {
+	h, s := w.h, w.s
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if s.done {
+		w.buffer = w.buffer[:0]
+		return errHTTP2StreamClosed
+	}
+
+	if s.request.Method == http.MethodHead {
+		// the Content-Length is set by the size written, but the body is not sent.
+		if !w.headerSent && end && !w.headerExists(contentLengthHeader) {
+			w.header[contentLengthHeader] = []string{strconv.Itoa(len(w.buffer))}
+		}
+		w.buffer = w.buffer[:0]
+	}
+
+	buf := mempool.Malloc(len(w.buffer) + 256)[0:0]
+	var trailers []byte
+	if end {
+		trailers = w.appendTrailers(nil)
+	}
+	if !w.headerSent {
+		w.headerSent = true
+		if end && !w.headerExists(contentLengthHeader) && http2BodyAllowed(w.statusCode) {
+			w.header[contentLengthHeader] = []string{strconv.Itoa(len(w.buffer))}
+		}
+		block := w.appendHeaders(nil)
+		if end && len(w.buffer) == 0 && trailers == nil {
+			buf = appendHTTP2Headers(buf, s.id, block, true, h.maxFrameSize)
+			h.closeStream(s)
+			h.write(buf)
+			return nil
+		}
+		buf = appendHTTP2Headers(buf, s.id, block, false, h.maxFrameSize)
+	}
+	s.pending = append(s.pending, w.buffer...)
+	w.buffer = w.buffer[:0]
+	if end {
+		s.endPending = true
+		s.trailers = trailers
+	}
+	h.write(h.appendPending(buf, s))
+	return nil
+}
+
+func (w *http2Response) headerExists(key string) bool {
+	return len(w.header[key]) > 0
+}
+
+func (w *http2Response) trailerKeys() map[string]bool {
+	var keys map[string]bool
+	for _, v := range w.header[trailerHeader] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				if keys == nil {
+					keys = map[string]bool{}
+				}
+				keys[http.CanonicalHeaderKey(k)] = true
+			}
+		}
+	}
+	return keys
+}
+
+// appendHeaders encodes the headers, it must be called with the mux of the http2Conn held.
+func (w *http2Response) appendHeaders(block []byte) []byte {
+	enc := w.h.encoder
+	block = enc.AppendField(block, hpack.HeaderField{Name: ":status", Value: strconv.Itoa(w.statusCode)})
+	if w.hasBody && !w.headerExists("Content-Type") {
+		block = enc.AppendField(block, hpack.HeaderField{Name: "content-type", Value: "text/plain; charset=utf-8"})
+	}
+	if !w.headerExists("Date") {
+		block = enc.AppendField(block, hpack.HeaderField{Name: "date", Value: time.Now().UTC().Format(http.TimeFormat)})
+	}
+	trailers := w.trailerKeys()
+	for k, vv := range w.header {
+		if http2ConnHeaders[k] || trailers[k] {
+			continue
+		}
+		name := strings.ToLower(k)
+		for _, v := range vv {
+			block = enc.AppendField(block, hpack.HeaderField{Name: name, Value: v})
+		}
+	}
+	return block
+}
+
+// appendTrailers encodes the trailers declared by the header "Trailer", it returns nil if there's none.
+func (w *http2Response) appendTrailers(block []byte) []byte {
+	for k := range w.trailerKeys() {
+		for _, v := range w.header[k] {
+			block = w.h.encoder.AppendField(block, hpack.HeaderField{Name: strings.ToLower(k), Value: v})
+		}
+	}
+	return block
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbhttp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	http2ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	// http2PrefaceTail is the part of the preface after the request "PRI * HTTP/2.0" parsed by the Parser.
+	http2PrefaceTail = "SM\r\n\r\n"
+
+	http2FrameHeaderLen = 9
+
+	http2DefaultMaxFrameSize    = 16384
+	http2MaxFrameSize           = 1<<24 - 1
+	http2DefaultWindowSize      = 65535
+	http2MaxWindowSize          = 1<<31 - 1
+	http2DefaultHeaderTableSize = 4096
+)
+
+const (
+	http2FrameData         uint8 = 0x0
+	http2FrameHeaders      uint8 = 0x1
+	http2FramePriority     uint8 = 0x2
+	http2FrameRSTStream    uint8 = 0x3
+	http2FrameSettings     uint8 = 0x4
+	http2FramePushPromise  uint8 = 0x5
+	http2FramePing         uint8 = 0x6
+	http2FrameGoAway       uint8 = 0x7
+	http2FrameWindowUpdate uint8 = 0x8
+	http2FrameContinuation uint8 = 0x9
+)
+
+const (
+	http2FlagEndStream  uint8 = 0x1
+	http2FlagAck        uint8 = 0x1
+	http2FlagEndHeaders uint8 = 0x4
+	http2FlagPadded     uint8 = 0x8
+	http2FlagPriority   uint8 = 0x20
+)
+
+const (
+	http2SettingHeaderTableSize      uint16 = 0x1
+	http2SettingEnablePush           uint16 = 0x2
+	http2SettingMaxConcurrentStreams uint16 = 0x3
+	http2SettingInitialWindowSize    uint16 = 0x4
+	http2SettingMaxFrameSize         uint16 = 0x5
+	http2SettingMaxHeaderListSize    uint16 = 0x6
+)
+
+// http2ErrCode is the error code of RST_STREAM and GOAWAY.
+type http2ErrCode uint32
+
+const (
+	http2ErrCodeNo                 http2ErrCode = 0x0
+	http2ErrCodeProtocol           http2ErrCode = 0x1
+	http2ErrCodeInternal           http2ErrCode = 0x2
+	http2ErrCodeFlowControl        http2ErrCode = 0x3
+	http2ErrCodeSettingsTimeout    http2ErrCode = 0x4
+	http2ErrCodeStreamClosed       http2ErrCode = 0x5
+	http2ErrCodeFrameSize          http2ErrCode = 0x6
+	http2ErrCodeRefusedStream      http2ErrCode = 0x7
+	http2ErrCodeCancel             http2ErrCode = 0x8
+	http2ErrCodeCompression        http2ErrCode = 0x9
+	http2ErrCodeConnect            http2ErrCode = 0xa
+	http2ErrCodeEnhanceYourCalm    http2ErrCode = 0xb
+	http2ErrCodeInadequateSecurity http2ErrCode = 0xc
+	http2ErrCodeHTTP11Required     http2ErrCode = 0xd
+)
+
+// http2ConnError is a connection error, the conn is closed after a GOAWAY with its code.
+type http2ConnError struct {
+	code   http2ErrCode
+	reason string
+}
+
+func (e http2ConnError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.code, e.reason)
+}
+
+type http2FrameHeader struct {
+	length   uint32
+	typ      uint8
+	flags    uint8
+	streamID uint32
+}
+
+func (h http2FrameHeader) has(flag uint8) bool {
+	return h.flags&flag != 0
+}
+
+func parseHTTP2FrameHeader(b []byte) http2FrameHeader {
+	return http2FrameHeader{
+		length:   uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]),
+		typ:      b[3],
+		flags:    b[4],
+		streamID: binary.BigEndian.Uint32(b[5:]) & (1<<31 - 1),
+	}
+}
+
+func appendHTTP2FrameHeader(dst []byte, length int, typ, flags uint8, streamID uint32) []byte {
+	return append(dst,
+		byte(length>>16), byte(length>>8), byte(length),
+		typ, flags,
+		byte(streamID>>24), byte(streamID>>16), byte(streamID>>8), byte(streamID),
+	)
+}
+
+type http2Setting struct {
+	id  uint16
+	val uint32
+}
+
+func appendHTTP2Settings(dst []byte, settings ...http2Setting) []byte {
+	dst = appendHTTP2FrameHeader(dst, 6*len(settings), http2FrameSettings, 0, 0)
+	for _, s := range settings {
+		dst = append(dst, byte(s.id>>8), byte(s.id),
+			byte(s.val>>24), byte(s.val>>16), byte(s.val>>8), byte(s.val))
+	}
+	return dst
+}
+
+func appendHTTP2SettingsAck(dst []byte) []byte {
+	return appendHTTP2FrameHeader(dst, 0, http2FrameSettings, http2FlagAck, 0)
+}
+
+func appendHTTP2WindowUpdate(dst []byte, streamID uint32, incr uint32) []byte {
+	dst = appendHTTP2FrameHeader(dst, 4, http2FrameWindowUpdate, 0, streamID)
+	return append(dst, byte(incr>>24), byte(incr>>16), byte(incr>>8), byte(incr))
+}
+
+func appendHTTP2RSTStream(dst []byte, streamID uint32, code http2ErrCode) []byte {
+	dst = appendHTTP2FrameHeader(dst, 4, http2FrameRSTStream, 0, streamID)
+	return append(dst, byte(code>>24), byte(code>>16), byte(code>>8), byte(code))
+}
+
+func appendHTTP2GoAway(dst []byte, lastStreamID uint32, code http2ErrCode) []byte {
+	dst = appendHTTP2FrameHeader(dst, 8, http2FrameGoAway, 0, 0)
+	return append(dst,
+		byte(lastStreamID>>24), byte(lastStreamID>>16), byte(lastStreamID>>8), byte(lastStreamID),
+		byte(code>>24), byte(code>>16), byte(code>>8), byte(code))
+}
+
+func appendHTTP2Ping(dst []byte, flags uint8, payload []byte) []byte {
+	dst = appendHTTP2FrameHeader(dst, 8, http2FramePing, flags, 0)
+	return append(dst, payload...)
+}
+
+// appendHTTP2Headers appends block as a HEADERS frame and the CONTINUATION frames after it.
+func appendHTTP2Headers(dst []byte, streamID uint32, block []byte, endStream bool, maxFrameSize int) []byte {
+	typ, flags := http2FrameHeaders, uint8(0)
+	if endStream {
+		flags = http2FlagEndStream
+	}
+	for {
+		n := len(block)
+		if n > maxFrameSize {
+			n = maxFrameSize
+		} else {
+			flags |= http2FlagEndHeaders
+		}
+		dst = appendHTTP2FrameHeader(dst, n, typ, flags, streamID)
+		dst = append(dst, block[:n]...)
+		block = block[n:]
+		if len(block) == 0 {
+			return dst
+		}
+		typ, flags = http2FrameContinuation, 0
+	}
+}
+
+func appendHTTP2Data(dst []byte, streamID uint32, data []byte, endStream bool) []byte {
+	flags := uint8(0)
+	if endStream {
+		flags = http2FlagEndStream
+	}
+	dst = appendHTTP2FrameHeader(dst, len(data), http2FrameData, flags, streamID)
+	return append(dst, data...)
+}
@@ -0,0 +1,60 @@
+//go:build go1.18
+// +build go1.18
+
+package nbhttp
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/lesismal/nbio/nbhttp/hpack"
+)
+
+// http2FuzzConn discards the frames written by the server.
+type http2FuzzConn struct {
+	net.Conn
+}
+
+func (c http2FuzzConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c http2FuzzConn) Close() error {
+	return nil
+}
+
+func (c http2FuzzConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func FuzzHTTP2Frames(f *testing.F) {
+	enc := hpack.NewEncoder()
+	var block []byte
+	for _, field := range []hpack.HeaderField{{Name: ":method", Value: "POST"}, {Name: ":scheme", Value: "http"}, {Name: ":path", Value: "/"}, {Name: ":authority", Value: "localhost"}} {
+		block = enc.AppendField(block, field)
+	}
+	buf := appendHTTP2Settings(nil, http2Setting{http2SettingInitialWindowSize, 10})
+	buf = appendHTTP2Headers(buf, 1, block, false, 8)
+	buf = appendHTTP2Data(buf, 1, []byte("body"), false)
+	buf = appendHTTP2Headers(buf, 1, enc.AppendField(nil, hpack.HeaderField{Name: "x-sum", Value: "ok"}), true, 16)
+	f.Add(buf)
+	buf = appendHTTP2WindowUpdate(nil, 0, 100)
+	buf = appendHTTP2Ping(buf, 0, []byte("12345678"))
+	buf = appendHTTP2RSTStream(buf, 1, http2ErrCodeCancel)
+	buf = appendHTTP2GoAway(buf, 0, http2ErrCodeNo)
+	f.Add(buf)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// the frames must not panic the server, whatever the error is.
+		processor := NewServerProcessor(http2FuzzConn{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}), DefaultKeepaliveTime, false)
+		parser := NewParser(processor, false, 1024*1024, nil)
+		parser.Engine = &Engine{Config: &Config{EnableHTTP2: true}, emptyRequest: &http.Request{}}
+		processor.(*ServerProcessor).parser = parser
+		upgradeHTTP2(parser, http2ClientPreface, "")
+		err := parser.Read(append([]byte(http2ClientPreface), data...))
+		parser.Close(err)
+	})
+}
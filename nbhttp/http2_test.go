@@ -0,0 +1,753 @@
+package nbhttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lesismal/nbio/nbhttp/hpack"
+	"github.com/lesismal/nbio/niotest"
+)
+
+type http2TestClient struct {
+	t       *testing.T
+	conn    net.Conn
+	r       *bufio.Reader
+	encoder *hpack.Encoder
+	decoder *hpack.Decoder
+}
+
+type http2TestResponse struct {
+	header http.Header
+	body   []byte
+}
+
+func newHTTP2TestClient(t *testing.T, conn net.Conn) *http2TestClient {
+	return &http2TestClient{
+		t:       t,
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		encoder: hpack.NewEncoder(),
+		decoder: hpack.NewDecoder(http2DefaultHeaderTableSize, 0),
+	}
+}
+
+func (c *http2TestClient) write(buf []byte) {
+	if _, err := c.conn.Write(buf); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func (c *http2TestClient) headers(fields ...string) []byte {
+	var block []byte
+	for i := 0; i+1 < len(fields); i += 2 {
+		block = c.encoder.AppendField(block, hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return block
+}
+
+func (c *http2TestClient) readFrame() (http2FrameHeader, []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	head := make([]byte, http2FrameHeaderLen)
+	if _, err := io.ReadFull(c.r, head); err != nil {
+		c.t.Fatalf("read frame header failed: %v", err)
+	}
+	fh := parseHTTP2FrameHeader(head)
+	payload := make([]byte, fh.length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		c.t.Fatalf("read frame payload failed: %v", err)
+	}
+	return fh, payload
+}
+
+// readResponses reads the frames until n streams are ended.
+func (c *http2TestClient) readResponses(n int) map[uint32]*http2TestResponse {
+	responses := map[uint32]*http2TestResponse{}
+	for ended := 0; ended < n; {
+		fh, payload := c.readFrame()
+		switch fh.typ {
+		case http2FrameHeaders:
+			res, ok := responses[fh.streamID]
+			if !ok {
+				res = &http2TestResponse{header: http.Header{}}
+				responses[fh.streamID] = res
+			}
+			err := c.decoder.Decode(payload, func(f hpack.HeaderField) {
+				res.header.Add(f.Name, f.Value)
+			})
+			if err != nil {
+				c.t.Fatalf("Decode failed: %v", err)
+			}
+		case http2FrameData:
+			res := responses[fh.streamID]
+			if res == nil {
+				c.t.Fatalf("DATA before HEADERS")
+			}
+			res.body = append(res.body, payload...)
+		case http2FrameRSTStream, http2FrameGoAway:
+			c.t.Fatalf("unexpected frame %d: %v", fh.typ, payload)
+		default:
+			continue
+		}
+		if fh.has(http2FlagEndStream) {
+			ended++
+		}
+	}
+	return responses
+}
+
+func newHTTP2TestEngine(t *testing.T) *Engine {
+	engine := NewEngine(Config{
+		NPoller:     1,
+		EnableHTTP2: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Proto", r.Proto)
+			w.Header().Set("Trailer", "X-Size")
+			w.Write([]byte(r.Method + " " + r.URL.Path + " " + string(body)))
+			w.Header().Set("X-Size", strconv.Itoa(len(body)))
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	return engine
+}
+
+func checkHTTP2Response(t *testing.T, res *http2TestResponse, body string) {
+	if res == nil {
+		t.Fatalf("no response")
+	}
+	if res.header.Get(":status") != "200" || res.header.Get("x-proto") != "HTTP/2.0" {
+		t.Fatalf("invalid header: %v", res.header)
+	}
+	if string(res.body) != body {
+		t.Fatalf("invalid body: %q, want %q", res.body, body)
+	}
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	engine := newHTTP2TestEngine(t)
+
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+
+	c := newHTTP2TestClient(t, remote)
+	buf := []byte(http2ClientPreface)
+	buf = appendHTTP2Settings(buf, http2Setting{http2SettingInitialWindowSize, 1 << 20})
+	buf = appendHTTP2WindowUpdate(buf, 0, 1<<20)
+	buf = appendHTTP2Headers(buf, 1, c.headers(":method", "GET", ":scheme", "http", ":path", "/get", ":authority", "localhost"), true, http2DefaultMaxFrameSize)
+	// the body of stream 3 is larger than the initial window of the conn.
+	body := strings.Repeat("x", http2DefaultWindowSize+1)
+	buf = appendHTTP2Headers(buf, 3, c.headers(":method", "POST", ":scheme", "http", ":path", "/post", ":authority", "localhost"), false, http2DefaultMaxFrameSize)
+	for i := 0; i < len(body); i += http2DefaultMaxFrameSize {
+		end := i + http2DefaultMaxFrameSize
+		if end > len(body) {
+			end = len(body)
+		}
+		buf = appendHTTP2Data(buf, 3, []byte(body[i:end]), end == len(body))
+	}
+	c.write(buf)
+
+	responses := c.readResponses(2)
+	checkHTTP2Response(t, responses[1], "GET /get ")
+	checkHTTP2Response(t, responses[3], "POST /post "+body)
+	if size := responses[3].header.Get("x-size"); size != strconv.Itoa(len(body)) {
+		t.Fatalf("invalid trailer: %v", size)
+	}
+
+	// the conn is closed by Shutdown after a GOAWAY.
+	ch := make(chan error, 1)
+	go func() {
+		ch <- engine.Shutdown(context.Background())
+	}()
+	for {
+		fh, payload := c.readFrame()
+		if fh.typ == http2FrameGoAway {
+			if id := binary.BigEndian.Uint32(payload); id != 3 {
+				t.Fatalf("invalid last stream id: %v", id)
+			}
+			break
+		}
+	}
+	if err := <-ch; err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+}
+
+func TestHTTP2Upgrade(t *testing.T) {
+	engine := newHTTP2TestEngine(t)
+	defer engine.Stop()
+
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+
+	c := newHTTP2TestClient(t, remote)
+	settings := appendHTTP2Settings(nil, http2Setting{http2SettingMaxFrameSize, http2DefaultMaxFrameSize})[http2FrameHeaderLen:]
+	c.write([]byte("GET /upgrade HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: " +
+		base64.RawURLEncoding.EncodeToString(settings) + "\r\n\r\n"))
+
+	res, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse failed: %v", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Upgrade") != "h2c" {
+		t.Fatalf("invalid upgrade response: %v %v", res.StatusCode, res.Header)
+	}
+	buf := []byte(http2ClientPreface)
+	buf = appendHTTP2Settings(buf)
+	buf = appendHTTP2Headers(buf, 3, c.headers(":method", "GET", ":scheme", "http", ":path", "/next", ":authority", "localhost"), true, http2DefaultMaxFrameSize)
+	c.write(buf)
+
+	responses := c.readResponses(2)
+	checkHTTP2Response(t, responses[1], "GET /upgrade ")
+	checkHTTP2Response(t, responses[3], "GET /next ")
+}
+
+func TestHTTP2StreamRequestBody(t *testing.T) {
+	chStart := make(chan struct{}, 1)
+	engine := NewEngine(Config{
+		NPoller:           1,
+		EnableHTTP2:       true,
+		StreamRequestBody: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			chStart <- struct{}{}
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Proto", r.Proto)
+			w.Write([]byte(strconv.Itoa(len(body)) + " " + r.Trailer.Get("X-Sum")))
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+
+	c := newHTTP2TestClient(t, remote)
+	buf := []byte(http2ClientPreface)
+	buf = appendHTTP2Settings(buf)
+	buf = appendHTTP2Headers(buf, 1, c.headers(":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost"), false, http2DefaultMaxFrameSize)
+	c.write(buf)
+	// the handler is called before the body is sent.
+	select {
+	case <-chStart:
+	case <-time.After(time.Second):
+		t.Fatalf("handler not called")
+	}
+
+	buf = nil
+	data := make([]byte, http2DefaultMaxFrameSize)
+	for i := 0; i < 16; i++ {
+		buf = appendHTTP2Data(buf, 1, data, false)
+	}
+	buf = appendHTTP2Headers(buf, 1, c.headers("x-sum", "ok"), true, http2DefaultMaxFrameSize)
+	c.write(buf)
+
+	responses := c.readResponses(1)
+	checkHTTP2Response(t, responses[1], strconv.Itoa(16*http2DefaultMaxFrameSize)+" ok")
+}
+
+// newHTTP2TestConn adds a conn to engine and sends the client preface with settings.
+func newHTTP2TestConn(t *testing.T, engine *Engine, settings ...http2Setting) *http2TestClient {
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	t.Cleanup(func() {
+		remote.Close()
+	})
+	engine.AddConnNonTLS(local)
+
+	c := newHTTP2TestClient(t, remote)
+	c.write(appendHTTP2Settings([]byte(http2ClientPreface), settings...))
+	return c
+}
+
+// readFrameOf reads the frames until one of typ, the SETTINGS and WINDOW_UPDATE frames are skipped.
+func (c *http2TestClient) readFrameOf(typ uint8) (http2FrameHeader, []byte) {
+	for {
+		fh, payload := c.readFrame()
+		switch fh.typ {
+		case typ:
+			return fh, payload
+		case http2FrameSettings, http2FrameWindowUpdate:
+		default:
+			c.t.Fatalf("unexpected frame %d on stream %d: %v", fh.typ, fh.streamID, payload)
+		}
+	}
+}
+
+// readData reads the DATA frames of a stream until n bytes are received.
+func (c *http2TestClient) readData(id uint32, n int) (endStream bool) {
+	for n > 0 {
+		fh, payload := c.readFrameOf(http2FrameData)
+		if fh.streamID != id {
+			c.t.Fatalf("DATA on stream %d, want %d", fh.streamID, id)
+		}
+		n -= len(payload)
+		endStream = fh.has(http2FlagEndStream)
+	}
+	if n < 0 {
+		c.t.Fatalf("%d bytes more than the window", -n)
+	}
+	return endStream
+}
+
+// expectNoFrame checks that nothing but SETTINGS and WINDOW_UPDATE is sent for d.
+func (c *http2TestClient) expectNoFrame(d time.Duration) {
+	c.conn.SetReadDeadline(time.Now().Add(d))
+	for {
+		head, err := c.r.Peek(http2FrameHeaderLen)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return
+			}
+			c.t.Fatalf("Peek failed: %v", err)
+		}
+		fh := parseHTTP2FrameHeader(head)
+		if fh.typ != http2FrameSettings && fh.typ != http2FrameWindowUpdate {
+			c.t.Fatalf("unexpected frame %d on stream %d", fh.typ, fh.streamID)
+		}
+		c.readFrame()
+		c.conn.SetReadDeadline(time.Now().Add(d))
+	}
+}
+
+// ping checks that the conn is still served after the frames sent before.
+func (c *http2TestClient) ping() {
+	c.write(appendHTTP2Ping(nil, 0, []byte("12345678")))
+	fh, payload := c.readFrameOf(http2FramePing)
+	if !fh.has(http2FlagAck) || string(payload) != "12345678" {
+		c.t.Fatalf("invalid PING ack: %v %q", fh.flags, payload)
+	}
+}
+
+func (c *http2TestClient) readRSTStream(id uint32, code http2ErrCode) {
+	fh, payload := c.readFrameOf(http2FrameRSTStream)
+	if fh.streamID != id || http2ErrCode(binary.BigEndian.Uint32(payload)) != code {
+		c.t.Fatalf("invalid RST_STREAM on stream %d: %v, want %d on stream %d", fh.streamID, payload, code, id)
+	}
+}
+
+func (c *http2TestClient) readGoAway(lastStreamID uint32, code http2ErrCode) {
+	_, payload := c.readFrameOf(http2FrameGoAway)
+	if id := binary.BigEndian.Uint32(payload); id != lastStreamID {
+		c.t.Fatalf("invalid last stream id: %v, want %v", id, lastStreamID)
+	}
+	if v := http2ErrCode(binary.BigEndian.Uint32(payload[4:])); v != code {
+		c.t.Fatalf("invalid GOAWAY code: %v, want %v", v, code)
+	}
+}
+
+func TestHTTP2Disabled(t *testing.T) {
+	engine := NewEngine(Config{
+		NPoller: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+
+	// the preface is parsed as an HTTP/1.x request without EnableHTTP2.
+	remote.Write(appendHTTP2Settings([]byte(http2ClientPreface)))
+	remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+	if _, err := http.ReadResponse(bufio.NewReader(remote), nil); err != nil {
+		t.Fatalf("ReadResponse failed: %v", err)
+	}
+}
+
+func TestHTTP2FlowControl(t *testing.T) {
+	engine := NewEngine(Config{
+		NPoller:     1,
+		EnableHTTP2: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+			w.Write(make([]byte, n))
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	// the window of the stream stalls the response until the WINDOW_UPDATE of the stream.
+	c := newHTTP2TestConn(t, engine, http2Setting{http2SettingInitialWindowSize, 10})
+	c.write(appendHTTP2Headers(nil, 1, c.headers(":method", "GET", ":scheme", "http", ":path", "/?n=100", ":authority", "localhost"), true, http2DefaultMaxFrameSize))
+	c.readFrameOf(http2FrameHeaders)
+	if c.readData(1, 10) {
+		t.Fatalf("stream ended before the WINDOW_UPDATE")
+	}
+	c.expectNoFrame(time.Millisecond * 50)
+	c.write(appendHTTP2WindowUpdate(nil, 1, 50))
+	if c.readData(1, 50) {
+		t.Fatalf("stream ended before the WINDOW_UPDATE")
+	}
+	c.expectNoFrame(time.Millisecond * 50)
+	c.write(appendHTTP2WindowUpdate(nil, 1, 1000))
+	if !c.readData(1, 40) {
+		t.Fatalf("stream not ended")
+	}
+
+	// the window of the conn, 100 bytes of which are used, stalls the response until the WINDOW_UPDATE of the conn.
+	c.write(appendHTTP2Settings(nil, http2Setting{http2SettingInitialWindowSize, 1 << 20}))
+	c.write(appendHTTP2Headers(nil, 3, c.headers(":method", "GET", ":scheme", "http", ":path", "/?n=70000", ":authority", "localhost"), true, http2DefaultMaxFrameSize))
+	c.readFrameOf(http2FrameHeaders)
+	if c.readData(3, http2DefaultWindowSize-100) {
+		t.Fatalf("stream ended before the WINDOW_UPDATE")
+	}
+	c.expectNoFrame(time.Millisecond * 50)
+	c.write(appendHTTP2WindowUpdate(nil, 0, 10000))
+	if !c.readData(3, 70000-http2DefaultWindowSize+100) {
+		t.Fatalf("stream not ended")
+	}
+}
+
+func TestHTTP2GoAway(t *testing.T) {
+	chStart := make(chan struct{}, 1)
+	chRelease := make(chan struct{})
+	engine := NewEngine(Config{
+		NPoller:     1,
+		EnableHTTP2: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			chStart <- struct{}{}
+			<-chRelease
+			w.Header().Set("X-Proto", r.Proto)
+			w.Write([]byte("ok"))
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	c := newHTTP2TestConn(t, engine)
+	c.write(appendHTTP2Headers(nil, 1, c.headers(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "localhost"), true, http2DefaultMaxFrameSize))
+	select {
+	case <-chStart:
+	case <-time.After(time.Second):
+		t.Fatalf("handler not called")
+	}
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- engine.Shutdown(context.Background())
+	}()
+	c.readGoAway(1, http2ErrCodeNo)
+
+	// the streams opened after the GOAWAY are refused, and the trailers sent before the client
+	// gets the RST_STREAM are ignored.
+	buf := appendHTTP2Headers(nil, 3, c.headers(":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost"), false, http2DefaultMaxFrameSize)
+	buf = appendHTTP2Data(buf, 3, []byte("body"), false)
+	buf = appendHTTP2Headers(buf, 3, c.headers("x-sum", "ok"), true, http2DefaultMaxFrameSize)
+	c.write(buf)
+	c.readRSTStream(3, http2ErrCodeRefusedStream)
+	c.readRSTStream(3, http2ErrCodeStreamClosed)
+	c.ping()
+
+	// the stream opened before the GOAWAY is still served.
+	close(chRelease)
+	responses := c.readResponses(1)
+	checkHTTP2Response(t, responses[1], "ok")
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("Shutdown not returned")
+	}
+}
+
+func TestHTTP2RSTStream(t *testing.T) {
+	chStart := make(chan struct{}, 1)
+	chDone := make(chan error, 1)
+	engine := NewEngine(Config{
+		NPoller:     1,
+		EnableHTTP2: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			chStart <- struct{}{}
+			<-r.Context().Done()
+			chDone <- r.Context().Err()
+			w.Write([]byte("late"))
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	c := newHTTP2TestConn(t, engine)
+	c.write(appendHTTP2Headers(nil, 1, c.headers(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "localhost"), true, http2DefaultMaxFrameSize))
+	select {
+	case <-chStart:
+	case <-time.After(time.Second):
+		t.Fatalf("handler not called")
+	}
+
+	// the context of the request is cancelled by the RST_STREAM and the response is dropped.
+	c.write(appendHTTP2RSTStream(nil, 1, http2ErrCodeCancel))
+	select {
+	case err := <-chDone:
+		if err != context.Canceled {
+			t.Fatalf("invalid context error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("context not cancelled")
+	}
+	c.ping()
+	c.expectNoFrame(time.Millisecond * 50)
+
+	// RST_STREAM on an idle stream is a connection error.
+	c.write(appendHTTP2RSTStream(nil, 5, http2ErrCodeCancel))
+	c.readGoAway(1, http2ErrCodeProtocol)
+}
+
+func TestHTTP2Continuation(t *testing.T) {
+	engine := newHTTP2TestEngine(t)
+	defer engine.Stop()
+
+	// the header block is split into a HEADERS and the CONTINUATION frames of 16 bytes.
+	c := newHTTP2TestConn(t, engine)
+	path := "/" + strings.Repeat("a", 100)
+	c.write(appendHTTP2Headers(nil, 1, c.headers(":method", "GET", ":scheme", "http", ":path", path, ":authority", "localhost"), true, 16))
+	responses := c.readResponses(1)
+	checkHTTP2Response(t, responses[1], "GET "+path+" ")
+
+	// a frame between the HEADERS and its CONTINUATION is a connection error.
+	block := c.headers(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	buf := appendHTTP2FrameHeader(nil, 4, http2FrameHeaders, http2FlagEndStream, 3)
+	buf = append(buf, block[:4]...)
+	buf = appendHTTP2Ping(buf, 0, []byte("12345678"))
+	c.write(buf)
+	c.readGoAway(1, http2ErrCodeProtocol)
+}
+
+func TestHTTP2MalformedHeaders(t *testing.T) {
+	engine := newHTTP2TestEngine(t)
+	defer engine.Stop()
+
+	c := newHTTP2TestConn(t, engine)
+	id := uint32(1)
+	for _, fields := range [][]string{
+		{":method", "GET", ":scheme", "http", ":authority", "localhost"},
+		{":method", "GET", ":scheme", "http", ":path", "/", ":foo", "bar"},
+		{":method", "GET", ":scheme", "http", "x-a", "1", ":path", "/"},
+		{":method", "GET", ":method", "POST", ":scheme", "http", ":path", "/"},
+		{":method", "GET", ":scheme", "http", ":path", "/", "X-Upper", "1"},
+		{":method", "GET", ":scheme", "http", ":path", "/", "connection", "close"},
+		{":method", "GET", ":scheme", "http", ":path", "/", "te", "gzip"},
+		{":method", "CONNECT", ":scheme", "http", ":path", "/", ":authority", "localhost"},
+	} {
+		// the malformed requests are reset, but the conn is still served.
+		c.write(appendHTTP2Headers(nil, id, c.headers(fields...), true, http2DefaultMaxFrameSize))
+		c.readRSTStream(id, http2ErrCodeProtocol)
+		id += 2
+	}
+	c.write(appendHTTP2Headers(nil, id, c.headers(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "localhost"), true, http2DefaultMaxFrameSize))
+	responses := c.readResponses(1)
+	checkHTTP2Response(t, responses[id], "GET / ")
+}
+
+func TestHTTP2HeaderLimits(t *testing.T) {
+	engine := NewEngine(Config{
+		NPoller:        1,
+		EnableHTTP2:    true,
+		MaxHeaderBytes: 1024,
+		MaxHeaderCount: 4,
+		MaxURILength:   64,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Proto", r.Proto)
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	c := newHTTP2TestConn(t, engine)
+	fh, payload := c.readFrameOf(http2FrameSettings)
+	for ; len(payload) >= 6; payload = payload[6:] {
+		if binary.BigEndian.Uint16(payload) == http2SettingMaxHeaderListSize {
+			if v := binary.BigEndian.Uint32(payload[2:]); v != 1024 {
+				t.Fatalf("invalid SETTINGS_MAX_HEADER_LIST_SIZE: %v, want 1024", v)
+			}
+		}
+	}
+	if fh.has(http2FlagAck) {
+		t.Fatalf("SETTINGS ack before the SETTINGS of the server")
+	}
+
+	id := uint32(1)
+	for _, tc := range []struct {
+		fields []string
+		status string
+	}{
+		{[]string{":path", "/" + strings.Repeat("a", 64)}, "414"},
+		{[]string{":path", "/", "x-a", "1", "x-b", "2", "x-c", "3", "x-d", "4", "x-e", "5"}, "431"},
+		{[]string{":path", "/", "x-a", strings.Repeat("a", 1024)}, "431"},
+		{[]string{":path", "/" + strings.Repeat("a", 63), "x-a", "1", "x-b", "2", "x-c", "3", "x-d", "4"}, "200"},
+	} {
+		// the header block is split into a HEADERS and the CONTINUATION frames.
+		fields := append([]string{":method", "GET", ":scheme", "http", ":authority", "localhost"}, tc.fields...)
+		c.write(appendHTTP2Headers(nil, id, c.headers(fields...), true, 256))
+		responses := c.readResponses(1)
+		if res := responses[id]; res == nil || res.header.Get(":status") != tc.status {
+			t.Fatalf("invalid response of stream %d: %v, want %v", id, res, tc.status)
+		}
+		id += 2
+	}
+}
+
+func TestHTTP2Timeouts(t *testing.T) {
+	engine := NewEngine(Config{
+		NPoller:             1,
+		EnableHTTP2:         true,
+		ReadHeaderTimeout:   time.Second / 10,
+		MinBodyRate:         1024,
+		MinBodyRateInterval: time.Second / 10,
+		StreamRequestBodyFunc: func(r *http.Request) bool {
+			return r.URL.Path == "/stream"
+		},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/stream" {
+				// the body not read pauses the stream, so it's not too slow.
+				time.Sleep(time.Second / 2)
+			}
+			ioutil.ReadAll(r.Body)
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	expectClosed := func(c *http2TestClient) {
+		c.conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+		if _, err := io.Copy(ioutil.Discard, c.r); err != nil {
+			t.Fatalf("the conn is not closed: %v", err)
+		}
+	}
+
+	// the header block not received entirely.
+	c := newHTTP2TestConn(t, engine)
+	block := c.headers(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	buf := appendHTTP2FrameHeader(nil, 4, http2FrameHeaders, http2FlagEndStream, 1)
+	c.write(append(buf, block[:4]...))
+	c.readGoAway(0, http2ErrCodeEnhanceYourCalm)
+	expectClosed(c)
+
+	// the header blocks received in time on a conn kept alive.
+	c = newHTTP2TestConn(t, engine)
+	for id := uint32(1); id <= 5; id += 2 {
+		block := c.headers(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "localhost")
+		c.write(appendHTTP2Headers(nil, id, block, true, http2DefaultMaxFrameSize))
+		c.readResponses(1)
+		time.Sleep(time.Second / 10)
+	}
+	c.ping()
+
+	// the body sent too slow.
+	c = newHTTP2TestConn(t, engine)
+	block = c.headers(":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	c.write(appendHTTP2Headers(nil, 1, block, false, http2DefaultMaxFrameSize))
+	c.write(appendHTTP2Data(nil, 1, []byte("hello"), false))
+	c.readGoAway(1, http2ErrCodeEnhanceYourCalm)
+	expectClosed(c)
+
+	// the window of a streamed body not read.
+	c = newHTTP2TestConn(t, engine, http2Setting{http2SettingInitialWindowSize, http2InitialWindowSize})
+	block = c.headers(":method", "POST", ":scheme", "http", ":path", "/stream", ":authority", "localhost")
+	c.write(appendHTTP2Headers(nil, 1, block, false, http2DefaultMaxFrameSize))
+	data := make([]byte, http2DefaultMaxFrameSize)
+	for i := 0; i < http2InitialWindowSize/len(data); i++ {
+		c.write(appendHTTP2Data(nil, 1, data, false))
+	}
+	c.expectNoFrame(time.Second / 3)
+	c.write(appendHTTP2Data(nil, 1, nil, true))
+	c.readResponses(1)
+}
+
+func TestHTTP2HandlerTimeout(t *testing.T) {
+	chErr := make(chan error, 1)
+	engine := NewEngine(Config{
+		NPoller:        1,
+		EnableHTTP2:    true,
+		HandlerTimeout: time.Millisecond * 100,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/slow":
+				<-r.Context().Done()
+				_, err := w.Write([]byte("late"))
+				chErr <- err
+			case "/flushed":
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			default:
+				w.Write([]byte("ok"))
+			}
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	c := newHTTP2TestConn(t, engine)
+	c.write(appendHTTP2Headers(nil, 1, c.headers(":method", "GET", ":scheme", "http", ":path", "/slow", ":authority", "localhost"), true, http2DefaultMaxFrameSize))
+	responses := c.readResponses(1)
+	if res := responses[1]; res.header.Get(":status") != "503" || len(res.body) != 0 {
+		t.Fatalf("invalid response: %v, %q", res.header, res.body)
+	}
+	select {
+	case err := <-chErr:
+		if err != http.ErrHandlerTimeout {
+			t.Fatalf("invalid error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("handler not returned")
+	}
+
+	// the stream is reset after the head has been sent.
+	c.write(appendHTTP2Headers(nil, 3, c.headers(":method", "GET", ":scheme", "http", ":path", "/flushed", ":authority", "localhost"), true, http2DefaultMaxFrameSize))
+	if fh, _ := c.readFrameOf(http2FrameHeaders); fh.streamID != 3 || fh.has(http2FlagEndStream) {
+		t.Fatalf("invalid HEADERS on stream %d: %v", fh.streamID, fh.flags)
+	}
+	c.readRSTStream(3, http2ErrCodeCancel)
+
+	// the other streams are still served.
+	c.write(appendHTTP2Headers(nil, 5, c.headers(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "localhost"), true, http2DefaultMaxFrameSize))
+	responses = c.readResponses(1)
+	if res := responses[5]; res.header.Get(":status") != "200" || string(res.body) != "ok" {
+		t.Fatalf("invalid response: %v, %q", res.header, res.body)
+	}
+}
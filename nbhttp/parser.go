@@ -12,7 +12,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/lesismal/nbio"
 	"github.com/lesismal/nbio/mempool"
 )
 
@@ -20,6 +22,7 @@ const (
 	transferEncodingHeader = "Transfer-Encoding"
 	trailerHeader          = "Trailer"
 	contentLengthHeader    = "Content-Length"
+	hostHeader             = "Host"
 
 	// MaxUint .
 	MaxUint = ^uint(0)
@@ -49,9 +52,37 @@ type Parser struct {
 	chunked       bool
 	headerExists  bool
 
+	// streamBody is set by the Processor to receive the body of the current request in pieces
+	// instead of caching it until it's received entirely.
+	streamBody bool
+
+	// rejected is set after a malformed request, or by the Processor after a request is replied
+	// without receiving its body, the data after it is discarded until the conn is closed.
+	rejected bool
+
+	// headerSize and headerCount are the size and the number of the header lines of the request
+	// being parsed, which are limited by the Engine.
+	headerSize  int
+	headerCount int
+
+	// version and hostCount are recorded for the checks of the strict parsing.
+	version   string
+	hostCount int
+
+	// chunkExt is set after the ';' of the chunk extensions of a chunk size line.
+	chunkExt bool
+
+	// headerTimer and bodyTimer enforce ReadHeaderTimeout and MinBodyRate of the Engine, they're
+	// armed only if the headers or the body of a request are not received by one Read.
+	headerTimer  *nbio.Timer
+	bodyTimer    *nbio.Periodic
+	bodyReceived int
+
 	state    int8
 	isClient bool
 
+	tlsHandshaked bool
+
 	readLimit int
 
 	errClose error
@@ -67,6 +98,9 @@ type Parser struct {
 	Conn net.Conn
 
 	Execute func(f func())
+
+	// TryExecute runs the server handlers if it's set, the request is replied 503 if it returns an error.
+	TryExecute func(f func()) error
 }
 
 func (p *Parser) nextState(state int8) {
@@ -94,6 +128,7 @@ func (p *Parser) Close(err error) {
 	p.state = stateClose
 
 	p.errClose = err
+	p.stopTimers()
 
 	if p.ConnState != nil {
 		p.ConnState.Close(p, p.errClose)
@@ -102,7 +137,7 @@ func (p *Parser) Close(err error) {
 		p.Processor.Close(p, p.errClose)
 	}
 	if len(p.cache) > 0 {
-		mempool.Free(p.cache)
+		p.allocator().Free(p.cache)
 	}
 	if p.onClose != nil {
 		p.onClose(p, err)
@@ -124,26 +159,46 @@ func parseAndValidateChunkSize(originalStr string) (int, error) {
 }
 
 // Read .
+// The errors of a server parsing a request are returned as *ParseError, the data after it is discarded.
 func (p *Parser) Read(data []byte) error {
 	p.mux.Lock()
 	defer p.mux.Unlock()
 
+	err := p.read(data)
+	if err != nil && err != ErrClosed && !p.isClient && p.ConnState == nil {
+		p.rejected = true
+		return newParseError(err)
+	}
+	return err
+}
+
+func (p *Parser) read(data []byte) error {
 	if p.state == stateClose {
 		return ErrClosed
 	}
 
-	if len(data) == 0 {
+	if len(data) == 0 || p.rejected {
 		return nil
 	}
 
+	if p.bodyTimer != nil {
+		p.bodyReceived += len(data)
+	}
+	maxHeaderBytes, maxHeaderCount, maxURILength := 0, 0, 0
+	if !p.isClient {
+		maxHeaderBytes, maxHeaderCount, maxURILength = p.Engine.headerLimits()
+	}
+	strict := p.strictParsing()
+
 	var c byte
 	var start = 0
 	var offset = len(p.cache)
 	if offset > 0 {
 		if offset+len(data) > p.readLimit {
-			return ErrTooLong
+			return p.errTooLong()
 		}
-		p.cache = append(p.cache, data...)
+		p.cache = p.allocator().Realloc(p.cache, offset+len(data))
+		copy(p.cache[offset:], data)
 		data = p.cache
 	}
 
@@ -155,7 +210,7 @@ UPGRADER:
 		}
 		err := p.ConnState.Read(p, udata)
 		if p.cache != nil {
-			mempool.Free(p.cache)
+			p.allocator().Free(p.cache)
 			p.cache = nil
 		}
 		return err
@@ -166,6 +221,12 @@ UPGRADER:
 			goto UPGRADER
 		}
 		c = data[i]
+		if maxHeaderBytes > 0 && (p.state <= stateHeaderValue || p.state == stateHeaderOverLF) {
+			p.headerSize++
+			if p.headerSize > maxHeaderBytes {
+				return ErrHeaderTooLarge
+			}
+		}
 		switch p.state {
 		case stateClose:
 			return ErrClosed
@@ -199,6 +260,9 @@ UPGRADER:
 			}
 			switch c {
 			case ' ':
+				if strict {
+					return ErrInvalidRequestURI
+				}
 			default:
 				return ErrInvalidRequestURI
 			}
@@ -210,22 +274,40 @@ UPGRADER:
 				}
 				start = i + 1
 				p.nextState(stateProtoBefore)
+			} else if maxURILength > 0 && i-start >= maxURILength {
+				return ErrURITooLong
 			}
 		case stateProtoBefore:
 			if c != ' ' {
 				start = i
 				p.nextState(stateProto)
+			} else if strict {
+				return ErrInvalidHTTPVersion
 			}
 		case stateProto:
 			switch c {
 			case ' ':
+				if strict {
+					return ErrInvalidHTTPVersion
+				}
 				if p.proto == "" {
 					p.proto = string(data[start:i])
 				}
+			case '\n':
+				if strict {
+					return ErrCRExpected
+				}
 			case '\r':
 				if p.proto == "" {
 					p.proto = string(data[start:i])
 				}
+				if strict {
+					if !isStrictVersion(p.proto) {
+						p.proto = ""
+						return ErrInvalidHTTPVersion
+					}
+					p.version = p.proto
+				}
 				if err := p.Processor.OnProto(p.proto); err != nil {
 					p.proto = ""
 					return err
@@ -327,10 +409,18 @@ UPGRADER:
 		case stateHeaderKeyBefore:
 			switch c {
 			case ' ':
-				if !p.headerExists {
+				// obs-fold, the continuation of the header line before.
+				if !p.headerExists || strict {
 					return ErrInvalidCharInHeader
 				}
 			case '\r':
+				if strict {
+					// RFC 9112 3.2, an HTTP/1.1 request must have exactly one Host.
+					if p.version == "HTTP/1.1" && p.hostCount != 1 {
+						return ErrInvalidHost
+					}
+					p.hostCount = 0
+				}
 				err := p.parseTransferEncoding()
 				if err != nil {
 					return err
@@ -353,6 +443,10 @@ UPGRADER:
 					start = i
 					p.nextState(stateHeaderKey)
 					p.headerExists = true
+					p.headerCount++
+					if maxHeaderCount > 0 && p.headerCount > maxHeaderCount {
+						return ErrTooManyHeaders
+					}
 					continue
 				}
 				return ErrInvalidCharInHeader
@@ -360,6 +454,10 @@ UPGRADER:
 		case stateHeaderKey:
 			switch c {
 			case ' ':
+				// the whitespace between the field name and the colon.
+				if strict {
+					return ErrInvalidCharInHeader
+				}
 				if p.headerKey == "" {
 					p.headerKey = http.CanonicalHeaderKey(string(data[start:i]))
 				}
@@ -367,6 +465,9 @@ UPGRADER:
 				if p.headerKey == "" {
 					p.headerKey = http.CanonicalHeaderKey(string(data[start:i]))
 				}
+				if strict && p.headerKey == hostHeader {
+					p.hostCount++
+				}
 				start = i + 1
 				p.nextState(stateHeaderValueBefore)
 			case '\r', '\n':
@@ -404,6 +505,9 @@ UPGRADER:
 				// if !isToken(c) {
 				// 	return ErrInvalidCharInHeader
 				// }
+				if strict && isCTL(c) {
+					return ErrInvalidCharInHeader
+				}
 				start = i
 				p.nextState(stateHeaderValue)
 			}
@@ -431,10 +535,29 @@ UPGRADER:
 			case '\n':
 				return ErrInvalidCharInHeader
 			default:
+				if strict && isCTL(c) {
+					return ErrInvalidCharInHeader
+				}
 			}
 		case stateHeaderOverLF:
 			if c == '\n' {
 				p.headerExists = false
+				p.headerSize = 0
+				p.headerCount = 0
+				if p.headerTimer != nil {
+					p.headerTimer.Stop()
+					p.headerTimer = nil
+				}
+				if hc, ok := p.Processor.(headerCompleter); ok {
+					hc.OnHeaderComplete(p)
+				}
+				if p.rejected {
+					if p.cache != nil {
+						p.allocator().Free(p.cache)
+						p.cache = nil
+					}
+					return nil
+				}
 				if p.chunked {
 					start = i + 1
 					p.nextState(stateBodyChunkSizeBefore)
@@ -458,11 +581,17 @@ UPGRADER:
 				start += cl
 				i = start - 1
 			} else {
+				if p.streamBody {
+					p.Processor.OnBody(data[start:])
+					p.contentLength -= left
+					start = len(data)
+				}
 				goto Exit
 			}
 		case stateBodyChunkSizeBefore:
 			if isHex(c) {
 				p.chunkSize = -1
+				p.chunkExt = false
 				start = i
 				p.nextState(stateBodyChunkSize)
 				continue
@@ -496,6 +625,17 @@ UPGRADER:
 					}
 					p.chunkSize = chunkSize
 				}
+				// only the whitespaces and the extensions are allowed after the size,
+				// a bare LF could end the line for another parser.
+				if strict && p.chunkSize >= 0 {
+					switch {
+					case c == ';':
+						p.chunkExt = true
+					case c == '\t':
+					case isCTL(c), !p.chunkExt:
+						return ErrInvalidChunkSize
+					}
+				}
 			}
 		case stateBodyChunkSizeLF:
 			if c == '\n' {
@@ -525,6 +665,11 @@ UPGRADER:
 				i = start - 1
 				p.nextState(stateBodyChunkDataCR)
 			} else {
+				if p.streamBody {
+					p.Processor.OnBody(data[start:])
+					p.chunkSize -= left
+					start = len(data)
+				}
 				goto Exit
 			}
 		case stateBodyChunkDataCR:
@@ -562,9 +707,15 @@ UPGRADER:
 				p.nextState(stateTailLF)
 				continue
 			}
+			if strict {
+				return ErrInvalidCharInHeader
+			}
 		case stateBodyTrailerHeaderKey:
 			switch c {
 			case ' ':
+				if strict {
+					return ErrInvalidCharInHeader
+				}
 				if p.headerKey == "" {
 					p.headerKey = http.CanonicalHeaderKey(string(data[start:i]))
 				}
@@ -624,6 +775,9 @@ UPGRADER:
 				// if !isToken(c) {
 				// 	return ErrInvalidCharInHeader
 				// }
+				if strict && isCTL(c) {
+					return ErrInvalidCharInHeader
+				}
 			}
 		case stateTailCR:
 			if c == '\r' {
@@ -643,25 +797,123 @@ UPGRADER:
 	}
 
 Exit:
+	if !p.isClient && p.Engine != nil && p.Engine.Config != nil {
+		p.armTimers()
+	}
+
 	left := len(data) - start
 	if left > 0 {
+		allocator := p.allocator()
 		if p.cache == nil {
-			p.cache = mempool.Malloc(left)
+			p.cache = allocator.Malloc(left)
 			copy(p.cache, data[start:])
 		} else if start > 0 {
 			oldCache := p.cache
-			p.cache = mempool.Malloc(left)
+			p.cache = allocator.Malloc(left)
 			copy(p.cache, data[start:])
-			mempool.Free(oldCache)
+			allocator.Free(oldCache)
 		}
 	} else if len(p.cache) > 0 {
-		mempool.Free(p.cache)
+		p.allocator().Free(p.cache)
 		p.cache = nil
 	}
 
 	return nil
 }
 
+// armTimers arms the timers of the request not received entirely by the current Read.
+func (p *Parser) armTimers() {
+	switch {
+	case p.state == stateMethodBefore:
+	case p.state <= stateHeaderValue || p.state == stateHeaderOverLF:
+		if p.headerTimer == nil && p.Engine.ReadHeaderTimeout > 0 {
+			p.headerTimer = p.Engine.AfterFunc(p.Engine.ReadHeaderTimeout, p.onReadHeaderTimeout)
+		}
+	default:
+		if p.bodyTimer == nil && p.Engine.MinBodyRate > 0 {
+			p.bodyReceived = 0
+			p.bodyTimer = p.Engine.Every(p.Engine.MinBodyRateInterval, 0, p.checkBodyRate)
+		}
+	}
+}
+
+func (p *Parser) stopTimers() {
+	if p.headerTimer != nil {
+		p.headerTimer.Stop()
+		p.headerTimer = nil
+	}
+	if p.bodyTimer != nil {
+		p.bodyTimer.Stop()
+		p.bodyTimer = nil
+	}
+}
+
+// onReadHeaderTimeout replies 408 to the request whose headers are not received in time,
+// an HTTP/2 conn is sent a GOAWAY and closed instead.
+func (p *Parser) onReadHeaderTimeout() {
+	p.mux.Lock()
+	if p.headerTimer == nil || p.state == stateClose || p.rejected {
+		p.mux.Unlock()
+		return
+	}
+	p.headerTimer = nil
+	p.rejected = true
+	h2, isHTTP2 := p.ConnState.(*http2Conn)
+	p.mux.Unlock()
+
+	if isHTTP2 {
+		h2.fail(http2ErrCodeEnhanceYourCalm, ErrReadHeaderTimeout)
+		return
+	}
+	if nbc := underlyingConn(p.Processor.Conn()); nbc != nil {
+		p.Engine.closeWithParseError(nbc, p, newParseError(ErrReadHeaderTimeout))
+	}
+}
+
+// checkBodyRate closes the conn receiving the body slower than the MinBodyRate, it's not replied
+// since the handler of a streamed body may be running.
+func (p *Parser) checkBodyRate() {
+	p.mux.Lock()
+	if p.bodyTimer == nil || p.state == stateClose || p.rejected {
+		p.mux.Unlock()
+		return
+	}
+	received := p.bodyReceived
+	p.bodyReceived = 0
+	nbc := underlyingConn(p.Processor.Conn())
+	min := int64(p.Engine.MinBodyRate) * int64(p.Engine.MinBodyRateInterval) / int64(time.Second)
+	h2, isHTTP2 := p.ConnState.(*http2Conn)
+	// an HTTP/2 conn is paused by the windows of the streams not read.
+	if nbc == nil || int64(received) >= min || nbc.ReadPaused() || (isHTTP2 && !h2.receiving()) {
+		p.mux.Unlock()
+		return
+	}
+	p.bodyTimer.Stop()
+	p.bodyTimer = nil
+	p.rejected = true
+	p.mux.Unlock()
+
+	if isHTTP2 {
+		h2.fail(http2ErrCodeEnhanceYourCalm, ErrBodyTooSlow)
+		return
+	}
+	nbc.CloseWithError(ErrBodyTooSlow)
+}
+
+// errTooLong returns the error of the data cached over readLimit by the part of the request being parsed.
+func (p *Parser) errTooLong() error {
+	switch {
+	case p.isClient:
+		return ErrTooLong
+	case p.state <= stateProtoLF:
+		return ErrURITooLong
+	case p.state <= stateHeaderValue || p.state == stateHeaderOverLF:
+		return ErrHeaderTooLarge
+	default:
+		return ErrBodyTooLarge
+	}
+}
+
 func (p *Parser) parseTransferEncoding() error {
 	raw, present := p.header[transferEncodingHeader]
 	if !present {
@@ -675,6 +927,15 @@ func (p *Parser) parseTransferEncoding() error {
 	if strings.ToLower(textproto.TrimString(raw[0])) != "chunked" {
 		return fmt.Errorf("unsupported transfer encoding: %q", raw[0])
 	}
+	if p.strictParsing() {
+		// RFC 9112 6.1 and 6.3, the length of such a request is ambiguous between the intermediaries.
+		if _, ok := p.header[contentLengthHeader]; ok {
+			return fmt.Errorf("transfer encoding with content-length: %w", ErrUnexpectedContentLength)
+		}
+		if p.version == "HTTP/1.0" {
+			return fmt.Errorf("transfer encoding in HTTP/1.0: %q", raw[0])
+		}
+	}
 	delete(p.header, contentLengthHeader)
 	p.chunked = true
 
@@ -682,6 +943,9 @@ func (p *Parser) parseTransferEncoding() error {
 }
 
 func (p *Parser) parseContentLength() (err error) {
+	if p.strictParsing() {
+		return p.parseStrictContentLength()
+	}
 	if cl := p.header.Get(contentLengthHeader); cl != "" {
 		if p.chunked {
 			return ErrUnexpectedContentLength
@@ -712,6 +976,47 @@ func (p *Parser) parseContentLength() (err error) {
 	return nil
 }
 
+// parseStrictContentLength accepts the Content-Length of digits only, the values of the duplicate
+// fields and lists must be identical.
+func (p *Parser) parseStrictContentLength() error {
+	p.contentLength = -1
+	cl := ""
+	for _, v := range p.header[contentLengthHeader] {
+		for _, s := range strings.Split(v, ",") {
+			s = textproto.TrimString(s)
+			if s == "" {
+				return fmt.Errorf("%s %q", "bad Content-Length", v)
+			}
+			for i := 0; i < len(s); i++ {
+				if !isNum(s[i]) {
+					return fmt.Errorf("%s %q", "bad Content-Length", v)
+				}
+			}
+			if cl != "" && s != cl {
+				return fmt.Errorf("conflicting content-length %q and %q: %w", cl, s, ErrInvalidContentLength)
+			}
+			cl = s
+		}
+	}
+	if cl == "" {
+		return nil
+	}
+	if p.chunked {
+		return ErrUnexpectedContentLength
+	}
+	l, err := strconv.ParseInt(cl, 10, 63)
+	if err != nil || l > MaxInt {
+		return fmt.Errorf("length greater than maxint (%s): %w", cl, ErrInvalidContentLength)
+	}
+	p.contentLength = int(l)
+	return nil
+}
+
+// strictParsing reports whether the request is parsed by the StrictParsing of the Engine.
+func (p *Parser) strictParsing() bool {
+	return !p.isClient && p.Engine.strictParsing()
+}
+
 func (p *Parser) parseTrailer() error {
 	if !p.chunked {
 		return nil
@@ -760,8 +1065,15 @@ func (p *Parser) parseTrailer() error {
 }
 
 func (p *Parser) handleMessage() {
+	if p.bodyTimer != nil {
+		p.bodyTimer.Stop()
+		p.bodyTimer = nil
+	}
 	p.Processor.OnComplete(p)
 	p.header = nil
+	p.trailer = nil
+	p.chunked = false
+	p.streamBody = false
 
 	if !p.isClient {
 		p.nextState(stateMethodBefore)
@@ -770,6 +1082,26 @@ func (p *Parser) handleMessage() {
 	}
 }
 
+// newBodyReader creates a BodyReader by the allocator and the body spooling config of the Engine.
+func (p *Parser) newBodyReader(data []byte) *BodyReader {
+	br := newBodyReader(p.allocator(), nil)
+	if e := p.Engine; e.spoolBody() {
+		br.spoolThreshold = e.BodySpoolThreshold
+		br.spoolLimit = e.MaxBodySpoolSize
+		br.spoolDir = e.BodySpoolDir
+	}
+	br.Append(data)
+	return br
+}
+
+// allocator returns the Engine's BodyAllocator for the cache, or the default mempool.
+func (p *Parser) allocator() mempool.Allocator {
+	if p.Engine != nil && p.Engine.BodyAllocator != nil {
+		return p.Engine.BodyAllocator
+	}
+	return mempool.DefaultMemPool
+}
+
 // NewParser .
 func NewParser(processor Processor, isClient bool, readLimit int, executor func(f func())) *Parser {
 	if processor == nil {
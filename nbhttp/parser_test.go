@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"testing"
 	"time"
+
+	"github.com/lesismal/nbio/mempool"
 )
 
 func TestServerParserContentLength(t *testing.T) {
@@ -256,6 +258,13 @@ func BenchmarkServerProcessor(b *testing.B) {
 	}
 }
 
+func BenchmarkServerProcessorTieredPool(b *testing.B) {
+	defaultMemPool := mempool.DefaultMemPool
+	mempool.DefaultMemPool = mempool.NewTiered(mempool.DefaultTieredMinSize, mempool.DefaultTieredMaxSize)
+	defer func() { mempool.DefaultMemPool = defaultMemPool }()
+	BenchmarkServerProcessor(b)
+}
+
 func BenchmarkEmpryProcessor(b *testing.B) {
 	maxReadSize := 1024 * 1024 * 4
 	isClient := false
@@ -270,3 +279,86 @@ func BenchmarkEmpryProcessor(b *testing.B) {
 		}
 	}
 }
+
+func TestServerParserStrict(t *testing.T) {
+	const host = "Host: localhost\r\n"
+	for _, v := range []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"get", "GET / HTTP/1.1\r\n" + host + "\r\n", true},
+		{"content-length", "POST / HTTP/1.1\r\n" + host + "Content-Length: 5\r\n\r\nhello", true},
+		{"identical content-length fields", "POST / HTTP/1.1\r\n" + host + "Content-Length: 5\r\nContent-Length: 5\r\n\r\nhello", true},
+		{"identical content-length list", "POST / HTTP/1.1\r\n" + host + "Content-Length: 5, 5\r\n\r\nhello", true},
+		{"chunked", "POST / HTTP/1.1\r\n" + host + "Transfer-Encoding: Chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", true},
+		{"chunk extension", "POST / HTTP/1.1\r\n" + host + "Transfer-Encoding: chunked\r\n\r\n5 ;a=b\r\nhello\r\n0;c\r\n\r\n", true},
+		{"htab in value", "GET / HTTP/1.1\r\n" + host + "X-Tab: a\tb\r\n\r\n", true},
+		{"http/1.0 without host", "GET / HTTP/1.0\r\n\r\n", true},
+
+		// RFC 9112 6.1 and 6.3, the smuggling by the conflicting framing.
+		{"content-length with transfer-encoding", "POST / HTTP/1.1\r\n" + host + "Content-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false},
+		{"transfer-encoding with content-length", "POST / HTTP/1.1\r\n" + host + "Transfer-Encoding: chunked\r\nContent-Length: 4\r\n\r\n0\r\n\r\n", false},
+		{"conflicting content-length fields", "POST / HTTP/1.1\r\n" + host + "Content-Length: 5\r\nContent-Length: 6\r\n\r\nhello", false},
+		{"conflicting content-length list", "POST / HTTP/1.1\r\n" + host + "Content-Length: 5, 6\r\n\r\nhello", false},
+		{"signed content-length", "POST / HTTP/1.1\r\n" + host + "Content-Length: +5\r\n\r\nhello", false},
+		{"negative content-length", "POST / HTTP/1.1\r\n" + host + "Content-Length: -1\r\n\r\n", false},
+		{"hex content-length", "POST / HTTP/1.1\r\n" + host + "Content-Length: 0x5\r\n\r\nhello", false},
+		{"empty content-length", "POST / HTTP/1.1\r\n" + host + "Content-Length: \r\n\r\n", false},
+		{"unknown transfer coding", "POST / HTTP/1.1\r\n" + host + "Transfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", false},
+		{"obfuscated transfer coding", "POST / HTTP/1.1\r\n" + host + "Transfer-Encoding: xchunked\r\n\r\n0\r\n\r\n", false},
+		{"duplicate transfer-encoding", "POST / HTTP/1.1\r\n" + host + "Transfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false},
+		{"transfer-encoding in http/1.0", "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false},
+
+		// RFC 9112 5.1 and 5.2, the field lines.
+		{"whitespace before colon", "POST / HTTP/1.1\r\n" + host + "Transfer-Encoding : chunked\r\n\r\n0\r\n\r\n", false},
+		{"obs-fold", "GET / HTTP/1.1\r\n" + host + "X-Fold: a\r\n b\r\n\r\n", false},
+		{"obs-fold by htab", "GET / HTTP/1.1\r\n" + host + "X-Fold: a\r\n\tb\r\n\r\n", false},
+		{"nul in value", "GET / HTTP/1.1\r\n" + host + "X-Nul: a\x00b\r\n\r\n", false},
+		{"bare cr in value", "GET / HTTP/1.1\r\n" + host + "X-Cr: a\rb\r\n\r\n", false},
+		{"bare lf in header", "GET / HTTP/1.1\r\n" + host + "X-Lf: a\n\r\n", false},
+
+		// RFC 9112 2.2 and 3, the request line.
+		{"bare lf in request line", "GET / HTTP/1.1\n" + host + "\r\n", false},
+		{"double space in request line", "GET  / HTTP/1.1\r\n" + host + "\r\n", false},
+		{"space before version", "GET /  HTTP/1.1\r\n" + host + "\r\n", false},
+		{"space after version", "GET / HTTP/1.1 \r\n" + host + "\r\n", false},
+		{"lowercase version", "GET / http/1.1\r\n" + host + "\r\n", false},
+		{"long version", "GET / HTTP/1.10\r\n" + host + "\r\n", false},
+
+		// RFC 9112 3.2, the host.
+		{"missing host", "GET / HTTP/1.1\r\n\r\n", false},
+		{"duplicate host", "GET / HTTP/1.1\r\n" + host + host + "\r\n", false},
+
+		// RFC 9112 7.1, the chunks.
+		{"bare lf after chunk size", "POST / HTTP/1.1\r\n" + host + "Transfer-Encoding: chunked\r\n\r\n5\nhello\r\n0\r\n\r\n", false},
+		{"junk after chunk size", "POST / HTTP/1.1\r\n" + host + "Transfer-Encoding: chunked\r\n\r\n5 5\r\nhello\r\n0\r\n\r\n", false},
+		{"bare lf in chunk extension", "POST / HTTP/1.1\r\n" + host + "Transfer-Encoding: chunked\r\n\r\n5;a\nb\r\nhello\r\n0\r\n\r\n", false},
+		{"bare lf in trailer", "POST / HTTP/1.1\r\n" + host + "Transfer-Encoding: chunked\r\nTrailer: X-Sum\r\n\r\n0\r\nX-Sum: a\nb\r\n\r\n", false},
+	} {
+		// every case is parsed at once and byte by byte.
+		for _, step := range []int{len(v.data), 1} {
+			nRequest := 0
+			processor := NewServerProcessor(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nRequest++
+			}), DefaultKeepaliveTime, false)
+			parser := NewParser(processor, false, 1024*1024, nil)
+			parser.Engine = &Engine{Config: &Config{StrictParsing: true}}
+
+			var err error
+			for i := 0; i < len(v.data) && err == nil; i += step {
+				end := i + step
+				if end > len(v.data) {
+					end = len(v.data)
+				}
+				err = parser.Read([]byte(v.data[i:end]))
+			}
+			if v.ok && (err != nil || nRequest != 1) {
+				t.Fatalf("%s: step %d: %v, %d requests", v.name, step, err, nRequest)
+			}
+			if !v.ok && err == nil {
+				t.Fatalf("%s: step %d: parsed without error", v.name, step)
+			}
+		}
+	}
+}
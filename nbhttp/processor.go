@@ -5,16 +5,28 @@
 package nbhttp
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/lesismal/llib/std/crypto/tls"
+	"github.com/lesismal/nbio"
+	"github.com/lesismal/nbio/mempool"
 )
 
+// continueResponse is the interim response sent before the body of a request with "Expect: 100-continue".
+const continueResponse = "HTTP/1.1 100 Continue\r\n\r\n"
+
+// timeoutResponse is the response of a request whose handler exceeds the HandlerTimeout before writing the head.
+const timeoutResponse = "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+
 var (
 	emptyRequest  = http.Request{}
 	emptyResponse = Response{}
@@ -34,10 +46,12 @@ var (
 
 func releaseRequest(req *http.Request) {
 	if req != nil {
-		if req.Body != nil {
-			br := req.Body.(*BodyReader)
-			br.close()
-			bodyReaderPool.Put(br)
+		switch body := req.Body.(type) {
+		case *BodyReader:
+			body.close()
+			bodyReaderPool.Put(body)
+		case *streamBody:
+			body.Close()
 		}
 		// fast gc for fields
 		*req = emptyRequest
@@ -74,6 +88,12 @@ type Processor interface {
 	Close(p *Parser, err error)
 }
 
+// headerCompleter is implemented by the Processors that handle a message once its headers are parsed,
+// it's optional so the Processors implemented out of the package keep compiling.
+type headerCompleter interface {
+	OnHeaderComplete(parser *Parser)
+}
+
 // ServerProcessor .
 type ServerProcessor struct {
 	// active int32
@@ -90,6 +110,23 @@ type ServerProcessor struct {
 	enableSendfile bool
 	// isUpgrade      bool
 	remoteAddr string
+
+	tracer Tracer
+
+	// emptyRequest carries the conn's context, it's copied to every request of the conn.
+	emptyRequest *http.Request
+
+	// stream is the body of the request dispatched before its body is received, it's set and
+	// cleared on the parser's goroutine with streamMux held, so the close paths fail it at once.
+	streamMux sync.Mutex
+	stream    *streamBody
+
+	// writeTimer enforces the WriteTimeout of the conn, it's armed for writeTarget, the written offset
+	// of a response flushed, and then for writeNext, the offset of the responses flushed after it.
+	writeMux    sync.Mutex
+	writeTimer  *nbio.Timer
+	writeTarget int64
+	writeNext   int64
 }
 
 // Conn .
@@ -102,7 +139,10 @@ func (p *ServerProcessor) OnMethod(method string) {
 	if p.request == nil {
 		p.request = requestPool.Get().(*http.Request)
 		if p.parser != nil {
-			*p.request = *p.parser.Engine.emptyRequest
+			if p.emptyRequest == nil {
+				p.emptyRequest = p.newEmptyRequest()
+			}
+			*p.request = *p.emptyRequest
 		}
 		p.request.Method = method
 		p.request.Header = http.Header{}
@@ -111,6 +151,27 @@ func (p *ServerProcessor) OnMethod(method string) {
 	}
 }
 
+// newEmptyRequest returns a request carrying the context of the underlying nbio.Conn,
+// which is cancelled when the conn is closed or the Engine is shutting down.
+func (p *ServerProcessor) newEmptyRequest() *http.Request {
+	if nbc := underlyingConn(p.conn); nbc != nil {
+		return (&http.Request{}).WithContext(nbc.Context())
+	}
+	return p.parser.Engine.emptyRequest
+}
+
+// underlyingConn returns the nbio.Conn of conn, or nil if it's not an nbio.Conn or a tls.Conn of it.
+func underlyingConn(conn net.Conn) *nbio.Conn {
+	switch conn := conn.(type) {
+	case *nbio.Conn:
+		return conn
+	case *tls.Conn:
+		nbc, _ := conn.Conn().(*nbio.Conn)
+		return nbc
+	}
+	return nil
+}
+
 // OnURL .
 func (p *ServerProcessor) OnURL(uri string) error {
 	u, err := url.ParseRequestURI(uri)
@@ -128,6 +189,10 @@ func (p *ServerProcessor) OnProto(proto string) error {
 	if !ok {
 		return fmt.Errorf("%s %q", "malformed HTTP version", proto)
 	}
+	// HTTP/2.0 is parsed only for the preface of h2c with prior knowledge.
+	if protoMajor > 2 || (protoMajor == 2 && (protoMinor != 0 || p.request.Method != "PRI")) {
+		return fmt.Errorf("%w: %q", ErrHTTPVersionNotSupported, proto)
+	}
 	p.request.Proto = proto
 	p.request.ProtoMajor = protoMajor
 	p.request.ProtoMinor = protoMinor
@@ -152,17 +217,100 @@ func (p *ServerProcessor) OnContentLength(contentLength int) {
 	p.request.ContentLength = int64(contentLength)
 }
 
+// OnHeaderComplete .
+func (p *ServerProcessor) OnHeaderComplete(parser *Parser) {
+	p.prepareRequest(p.request)
+	p.tracer.OnRequestHeaders(p.request)
+
+	engine := parser.Engine
+	if !parser.chunked && parser.contentLength <= 0 {
+		return
+	}
+	if expectsContinue(p.request) {
+		if status := engine.expectContinue(p.request); status != http.StatusContinue {
+			p.reject(parser, status)
+			return
+		}
+		p.writeContinue(parser)
+	}
+	if !engine.streamRequestBody(p.request) {
+		// the body is spooled while it's received, instead of being cached by the parser.
+		parser.streamBody = engine.spoolBody()
+		return
+	}
+	request := p.request
+	p.request = nil
+	p.setStream(newStreamBody(p.bodyAllocator(), request, underlyingConn(p.conn), engine.StreamRequestBodyBufferSize))
+	request.Body = p.stream
+	parser.streamBody = true
+	p.serve(parser, request)
+}
+
+// expectsContinue reports whether the client waits for 100 Continue before sending the body of r.
+func expectsContinue(r *http.Request) bool {
+	return r.ProtoAtLeast(1, 1) && len(r.Header["Expect"]) == 1 && strings.EqualFold(strings.TrimSpace(r.Header["Expect"][0]), "100-continue")
+}
+
+// writeContinue sends 100 Continue by the parser's executor, so it's sent after the responses
+// of the requests before.
+func (p *ServerProcessor) writeContinue(parser *Parser) {
+	conn := p.conn
+	if conn == nil {
+		return
+	}
+	parser.Execute(func() {
+		conn.Write(append(mempool.Malloc(len(continueResponse))[0:0], continueResponse...))
+	})
+}
+
+// reject replies status to the current request instead of receiving its body, the conn is closed
+// after the reply since the client may send the body anyway.
+func (p *ServerProcessor) reject(parser *Parser, status int) {
+	request := p.request
+	p.request = nil
+	request.Close = true
+	parser.rejected = true
+
+	response := NewResponse(parser, request, false)
+	response.WriteHeader(status)
+	parser.Execute(func() {
+		p.flushResponse(response)
+	})
+}
+
 // OnBody .
 func (p *ServerProcessor) OnBody(data []byte) {
+	if p.stream != nil {
+		p.stream.write(data)
+		return
+	}
 	if p.request.Body == nil {
-		p.request.Body = NewBodyReader(data)
+		p.request.Body = p.newBodyReader(data)
 	} else {
 		p.request.Body.(*BodyReader).Append(data)
 	}
 }
 
+func (p *ServerProcessor) newBodyReader(data []byte) *BodyReader {
+	if p.parser != nil {
+		return p.parser.newBodyReader(data)
+	}
+	return newBodyReader(mempool.DefaultMemPool, data)
+}
+
+func (p *ServerProcessor) bodyAllocator() mempool.Allocator {
+	if p.parser != nil {
+		return p.parser.allocator()
+	}
+	return mempool.DefaultMemPool
+}
+
 // OnTrailerHeader .
 func (p *ServerProcessor) OnTrailerHeader(key, value string) {
+	if p.stream != nil {
+		p.stream.addTrailer(key, value)
+		return
+	}
 	if p.request.Trailer == nil {
 		p.request.Trailer = http.Header{}
 	}
@@ -171,6 +319,13 @@ func (p *ServerProcessor) OnTrailerHeader(key, value string) {
 
 // OnComplete .
 func (p *ServerProcessor) OnComplete(parser *Parser) {
+	if p.stream != nil {
+		// the handler has been dispatched by OnHeaderComplete.
+		p.stream.finish()
+		p.setStream(nil)
+		return
+	}
+
 	// p.mux.Lock()
 	request := p.request
 	p.request = nil
@@ -180,6 +335,26 @@ func (p *ServerProcessor) OnComplete(parser *Parser) {
 		return
 	}
 
+	if parser.Engine.http2Enabled() {
+		// h2c with prior knowledge, the rest of the preface and the frames are read by the http2Conn.
+		if request.Method == "PRI" && request.RequestURI == "*" && request.ProtoMajor == 2 {
+			releaseRequest(request)
+			upgradeHTTP2(parser, http2PrefaceTail, "")
+			return
+		}
+		if _, isTLS := p.conn.(*tls.Conn); !isTLS {
+			if settings, ok := h2cSettings(request); ok {
+				upgradeHTTP2(parser, http2ClientPreface, http2UpgradeResponse).serveUpgrade(request, settings)
+				return
+			}
+		}
+	}
+
+	p.serve(parser, request)
+}
+
+// prepareRequest sets the fields of request parsed from its headers.
+func (p *ServerProcessor) prepareRequest(request *http.Request) {
 	if p.conn != nil {
 		request.RemoteAddr = p.remoteAddr
 	}
@@ -212,23 +387,135 @@ func (p *ServerProcessor) OnComplete(parser *Parser) {
 			request.Close = hasClose
 		}
 	}
+}
 
-	// http 2.0
-	// if request.Method == "PRI" && len(request.Header) == 0 && request.URL.Path == "*" && request.Proto == "HTTP/2.0" {
-	// 	p.isUpgrade = true
-	// 	p.parser.Upgrader = &Http2Upgrader{}
-	// 	return
-	// }
-
+// serve runs the handler of request by the parser's executor.
+func (p *ServerProcessor) serve(parser *Parser, request *http.Request) {
 	if request.Body == nil {
-		request.Body = NewBodyReader(nil)
+		request.Body = newBodyReader(p.bodyAllocator(), nil)
 	}
 
 	response := NewResponse(p.parser, request, p.enableSendfile)
-	parser.Execute(func() {
-		p.handler.ServeHTTP(response, request)
+	handle := func() {
+		p.tracer.OnHandlerStart(request)
+		timedOut := p.serveHTTP(parser.Engine, response, request)
+		p.tracer.OnHandlerEnd(request)
+		if timedOut {
+			// the request has been replied and the conn closed by the timeout.
+			response.discard()
+			releaseRequest(request)
+			releaseResponse(response)
+			return
+		}
 		p.flushResponse(response)
+	}
+	if parser.TryExecute == nil {
+		parser.Execute(handle)
+		return
+	}
+	if err := parser.TryExecute(handle); err != nil {
+		// the conn has no request in flight, reply on the caller's goroutine instead of stalling it.
+		response.WriteHeader(http.StatusServiceUnavailable)
+		p.flushResponse(response)
+	}
+}
+
+// serveHTTP runs the handler bounded by the HandlerTimeout, it reports whether the timeout has been exceeded.
+func (p *ServerProcessor) serveHTTP(engine *Engine, response *Response, request *http.Request) (timedOut bool) {
+	timeout := engine.handlerTimeout()
+	if timeout <= 0 || p.conn == nil {
+		p.handler.ServeHTTP(response, request)
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(request.Context())
+	*request = *request.WithContext(ctx)
+	t := &handlerTimeout{cancel: cancel}
+	response.timeout = t
+	t.timer = engine.AfterFunc(timeout, func() {
+		p.onHandlerTimeout(response)
 	})
+	defer func() {
+		timedOut = t.stop()
+		cancel()
+	}()
+	p.handler.ServeHTTP(response, request)
+	return
+}
+
+// onHandlerTimeout replies 503 if the head of res hasn't been written, and closes the conn.
+// It's called on the timer loop, res is not used after t is released since the handler may return.
+func (p *ServerProcessor) onHandlerTimeout(res *Response) {
+	t := res.timeout
+	t.mux.Lock()
+	if t.done || res.hijacked {
+		t.mux.Unlock()
+		return
+	}
+	t.timedOut = true
+	written := res.written
+	t.mux.Unlock()
+
+	t.cancel()
+	if !written {
+		p.conn.Write(append(mempool.Malloc(len(timeoutResponse))[0:0], timeoutResponse...))
+	}
+	p.conn.Close()
+}
+
+// armWriteTimeout closes the conn if the data written by now isn't sent to the socket within the WriteTimeout.
+func (p *ServerProcessor) armWriteTimeout() {
+	if p.parser == nil {
+		return
+	}
+	engine := p.parser.Engine
+	timeout := engine.writeTimeout()
+	nbc := underlyingConn(p.conn)
+	if timeout <= 0 || nbc == nil {
+		return
+	}
+	written, sent := nbc.WriteOffsets()
+	if sent >= written {
+		return
+	}
+
+	p.writeMux.Lock()
+	defer p.writeMux.Unlock()
+	if p.writeTarget > 0 {
+		// the timer is armed for an earlier response, this one is checked after it.
+		p.writeNext = written
+		return
+	}
+	p.writeTarget = written
+	if p.writeTimer == nil {
+		p.writeTimer = engine.AfterFunc(timeout, p.onWriteTimeout)
+		return
+	}
+	p.writeTimer.Reset(timeout)
+}
+
+// onWriteTimeout closes the conn if the writeTarget isn't sent, or rearms the timer for the writeNext.
+func (p *ServerProcessor) onWriteTimeout() {
+	nbc := underlyingConn(p.conn)
+	_, sent := nbc.WriteOffsets()
+
+	p.writeMux.Lock()
+	if p.writeTarget == 0 {
+		p.writeMux.Unlock()
+		return
+	}
+	if sent < p.writeTarget {
+		p.writeMux.Unlock()
+		nbc.CloseWithError(ErrWriteTimeout)
+		return
+	}
+	p.writeTarget = 0
+	if p.writeNext > sent {
+		p.writeTarget = p.writeNext
+		p.writeTimer.Reset(p.parser.Engine.writeTimeout())
+	}
+	p.writeNext = 0
+	p.writeMux.Unlock()
 }
 
 func (p *ServerProcessor) flushResponse(res *Response) {
@@ -236,12 +523,15 @@ func (p *ServerProcessor) flushResponse(res *Response) {
 		req := res.request
 		if !res.hijacked {
 			res.eoncodeHead()
-			if err := res.flushTrailer(p.conn); err != nil {
+			err := res.flushTrailer(p.conn)
+			p.tracer.OnResponseFlushed(req, err)
+			if err != nil {
 				p.conn.Close()
 				releaseRequest(req)
 				releaseResponse(res)
 				return
 			}
+			p.armWriteTimeout()
 		}
 		if req.Close {
 			// the data may still in the send queue
@@ -256,7 +546,38 @@ func (p *ServerProcessor) flushResponse(res *Response) {
 
 // Close .
 func (p *ServerProcessor) Close(parser *Parser, err error) {
+	if p.stream != nil {
+		p.stream.fail(io.ErrUnexpectedEOF)
+		p.setStream(nil)
+	}
+	// the request not received entirely is released, or its spooled body would leak the temp file.
+	if p.request != nil {
+		releaseRequest(p.request)
+		p.request = nil
+	}
+	p.writeMux.Lock()
+	if p.writeTimer != nil {
+		p.writeTimer.Stop()
+		p.writeTarget, p.writeNext = 0, 0
+	}
+	p.writeMux.Unlock()
+}
 
+func (p *ServerProcessor) setStream(stream *streamBody) {
+	p.streamMux.Lock()
+	p.stream = stream
+	p.streamMux.Unlock()
+}
+
+// failStream fails the body streamed to the running handler, it's called by the close paths
+// instead of Close, which is queued behind the handler and never runs if the handler waits for the body.
+func (p *ServerProcessor) failStream(err error) {
+	p.streamMux.Lock()
+	stream := p.stream
+	p.streamMux.Unlock()
+	if stream != nil {
+		stream.fail(err)
+	}
 }
 
 // NewServerProcessor .
@@ -276,6 +597,7 @@ func NewServerProcessor(conn net.Conn, handler http.Handler, keepaliveTime time.
 		handler:        handler,
 		keepaliveTime:  keepaliveTime,
 		enableSendfile: enableSendfile,
+		tracer:         EmptyTracer{},
 	}
 	if conn != nil {
 		p.remoteAddr = conn.RemoteAddr().String()
@@ -10,11 +10,15 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/textproto"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"unsafe"
 
+	"github.com/lesismal/nbio"
 	"github.com/lesismal/nbio/logging"
 	"github.com/lesismal/nbio/mempool"
 )
@@ -28,9 +32,8 @@ type Response struct {
 	status     string
 	statusCode int // status code passed to WriteHeader
 
-	header      http.Header
-	trailer     map[string]string
-	trailerSize int
+	header  http.Header
+	trailer map[string]bool
 
 	buffer       []byte
 	bodyBuffer   []byte
@@ -38,10 +41,65 @@ type Response struct {
 
 	chunked        bool
 	chunkChecked   bool
+	closeDelimited bool
 	headEncoded    bool
 	hasBody        bool
 	enableSendfile bool
 	hijacked       bool
+	// written is set once the head has been written to the conn.
+	written bool
+
+	timeout *handlerTimeout
+}
+
+// handlerTimeout guards a Response or an http2Response against the timer of the HandlerTimeout, which replies
+// on the timer loop while the handler may still be writing.
+type handlerTimeout struct {
+	mux      sync.Mutex
+	timer    *nbio.Timer
+	cancel   func()
+	done     bool
+	timedOut bool
+}
+
+// lock acquires the response guarded by t if it's not nil, it returns http.ErrHandlerTimeout after the timeout.
+func (t *handlerTimeout) lock() error {
+	if t == nil {
+		return nil
+	}
+	t.mux.Lock()
+	if t.timedOut {
+		t.mux.Unlock()
+		return http.ErrHandlerTimeout
+	}
+	return nil
+}
+
+func (t *handlerTimeout) unlock() {
+	if t != nil {
+		t.mux.Unlock()
+	}
+}
+
+// stop stops the timer after the handler returns, it reports whether the timeout has been exceeded.
+func (t *handlerTimeout) stop() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.done = true
+	t.timer.Stop()
+	return t.timedOut
+}
+
+// discard frees the buffers not written, it's called instead of flushing a response replied by the timeout.
+func (res *Response) discard() {
+	if res.buffer != nil {
+		mempool.Free(res.buffer)
+		res.buffer = nil
+	}
+	if res.bodyBuffer != nil {
+		mempool.Free(res.bodyBuffer)
+		res.bodyBuffer = nil
+	}
 }
 
 // Hijack .
@@ -49,7 +107,15 @@ func (res *Response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	if res.parser.Processor == nil {
 		return nil, nil, errors.New("nil Proccessor")
 	}
+	if err := res.timeout.lock(); err != nil {
+		return nil, nil, err
+	}
+	defer res.timeout.unlock()
 	res.hijacked = true
+	if res.timeout != nil {
+		// the hijacked conn is not replied or closed by the timeout.
+		res.timeout.timer.Stop()
+	}
 	return res.parser.Processor.Conn(), nil, nil
 }
 
@@ -58,8 +124,23 @@ func (res *Response) Header() http.Header {
 	return res.header
 }
 
+func (res *Response) logger() logging.FieldLogger {
+	if res.parser == nil {
+		return logging.Adapt(nil)
+	}
+	return res.parser.Engine.ConnLogger(res.parser.Conn)
+}
+
 // WriteHeader .
 func (res *Response) WriteHeader(statusCode int) {
+	if res.timeout.lock() != nil {
+		return
+	}
+	defer res.timeout.unlock()
+	res.writeHeader(statusCode)
+}
+
+func (res *Response) writeHeader(statusCode int) {
 	if !res.hijacked && res.statusCode == 0 && res.statusCode != statusCode {
 		status := http.StatusText(statusCode)
 		if status != "" {
@@ -71,7 +152,7 @@ func (res *Response) WriteHeader(statusCode int) {
 			v, err := strconv.ParseInt(cl, 10, 64)
 			if err == nil && v >= 0 {
 			} else {
-				logging.Error("http: invalid Content-Length of %q", cl)
+				res.logger().Log(logging.LevelError, "http: invalid Content-Length", logging.Any("Content-Length", cl))
 				res.header.Del(contentLengthHeader)
 			}
 		}
@@ -98,7 +179,12 @@ func (res *Response) Write(data []byte) (int, error) {
 		return 0, nil
 	}
 
-	res.WriteHeader(http.StatusOK)
+	if err := res.timeout.lock(); err != nil {
+		return 0, err
+	}
+	defer res.timeout.unlock()
+
+	res.writeHeader(http.StatusOK)
 
 	res.hasBody = true
 
@@ -118,6 +204,7 @@ func (res *Response) Write(data []byte) (int, error) {
 			res.buffer = buf
 			return l, nil
 		}
+		res.written = true
 		_, err := conn.Write(buf)
 		if err != nil {
 			return 0, err
@@ -134,7 +221,7 @@ func (res *Response) Write(data []byte) (int, error) {
 		return conn.Write(buf)
 	}
 
-	if len(res.header[contentLengthHeader]) > 0 {
+	if len(res.header[contentLengthHeader]) > 0 || res.closeDelimited {
 		res.eoncodeHead()
 
 		buf := res.buffer
@@ -143,6 +230,7 @@ func (res *Response) Write(data []byte) (int, error) {
 			buf = mempool.Malloc(l)[0:0]
 		}
 		buf = append(buf, data...)
+		res.written = true
 		return conn.Write(buf)
 	}
 	if res.bodyBuffer == nil {
@@ -154,6 +242,55 @@ func (res *Response) Write(data []byte) (int, error) {
 	return l, nil
 }
 
+// Flush implements http.Flusher, it sends the head and the body written so far to the conn.
+// The body is sent with chunked encoding after it unless Content-Length is set,
+// or delimited by closing the conn for HTTP/1.0.
+func (res *Response) Flush() {
+	conn := res.parser.Processor.Conn()
+	if res.hijacked || conn == nil {
+		return
+	}
+
+	if res.timeout.lock() != nil {
+		return
+	}
+	defer res.timeout.unlock()
+
+	if !res.headEncoded {
+		res.writeHeader(http.StatusOK)
+		if !res.chunked && len(res.header[contentLengthHeader]) == 0 {
+			if res.request.ProtoAtLeast(1, 1) {
+				res.chunked = true
+				res.header[transferEncodingHeader] = append(res.header[transferEncodingHeader], "chunked")
+			} else {
+				res.closeDelimited = true
+				res.request.Close = true
+			}
+		}
+		res.hasBody = true
+		body := res.bodyBuffer
+		res.bodyBuffer = nil
+		res.eoncodeHead()
+		if len(body) > 0 {
+			if res.chunked {
+				res.buffer = append(res.buffer, res.formatInt(len(body), 16)...)
+				res.buffer = append(res.buffer, "\r\n"...)
+				res.buffer = append(res.buffer, body...)
+				res.buffer = append(res.buffer, "\r\n"...)
+			} else {
+				res.buffer = append(res.buffer, body...)
+			}
+			mempool.Free(body)
+		}
+	}
+
+	if res.buffer != nil {
+		res.written = true
+		conn.Write(res.buffer)
+		res.buffer = nil
+	}
+}
+
 // ReadFrom .
 func (res *Response) ReadFrom(r io.Reader) (n int64, err error) {
 	c := res.parser.Processor.Conn()
@@ -161,10 +298,18 @@ func (res *Response) ReadFrom(r io.Reader) (n int64, err error) {
 		return 0, nil
 	}
 
+	if err = res.timeout.lock(); err != nil {
+		return 0, err
+	}
 	res.hasBody = true
 	res.eoncodeHead()
-	_, err = c.Write(res.buffer)
+	buf := res.buffer
 	res.buffer = nil
+	res.written = true
+	// the body is copied without res locked, the writes fail after the timeout closes the conn.
+	res.timeout.unlock()
+
+	_, err = c.Write(buf)
 	if err != nil {
 		return 0, err
 	}
@@ -228,7 +373,7 @@ func (res *Response) eoncodeHead() {
 		return
 	}
 
-	res.WriteHeader(http.StatusOK)
+	res.writeHeader(http.StatusOK)
 
 	res.headEncoded = true
 
@@ -246,7 +391,7 @@ func (res *Response) eoncodeHead() {
 		const contentType = "Content-Type: text/plain; charset=utf-8\r\n"
 		data = append(data, contentType...)
 	}
-	if !res.chunked {
+	if !res.chunked && !res.closeDelimited && len(res.header[contentLengthHeader]) == 0 {
 		const contentLenthKey = "Content-Length: "
 		if !res.hasBody {
 			data = append(data, contentLenthKey...)
@@ -289,23 +434,23 @@ func (res *Response) eoncodeHead() {
 			'\r', '\n')
 	}
 
-	res.trailer = map[string]string{}
-	trailers := res.header[trailerHeader]
-	for _, k := range trailers {
-		res.trailer[k] = ""
+	res.trailer = map[string]bool{}
+	for _, v := range res.header[trailerHeader] {
+		for _, k := range strings.Split(v, ",") {
+			if k = textproto.TrimString(k); k != "" {
+				res.trailer[http.CanonicalHeaderKey(k)] = true
+			}
+		}
 	}
 	for k, vv := range res.header {
-		if _, ok := res.trailer[k]; !ok {
-			for _, v := range vv {
-				data = append(data, k...)
-				data = append(data, ':', ' ')
-				data = append(data, v...)
-				data = append(data, '\r', '\n')
-			}
-		} else if len(vv) > 0 {
-			v := res.header.Get(k)
-			res.trailer[k] = v
-			res.trailerSize += (len(k) + len(v) + 4)
+		if (res.chunked && res.trailer[k]) || strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		for _, v := range vv {
+			data = append(data, k...)
+			data = append(data, ':', ' ')
+			data = append(data, v...)
+			data = append(data, '\r', '\n')
 		}
 	}
 
@@ -342,18 +487,23 @@ func (res *Response) flushTrailer(conn io.Writer) error {
 	if data == nil {
 		data = mempool.Malloc(0)
 	}
-	if len(res.trailer) == 0 {
-		data = append(data, "0\r\n\r\n"...)
-	} else {
-		data = append(data, "0\r\n"...)
-		for k, v := range res.trailer {
+	data = append(data, "0\r\n"...)
+	// the trailers are set after the head is sent, or by the keys with http.TrailerPrefix.
+	for k, vv := range res.header {
+		if !res.trailer[k] {
+			if !strings.HasPrefix(k, http.TrailerPrefix) {
+				continue
+			}
+			k = k[len(http.TrailerPrefix):]
+		}
+		for _, v := range vv {
 			data = append(data, k...)
 			data = append(data, ": "...)
 			data = append(data, v...)
 			data = append(data, "\r\n"...)
 		}
-		data = append(data, "\r\n"...)
 	}
+	data = append(data, "\r\n"...)
 	_, err = conn.Write(data)
 	return err
 }
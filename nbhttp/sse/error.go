@@ -0,0 +1,23 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sse
+
+import (
+	"errors"
+)
+
+var (
+	// ErrUpgradeNotHijacker .
+	ErrUpgradeNotHijacker = errors.New("sse: response does not implement http.Hijacker")
+
+	// ErrUpgradeHTTP2 is returned by Upgrade for the HTTP/2 requests, which are replied 505.
+	ErrUpgradeHTTP2 = errors.New("sse: HTTP/2 is not supported, the event streams are served on HTTP/1.x conns")
+
+	// ErrUpgradeNotNBIOConn .
+	ErrUpgradeNotNBIOConn = errors.New("sse: the hijacked conn is not an nbio.Conn of an Engine")
+
+	// ErrClosed .
+	ErrClosed = errors.New("sse: stream closed")
+)
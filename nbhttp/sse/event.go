@@ -0,0 +1,75 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sse
+
+import (
+	"strconv"
+	"time"
+)
+
+// Event is a message of an event stream.
+type Event struct {
+	// ID is sent as the id field if it's not empty, the client sends it back by the
+	// Last-Event-ID header when it reconnects.
+	ID string
+	// Event is the type of the event, the client dispatches it as "message" if it's empty.
+	Event string
+	// Data is sent as a data field per line.
+	Data []byte
+	// Retry is sent as the reconnection time of the client if it's positive.
+	Retry time.Duration
+}
+
+// appendTo appends the fields of e to buf, the line breaks in ID and Event are replaced
+// with spaces to prevent the stream from being split.
+func (e *Event) appendTo(buf []byte) []byte {
+	if e.ID != "" {
+		buf = appendLine(buf, "id: ", e.ID)
+	}
+	if e.Event != "" {
+		buf = appendLine(buf, "event: ", e.Event)
+	}
+	if e.Retry > 0 {
+		buf = append(buf, "retry: "...)
+		buf = strconv.AppendInt(buf, int64(e.Retry/time.Millisecond), 10)
+		buf = append(buf, '\n')
+	}
+	buf = appendLines(buf, "data: ", e.Data)
+	return append(buf, '\n')
+}
+
+func appendLine(buf []byte, field string, value string) []byte {
+	buf = append(buf, field...)
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		if b == '\r' || b == '\n' {
+			b = ' '
+		}
+		buf = append(buf, b)
+	}
+	return append(buf, '\n')
+}
+
+// appendLines appends a field for every line of data, the lines may end with "\r\n", "\r" or "\n".
+func appendLines(buf []byte, field string, data []byte) []byte {
+	start := 0
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '\r':
+			buf = append(append(buf, field...), data[start:i]...)
+			buf = append(buf, '\n')
+			if i+1 < len(data) && data[i+1] == '\n' {
+				i++
+			}
+			start = i + 1
+		case '\n':
+			buf = append(append(buf, field...), data[start:i]...)
+			buf = append(buf, '\n')
+			start = i + 1
+		}
+	}
+	buf = append(append(buf, field...), data[start:]...)
+	return append(buf, '\n')
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sse
+
+import (
+	"sync"
+
+	"github.com/lesismal/nbio/mempool"
+)
+
+// Hub is a group of streams to broadcast events to, a stream is removed from its hubs
+// when it's closed.
+type Hub struct {
+	mux     sync.RWMutex
+	streams map[*Stream]struct{}
+}
+
+// NewHub .
+func NewHub() *Hub {
+	return &Hub{streams: map[*Stream]struct{}{}}
+}
+
+// Add adds s to h, it returns false if s is closed.
+func (h *Hub) Add(s *Stream) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	// s.mux is acquired with h.mux held, a closing stream releases s.mux before removing itself.
+	if !s.addHub(h) {
+		return false
+	}
+	h.streams[s] = struct{}{}
+	return true
+}
+
+// Remove removes s from h.
+func (h *Hub) Remove(s *Stream) {
+	h.remove(s)
+	s.removeHub(h)
+}
+
+// Len returns the number of streams.
+func (h *Hub) Len() int {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return len(h.streams)
+}
+
+// Broadcast sends e to all the streams and returns the number of streams sent to,
+// the event is encoded once and written to the conns on the caller's goroutine.
+func (h *Hub) Broadcast(e *Event) int {
+	h.mux.RLock()
+	streams := make([]*Stream, 0, len(h.streams))
+	for s := range h.streams {
+		streams = append(streams, s)
+	}
+	h.mux.RUnlock()
+
+	data := e.appendTo(mempool.Malloc(256)[0:0])
+	n := 0
+	for _, s := range streams {
+		// the conn frees the buffer written.
+		buf := mempool.Malloc(len(data))
+		copy(buf, data)
+		if s.write(buf, e.ID) == nil {
+			n++
+		}
+	}
+	mempool.Free(data)
+	return n
+}
+
+func (h *Hub) remove(s *Stream) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	delete(h.streams, s)
+}
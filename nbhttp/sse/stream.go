@@ -0,0 +1,179 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sse
+
+import (
+	"net"
+	"sync"
+
+	"github.com/lesismal/nbio"
+	"github.com/lesismal/nbio/logging"
+	"github.com/lesismal/nbio/mempool"
+	"github.com/lesismal/nbio/nbhttp"
+)
+
+// Stream is an event stream upgraded from a request, the events are written to the conn directly
+// and it's closed when the conn is closed.
+type Stream struct {
+	conn net.Conn
+
+	mux         sync.Mutex
+	closed      bool
+	written     bool
+	lastEventID string
+	keepalive   *nbio.Periodic
+	hubs        map[*Hub]struct{}
+
+	session interface{}
+
+	onClose func(s *Stream, err error)
+	Engine  *nbhttp.Engine
+}
+
+// connState is the ConnState of the Parser after the upgrade, the client is not expected
+// to send anything, so the data received is discarded.
+type connState struct {
+	stream *Stream
+}
+
+// Read .
+func (c *connState) Read(p *nbhttp.Parser, data []byte) error {
+	return nil
+}
+
+// Close .
+func (c *connState) Close(p *nbhttp.Parser, err error) {
+	c.stream.onClosed(err)
+}
+
+// Conn returns the underlying conn.
+func (s *Stream) Conn() net.Conn {
+	return s.conn
+}
+
+// LastEventID returns the id of the last event sent, it's the Last-Event-ID header of the
+// request before any event with an id is sent.
+func (s *Stream) LastEventID() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.lastEventID
+}
+
+// Session .
+func (s *Stream) Session() interface{} {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.session
+}
+
+// SetSession .
+func (s *Stream) SetSession(session interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.session = session
+}
+
+// Send writes an event.
+func (s *Stream) Send(e *Event) error {
+	buf := e.appendTo(mempool.Malloc(256)[0:0])
+	return s.write(buf, e.ID)
+}
+
+// Comment writes text as comment lines, which are ignored by the client.
+func (s *Stream) Comment(text string) error {
+	buf := appendLines(mempool.Malloc(len(text) + 8)[0:0], ": ", []byte(text))
+	return s.write(buf, "")
+}
+
+// Close closes the conn, the OnClose handler is called after the conn is closed.
+func (s *Stream) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Stream) logger() logging.FieldLogger {
+	return s.Engine.ConnLogger(s.conn)
+}
+
+// write writes buf which is freed by the conn, the conn is written without s.mux held since
+// a failed write closes it.
+func (s *Stream) write(buf []byte, id string) error {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		mempool.Free(buf)
+		return ErrClosed
+	}
+	s.written = true
+	if id != "" {
+		s.lastEventID = id
+	}
+	s.mux.Unlock()
+
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+// sendKeepalive writes an empty comment if nothing is written since the last keepalive,
+// it's called on the timer loop of the Gopher.
+func (s *Stream) sendKeepalive() {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return
+	}
+	if s.written {
+		s.written = false
+		s.mux.Unlock()
+		return
+	}
+	s.mux.Unlock()
+
+	buf := append(mempool.Malloc(2)[0:0], ":\n"...)
+	if _, err := s.conn.Write(buf); err != nil {
+		s.logger().Log(logging.LevelDebug, "failed to send keepalive", logging.Err(err))
+	}
+}
+
+func (s *Stream) onClosed(err error) {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return
+	}
+	s.closed = true
+	if s.keepalive != nil {
+		s.keepalive.Stop()
+	}
+	hubs := s.hubs
+	s.hubs = nil
+	s.mux.Unlock()
+
+	for h := range hubs {
+		h.remove(s)
+	}
+	if s.onClose != nil {
+		s.onClose(s, err)
+	}
+}
+
+// addHub records h, it returns false if s is closed.
+func (s *Stream) addHub(h *Hub) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.hubs == nil {
+		s.hubs = map[*Hub]struct{}{}
+	}
+	s.hubs[h] = struct{}{}
+	return true
+}
+
+func (s *Stream) removeHub(h *Hub) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.hubs, h)
+}
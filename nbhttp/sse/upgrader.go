@@ -0,0 +1,153 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package sse
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lesismal/llib/std/crypto/tls"
+	"github.com/lesismal/nbio"
+	"github.com/lesismal/nbio/mempool"
+	"github.com/lesismal/nbio/nbhttp"
+)
+
+const (
+	// DefaultKeepaliveInterval .
+	DefaultKeepaliveInterval = time.Second * 15
+)
+
+// Upgrader .
+type Upgrader struct {
+	// KeepaliveInterval is the interval of the comment keepalives which keep the proxies from
+	// closing an idle stream, DefaultKeepaliveInterval is used if it's 0, negative disables them.
+	// A keepalive is skipped if an event is written since the last one.
+	KeepaliveInterval time.Duration
+
+	// Retry is sent to the client as the reconnection time if it's positive.
+	Retry time.Duration
+
+	openHandler func(*Stream)
+	onClose     func(s *Stream, err error)
+}
+
+// NewUpgrader .
+func NewUpgrader() *Upgrader {
+	return &Upgrader{}
+}
+
+// OnOpen .
+func (u *Upgrader) OnOpen(h func(*Stream)) {
+	u.openHandler = h
+}
+
+// OnClose .
+func (u *Upgrader) OnClose(h func(*Stream, error)) {
+	u.onClose = h
+}
+
+// Upgrade hijacks the conn of an HTTP/1.x request and replies the head of an event stream,
+// the events are written to the conn directly after it.
+// A Stream owns the whole conn, so the HTTP/2 requests are replied 505 with ErrUpgradeHTTP2,
+// the clients retry them over HTTP/1.1.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*Stream, error) {
+	if r.ProtoMajor >= 2 {
+		return nil, u.returnError(w, r, http.StatusHTTPVersionNotSupported, ErrUpgradeHTTP2)
+	}
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, u.returnError(w, r, http.StatusInternalServerError, ErrUpgradeNotHijacker)
+	}
+	conn, _, err := h.Hijack()
+	if err != nil {
+		return nil, u.returnError(w, r, http.StatusInternalServerError, err)
+	}
+
+	nbc, ok := conn.(*nbio.Conn)
+	if !ok {
+		tlsConn, tlsOk := conn.(*tls.Conn)
+		if !tlsOk {
+			return nil, u.returnError(w, r, http.StatusInternalServerError, ErrUpgradeNotNBIOConn)
+		}
+		nbc, tlsOk = tlsConn.Conn().(*nbio.Conn)
+		if !tlsOk {
+			return nil, u.returnError(w, r, http.StatusInternalServerError, ErrUpgradeNotNBIOConn)
+		}
+	}
+
+	parser, ok := nbhttp.ConnParser(nbc)
+	if !ok || parser.Engine == nil {
+		return nil, u.returnError(w, r, http.StatusInternalServerError, ErrUpgradeNotNBIOConn)
+	}
+
+	s := &Stream{
+		conn:        conn,
+		lastEventID: r.Header.Get("Last-Event-ID"),
+		onClose:     u.onClose,
+		Engine:      parser.Engine,
+	}
+	parser.ConnState = &connState{stream: s}
+	// the stream is ended by closing the conn instead of the request.
+	r.Close = false
+	// the client sends nothing after the request, so the conn is not closed by the keepalive time.
+	conn.SetReadDeadline(time.Time{})
+
+	buf := mempool.Malloc(1024)[0:0]
+	buf = append(buf, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nCache-Control: no-cache\r\n"...)
+	for k, vs := range responseHeader {
+		if k == "Content-Type" || k == "Content-Length" || k == "Transfer-Encoding" {
+			continue
+		}
+		for _, v := range vs {
+			buf = append(buf, k...)
+			buf = append(buf, ": "...)
+			for i := 0; i < len(v); i++ {
+				b := v[i]
+				if b <= 31 {
+					// prevent response splitting.
+					b = ' '
+				}
+				buf = append(buf, b)
+			}
+			buf = append(buf, "\r\n"...)
+		}
+	}
+	buf = append(buf, "\r\n"...)
+	if u.Retry > 0 {
+		buf = append(buf, "retry: "...)
+		buf = strconv.AppendInt(buf, int64(u.Retry/time.Millisecond), 10)
+		buf = append(buf, "\n\n"...)
+	}
+
+	if _, err = conn.Write(buf); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	interval := u.KeepaliveInterval
+	if interval == 0 {
+		interval = DefaultKeepaliveInterval
+	}
+	if interval > 0 {
+		s.mux.Lock()
+		if !s.closed {
+			// the jitter spreads the keepalives of the streams opened at the same time.
+			s.keepalive = parser.Engine.Every(interval, interval/10, s.sendKeepalive)
+		}
+		s.mux.Unlock()
+	}
+
+	if u.openHandler != nil {
+		u.openHandler(s)
+	}
+
+	return s, nil
+}
+
+func (u *Upgrader) returnError(w http.ResponseWriter, _ *http.Request, status int, err error) error {
+	http.Error(w, http.StatusText(status), status)
+	return err
+}
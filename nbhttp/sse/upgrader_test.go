@@ -0,0 +1,133 @@
+package sse
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lesismal/nbio/nbhttp"
+	"github.com/lesismal/nbio/niotest"
+)
+
+func TestEventAppendTo(t *testing.T) {
+	e := &Event{ID: "1\n2", Event: "update", Data: []byte("a\r\nb\rc\n"), Retry: time.Second}
+	want := "id: 1 2\nevent: update\nretry: 1000\ndata: a\ndata: b\ndata: c\ndata: \n\n"
+	if s := string(e.appendTo(nil)); s != want {
+		t.Fatalf("invalid event: %q, want %q", s, want)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	hub := NewHub()
+	chOpen := make(chan *Stream, 1)
+	chClose := make(chan *Stream, 1)
+	u := NewUpgrader()
+	u.KeepaliveInterval = time.Millisecond * 50
+	u.OnOpen(func(s *Stream) {
+		hub.Add(s)
+		chOpen <- s
+	})
+	u.OnClose(func(s *Stream, err error) {
+		chClose <- s
+	})
+	engine := nbhttp.NewEngine(nbhttp.Config{
+		NPoller: 1,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u.Upgrade(w, r, http.Header{"X-Test": {"sse"}})
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	engine.AddConnNonTLS(local)
+
+	if _, err := remote.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 7\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+	r := bufio.NewReader(remote)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse failed: %v", err)
+	}
+	if res.Header.Get("Content-Type") != "text/event-stream" || res.Header.Get("X-Test") != "sse" {
+		t.Fatalf("invalid header: %v", res.Header)
+	}
+
+	var s *Stream
+	select {
+	case s = <-chOpen:
+	case <-time.After(time.Second):
+		t.Fatalf("OnOpen not called")
+	}
+	if id := s.LastEventID(); id != "7" {
+		t.Fatalf("invalid last event id: %q", id)
+	}
+
+	// the keepalive is sent while no event is written.
+	if line, _ := r.ReadString('\n'); line != ":\n" {
+		t.Fatalf("invalid keepalive: %q", line)
+	}
+
+	if n := hub.Broadcast(&Event{ID: "8", Data: []byte("hello")}); n != 1 {
+		t.Fatalf("invalid broadcast count: %v", n)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("ReadString failed: %v", err)
+		}
+		if line == ":\n" {
+			continue
+		}
+		want := "id: 8\ndata: hello\n\n"
+		buf := make([]byte, len(want)-len(line))
+		if _, err := io.ReadFull(r, buf); err != nil || line+string(buf) != want {
+			t.Fatalf("invalid event: %q, want %q", line+string(buf), want)
+		}
+		break
+	}
+	if id := s.LastEventID(); id != "8" {
+		t.Fatalf("invalid last event id: %q", id)
+	}
+
+	// the stream is removed from the hub when the conn is closed.
+	remote.Close()
+	select {
+	case <-chClose:
+	case <-time.After(time.Second):
+		t.Fatalf("OnClose not called")
+	}
+	if hub.Len() != 0 {
+		t.Fatalf("stream not removed")
+	}
+	if err := s.Send(&Event{Data: []byte("closed")}); err != ErrClosed {
+		t.Fatalf("invalid error: %v", err)
+	}
+}
+
+func TestUpgradeHTTP2(t *testing.T) {
+	u := NewUpgrader()
+	u.OnOpen(func(s *Stream) {
+		t.Fatalf("OnOpen called for HTTP/2")
+	})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/events", nil)
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+	if _, err := u.Upgrade(w, r, nil); err != ErrUpgradeHTTP2 {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if w.Code != http.StatusHTTPVersionNotSupported {
+		t.Fatalf("invalid status code: %v", w.Code)
+	}
+}
@@ -161,6 +161,16 @@ func isHex(c byte) bool {
 // 	return alphaNumCharMap[c]
 // }
 
+// isCTL reports whether c is a control character other than HTAB, which is not allowed in the field values.
+func isCTL(c byte) bool {
+	return (c < 0x20 && c != '\t') || c == 0x7f
+}
+
+// isStrictVersion reports whether v is an HTTP-version of RFC 9112, "HTTP/" DIGIT "." DIGIT.
+func isStrictVersion(v string) bool {
+	return len(v) == 8 && v[:5] == "HTTP/" && isNum(v[5]) && v[6] == '.' && isNum(v[7])
+}
+
 func isToken(c byte) bool {
 	return tokenCharMap[c]
 }
@@ -7,10 +7,13 @@ package nbhttp
 
 import (
 	"context"
+	stdtls "crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -153,6 +156,50 @@ func TestServerSimulation(t *testing.T) {
 	cancelFunc()
 }
 
+func TestHTTP2TLS(t *testing.T) {
+	cert, err := tls.X509KeyPair(rsaCertPEM, rsaKeyPEM)
+	if err != nil {
+		t.Fatalf("tls.X509KeyPair failed: %v", err)
+	}
+	engine := nbhttp.NewEngine(nbhttp.Config{
+		Network:     "tcp",
+		AddrsTLS:    []string{"localhost:8890"},
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		EnableHTTP2: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte(r.Proto + " " + string(body)))
+		}),
+	})
+	if err = engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &stdtls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: time.Second * 3,
+	}
+	for i := 0; i < 3; i++ {
+		body := strings.Repeat("x", i*100000)
+		res, err := client.Post("https://localhost:8890/", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Post failed: %v", err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("read body failed: %v", err)
+		}
+		if res.ProtoMajor != 2 || string(data) != "HTTP/2.0 "+body {
+			t.Fatalf("invalid response: %v, %d bytes", res.Proto, len(data))
+		}
+	}
+}
+
 var rsaCertPEM = []byte(`-----BEGIN CERTIFICATE-----
 MIIDazCCAlOgAwIBAgIUJeohtgk8nnt8ofratXJg7kUJsI4wDQYJKoZIhvcNAQEL
 BQAwRTELMAkGA1UEBhMCQVUxEzARBgNVBAgMClNvbWUtU3RhdGUxITAfBgNVBAoM
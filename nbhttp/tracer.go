@@ -0,0 +1,192 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbhttp
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/lesismal/nbio"
+)
+
+// Tracer receives lifecycle events of an Engine's conns and requests.
+// Conn events are called on the poller goroutines, request events are called
+// on the parser and handler goroutines, handlers should not block.
+type Tracer interface {
+	nbio.Tracer
+
+	// OnTLSHandshake is called when a tls handshake is done or failed.
+	OnTLSHandshake(c *nbio.Conn, err error)
+
+	// OnRequestHeaders is called when the request line and headers have been parsed.
+	OnRequestHeaders(r *http.Request)
+
+	// OnHandlerStart is called before the http.Handler is called.
+	OnHandlerStart(r *http.Request)
+
+	// OnHandlerEnd is called after the http.Handler returned.
+	OnHandlerEnd(r *http.Request)
+
+	// OnResponseFlushed is called when the response has been written to the conn.
+	OnResponseFlushed(r *http.Request, err error)
+
+	// OnWebsocketUpgrade is called when a request has been upgraded to websocket.
+	OnWebsocketUpgrade(r *http.Request, c net.Conn)
+
+	// OnWebsocketClose is called when a websocket conn is closed, err is the close reason.
+	OnWebsocketClose(c net.Conn, err error)
+}
+
+// EmptyTracer implements Tracer and does nothing,
+// it can be embedded to implement part of the Tracer interface.
+type EmptyTracer struct {
+	nbio.EmptyTracer
+}
+
+// OnTLSHandshake .
+func (t EmptyTracer) OnTLSHandshake(c *nbio.Conn, err error) {}
+
+// OnRequestHeaders .
+func (t EmptyTracer) OnRequestHeaders(r *http.Request) {}
+
+// OnHandlerStart .
+func (t EmptyTracer) OnHandlerStart(r *http.Request) {}
+
+// OnHandlerEnd .
+func (t EmptyTracer) OnHandlerEnd(r *http.Request) {}
+
+// OnResponseFlushed .
+func (t EmptyTracer) OnResponseFlushed(r *http.Request, err error) {}
+
+// OnWebsocketUpgrade .
+func (t EmptyTracer) OnWebsocketUpgrade(r *http.Request, c net.Conn) {}
+
+// OnWebsocketClose .
+func (t EmptyTracer) OnWebsocketClose(c net.Conn, err error) {}
+
+const (
+	traceParentHeader = "Traceparent"
+	traceStateHeader  = "Tracestate"
+)
+
+// TraceContext is the W3C trace context carried by the traceparent and tracestate headers.
+type TraceContext struct {
+	TraceID  [16]byte
+	ParentID [8]byte
+	Flags    byte
+	State    string
+}
+
+// Sampled returns whether the sampled flag is set.
+func (tc TraceContext) Sampled() bool {
+	return tc.Flags&0x01 != 0
+}
+
+// String returns the traceparent header value.
+func (tc TraceContext) String() string {
+	buf := make([]byte, 55)
+	copy(buf, "00-")
+	hex.Encode(buf[3:35], tc.TraceID[:])
+	buf[35] = '-'
+	hex.Encode(buf[36:52], tc.ParentID[:])
+	buf[52] = '-'
+	hex.Encode(buf[53:55], []byte{tc.Flags})
+	return string(buf)
+}
+
+// ParseTraceParent parses a traceparent header value.
+func ParseTraceParent(s string) (TraceContext, error) {
+	var tc TraceContext
+
+	s = strings.TrimSpace(s)
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return tc, ErrInvalidTraceParent
+	}
+	if !isLowerHex(s) {
+		return tc, ErrInvalidTraceParent
+	}
+
+	var version [1]byte
+	if _, err := hex.Decode(version[:], []byte(s[:2])); err != nil || version[0] == 0xff {
+		return tc, ErrInvalidTraceParent
+	}
+	// future versions may append fields, version 00 must not.
+	if len(s) > 55 && (version[0] == 0 || s[55] != '-') {
+		return tc, ErrInvalidTraceParent
+	}
+
+	if _, err := hex.Decode(tc.TraceID[:], []byte(s[3:35])); err != nil {
+		return tc, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(tc.ParentID[:], []byte(s[36:52])); err != nil {
+		return tc, ErrInvalidTraceParent
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(s[53:55])); err != nil {
+		return tc, ErrInvalidTraceParent
+	}
+	tc.Flags = flags[0]
+
+	if tc.TraceID == [16]byte{} || tc.ParentID == [8]byte{} {
+		return tc, ErrInvalidTraceParent
+	}
+
+	return tc, nil
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < 55; i++ {
+		switch i {
+		case 2, 35, 52:
+			continue
+		}
+		c := s[i]
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type traceContextKey struct{}
+
+// ContextWithTraceContext returns a copy of ctx carrying tc.
+func ContextWithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceContextFromContext returns the TraceContext carried by ctx.
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}
+
+// TraceContextFromRequest parses the traceparent and tracestate headers of r.
+func TraceContextFromRequest(r *http.Request) (TraceContext, bool) {
+	tp := r.Header[traceParentHeader]
+	if len(tp) != 1 {
+		return TraceContext{}, false
+	}
+	tc, err := ParseTraceParent(tp[0])
+	if err != nil {
+		return TraceContext{}, false
+	}
+	tc.State = strings.Join(r.Header[traceStateHeader], ",")
+	return tc, true
+}
+
+// TraceContextHandler wraps h and propagates the W3C traceparent of the request
+// into the request's context, the handler can get it by TraceContextFromContext.
+func TraceContextHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tc, ok := TraceContextFromRequest(r); ok {
+			r = r.WithContext(ContextWithTraceContext(r.Context(), tc))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,134 @@
+package nbhttp
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lesismal/nbio"
+	"github.com/lesismal/nbio/niotest"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"validNotSampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false},
+		{"futureVersion", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"tooShort", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0", true},
+		{"upperHex", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", true},
+		{"invalidVersion", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"zeroTraceID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", true},
+		{"zeroParentID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", true},
+		{"version00WithExtra", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"badDelimiter", "00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := ParseTraceParent(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTraceParent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.value[:2] == "00" && tc.String() != tt.value {
+				t.Fatalf("TraceContext.String() = %v, want %v", tc.String(), tt.value)
+			}
+		})
+	}
+}
+
+func TestTraceContextHandler(t *testing.T) {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	var got TraceContext
+	var ok bool
+	h := TraceContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok = TraceContextFromContext(r.Context())
+	}))
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", traceParent)
+	r.Header.Set("tracestate", "congo=t61rcWkgMzE")
+	h.ServeHTTP(nil, r)
+	if !ok {
+		t.Fatalf("trace context not propagated")
+	}
+	if got.String() != traceParent || !got.Sampled() || got.State != "congo=t61rcWkgMzE" {
+		t.Fatalf("invalid trace context: %v, %v", got.String(), got.State)
+	}
+}
+
+type recordTracer struct {
+	EmptyTracer
+	mux    sync.Mutex
+	events []string
+	closed chan struct{}
+}
+
+func (t *recordTracer) record(event string) {
+	t.mux.Lock()
+	t.events = append(t.events, event)
+	t.mux.Unlock()
+}
+
+func (t *recordTracer) OnAccept(c *nbio.Conn)            { t.record("accept") }
+func (t *recordTracer) OnFirstByte(c *nbio.Conn)         { t.record("first byte") }
+func (t *recordTracer) OnRequestHeaders(r *http.Request) { t.record("request headers") }
+func (t *recordTracer) OnHandlerStart(r *http.Request)   { t.record("handler start") }
+func (t *recordTracer) OnHandlerEnd(r *http.Request)     { t.record("handler end") }
+func (t *recordTracer) OnResponseFlushed(r *http.Request, err error) {
+	t.record("response flushed")
+}
+func (t *recordTracer) OnClose(c *nbio.Conn, err error) {
+	t.record("close")
+	close(t.closed)
+}
+
+func TestTracerHooks(t *testing.T) {
+	tracer := &recordTracer{closed: make(chan struct{})}
+	engine := NewEngine(Config{
+		NPoller: 1,
+		Tracer:  tracer,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+	})
+	if err := engine.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer engine.Stop()
+
+	local, remote, err := niotest.Pipe(niotest.Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	engine.AddConnNonTLS(local)
+	if _, err := remote.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+	res, err := http.ReadResponse(bufio.NewReader(remote), nil)
+	if err != nil {
+		t.Fatalf("ReadResponse failed: %v", err)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	remote.Close()
+
+	select {
+	case <-tracer.closed:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("OnClose not called")
+	}
+	want := []string{"accept", "first byte", "request headers", "handler start", "handler end", "response flushed", "close"}
+	tracer.mux.Lock()
+	defer tracer.mux.Unlock()
+	if !reflect.DeepEqual(tracer.events, want) {
+		t.Fatalf("invalid events: %v, want %v", tracer.events, want)
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"net"
 	"sync"
 
+	"github.com/lesismal/nbio"
+	"github.com/lesismal/nbio/logging"
 	"github.com/lesismal/nbio/mempool"
 	"github.com/lesismal/nbio/nbhttp"
 )
@@ -129,6 +131,10 @@ func (c *Conn) OnClose(h func(*Conn, error)) {
 	}
 }
 
+func (c *Conn) logger() logging.FieldLogger {
+	return c.Engine.ConnLogger(c.Conn)
+}
+
 // WriteMessage .
 func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
 	c.mux.Lock()
@@ -193,6 +199,14 @@ func (c *Conn) SetSession(session interface{}) {
 	c.session = session
 }
 
+type connKey struct{}
+
+// GetConn returns the websocket Conn upgraded from an nbio.Conn.
+func GetConn(c *nbio.Conn) (*Conn, bool) {
+	wsConn, ok := c.Attr(connKey{}).(*Conn)
+	return wsConn, ok
+}
+
 type writeBuffer struct {
 	*bytes.Buffer
 }
@@ -197,7 +197,7 @@ func (d *Dialer) DialContext(ctx context.Context, urlStr string, requestHeader h
 			}
 		}
 
-		parser, ok := nbc.Session().(*nbhttp.Parser)
+		parser, ok := nbhttp.ConnParser(nbc)
 		if !ok {
 			err = errors.New(http.StatusText(http.StatusInternalServerError))
 			notifyResult(err)
@@ -246,6 +246,7 @@ func (d *Dialer) DialContext(ctx context.Context, urlStr string, requestHeader h
 
 		state.conn = wsConn
 		state.Engine = parser.Engine
+		nbc.SetAttr(connKey{}, wsConn)
 
 		if upgrader.openHandler != nil {
 			upgrader.openHandler(wsConn)
@@ -76,7 +76,7 @@ func NewUpgrader() *Upgrader {
 		}
 		err := c.WriteMessage(PongMessage, []byte(data))
 		if err != nil {
-			logging.Debug("failed to send pong %v", err)
+			c.logger().Log(logging.LevelDebug, "failed to send pong", logging.Err(err))
 			c.Close()
 			return
 		}
@@ -236,7 +236,7 @@ func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeade
 		}
 	}
 
-	parser, ok := nbc.Session().(*nbhttp.Parser)
+	parser, ok := nbhttp.ConnParser(nbc)
 	if !ok {
 		return nil, u.returnError(w, r, http.StatusInternalServerError, err)
 	}
@@ -283,6 +283,7 @@ func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeade
 	state.conn = newConn(u, conn, subprotocol, compress)
 	state.Engine = parser.Engine
 	state.conn.Engine = parser.Engine
+	nbc.SetAttr(connKey{}, state.conn)
 
 	if u.openHandler != nil {
 		u.openHandler(state.conn)
@@ -294,6 +295,7 @@ func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeade
 	}
 
 	state.conn.OnClose(u.onClose)
+	state.Engine.Tracer.OnWebsocketUpgrade(r, state.conn)
 
 	return state.conn, nil
 }
@@ -337,7 +339,8 @@ func (u *connState) Read(p *nbhttp.Parser, data []byte) error {
 	if bufLen == 0 {
 		u.buffer = data
 	} else {
-		u.buffer = append(u.buffer, data...)
+		u.buffer = u.Engine.BodyAllocator.Realloc(u.buffer, bufLen+len(data))
+		copy(u.buffer[bufLen:], data)
 		oldBuffer = u.buffer
 	}
 
@@ -385,7 +388,9 @@ func (u *connState) Read(p *nbhttp.Parser, data []byte) error {
 						err = ErrMessageTooLarge
 						break
 					}
-					u.message = append(u.message, body...)
+					l := len(u.message)
+					u.message = u.Engine.BodyAllocator.Realloc(u.message, l+len(body))
+					copy(u.message[l:], body)
 				}
 			}
 			if fin {
@@ -431,15 +436,18 @@ func (u *connState) Read(p *nbhttp.Parser, data []byte) error {
 	if bufLen == 0 {
 		if len(u.buffer) > 0 {
 			tmp := u.buffer
-			u.buffer = mempool.Malloc(len(tmp))
+			u.buffer = u.Engine.BodyAllocator.Malloc(len(tmp))
 			copy(u.buffer, tmp)
 		}
 	} else {
 		if len(u.buffer) < len(oldBuffer) {
 			tmp := u.buffer
-			u.buffer = mempool.Malloc(len(tmp))
-			copy(u.buffer, tmp)
-			mempool.Free(oldBuffer)
+			u.buffer = nil
+			if len(tmp) > 0 {
+				u.buffer = u.Engine.BodyAllocator.Malloc(len(tmp))
+				copy(u.buffer, tmp)
+			}
+			u.Engine.BodyAllocator.Free(oldBuffer)
 		}
 	}
 
@@ -449,13 +457,14 @@ func (u *connState) Read(p *nbhttp.Parser, data []byte) error {
 // Close .
 func (u *connState) Close(p *nbhttp.Parser, err error) {
 	if u.conn != nil {
+		u.Engine.Tracer.OnWebsocketClose(u.conn, err)
 		u.conn.onClose(u.conn, err)
 	}
 	if len(u.buffer) > 0 {
-		mempool.Free(u.buffer)
+		u.Engine.BodyAllocator.Free(u.buffer)
 	}
 	if len(u.message) > 0 {
-		mempool.Free(u.message)
+		u.Engine.BodyAllocator.Free(u.message)
 	}
 }
 
@@ -511,7 +520,7 @@ func (u *Upgrader) handleWsMessage(c *Conn, opcode MessageType, data []byte) {
 	case PongMessage:
 		u.pongMessageHandler(c, string(data))
 	case FragmentMessage:
-		logging.Debug("invalid fragment message")
+		c.logger().Log(logging.LevelDebug, "invalid fragment message")
 		c.Close()
 	default:
 		c.Close()
@@ -888,7 +897,7 @@ func (u *connState) readAll(r io.Reader, size int) ([]byte, error) {
 			if al > maxAppendSize {
 				al = maxAppendSize
 			}
-			buf = append(buf, make([]byte, al)...)[:l]
+			buf = u.Engine.BodyAllocator.Realloc(buf, l+al)[:l]
 		}
 	}
 }
@@ -360,6 +360,87 @@ LOOP_RECV:
 	it.Stop()
 }
 
+func TestAttr(t *testing.T) {
+	type keyA struct{}
+	type keyB struct{}
+	c := &Conn{}
+	if c.Attr(keyA{}) != nil {
+		t.Fatalf("attr exists before set")
+	}
+	c.SetAttr(keyA{}, 1)
+	c.SetAttr(keyB{}, 2)
+	c.SetAttr(keyA{}, 3)
+	if c.Attr(keyA{}) != 3 || c.Attr(keyB{}) != 2 {
+		t.Fatalf("invalid attrs: %v, %v", c.Attr(keyA{}), c.Attr(keyB{}))
+	}
+	if v, loaded := c.LoadOrStoreAttr(keyB{}, 4); !loaded || v != 2 {
+		t.Fatalf("invalid LoadOrStoreAttr: %v, %v", v, loaded)
+	}
+	c.DeleteAttr(keyA{})
+	if c.Attr(keyA{}) != nil || c.Attr(keyB{}) != 2 {
+		t.Fatalf("invalid attrs after delete: %v, %v", c.Attr(keyA{}), c.Attr(keyB{}))
+	}
+	if c.Session() != nil {
+		t.Fatalf("attrs should not use session")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	conn := NewRateLimiter(1000, 0)
+	group := NewRateLimiter(300, 0)
+	limiters := []*RateLimiter{conn, group}
+
+	if n, _ := takeTokens(limiters, now, 500); n != 300 {
+		t.Fatalf("invalid tokens: %v", n)
+	}
+	// the conn limiter should get back what the group limiter refused.
+	if n, _ := takeTokens(limiters[:1], now, 1000); n != 700 {
+		t.Fatalf("invalid refunded tokens: %v", n)
+	}
+	n, wait := takeTokens(limiters, now, 100)
+	if n != 0 || wait <= 0 {
+		t.Fatalf("invalid empty bucket: %v, %v", n, wait)
+	}
+	if n, _ := takeTokens(limiters, now.Add(time.Second/10), 1000); n != 30 {
+		t.Fatalf("invalid refilled tokens: %v", n)
+	}
+}
+
+func TestCron(t *testing.T) {
+	for _, v := range []struct {
+		expr string
+		now  string
+		next string
+	}{
+		{"* * * * *", "2021-01-01 10:00:30", "2021-01-01 10:01:00"},
+		{"*/15 * * * *", "2021-01-01 10:16:00", "2021-01-01 10:30:00"},
+		{"0 9-17/4 * * *", "2021-01-01 14:00:00", "2021-01-01 17:00:00"},
+		{"30 2 * * 1", "2021-01-01 00:00:00", "2021-01-04 02:30:00"},
+		{"0 0 13 * 5", "2021-01-01 00:00:00", "2021-01-08 00:00:00"},
+		{"0 0 29 2 *", "2021-03-01 00:00:00", "2024-02-29 00:00:00"},
+		{"@daily", "2021-12-31 23:59:00", "2022-01-01 00:00:00"},
+		{"0 12 * * 7", "2021-01-01 00:00:00", "2021-01-03 12:00:00"},
+	} {
+		s, err := ParseCron(v.expr)
+		if err != nil {
+			t.Fatalf("ParseCron %q failed: %v", v.expr, err)
+		}
+		now, _ := time.Parse("2006-01-02 15:04:05", v.now)
+		if next := s.Next(now).Format("2006-01-02 15:04:05"); next != v.next {
+			t.Fatalf("invalid next of %q after %v: %v, want %v", v.expr, v.now, next, v.next)
+		}
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Fatalf("invalid cron expression %q parsed", expr)
+		}
+	}
+	if s, _ := ParseCron("0 0 30 2 *"); !s.Next(time.Now()).IsZero() {
+		t.Fatalf("invalid next of Feb 30")
+	}
+}
+
 func TestStop(t *testing.T) {
 	gopher.Stop()
 	os.Remove(testfile)
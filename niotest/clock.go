@@ -0,0 +1,97 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package niotest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lesismal/nbio"
+)
+
+// Clock is a virtual nbio.Clock, time only moves when Advance is called.
+// Use it as nbio.Config.Clock to drive AfterFunc and deadlines deterministically.
+type Clock struct {
+	mux    sync.Mutex
+	now    time.Time
+	timers map[*clockTimer]struct{}
+}
+
+// Now .
+func (c *Clock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+// NewTimer .
+func (c *Clock) NewTimer(d time.Duration) nbio.ClockTimer {
+	t := &clockTimer{
+		clock: c,
+		ch:    make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d and fires the timers expired.
+func (c *Clock) Advance(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(d)
+	for t := range c.timers {
+		if !c.now.Before(t.expire) {
+			t.fireWithoutLock()
+		}
+	}
+}
+
+// NewClock creates a virtual Clock starting at now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{
+		now:    now,
+		timers: map[*clockTimer]struct{}{},
+	}
+}
+
+type clockTimer struct {
+	clock  *Clock
+	ch     chan time.Time
+	expire time.Time
+}
+
+func (t *clockTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *clockTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	_, active := c.timers[t]
+	t.expire = c.now.Add(d)
+	c.timers[t] = struct{}{}
+	if d <= 0 {
+		t.fireWithoutLock()
+	}
+	return active
+}
+
+func (t *clockTimer) Stop() bool {
+	c := t.clock
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	_, active := c.timers[t]
+	delete(c.timers, t)
+	return active
+}
+
+func (t *clockTimer) fireWithoutLock() {
+	delete(t.clock.timers, t)
+	select {
+	case t.ch <- t.clock.now:
+	default:
+	}
+}
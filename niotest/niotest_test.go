@@ -0,0 +1,393 @@
+package niotest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lesismal/nbio"
+)
+
+func TestPipeEcho(t *testing.T) {
+	g := nbio.NewGopher(nbio.Config{NPoller: 1})
+	g.OnData(func(c *nbio.Conn, data []byte) {
+		c.Write(append([]byte{}, data...))
+	})
+	if err := g.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	local, remote, err := Pipe(Faults{MaxWriteSize: 3, WriteDelay: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	g.AddConn(local)
+
+	msg := []byte("hello niotest")
+	if _, err = remote.Write(msg); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(remote, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(buf) != string(msg) {
+		t.Fatalf("invalid echo: %q", buf)
+	}
+}
+
+func TestClockDeadline(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	g := nbio.NewGopher(nbio.Config{NPoller: 1, Clock: clock})
+	chClose := make(chan error, 1)
+	g.OnClose(func(c *nbio.Conn, err error) {
+		chClose <- err
+	})
+	if err := g.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	chTimer := make(chan struct{}, 1)
+	g.AfterFunc(time.Second*10, func() {
+		chTimer <- struct{}{}
+	})
+
+	local, remote, err := Pipe(Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	g.AddConn(local)
+	local.SetReadDeadline(clock.Now().Add(time.Second * 20))
+
+	clock.Advance(time.Second * 5)
+	select {
+	case <-chTimer:
+		t.Fatalf("timer fired too early")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	clock.Advance(time.Second * 5)
+	select {
+	case <-chTimer:
+	case <-time.After(time.Second):
+		t.Fatalf("timer not fired")
+	}
+
+	clock.Advance(time.Second * 10)
+	select {
+	case err := <-chClose:
+		if err == nil {
+			t.Fatalf("conn closed without read timeout")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("read deadline not fired")
+	}
+}
+
+func TestReset(t *testing.T) {
+	g := nbio.NewGopher(nbio.Config{NPoller: 1})
+	chClose := make(chan error, 1)
+	g.OnClose(func(c *nbio.Conn, err error) {
+		chClose <- err
+	})
+	if err := g.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	local, remote, err := Pipe(Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	g.AddConn(local)
+	Reset(local)
+
+	select {
+	case err := <-chClose:
+		if err == nil {
+			t.Fatalf("conn closed without reset error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("conn not closed")
+	}
+}
+
+func TestConnContext(t *testing.T) {
+	g := nbio.NewGopher(nbio.Config{NPoller: 1})
+	if err := g.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	local, remote, err := Pipe(Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	g.AddConn(local)
+
+	ctx := local.Context()
+	if ctx.Err() != nil {
+		t.Fatalf("context done before close: %v", ctx.Err())
+	}
+	Reset(local)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("context not cancelled")
+	}
+	if !errors.Is(ctx.Err(), context.Canceled) || !errors.Is(ctx.Err(), syscall.ECONNRESET) {
+		t.Fatalf("invalid context error: %v", ctx.Err())
+	}
+	if local.Context() != ctx {
+		t.Fatalf("context changed after close")
+	}
+}
+
+func TestWriteLimit(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	g := nbio.NewGopher(nbio.Config{NPoller: 1, Clock: clock, ConnWriteRate: 1000})
+	if err := g.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	local, remote, err := Pipe(Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	g.AddConn(local)
+
+	if _, err = local.Write(make([]byte, 2500)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checkWriteLimit(t, clock, local, remote)
+}
+
+func TestSendfileLimit(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	g := nbio.NewGopher(nbio.Config{NPoller: 1, Clock: clock, ConnWriteRate: 1000})
+	if err := g.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	local, remote, err := Pipe(Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	g.AddConn(local)
+
+	f, err := ioutil.TempFile("", "niotest-sendfile-*")
+	if err != nil {
+		t.Fatalf("TempFile failed: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = f.Write(make([]byte, 2500)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+
+	// Sendfile returns without waiting for the tokens, the rest is held in the write buffer.
+	if n, err := local.Sendfile(f, 2500); err != nil || n != 2500 {
+		t.Fatalf("Sendfile failed: %v, %v", n, err)
+	}
+	checkWriteLimit(t, clock, local, remote)
+}
+
+// checkWriteLimit checks 2500 bytes written to local with a write rate of 1000 are sent by the clock.
+func checkWriteLimit(t *testing.T, clock *Clock, local *nbio.Conn, remote *Conn) {
+	buf := make([]byte, 4096)
+	remote.SetReadDeadline(time.Now().Add(time.Second * 3))
+	for i, want := range []int{1000, 1000, 500} {
+		if _, err := io.ReadFull(remote, buf[:want]); err != nil {
+			t.Fatalf("ReadFull failed at step %v: %v", i, err)
+		}
+		if n := local.WriteBuffered(); n != 2500-1000*i-want {
+			t.Fatalf("invalid bytes buffered at step %v: %v", i, n)
+		}
+		if written, sent := local.WriteOffsets(); written != 2500 || sent != int64(1000*i+want) {
+			t.Fatalf("invalid write offsets at step %v: %v, %v", i, written, sent)
+		}
+		clock.Advance(time.Second)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	var total int64
+	chData := make(chan struct{}, 16)
+	g := nbio.NewGopher(nbio.Config{NPoller: 1, Clock: clock, ReadLimiter: nbio.NewRateLimiter(1000, 0)})
+	g.OnData(func(c *nbio.Conn, data []byte) {
+		atomic.AddInt64(&total, int64(len(data)))
+		chData <- struct{}{}
+	})
+	if err := g.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	local, remote, err := Pipe(Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	g.AddConn(local)
+
+	if _, err = remote.Write(make([]byte, 2500)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	for i, want := range []int64{1000, 2000, 2500} {
+		// the reads are paused until the clock is advanced, so the total stops at want.
+		for atomic.LoadInt64(&total) < want {
+			select {
+			case <-chData:
+			case <-time.After(time.Second * 3):
+				t.Fatalf("read timeout at step %v: %v, want %v", i, atomic.LoadInt64(&total), want)
+			}
+		}
+		if n := atomic.LoadInt64(&total); n != want {
+			t.Fatalf("invalid bytes read at step %v: %v, want %v", i, n, want)
+		}
+		if !local.ReadPaused() && want < 2500 {
+			t.Fatalf("read not paused at step %v", i)
+		}
+		clock.Advance(time.Second)
+	}
+}
+
+func TestEvery(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	g := nbio.NewGopher(nbio.Config{NPoller: 1, Clock: clock})
+	if err := g.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	interval := time.Second
+	jitter := interval / 2
+	chRun := make(chan struct{}, 10)
+	p := g.Every(interval, jitter, func() {
+		chRun <- struct{}{}
+	})
+	clock.Advance(jitter)
+	checkRuns(t, chRun, 0)
+	// the jitter is not accumulated: the nth run is in [n*interval, n*interval+jitter).
+	for i := 1; i <= 10; i++ {
+		clock.Advance(interval)
+		checkRuns(t, chRun, 1)
+		base := time.Unix(0, 0).Add(interval * time.Duration(i+1))
+		if next := p.Next(); next.Before(base) || !next.Before(base.Add(jitter)) {
+			t.Fatalf("invalid next run %v: %v", i+1, next.Sub(time.Unix(0, 0)))
+		}
+	}
+	p.Stop()
+	clock.Advance(interval * 2)
+	checkRuns(t, chRun, 0)
+
+	ticker := g.NewTicker(interval)
+	for i := 0; i < 2; i++ {
+		clock.Advance(interval)
+		select {
+		case <-ticker.C:
+		case <-time.After(time.Second):
+			t.Fatalf("tick not fired")
+		}
+	}
+	ticker.Reset(interval * 2)
+	clock.Advance(interval)
+	select {
+	case <-ticker.C:
+		t.Fatalf("tick fired before the period reset")
+	case <-time.After(time.Millisecond * 20):
+	}
+	clock.Advance(interval)
+	select {
+	case <-ticker.C:
+	case <-time.After(time.Second):
+		t.Fatalf("tick not fired after Reset")
+	}
+	ticker.Stop()
+}
+
+// checkRuns checks that n runs are done after the clock advanced, then gives
+// the timer loop a moment to fail on an extra run.
+func checkRuns(t *testing.T, chRun chan struct{}, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-chRun:
+		case <-time.After(time.Second):
+			t.Fatalf("run not fired")
+		}
+	}
+	select {
+	case <-chRun:
+		t.Fatalf("extra run fired")
+	case <-time.After(time.Millisecond * 20):
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	g := nbio.NewGopher(nbio.Config{NPoller: 1, Clock: clock})
+	idleTimeout := time.Second * 10
+	chClose := make(chan error, 1)
+	g.OnOpen(func(c *nbio.Conn) {
+		c.SetIdleTimeout(idleTimeout)
+	})
+	g.OnClose(func(c *nbio.Conn, err error) {
+		chClose <- err
+	})
+	if err := g.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer g.Stop()
+
+	local, remote, err := Pipe(Faults{})
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	defer remote.Close()
+	c, err := g.AddConn(local)
+	if err != nil {
+		t.Fatalf("AddConn failed: %v", err)
+	}
+	// active for 2 idle timeouts, and idle for less than 1 after the last write.
+	for i := 0; i < 4; i++ {
+		c.Write([]byte("ping"))
+		clock.Advance(idleTimeout / 2)
+	}
+	select {
+	case err = <-chClose:
+		t.Fatalf("active conn closed: %v", err)
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	clock.Advance(idleTimeout / 2)
+	select {
+	case err = <-chClose:
+	case <-time.After(time.Second):
+		t.Fatalf("idle conn not closed")
+	}
+	if err == nil || err.Error() != "idle timeout" {
+		t.Fatalf("invalid close error: %v", err)
+	}
+}
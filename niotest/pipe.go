@@ -0,0 +1,91 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package niotest
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/lesismal/nbio"
+)
+
+// Faults describes the faults injected into a Pipe.
+type Faults struct {
+	// MaxWriteSize splits the remote side's writes into chunks of at most MaxWriteSize bytes,
+	// used to deliver partial frames to the Gopher side.
+	MaxWriteSize int
+
+	// WriteDelay is the delay between the chunks of the remote side's writes.
+	WriteDelay time.Duration
+
+	// ReadDelay is the delay before each read of the remote side.
+	ReadDelay time.Duration
+
+	// BufferSize sets the socket buffer size of both sides, small values make the
+	// Gopher side's writes return EAGAIN and be queued when the remote side doesn't read.
+	BufferSize int
+}
+
+// Conn is the remote side of a Pipe, it's used by tests as the peer of a Gopher's Conn.
+type Conn struct {
+	net.Conn
+	faults Faults
+}
+
+// Read reads data sent by the Gopher side.
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.faults.ReadDelay > 0 {
+		time.Sleep(c.faults.ReadDelay)
+	}
+	return c.Conn.Read(b)
+}
+
+// Write sends data to the Gopher side, split by Faults.MaxWriteSize.
+func (c *Conn) Write(b []byte) (int, error) {
+	chunk := c.faults.MaxWriteSize
+	if chunk <= 0 {
+		chunk = len(b)
+	}
+	nwrite := 0
+	for len(b) > 0 {
+		if nwrite > 0 && c.faults.WriteDelay > 0 {
+			time.Sleep(c.faults.WriteDelay)
+		}
+		n := chunk
+		if n > len(b) {
+			n = len(b)
+		}
+		n, err := c.Conn.Write(b[:n])
+		nwrite += n
+		if err != nil {
+			return nwrite, err
+		}
+		b = b[n:]
+	}
+	return nwrite, nil
+}
+
+// Pipe creates a pair of connected in-memory conns without a tcp listener.
+// The first one is to be added to a Gopher by Gopher.AddConn or Engine.AddConnNonTLS,
+// the second one is the remote side used by tests.
+func Pipe(faults Faults) (*nbio.Conn, *Conn, error) {
+	local, remote, err := pipe(faults.BufferSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	nbc, err := nbio.NBConn(local)
+	if err != nil {
+		local.Close()
+		remote.Close()
+		return nil, nil, err
+	}
+	return nbc, &Conn{Conn: remote, faults: faults}, nil
+}
+
+// Reset closes c with a connection reset error, as if the peer had reset the connection.
+func Reset(c *nbio.Conn) error {
+	return c.CloseWithError(syscall.ECONNRESET)
+}
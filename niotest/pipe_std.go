@@ -0,0 +1,17 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package niotest
+
+import (
+	"net"
+)
+
+func pipe(bufferSize int) (net.Conn, net.Conn, error) {
+	local, remote := net.Pipe()
+	return local, remote, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || netbsd || freebsd || openbsd || dragonfly
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package niotest
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+func pipe(bufferSize int) (net.Conn, net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		if bufferSize > 0 {
+			syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, bufferSize)
+			syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, bufferSize)
+		}
+		// net.FileConn dups the fd and sets it to non-blocking mode.
+		f := os.NewFile(uintptr(fd), "niotest")
+		conns[i], err = net.FileConn(f)
+		f.Close()
+		if err != nil {
+			if i > 0 {
+				conns[0].Close()
+			} else {
+				syscall.Close(fds[1])
+			}
+			return nil, nil, err
+		}
+	}
+
+	return conns[0], conns[1], nil
+}
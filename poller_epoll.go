@@ -53,10 +53,14 @@ type poller struct {
 	ReadBuffer []byte
 
 	pollType string
+
+	logger logging.FieldLogger
 }
 
 func (p *poller) addConn(c *Conn) {
 	c.g = p.g
+	p.g.initConnLimiters(c)
+	p.g.tracer.OnAccept(c)
 	p.g.onOpen(c)
 	fd := c.fd
 	p.g.connsUnix[fd] = c
@@ -64,7 +68,7 @@ func (p *poller) addConn(c *Conn) {
 	if err != nil {
 		p.g.connsUnix[fd] = nil
 		c.closeWithError(err)
-		logging.Error("[%v] add read event failed: %v", c.fd, err)
+		c.Logger().Log(logging.LevelError, "add read event failed", logging.Err(err))
 		return
 	}
 }
@@ -82,14 +86,15 @@ func (p *poller) deleteConn(c *Conn) {
 		p.g.connsUnix[fd] = nil
 		p.deleteEvent(fd)
 	}
+	p.g.tracer.OnClose(c, c.closeErr)
 	p.g.onClose(c, c.closeErr)
 }
 
 func (p *poller) start() {
 	defer p.g.Done()
 
-	logging.Debug("Poller[%v_%v_%v] start", p.g.Name, p.pollType, p.index)
-	defer logging.Debug("Poller[%v_%v_%v] stopped", p.g.Name, p.pollType, p.index)
+	p.logger.Log(logging.LevelDebug, "poller start")
+	defer p.logger.Log(logging.LevelDebug, "poller stopped")
 
 	if p.isListener {
 		p.acceptorLoop()
@@ -108,7 +113,6 @@ func (p *poller) acceptorLoop() {
 		defer runtime.UnlockOSThread()
 	}
 
-	p.shutdown = false
 	for !p.shutdown {
 		conn, err := p.listener.Accept()
 		if err == nil {
@@ -123,10 +127,10 @@ func (p *poller) acceptorLoop() {
 		} else {
 			var ne net.Error
 			if ok := errors.As(err, &ne); ok && ne.Temporary() {
-				logging.Error("Poller[%v_%v_%v] Accept failed: temporary error, retrying...", p.g.Name, p.pollType, p.index)
+				p.g.logSampler.Log(p.logger, logging.LevelError, "accept failed: temporary error, retrying...", logging.Err(err))
 				time.Sleep(time.Second / 20)
 			} else {
-				logging.Error("Poller[%v_%v_%v] Accept failed: %v, exit...", p.g.Name, p.pollType, p.index, err)
+				p.logger.Log(logging.LevelError, "accept failed, exit...", logging.Err(err))
 				break
 			}
 		}
@@ -146,8 +150,6 @@ func (p *poller) readWriteLoop() {
 		p.g.maxReadTimesPerEventLoop = 1<<31 - 1
 	}
 
-	p.shutdown = false
-
 	for !p.shutdown {
 		n, err := syscall.EpollWait(p.epfd, events, msec)
 		if err != nil && !errors.Is(err, syscall.EINTR) {
@@ -213,7 +215,7 @@ func (p *poller) readWriteLoop() {
 }
 
 func (p *poller) stop() {
-	logging.Debug("Poller[%v_%v_%v] stop...", p.g.Name, p.pollType, p.index)
+	p.logger.Log(logging.LevelDebug, "poller stop...")
 	p.shutdown = true
 	if p.listener != nil {
 		p.listener.Close()
@@ -245,6 +247,30 @@ func (p *poller) modWrite(fd int) error {
 	}
 }
 
+// pauseRead removes EPOLLIN of a conn whose read is throttled.
+func (p *poller) pauseRead(c *Conn) error {
+	var events uint32
+	if c.isWAdded {
+		events = epollEventsWrite
+	}
+	if p.g.epollMod == EPOLLET {
+		events |= EPOLLET
+	}
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, c.fd, &syscall.EpollEvent{Fd: int32(c.fd), Events: events})
+}
+
+// resumeRead adds EPOLLIN back, the pending data triggers the event again.
+func (p *poller) resumeRead(c *Conn) error {
+	var events uint32 = epollEventsRead
+	if c.isWAdded {
+		events = epollEventsReadWrite
+	}
+	if p.g.epollMod == EPOLLET {
+		events |= EPOLLET
+	}
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, c.fd, &syscall.EpollEvent{Fd: int32(c.fd), Events: events})
+}
+
 func (p *poller) deleteEvent(fd int) error {
 	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, fd, &syscall.EpollEvent{Fd: int32(fd)})
 }
@@ -267,6 +293,7 @@ func newPoller(g *Gopher, isListener bool, index int) (*poller, error) {
 			listener:   ln,
 			isListener: isListener,
 			pollType:   "LISTENER",
+			logger:     g.pollerLogger("LISTENER", index),
 		}
 
 		return p, nil
@@ -301,6 +328,7 @@ func newPoller(g *Gopher, isListener bool, index int) (*poller, error) {
 		index:      index,
 		isListener: isListener,
 		pollType:   "POLLER",
+		logger:     g.pollerLogger("POLLER", index),
 	}
 
 	return p, nil
@@ -45,11 +45,15 @@ type poller struct {
 
 	pollType string
 
+	logger logging.FieldLogger
+
 	eventList []syscall.Kevent_t
 }
 
 func (p *poller) addConn(c *Conn) {
 	c.g = p.g
+	p.g.initConnLimiters(c)
+	p.g.tracer.OnAccept(c)
 	p.g.onOpen(c)
 	fd := c.fd
 	p.g.connsUnix[fd] = c
@@ -69,6 +73,7 @@ func (p *poller) deleteConn(c *Conn) {
 		p.g.connsUnix[fd] = nil
 		p.deleteEvent(fd)
 	}
+	p.g.tracer.OnClose(c, c.closeErr)
 	p.g.onClose(c, c.closeErr)
 }
 
@@ -97,6 +102,22 @@ func (p *poller) deleteEvent(fd int) {
 	p.trigger()
 }
 
+// pauseRead disables the read filter of a conn whose read is throttled.
+func (p *poller) pauseRead(c *Conn) {
+	p.mux.Lock()
+	p.eventList = append(p.eventList, syscall.Kevent_t{Ident: uint64(c.fd), Flags: syscall.EV_DISABLE, Filter: syscall.EVFILT_READ})
+	p.mux.Unlock()
+	p.trigger()
+}
+
+// resumeRead enables the read filter again.
+func (p *poller) resumeRead(c *Conn) {
+	p.mux.Lock()
+	p.eventList = append(p.eventList, syscall.Kevent_t{Ident: uint64(c.fd), Flags: syscall.EV_ENABLE, Filter: syscall.EVFILT_READ})
+	p.mux.Unlock()
+	p.trigger()
+}
+
 func (p *poller) readWrite(ev *syscall.Kevent_t) {
 	if ev.Flags&syscall.EV_DELETE > 0 {
 		return
@@ -147,8 +168,8 @@ func (p *poller) start() {
 	}
 	defer p.g.Done()
 
-	logging.Debug("Poller[%v_%v_%v] start", p.g.Name, p.pollType, p.index)
-	defer logging.Debug("Poller[%v_%v_%v] stopped", p.g.Name, p.pollType, p.index)
+	p.logger.Log(logging.LevelDebug, "poller start")
+	defer p.logger.Log(logging.LevelDebug, "poller stopped")
 
 	if p.isListener {
 		p.acceptorLoop()
@@ -164,7 +185,6 @@ func (p *poller) acceptorLoop() {
 		defer runtime.UnlockOSThread()
 	}
 
-	p.shutdown = false
 	for !p.shutdown {
 		conn, err := p.listener.Accept()
 		if err == nil {
@@ -177,10 +197,10 @@ func (p *poller) acceptorLoop() {
 			o.addConn(c)
 		} else {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				logging.Error("Poller[%v_%v_%v] Accept failed: temporary error, retrying...", p.g.Name, p.pollType, p.index)
+				p.g.logSampler.Log(p.logger, logging.LevelError, "accept failed: temporary error, retrying...", logging.Err(err))
 				time.Sleep(time.Second / 20)
 			} else {
-				logging.Error("Poller[%v_%v_%v] Accept failed: %v, exit...", p.g.Name, p.pollType, p.index, err)
+				p.logger.Log(logging.LevelError, "accept failed, exit...", logging.Err(err))
 				break
 			}
 		}
@@ -196,7 +216,6 @@ func (p *poller) readWriteLoop() {
 	var events = make([]syscall.Kevent_t, 1024)
 	var changes []syscall.Kevent_t
 
-	p.shutdown = false
 	for !p.shutdown {
 		p.mux.Lock()
 		changes = p.eventList
@@ -218,7 +237,7 @@ func (p *poller) readWriteLoop() {
 }
 
 func (p *poller) stop() {
-	logging.Debug("Poller[%v_%v_%v] stop...", p.g.Name, p.pollType, p.index)
+	p.logger.Log(logging.LevelDebug, "poller stop...")
 	p.shutdown = true
 	if p.listener != nil {
 		p.listener.Close()
@@ -244,6 +263,7 @@ func newPoller(g *Gopher, isListener bool, index int) (*poller, error) {
 			listener:   ln,
 			isListener: isListener,
 			pollType:   "LISTENER",
+			logger:     g.pollerLogger("LISTENER", index),
 		}
 		return p, nil
 	}
@@ -270,6 +290,7 @@ func newPoller(g *Gopher, isListener bool, index int) (*poller, error) {
 		index:      index,
 		isListener: isListener,
 		pollType:   "POLLER",
+		logger:     g.pollerLogger("POLLER", index),
 	}
 
 	return p, nil
@@ -32,6 +32,7 @@ type poller struct {
 
 	pollType   string
 	isListener bool
+	logger     logging.FieldLogger
 	listener   net.Listener
 	shutdown   bool
 
@@ -68,6 +69,8 @@ func (p *poller) addConn(c *Conn) error {
 	p.g.mux.Lock()
 	p.g.connsStd[c] = struct{}{}
 	p.g.mux.Unlock()
+	p.g.initConnLimiters(c)
+	p.g.tracer.OnAccept(c)
 	p.g.onOpen(c)
 	go p.readConn(c)
 
@@ -78,6 +81,7 @@ func (p *poller) deleteConn(c *Conn) {
 	p.g.mux.Lock()
 	delete(p.g.connsStd, c)
 	p.g.mux.Unlock()
+	p.g.tracer.OnClose(c, c.closeErr)
 	p.g.onClose(c, c.closeErr)
 }
 
@@ -88,20 +92,19 @@ func (p *poller) start() {
 	}
 	defer p.g.Done()
 
-	logging.Debug("Poller[%v_%v_%v] start", p.g.Name, p.pollType, p.index)
-	defer logging.Debug("Poller[%v_%v_%v] stopped", p.g.Name, p.pollType, p.index)
+	p.logger.Log(logging.LevelDebug, "poller start")
+	defer p.logger.Log(logging.LevelDebug, "poller stopped")
 
 	if p.isListener {
 		var err error
-		p.shutdown = false
 		for !p.shutdown {
 			err = p.accept()
 			if err != nil {
 				if ne, ok := err.(net.Error); ok && ne.Temporary() {
-					logging.Error("Poller[%v_%v_%v] Accept failed: temporary error, retrying...", p.g.Name, p.pollType, p.index)
+					p.g.logSampler.Log(p.logger, logging.LevelError, "accept failed: temporary error, retrying...", logging.Err(err))
 					time.Sleep(time.Second / 20)
 				} else {
-					logging.Error("Poller[%v_%v_%v] Accept failed: %v, exit...", p.g.Name, p.pollType, p.index, err)
+					p.logger.Log(logging.LevelError, "accept failed, exit...", logging.Err(err))
 					break
 				}
 			}
@@ -112,7 +115,7 @@ func (p *poller) start() {
 }
 
 func (p *poller) stop() {
-	logging.Debug("Poller[%v_%v_%v] stop...", p.g.Name, p.pollType, p.index)
+	p.logger.Log(logging.LevelDebug, "poller stop...")
 	p.shutdown = true
 	if p.isListener {
 		p.listener.Close()
@@ -139,6 +142,7 @@ func newPoller(g *Gopher, isListener bool, index int) (*poller, error) {
 	} else {
 		p.pollType = "POLLER"
 	}
+	p.logger = g.pollerLogger(p.pollType, index)
 
 	return p, nil
 }
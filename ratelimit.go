@@ -0,0 +1,174 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting bytes per second.
+// It's safe to be shared by many conns, a shared RateLimiter is the group budget of them.
+type RateLimiter struct {
+	mux    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter, burst is set to bytesPerSecond if it's not positive.
+func NewRateLimiter(bytesPerSecond int, burst int) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(bytesPerSecond, burst)
+	l.tokens = l.burst
+	return l
+}
+
+// SetRate resets the rate and the burst size.
+func (l *RateLimiter) SetRate(bytesPerSecond int, burst int) {
+	if bytesPerSecond <= 0 {
+		bytesPerSecond = 1
+	}
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	l.mux.Lock()
+	l.rate = float64(bytesPerSecond)
+	l.burst = float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.mux.Unlock()
+}
+
+// take takes up to want tokens, if there's no token it returns 0 and the wait duration.
+func (l *RateLimiter) take(now time.Time, want int) (int, time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.refill(now)
+	if l.tokens >= 1 {
+		n := want
+		if float64(n) > l.tokens {
+			n = int(l.tokens)
+		}
+		l.tokens -= float64(n)
+		return n, 0
+	}
+	return 0, l.wait(want)
+}
+
+// delay returns the duration to wait before taking want tokens, 0 if any token is available.
+func (l *RateLimiter) delay(now time.Time, want int) time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.refill(now)
+	if l.tokens >= 1 {
+		return 0
+	}
+	return l.wait(want)
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() && now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	if l.last.IsZero() || now.After(l.last) {
+		l.last = now
+	}
+}
+
+// wait returns the duration for a tenth of a second's budget or want,
+// waking up for every byte would cost too much.
+func (l *RateLimiter) wait(want int) time.Duration {
+	need := l.rate / 10
+	if need > float64(want) {
+		need = float64(want)
+	}
+	if need > l.burst {
+		need = l.burst
+	}
+	if need < 1 {
+		need = 1
+	}
+	wait := time.Duration((need - l.tokens) / l.rate * float64(time.Second))
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// refund returns the tokens taken but not used.
+func (l *RateLimiter) refund(n int) {
+	if n <= 0 {
+		return
+	}
+	l.mux.Lock()
+	l.tokens += float64(n)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.mux.Unlock()
+}
+
+// takeTokens takes the same number of tokens from all the limiters, up to want.
+func takeTokens(limiters []*RateLimiter, now time.Time, want int) (int, time.Duration) {
+	n := want
+	for i, l := range limiters {
+		got, wait := l.take(now, n)
+		if got < n {
+			for _, prev := range limiters[:i] {
+				prev.refund(n - got)
+			}
+			n = got
+		}
+		if n == 0 {
+			return 0, wait
+		}
+	}
+	return n, 0
+}
+
+func refundTokens(limiters []*RateLimiter, n int) {
+	for _, l := range limiters {
+		l.refund(n)
+	}
+}
+
+// limitDelay returns the max delay of the limiters, but at least 1ms.
+func limitDelay(limiters []*RateLimiter, now time.Time, want int) time.Duration {
+	delay := time.Millisecond
+	for _, l := range limiters {
+		if d := l.delay(now, want); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// connLimiters returns the limiters of a new conn by the Gopher's Config.
+func connLimiters(group *RateLimiter, rate int) []*RateLimiter {
+	var limiters []*RateLimiter
+	if rate > 0 {
+		limiters = append(limiters, NewRateLimiter(rate, 0))
+	}
+	if group != nil {
+		limiters = append(limiters, group)
+	}
+	return limiters
+}
+
+// initConnLimiters sets the Config's limiters to a new conn unless they have been set.
+func (g *Gopher) initConnLimiters(c *Conn) {
+	if c.rLimiters == nil {
+		c.rLimiters = connLimiters(g.readLimiter, g.connReadRate)
+	}
+	if c.wLimiters == nil {
+		c.wLimiters = connLimiters(g.writeLimiter, g.connWriteRate)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package nbio
+
+// SetReadLimiters sets the read limiters of the conn, reading stops until all of them allow.
+// Pass a per-conn limiter and shared group limiters together, or nothing to remove the limits.
+func (c *Conn) SetReadLimiters(limiters ...*RateLimiter) {
+	if limiters == nil {
+		limiters = []*RateLimiter{}
+	}
+	c.mux.Lock()
+	c.rLimiters = limiters
+	c.mux.Unlock()
+}
+
+// SetWriteLimiters sets the write limiters of the conn, Write blocks until all of them allow.
+// Pass a per-conn limiter and shared group limiters together, or nothing to remove the limits.
+func (c *Conn) SetWriteLimiters(limiters ...*RateLimiter) {
+	if limiters == nil {
+		limiters = []*RateLimiter{}
+	}
+	c.mux.Lock()
+	c.wLimiters = limiters
+	c.mux.Unlock()
+}
+
+// waitQuota blocks the conn's goroutine until the limiters allow some bytes.
+func (c *Conn) waitQuota(limiters []*RateLimiter, want int) int {
+	if len(limiters) == 0 || want == 0 {
+		return want
+	}
+	for {
+		n, wait := takeTokens(limiters, c.g.clock.Now(), want)
+		if n > 0 {
+			return n
+		}
+		<-c.g.clock.NewTimer(wait).C()
+	}
+}
+
+func (c *Conn) writeLimited(b []byte) (int, error) {
+	c.mux.Lock()
+	limiters := c.wLimiters
+	c.mux.Unlock()
+	if len(limiters) == 0 {
+		return c.conn.Write(b)
+	}
+	nwrite := 0
+	for nwrite < len(b) {
+		quota := c.waitQuota(limiters, len(b)-nwrite)
+		n, err := c.conn.Write(b[nwrite : nwrite+quota])
+		if n > 0 {
+			nwrite += n
+		}
+		if err != nil {
+			return nwrite, err
+		}
+	}
+	return nwrite, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || netbsd || freebsd || openbsd || dragonfly
+// +build linux darwin netbsd freebsd openbsd dragonfly
+
+package nbio
+
+import (
+	"time"
+)
+
+// SetReadLimiters sets the read limiters of the conn, reading stops until all of them allow.
+// Pass a per-conn limiter and shared group limiters together, or nothing to remove the limits.
+func (c *Conn) SetReadLimiters(limiters ...*RateLimiter) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.rLimiters = limiters
+	if c.rLimiters == nil {
+		c.rLimiters = []*RateLimiter{}
+	}
+	if len(limiters) == 0 && c.rPaused {
+		if c.rLimitTimer != nil {
+			c.rLimitTimer.Stop()
+			c.rLimitTimer = nil
+		}
+		c.rPaused = false
+		if !c.closed && !c.rHeld {
+			c.g.pollers[c.Hash()%len(c.g.pollers)].resumeRead(c)
+		}
+	}
+}
+
+// SetWriteLimiters sets the write limiters of the conn, written data is held in the
+// write buffer until all of them allow, the buffered data is still limited by MaxWriteBufferSize.
+// Pass a per-conn limiter and shared group limiters together, or nothing to remove the limits.
+func (c *Conn) SetWriteLimiters(limiters ...*RateLimiter) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.wLimiters = limiters
+	if c.wLimiters == nil {
+		c.wLimiters = []*RateLimiter{}
+	}
+	if len(limiters) == 0 && c.wLimitTimer != nil {
+		c.wLimitTimer.Stop()
+		c.wLimitTimer = nil
+		if len(c.writeBuffer) > 0 {
+			c.modWrite()
+		}
+	}
+}
+
+// pauseRead removes the read event until wait passed, c.mux must be held.
+func (c *Conn) pauseRead(wait time.Duration) {
+	if c.closed || c.rPaused {
+		return
+	}
+	c.rPaused = true
+	if !c.rHeld {
+		c.g.pollers[c.Hash()%len(c.g.pollers)].pauseRead(c)
+	}
+	c.rLimitTimer = c.g.afterFunc(wait, c.resumeRead)
+}
+
+func (c *Conn) resumeRead() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.rLimitTimer = nil
+	if c.closed || !c.rPaused {
+		return
+	}
+	c.rPaused = false
+	if !c.rHeld {
+		c.g.pollers[c.Hash()%len(c.g.pollers)].resumeRead(c)
+	}
+}
+
+func (c *Conn) flushLimited() {
+	c.mux.Lock()
+	c.wLimitTimer = nil
+	c.mux.Unlock()
+	c.flush()
+}
+
+func (c *Conn) stopLimitTimers() {
+	if c.rLimitTimer != nil {
+		c.rLimitTimer.Stop()
+		c.rLimitTimer = nil
+	}
+	if c.wLimitTimer != nil {
+		c.wLimitTimer.Stop()
+		c.wLimitTimer = nil
+	}
+}
@@ -8,14 +8,11 @@
 package nbio
 
 import (
-	"io"
 	"os"
-
-	"github.com/lesismal/nbio/mempool"
 )
 
 // Sendfile .
-func (c *Conn) Sendfile(f *os.File, remain int64) (written int64, err error) {
+func (c *Conn) Sendfile(f *os.File, remain int64) (int64, error) {
 	if f == nil {
 		return 0, nil
 	}
@@ -28,35 +25,5 @@ func (c *Conn) Sendfile(f *os.File, remain int64) (written int64, err error) {
 		remain = stat.Size()
 	}
 
-	for remain > 0 {
-		bufLen := 1024 * 32
-		if bufLen > int(remain) {
-			bufLen = int(remain)
-		}
-		buf := mempool.Malloc(bufLen)
-		nr, er := f.Read(buf)
-		if nr > 0 {
-			nw, ew := c.Write(buf[0:nr])
-			if nw < 0 {
-				nw = 0
-			}
-			remain -= int64(nw)
-			written += int64(nw)
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
-		}
-		if er != nil {
-			if er != io.EOF {
-				err = er
-			}
-			break
-		}
-	}
-	return written, err
+	return c.writeFile(f, remain)
 }
@@ -29,11 +29,18 @@ func (c *Conn) Sendfile(f *os.File, remain int64) (int64, error) {
 	if remain <= 0 {
 		stat, err := f.Stat()
 		if err != nil {
+			c.mux.Unlock()
 			return 0, err
 		}
 		remain = stat.Size()
 	}
 
+	if len(c.wLimiters) > 0 {
+		// the limited data is sent by the write buffer as Write, instead of waiting for the tokens.
+		c.mux.Unlock()
+		return c.writeFile(f, remain)
+	}
+
 	if len(c.writeBuffer) > 0 {
 		if c.chWaitWrite == nil {
 			c.chWaitWrite = make(chan struct{}, 1)
@@ -65,6 +72,7 @@ func (c *Conn) Sendfile(f *os.File, remain int64) (int64, error) {
 		n, err = syscall.Sendfile(dst, src, nil, n)
 		if n > 0 {
 			remain -= int64(n)
+			c.written += int64(n)
 		} else if n == 0 && err == nil {
 			break
 		}
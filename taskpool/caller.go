@@ -11,14 +11,22 @@ import (
 	"github.com/lesismal/nbio/logging"
 )
 
-func call(f func()) {
+// call runs f and recovers the panic, it returns true if f panicked.
+func call(f func()) (panicked bool) {
 	defer func() {
 		if err := recover(); err != nil {
 			const size = 64 << 10
 			buf := make([]byte, size)
 			buf = buf[:runtime.Stack(buf, false)]
 			logging.Error("taskpool call failed: %v\n%v\n", err, *(*string)(unsafe.Pointer(&buf)))
+			panicked = true
 		}
 	}()
 	f()
+	return false
+}
+
+func callWithoutRecover(f func()) bool {
+	f()
+	return false
 }
@@ -4,20 +4,45 @@
 
 package taskpool
 
+import (
+	"context"
+	"sync/atomic"
+)
+
 // FixedNoOrderPool .
 type FixedNoOrderPool struct {
+	stopper
+	resizer
 	chTask chan func()
+	policy RejectPolicy
+	stats  *poolStats
 }
 
 func (np *FixedNoOrderPool) taskLoop() {
-	for f := range np.chTask {
-		call(f)
+	defer np.wg.Done()
+	for {
+		select {
+		case f := <-np.chTask:
+			np.stats.call(f)
+		case <-np.chWake:
+		case <-np.chClose:
+			np.drain(np.chTask)
+			return
+		}
+		if np.exit() {
+			return
+		}
 	}
 }
 
-// Go .
+func (np *FixedNoOrderPool) startWorker() {
+	np.wg.Add(1)
+	go np.taskLoop()
+}
+
+// Go pushes f by the RejectPolicy, it blocks until the pool has room by default.
 func (np *FixedNoOrderPool) Go(f func()) {
-	np.chTask <- f
+	np.Submit(f)
 }
 
 // GoByIndex .
@@ -25,19 +50,111 @@ func (np *FixedNoOrderPool) GoByIndex(index int, f func()) {
 	np.Go(f)
 }
 
-// Stop .
-func (np *FixedNoOrderPool) Stop() {
-	close(np.chTask)
+// Submit pushes f by the RejectPolicy, it returns ErrPoolFull if f is rejected by RejectError.
+func (np *FixedNoOrderPool) Submit(f func()) error {
+	if !np.lockPush() {
+		return ErrStopped
+	}
+	defer np.unlockPush()
+	f = np.stats.task(f)
+	if np.policy == RejectBlock {
+		return np.push(f)
+	}
+	return submit(np.policy, f, np.tryPush, np.push, np.dropOldest)
+}
+
+// TryGo pushes f without blocking, it returns ErrPoolFull if the pool is full.
+func (np *FixedNoOrderPool) TryGo(f func()) error {
+	if !np.lockPush() {
+		return ErrStopped
+	}
+	defer np.unlockPush()
+	if !np.tryPush(np.stats.task(f)) {
+		return ErrPoolFull
+	}
+	return nil
+}
+
+// GoContext pushes f, it blocks until the pool has room or ctx is done.
+func (np *FixedNoOrderPool) GoContext(ctx context.Context, f func()) error {
+	if !np.lockPush() {
+		return ErrStopped
+	}
+	defer np.unlockPush()
+	select {
+	case np.chTask <- np.stats.task(f):
+		return nil
+	case <-np.chClose:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetRejectPolicy sets the policy of Go and Submit when the pool is full,
+// it should be called before pushing tasks.
+func (np *FixedNoOrderPool) SetRejectPolicy(policy RejectPolicy) {
+	np.policy = policy
+}
+
+// SetTiming enables recording the WaitTime and ExecTime of the tasks pushed after it.
+func (np *FixedNoOrderPool) SetTiming(enable bool) {
+	np.stats.setTiming(enable)
+}
+
+func (np *FixedNoOrderPool) tryPush(f func()) bool {
+	return tryPushChan(np.chTask, f)
+}
+
+func (np *FixedNoOrderPool) push(f func()) error {
+	select {
+	case np.chTask <- f:
+		return nil
+	case <-np.chClose:
+		return ErrStopped
+	}
+}
+
+func (np *FixedNoOrderPool) dropOldest() {
+	dropOldestChan(np.chTask)
+}
+
+// Stats .
+func (np *FixedNoOrderPool) Stats() Stats {
+	return np.stats.snapshot(int(atomic.LoadInt32(&np.size)), len(np.chTask))
+}
+
+// Resize changes the number of the workers.
+func (np *FixedNoOrderPool) Resize(size int) error {
+	if size <= 0 {
+		return ErrInvalidSize
+	}
+	if !np.lockPush() {
+		return ErrStopped
+	}
+	defer np.unlockPush()
+	np.resize(size, np.startWorker)
+	return nil
+}
+
+// Stop rejects the new tasks and runs the queued ones until they are done or ctx is done,
+// it returns the number of the queued tasks that are abandoned.
+func (np *FixedNoOrderPool) Stop(ctx context.Context) int {
+	return np.stop(ctx, np.chTask)
 }
 
 // NewFixedNoOrderPool .
 func NewFixedNoOrderPool(size int, bufferSize int) *FixedNoOrderPool {
 	np := &FixedNoOrderPool{
 		chTask: make(chan func(), bufferSize),
+		stats:  newPoolStats(),
 	}
+	np.init(np.stats.call)
+	np.initSize(size)
 
+	np.workers = int32(size)
 	for i := 0; i < size; i++ {
-		go np.taskLoop()
+		np.startWorker()
 	}
 
 	return np
@@ -5,43 +5,30 @@
 package taskpool
 
 import (
-	"sync"
-	"sync/atomic"
+	"context"
 )
 
 // fixedRunner .
 type fixedRunner struct {
-	wg *sync.WaitGroup
+	parent *FixedPool
 
 	chTask   chan func()
 	chTaskBy chan func()
-	chClose  chan struct{}
 }
 
 func (r *fixedRunner) taskLoop() {
-	defer r.wg.Done()
-
-	// run all tasks
-	defer func() {
-		for {
-			select {
-			case f := <-r.chTaskBy:
-				call(f)
-			case f := <-r.chTask:
-				call(f)
-			default:
-				return
-			}
-		}
-	}()
+	defer r.parent.wg.Done()
 
 	for {
 		select {
 		case f := <-r.chTaskBy:
-			call(f)
+			r.parent.stats.call(f)
 		case f := <-r.chTask:
-			call(f)
-		case <-r.chClose:
+			r.parent.stats.call(f)
+		case <-r.parent.chClose:
+			// run the tasks left, the tasks of the same index first to keep them in order.
+			r.parent.drain(r.chTaskBy)
+			r.parent.drain(r.chTask)
 			return
 		}
 	}
@@ -49,22 +36,32 @@ func (r *fixedRunner) taskLoop() {
 
 // FixedPool .
 type FixedPool struct {
-	wg      *sync.WaitGroup
-	stopped int32
+	stopper
 
-	chTask  chan func()
-	chClose chan struct{}
+	chTask chan func()
+	policy RejectPolicy
+	stats  *poolStats
 
 	runners []*fixedRunner
 }
 
-func (tp *FixedPool) push(f func()) {
+func (tp *FixedPool) push(f func()) error {
 	select {
 	case tp.chTask <- f:
+		return nil
 	case <-tp.chClose:
+		return ErrStopped
 	}
 }
 
+func (tp *FixedPool) tryPush(f func()) bool {
+	return tryPushChan(tp.chTask, f)
+}
+
+func (tp *FixedPool) dropOldest() {
+	dropOldestChan(tp.chTask)
+}
+
 func (tp *FixedPool) pushByIndex(index int, f func()) {
 	r := tp.runners[uint32(index)%uint32(len(tp.runners))]
 	select {
@@ -73,50 +70,114 @@ func (tp *FixedPool) pushByIndex(index int, f func()) {
 	}
 }
 
-// Go .
+// Go pushes f by the RejectPolicy, it blocks until the pool has room by default.
 func (tp *FixedPool) Go(f func()) {
-	if atomic.LoadInt32(&tp.stopped) == 1 {
-		return
-	}
-	tp.push(f)
+	tp.Submit(f)
 }
 
-// GoByIndex .
+// GoByIndex pushes f to the runner of index, it blocks until the runner has room.
 func (tp *FixedPool) GoByIndex(index int, f func()) {
-	if atomic.LoadInt32(&tp.stopped) == 1 {
+	if !tp.lockPush() {
 		return
 	}
-	tp.pushByIndex(index, f)
+	defer tp.unlockPush()
+	tp.pushByIndex(index, tp.stats.task(f))
+}
+
+// Submit pushes f by the RejectPolicy, it returns ErrPoolFull if f is rejected by RejectError.
+func (tp *FixedPool) Submit(f func()) error {
+	if !tp.lockPush() {
+		return ErrStopped
+	}
+	defer tp.unlockPush()
+	f = tp.stats.task(f)
+	if tp.policy == RejectBlock {
+		return tp.push(f)
+	}
+	return submit(tp.policy, f, tp.tryPush, tp.push, tp.dropOldest)
+}
+
+// TryGo pushes f without blocking, it returns ErrPoolFull if the pool is full.
+func (tp *FixedPool) TryGo(f func()) error {
+	if !tp.lockPush() {
+		return ErrStopped
+	}
+	defer tp.unlockPush()
+	if !tp.tryPush(tp.stats.task(f)) {
+		return ErrPoolFull
+	}
+	return nil
+}
+
+// GoContext pushes f, it blocks until the pool has room or ctx is done.
+func (tp *FixedPool) GoContext(ctx context.Context, f func()) error {
+	if !tp.lockPush() {
+		return ErrStopped
+	}
+	defer tp.unlockPush()
+	select {
+	case tp.chTask <- tp.stats.task(f):
+		return nil
+	case <-tp.chClose:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetRejectPolicy sets the policy of Go and Submit when the pool is full,
+// it should be called before pushing tasks.
+func (tp *FixedPool) SetRejectPolicy(policy RejectPolicy) {
+	tp.policy = policy
+}
+
+// SetTiming enables recording the WaitTime and ExecTime of the tasks pushed after it.
+func (tp *FixedPool) SetTiming(enable bool) {
+	tp.stats.setTiming(enable)
+}
+
+// Stats .
+func (tp *FixedPool) Stats() Stats {
+	queued := len(tp.chTask)
+	for _, r := range tp.runners {
+		queued += len(r.chTaskBy)
+	}
+	return tp.stats.snapshot(len(tp.runners), queued)
+}
+
+// Resize returns ErrNotResizable, GoByIndex depends on the number of the runners to keep the tasks in order,
+// use a FixedNoOrderPool, a MixedPool or a KeyedPool to change the concurrency at runtime.
+func (tp *FixedPool) Resize(size int) error {
+	return ErrNotResizable
 }
 
-// Stop .
-func (tp *FixedPool) Stop() {
-	if atomic.CompareAndSwapInt32(&tp.stopped, 0, 1) {
-		close(tp.chClose)
-		tp.wg.Done()
-		tp.wg.Wait()
+// Stop rejects the new tasks and runs the queued ones until they are done or ctx is done,
+// it returns the number of the queued tasks that are abandoned.
+func (tp *FixedPool) Stop(ctx context.Context) int {
+	chs := []chan func(){tp.chTask}
+	for _, r := range tp.runners {
+		chs = append(chs, r.chTaskBy)
 	}
+	return tp.stop(ctx, chs...)
 }
 
 // NewFixedPool .
 func NewFixedPool(size int, bufferSize int) *FixedPool {
 	tp := &FixedPool{
-		wg:      &sync.WaitGroup{},
 		chTask:  make(chan func(), bufferSize),
-		chClose: make(chan struct{}),
+		stats:   newPoolStats(),
 		runners: make([]*fixedRunner, size),
 	}
-	tp.wg.Add(1)
+	tp.init(tp.stats.call)
 
+	tp.wg.Add(size)
 	for i := 0; i < size; i++ {
 		r := &fixedRunner{
-			wg:       tp.wg,
+			parent:   tp,
 			chTask:   tp.chTask,
 			chTaskBy: make(chan func(), bufferSize),
-			chClose:  tp.chClose,
 		}
 		tp.runners[i] = r
-		tp.wg.Add(1)
 		go r.taskLoop()
 	}
 
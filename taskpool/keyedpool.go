@@ -0,0 +1,247 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package taskpool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull .
+	ErrQueueFull = errors.New("queue full")
+)
+
+// keyedQueue is the pending tasks of a key.
+type keyedQueue struct {
+	tasks      []func()
+	running    bool
+	lastActive time.Time
+}
+
+// KeyedPool runs the tasks of the same key in submission order like Conn.Execute does for a conn,
+// and the tasks of different keys in parallel on a fixed number of workers.
+type KeyedPool struct {
+	wg      sync.WaitGroup
+	mux     sync.Mutex
+	cond    *sync.Cond
+	stopped bool
+
+	queues map[interface{}]*keyedQueue
+	ready  []*keyedQueue
+
+	size    int
+	workers int
+	stats   *poolStats
+
+	maxQueueSize int
+	maxIdleTime  time.Duration
+	chClose      chan struct{}
+}
+
+// Go pushes f to the queue of key, it returns ErrQueueFull if the queue has
+// maxQueueSize tasks waiting, or ErrStopped if the pool has been stopped.
+func (kp *KeyedPool) Go(key interface{}, f func()) error {
+	kp.mux.Lock()
+	defer kp.mux.Unlock()
+	if kp.stopped {
+		return ErrStopped
+	}
+	q, ok := kp.queues[key]
+	if !ok {
+		q = &keyedQueue{}
+		kp.queues[key] = q
+	}
+	if kp.maxQueueSize > 0 && len(q.tasks) >= kp.maxQueueSize {
+		return ErrQueueFull
+	}
+	q.tasks = append(q.tasks, kp.stats.task(f))
+	if !q.running {
+		q.running = true
+		kp.ready = append(kp.ready, q)
+		kp.cond.Signal()
+	}
+	return nil
+}
+
+// Len returns the number of the waiting tasks of key.
+func (kp *KeyedPool) Len(key interface{}) int {
+	kp.mux.Lock()
+	defer kp.mux.Unlock()
+	if q, ok := kp.queues[key]; ok {
+		return len(q.tasks)
+	}
+	return 0
+}
+
+// SetTiming enables recording the WaitTime and ExecTime of the tasks pushed after it.
+func (kp *KeyedPool) SetTiming(enable bool) {
+	kp.stats.setTiming(enable)
+}
+
+// Stats .
+func (kp *KeyedPool) Stats() Stats {
+	kp.mux.Lock()
+	size := kp.size
+	queued := 0
+	for _, q := range kp.queues {
+		queued += len(q.tasks)
+	}
+	kp.mux.Unlock()
+	return kp.stats.snapshot(size, queued)
+}
+
+// Resize changes the number of the workers, the extra workers exit after their current tasks.
+func (kp *KeyedPool) Resize(size int) error {
+	if size <= 0 {
+		return ErrInvalidSize
+	}
+	kp.mux.Lock()
+	defer kp.mux.Unlock()
+	if kp.stopped {
+		return ErrStopped
+	}
+	kp.size = size
+	for kp.workers < kp.size {
+		kp.startWorker()
+	}
+	if kp.workers > kp.size {
+		kp.cond.Broadcast()
+	}
+	return nil
+}
+
+// Stop rejects the new tasks and runs the waiting ones until they are done or ctx is done,
+// it returns the number of the waiting tasks that are abandoned.
+func (kp *KeyedPool) Stop(ctx context.Context) int {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	kp.mux.Lock()
+	if kp.stopped {
+		kp.mux.Unlock()
+		return 0
+	}
+	kp.stopped = true
+	close(kp.chClose)
+	kp.cond.Broadcast()
+	kp.mux.Unlock()
+
+	chDone := make(chan struct{})
+	go func() {
+		kp.wg.Wait()
+		close(chDone)
+	}()
+	select {
+	case <-chDone:
+		return 0
+	case <-ctx.Done():
+	}
+
+	kp.mux.Lock()
+	defer kp.mux.Unlock()
+	abandoned := 0
+	for _, q := range kp.queues {
+		abandoned += len(q.tasks)
+		q.tasks = nil
+	}
+	kp.ready = nil
+	return abandoned
+}
+
+// startWorker must be called with kp.mux held.
+func (kp *KeyedPool) startWorker() {
+	kp.workers++
+	kp.wg.Add(1)
+	go kp.worker()
+}
+
+func (kp *KeyedPool) worker() {
+	defer kp.wg.Done()
+
+	kp.mux.Lock()
+	for {
+		for len(kp.ready) == 0 || kp.workers > kp.size {
+			if kp.stopped || kp.workers > kp.size {
+				kp.workers--
+				kp.mux.Unlock()
+				return
+			}
+			kp.cond.Wait()
+		}
+		q := kp.ready[0]
+		kp.ready[0] = nil
+		kp.ready = kp.ready[1:]
+		f := q.tasks[0]
+		q.tasks[0] = nil
+		q.tasks = q.tasks[1:]
+		kp.mux.Unlock()
+
+		kp.stats.call(f)
+
+		kp.mux.Lock()
+		q.lastActive = time.Now()
+		if len(q.tasks) > 0 {
+			// requeue the key behind the others, a busy key should not starve them.
+			kp.ready = append(kp.ready, q)
+		} else {
+			q.running = false
+			q.tasks = nil
+		}
+	}
+}
+
+// evictLoop deletes the keys that have no task for maxIdleTime.
+func (kp *KeyedPool) evictLoop() {
+	defer kp.wg.Done()
+
+	ticker := time.NewTicker(kp.maxIdleTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			kp.mux.Lock()
+			for key, q := range kp.queues {
+				if !q.running && now.Sub(q.lastActive) >= kp.maxIdleTime {
+					delete(kp.queues, key)
+				}
+			}
+			kp.mux.Unlock()
+		case <-kp.chClose:
+			return
+		}
+	}
+}
+
+// NewKeyedPool returns a KeyedPool with size workers.
+// A key's queue holds maxQueueSize tasks at most, 0 means no limit,
+// and the key is evicted after it has no task for maxIdleTime, 0 means a minute.
+func NewKeyedPool(size int, maxQueueSize int, maxIdleTime time.Duration) *KeyedPool {
+	if size <= 0 {
+		size = 1
+	}
+	if maxIdleTime <= 0 {
+		maxIdleTime = time.Minute
+	}
+	kp := &KeyedPool{
+		queues:       map[interface{}]*keyedQueue{},
+		maxQueueSize: maxQueueSize,
+		maxIdleTime:  maxIdleTime,
+		chClose:      make(chan struct{}),
+		size:         size,
+		stats:        newPoolStats(),
+	}
+	kp.cond = sync.NewCond(&kp.mux)
+	kp.mux.Lock()
+	for i := 0; i < size; i++ {
+		kp.startWorker()
+	}
+	kp.mux.Unlock()
+	kp.wg.Add(1)
+	go kp.evictLoop()
+	return kp
+}
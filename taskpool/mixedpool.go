@@ -5,11 +5,8 @@
 package taskpool
 
 import (
-	"runtime"
+	"context"
 	"sync/atomic"
-	"unsafe"
-
-	"github.com/lesismal/nbio/logging"
 )
 
 // MixedPool .
@@ -17,55 +14,98 @@ type MixedPool struct {
 	*FixedNoOrderPool
 	cuncurrent int32
 	nativeSize int32
-	call       func(f func())
-}
-
-func (mp *MixedPool) callWithRecover(f func()) {
-	defer func() {
-		if err := recover(); err != nil {
-			const size = 64 << 10
-			buf := make([]byte, size)
-			buf = buf[:runtime.Stack(buf, false)]
-			logging.Error("taskpool call failed: %v\n%v\n", err, *(*string)(unsafe.Pointer(&buf)))
-		}
-		atomic.AddInt32(&mp.cuncurrent, -1)
-	}()
-	f()
+	taskCall   func(f func()) bool
 }
 
-func (mp *MixedPool) callWitoutRecover(f func()) {
-	defer atomic.AddInt32(&mp.cuncurrent, -1)
-	f()
-}
-
-// Go .
-func (mp *MixedPool) Go(f func()) {
-	if atomic.AddInt32(&mp.cuncurrent, 1) <= mp.nativeSize {
+// goNative runs f on a new goroutine if the number of the native goroutines is less than nativeSize,
+// the native goroutines are waited by Stop as the workers.
+func (mp *MixedPool) goNative(f func()) bool {
+	if !mp.lockPush() {
+		return false
+	}
+	defer mp.unlockPush()
+	if atomic.AddInt32(&mp.cuncurrent, 1) <= atomic.LoadInt32(&mp.nativeSize) {
+		f = mp.stats.task(f)
+		mp.wg.Add(1)
 		go func() {
-			mp.call(f)
-			for len(mp.chTask) > 0 {
+			// the goroutine is counted once however many tasks it runs.
+			defer func() {
+				atomic.AddInt32(&mp.cuncurrent, -1)
+				mp.wg.Done()
+			}()
+			mp.stats.run(f, mp.taskCall)
+			// the queued tasks are run until the pool is stopped, the ones left after Stop
+			// are run by the workers until the ctx of Stop is done.
+			for len(mp.chTask) > 0 && !mp.isStopped() {
 				select {
 				case f = <-mp.chTask:
-					mp.call(f)
+					mp.stats.call(f)
 				default:
 					return
 				}
 			}
 		}()
-	} else {
-		atomic.AddInt32(&mp.cuncurrent, -1)
+		return true
+	}
+	atomic.AddInt32(&mp.cuncurrent, -1)
+	return false
+}
+
+// Go .
+func (mp *MixedPool) Go(f func()) {
+	if !mp.goNative(f) {
 		mp.FixedNoOrderPool.Go(f)
 	}
 }
 
+// Submit .
+func (mp *MixedPool) Submit(f func()) error {
+	if mp.goNative(f) {
+		return nil
+	}
+	return mp.FixedNoOrderPool.Submit(f)
+}
+
+// TryGo .
+func (mp *MixedPool) TryGo(f func()) error {
+	if mp.goNative(f) {
+		return nil
+	}
+	return mp.FixedNoOrderPool.TryGo(f)
+}
+
+// GoContext .
+func (mp *MixedPool) GoContext(ctx context.Context, f func()) error {
+	if mp.goNative(f) {
+		return nil
+	}
+	return mp.FixedNoOrderPool.GoContext(ctx, f)
+}
+
 // GoByIndex .
 func (mp *MixedPool) GoByIndex(index int, f func()) {
 	mp.Go(f)
 }
 
-// Stop .
-func (mp *MixedPool) Stop() {
-	close(mp.chTask)
+// Stats .
+func (mp *MixedPool) Stats() Stats {
+	stats := mp.FixedNoOrderPool.Stats()
+	stats.Size += int(atomic.LoadInt32(&mp.nativeSize))
+	return stats
+}
+
+// Resize changes the max number of the native goroutines to size minus the fixed workers,
+// it returns ErrInvalidSize if size is less than the fixed workers.
+func (mp *MixedPool) Resize(size int) error {
+	fixedSize := int(atomic.LoadInt32(&mp.FixedNoOrderPool.size))
+	if size < fixedSize {
+		return ErrInvalidSize
+	}
+	if mp.isStopped() {
+		return ErrStopped
+	}
+	atomic.StoreInt32(&mp.nativeSize, int32(size-fixedSize))
+	return nil
 }
 
 // NewMixedPool .
@@ -74,10 +114,10 @@ func NewMixedPool(nativeSize int, fixedSize int, bufferSize int, v ...interface{
 		FixedNoOrderPool: NewFixedNoOrderPool(fixedSize, bufferSize),
 		nativeSize:       int32(nativeSize),
 	}
-	mp.call = mp.callWithRecover
+	mp.taskCall = call
 	if len(v) > 0 {
 		if withoutRecover, ok := v[0].(bool); ok && withoutRecover {
-			mp.call = mp.callWitoutRecover
+			mp.taskCall = callWithoutRecover
 		}
 	}
 	return mp
@@ -0,0 +1,89 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package taskpool
+
+import (
+	"errors"
+)
+
+var (
+	// ErrPoolFull .
+	ErrPoolFull = errors.New("pool full")
+)
+
+// RejectPolicy decides what to do with a task pushed to a full pool.
+type RejectPolicy int
+
+const (
+	// RejectBlock blocks the caller until the pool has room, it's the default policy.
+	RejectBlock RejectPolicy = iota
+
+	// RejectCallerRuns runs the task on the caller's goroutine.
+	RejectCallerRuns
+
+	// RejectDropNewest drops the task being pushed silently.
+	RejectDropNewest
+
+	// RejectDropOldest drops the oldest waiting task to make room for the task being pushed.
+	RejectDropOldest
+
+	// RejectError drops the task being pushed and returns ErrPoolFull by Submit.
+	RejectError
+)
+
+// String .
+func (p RejectPolicy) String() string {
+	switch p {
+	case RejectBlock:
+		return "block"
+	case RejectCallerRuns:
+		return "caller-runs"
+	case RejectDropNewest:
+		return "drop-newest"
+	case RejectDropOldest:
+		return "drop-oldest"
+	case RejectError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// submit pushes f by the policy if tryPush can't push it without blocking.
+func submit(policy RejectPolicy, f func(), tryPush func(f func()) bool, push func(f func()) error, dropOldest func()) error {
+	if tryPush(f) {
+		return nil
+	}
+	switch policy {
+	case RejectCallerRuns:
+		call(f)
+	case RejectDropNewest:
+	case RejectDropOldest:
+		for !tryPush(f) {
+			dropOldest()
+		}
+	case RejectError:
+		return ErrPoolFull
+	default:
+		return push(f)
+	}
+	return nil
+}
+
+func tryPushChan(ch chan func(), f func()) bool {
+	select {
+	case ch <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+func dropOldestChan(ch chan func()) {
+	select {
+	case <-ch:
+	default:
+	}
+}
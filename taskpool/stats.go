@@ -0,0 +1,238 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package taskpool
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrNotResizable .
+	ErrNotResizable = errors.New("not resizable")
+
+	// ErrInvalidSize .
+	ErrInvalidSize = errors.New("invalid size")
+)
+
+// HistogramBounds are the upper bounds of the buckets of Histogram, the last bucket has no upper bound.
+var HistogramBounds = []time.Duration{
+	time.Microsecond * 10,
+	time.Microsecond * 100,
+	time.Millisecond,
+	time.Millisecond * 10,
+	time.Millisecond * 100,
+	time.Second,
+	time.Second * 10,
+}
+
+const histogramBuckets = 8
+
+// Histogram counts durations by HistogramBounds.
+type Histogram struct {
+	// Counts has a bucket for each of HistogramBounds and one for the larger durations.
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// Mean .
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Percentile returns the upper bound of the bucket that the p (0-1) percentile falls in,
+// it returns -1 if the percentile falls in the last bucket that has no upper bound.
+func (h Histogram) Percentile(p float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	want := uint64(p * float64(h.Count))
+	if want >= h.Count {
+		want = h.Count - 1
+	}
+	n := uint64(0)
+	for i, c := range h.Counts {
+		n += c
+		if n > want && i < len(HistogramBounds) {
+			return HistogramBounds[i]
+		}
+	}
+	return -1
+}
+
+// Stats is a snapshot of a pool.
+type Stats struct {
+	// Size is the max number of the goroutines running tasks.
+	Size int
+
+	// Running is the number of the goroutines running tasks.
+	Running int
+
+	// Queued is the number of the tasks waiting for a goroutine.
+	Queued int
+
+	// Completed is the number of the tasks done, including the panicked ones.
+	Completed uint64
+
+	// Panicked is the number of the tasks that panicked.
+	Panicked uint64
+
+	// WaitTime is the time from a task is pushed to it starts, it's recorded after SetTiming(true).
+	WaitTime Histogram
+
+	// ExecTime is the time a task runs, it's recorded after SetTiming(true).
+	ExecTime Histogram
+}
+
+type histogram struct {
+	counts [histogramBuckets]uint64
+	count  uint64
+	sum    int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(HistogramBounds) && d > HistogramBounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Counts: make([]uint64, histogramBuckets),
+		Count:  atomic.LoadUint64(&h.count),
+		Sum:    time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+	for i := range s.Counts {
+		s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return s
+}
+
+// poolStats is allocated alone to keep the 64-bit atomic fields aligned.
+type poolStats struct {
+	completed uint64
+	panicked  uint64
+	running   int64
+	wait      histogram
+	exec      histogram
+	timing    int32
+}
+
+func newPoolStats() *poolStats {
+	return &poolStats{}
+}
+
+func (s *poolStats) setTiming(enable bool) {
+	v := int32(0)
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&s.timing, v)
+}
+
+// task wraps f to record the time it waits and runs if the timing is enabled, or returns f,
+// so the tasks cost no closure and no time.Now by default.
+func (s *poolStats) task(f func()) func() {
+	if atomic.LoadInt32(&s.timing) == 0 {
+		return f
+	}
+	pushed := time.Now()
+	return func() {
+		start := time.Now()
+		s.wait.observe(start.Sub(pushed))
+		defer func() {
+			s.exec.observe(time.Since(start))
+		}()
+		f()
+	}
+}
+
+// run runs the task f by call and counts it, it returns whether f panicked.
+func (s *poolStats) run(f func(), call func(f func()) bool) bool {
+	atomic.AddInt64(&s.running, 1)
+	panicked := true
+	defer func() {
+		atomic.AddInt64(&s.running, -1)
+		atomic.AddUint64(&s.completed, 1)
+		if panicked {
+			atomic.AddUint64(&s.panicked, 1)
+		}
+	}()
+	panicked = call(f)
+	return panicked
+}
+
+// call runs the task f with the panic recovered and counts it, it's the call of the workers.
+func (s *poolStats) call(f func()) bool {
+	return s.run(f, call)
+}
+
+func (s *poolStats) snapshot(size int, queued int) Stats {
+	return Stats{
+		Size:      size,
+		Running:   int(atomic.LoadInt64(&s.running)),
+		Queued:    queued,
+		Completed: atomic.LoadUint64(&s.completed),
+		Panicked:  atomic.LoadUint64(&s.panicked),
+		WaitTime:  s.wait.snapshot(),
+		ExecTime:  s.exec.snapshot(),
+	}
+}
+
+// resizer keeps the number of the workers at size, the workers exit by exit when there are too many.
+type resizer struct {
+	size    int32
+	workers int32
+	chWake  chan struct{}
+}
+
+func (r *resizer) initSize(size int) {
+	r.size = int32(size)
+	r.chWake = make(chan struct{}, 64)
+}
+
+// exit returns true and takes the worker off if there are more workers than size.
+func (r *resizer) exit() bool {
+	for {
+		workers := atomic.LoadInt32(&r.workers)
+		if workers <= atomic.LoadInt32(&r.size) {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&r.workers, workers, workers-1) {
+			return true
+		}
+	}
+}
+
+// resize sets size, starts the missing workers and wakes the idle workers to exit if there are too many.
+func (r *resizer) resize(size int, start func()) {
+	atomic.StoreInt32(&r.size, int32(size))
+	for {
+		workers := atomic.LoadInt32(&r.workers)
+		if workers >= int32(size) {
+			for i := int32(size); i < workers; i++ {
+				select {
+				case r.chWake <- struct{}{}:
+				default:
+					// the others exit after their next tasks.
+					return
+				}
+			}
+			return
+		}
+		if atomic.CompareAndSwapInt32(&r.workers, workers, workers+1) {
+			start()
+		}
+	}
+}
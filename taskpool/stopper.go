@@ -0,0 +1,152 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package taskpool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Pool is implemented by all the task pools.
+type Pool interface {
+	// Go pushes f by the RejectPolicy, f is dropped if the pool has been stopped.
+	Go(f func())
+
+	// GoByIndex pushes f, the pools that run tasks in order run the tasks of the same index in order.
+	GoByIndex(index int, f func())
+
+	// Submit pushes f by the RejectPolicy, it returns ErrPoolFull if f is rejected by RejectError.
+	Submit(f func()) error
+
+	// TryGo pushes f without blocking, it returns ErrPoolFull if the pool is full.
+	TryGo(f func()) error
+
+	// GoContext pushes f, it blocks until the pool has room or ctx is done.
+	GoContext(ctx context.Context, f func()) error
+
+	// SetRejectPolicy sets the policy of Go and Submit when the pool is full.
+	SetRejectPolicy(policy RejectPolicy)
+
+	// SetTiming enables recording the WaitTime and ExecTime of the tasks pushed after it, which costs
+	// a closure and two time.Now per task, it's disabled by default. The counters are always recorded.
+	SetTiming(enable bool)
+
+	// Stats returns a snapshot of the pool.
+	Stats() Stats
+
+	// Resize changes the max number of the goroutines running tasks at runtime. FixedPool is excluded
+	// on purpose and returns ErrNotResizable: GoByIndex maps an index to a runner by the number of the
+	// runners, so changing it would run the tasks of an index queued before and after it out of order.
+	Resize(size int) error
+
+	// Stop rejects the new tasks and runs the queued ones until they are done or ctx is done,
+	// it returns the number of the queued tasks that are abandoned.
+	Stop(ctx context.Context) int
+}
+
+// stopper rejects the tasks pushed after Stop and lets the workers drain the queued ones.
+type stopper struct {
+	wg sync.WaitGroup
+
+	mux     sync.RWMutex
+	stopped bool
+	closing int32
+	chClose chan struct{}
+	ctx     context.Context
+
+	// call runs a task left after Stop.
+	call func(f func()) bool
+}
+
+func (s *stopper) init(call func(f func()) bool) {
+	s.chClose = make(chan struct{})
+	s.call = call
+}
+
+// lockPush returns false if the pool has been stopped, or holds the read lock
+// until unlockPush, so Stop waits for the tasks being pushed.
+func (s *stopper) lockPush() bool {
+	s.mux.RLock()
+	if s.stopped {
+		s.mux.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (s *stopper) unlockPush() {
+	s.mux.RUnlock()
+}
+
+func (s *stopper) isStopped() bool {
+	return atomic.LoadInt32(&s.closing) == 1
+}
+
+// drain is called by the workers after chClose is closed,
+// it runs the tasks left in ch until ch is empty or the ctx of Stop is done.
+func (s *stopper) drain(ch chan func()) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		default:
+		}
+		select {
+		case f := <-ch:
+			s.call(f)
+		default:
+			return
+		}
+	}
+}
+
+// stop waits for the workers until ctx is done, then discards the tasks left in chs.
+func (s *stopper) stop(ctx context.Context, chs ...chan func()) int {
+	if !atomic.CompareAndSwapInt32(&s.closing, 0, 1) {
+		return 0
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s.ctx = ctx
+	// unblock the pushers waiting for room before waiting for them.
+	close(s.chClose)
+	s.mux.Lock()
+	s.stopped = true
+	s.mux.Unlock()
+
+	chDone := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(chDone)
+	}()
+	select {
+	case <-chDone:
+		// run the tasks left without a worker, such as the ones queued when a TaskPool had no runner.
+		for _, ch := range chs {
+			s.drain(ch)
+		}
+	case <-ctx.Done():
+	}
+
+	abandoned := 0
+	for _, ch := range chs {
+		abandoned += discard(ch)
+	}
+	return abandoned
+}
+
+func discard(ch chan func()) int {
+	n := 0
+	for {
+		select {
+		case <-ch:
+			n++
+		default:
+			return n
+		}
+	}
+}
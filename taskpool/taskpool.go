@@ -5,8 +5,8 @@
 package taskpool
 
 import (
+	"context"
 	"errors"
-	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -21,24 +21,34 @@ type runner struct {
 	parent *TaskPool
 }
 
-func (r *runner) taskLoop(maxIdleTime time.Duration, chTask <-chan func(), chClose <-chan struct{}, f func()) {
-	defer func() {
-		r.parent.wg.Done()
-		<-r.parent.chRunner
-	}()
+func (r *runner) taskLoop(maxIdleTime time.Duration, chTask chan func(), chClose <-chan struct{}, f func()) {
+	tp := r.parent
+	defer tp.wg.Done()
 
-	call(f)
+	if f != nil {
+		tp.stats.call(f)
+	}
 
 	timer := time.NewTimer(maxIdleTime)
 	defer timer.Stop()
-	for r.parent.running {
+	for {
+		if tp.exit() {
+			return
+		}
 		select {
 		case f := <-chTask:
-			call(f)
+			tp.stats.call(f)
 			timer.Reset(maxIdleTime)
 		case <-timer.C:
-			return
+			tp.release()
+			// a task may be queued after the select and before the release.
+			if len(chTask) == 0 || !tp.acquire() {
+				return
+			}
+			timer.Reset(maxIdleTime)
 		case <-chClose:
+			tp.drain(chTask)
+			tp.release()
 			return
 		}
 	}
@@ -46,34 +56,172 @@ func (r *runner) taskLoop(maxIdleTime time.Duration, chTask <-chan func(), chClo
 
 // TaskPool .
 type TaskPool struct {
-	wg      *sync.WaitGroup
-	running bool
-	stopped int32
+	stopper
 
-	chTask   chan func()
-	chRunner chan struct{}
-	chClose  chan struct{}
+	size    int32
+	runners int32
+	chTask  chan func()
 
 	maxIdleTime time.Duration
+	policy      RejectPolicy
+	stats       *poolStats
+}
+
+// acquire takes a runner slot if there are less runners than size.
+func (tp *TaskPool) acquire() bool {
+	for {
+		runners := atomic.LoadInt32(&tp.runners)
+		if runners >= atomic.LoadInt32(&tp.size) {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&tp.runners, runners, runners+1) {
+			return true
+		}
+	}
+}
+
+func (tp *TaskPool) release() {
+	atomic.AddInt32(&tp.runners, -1)
+}
+
+// exit returns true and releases the runner slot if there are more runners than size.
+func (tp *TaskPool) exit() bool {
+	for {
+		runners := atomic.LoadInt32(&tp.runners)
+		if runners <= atomic.LoadInt32(&tp.size) {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&tp.runners, runners, runners-1) {
+			return true
+		}
+	}
 }
 
-func (tp *TaskPool) push(f func()) {
+func (tp *TaskPool) push(f func()) error {
+	if tp.acquire() {
+		tp.goRunner(f)
+		return nil
+	}
 	select {
 	case tp.chTask <- f:
-	case tp.chRunner <- struct{}{}:
-		r := &runner{parent: tp}
-		tp.wg.Add(1)
-		go r.taskLoop(tp.maxIdleTime, tp.chTask, tp.chClose, f)
 	case <-tp.chClose:
+		return ErrStopped
+	}
+	tp.wakeRunner()
+	return nil
+}
+
+func (tp *TaskPool) tryPush(f func()) bool {
+	if tp.acquire() {
+		tp.goRunner(f)
+		return true
 	}
+	if !tryPushChan(tp.chTask, f) {
+		return false
+	}
+	tp.wakeRunner()
+	return true
+}
+
+// wakeRunner starts a runner for the queued tasks if all the runners exited before they were queued.
+func (tp *TaskPool) wakeRunner() {
+	if tp.acquire() {
+		tp.goRunner(nil)
+	}
+}
+
+func (tp *TaskPool) goRunner(f func()) {
+	r := &runner{parent: tp}
+	tp.wg.Add(1)
+	go r.taskLoop(tp.maxIdleTime, tp.chTask, tp.chClose, f)
+}
+
+func (tp *TaskPool) dropOldest() {
+	dropOldestChan(tp.chTask)
 }
 
-// Go .
+// Go pushes f by the RejectPolicy, it blocks until the pool has room by default.
 func (tp *TaskPool) Go(f func()) {
-	// if atomic.LoadInt32(&tp.stopped) == 1 {
-	// 	return
-	// }
-	tp.push(f)
+	tp.Submit(f)
+}
+
+// Submit pushes f by the RejectPolicy, it returns ErrPoolFull if f is rejected by RejectError.
+func (tp *TaskPool) Submit(f func()) error {
+	if !tp.lockPush() {
+		return ErrStopped
+	}
+	defer tp.unlockPush()
+	f = tp.stats.task(f)
+	if tp.policy == RejectBlock {
+		return tp.push(f)
+	}
+	return submit(tp.policy, f, tp.tryPush, tp.push, tp.dropOldest)
+}
+
+// TryGo pushes f without blocking, it returns ErrPoolFull if the pool is full.
+func (tp *TaskPool) TryGo(f func()) error {
+	if !tp.lockPush() {
+		return ErrStopped
+	}
+	defer tp.unlockPush()
+	if !tp.tryPush(tp.stats.task(f)) {
+		return ErrPoolFull
+	}
+	return nil
+}
+
+// GoContext pushes f, it blocks until the pool has room or ctx is done.
+func (tp *TaskPool) GoContext(ctx context.Context, f func()) error {
+	if !tp.lockPush() {
+		return ErrStopped
+	}
+	defer tp.unlockPush()
+	f = tp.stats.task(f)
+	if tp.acquire() {
+		tp.goRunner(f)
+		return nil
+	}
+	select {
+	case tp.chTask <- f:
+	case <-tp.chClose:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	tp.wakeRunner()
+	return nil
+}
+
+// SetRejectPolicy sets the policy of Go and Submit when the pool is full,
+// it should be called before pushing tasks.
+func (tp *TaskPool) SetRejectPolicy(policy RejectPolicy) {
+	tp.policy = policy
+}
+
+// SetTiming enables recording the WaitTime and ExecTime of the tasks pushed after it.
+func (tp *TaskPool) SetTiming(enable bool) {
+	tp.stats.setTiming(enable)
+}
+
+// Stats .
+func (tp *TaskPool) Stats() Stats {
+	return tp.stats.snapshot(int(atomic.LoadInt32(&tp.size)), len(tp.chTask))
+}
+
+// Resize changes the max number of the runners, the extra runners exit after their current tasks.
+func (tp *TaskPool) Resize(size int) error {
+	if size <= 0 {
+		return ErrInvalidSize
+	}
+	if !tp.lockPush() {
+		return ErrStopped
+	}
+	defer tp.unlockPush()
+	atomic.StoreInt32(&tp.size, int32(size))
+	for len(tp.chTask) > 0 && tp.acquire() {
+		tp.goRunner(nil)
+	}
+	return nil
 }
 
 // GoByIndex .
@@ -81,14 +229,10 @@ func (tp *TaskPool) GoByIndex(index int, f func()) {
 	tp.Go(f)
 }
 
-// Stop .
-func (tp *TaskPool) Stop() {
-	if atomic.CompareAndSwapInt32(&tp.stopped, 0, 1) {
-		tp.running = false
-		close(tp.chClose)
-		tp.wg.Done()
-		tp.wg.Wait()
-	}
+// Stop rejects the new tasks and runs the queued ones until they are done or ctx is done,
+// it returns the number of the queued tasks that are abandoned.
+func (tp *TaskPool) Stop(ctx context.Context) int {
+	return tp.stop(ctx, tp.chTask)
 }
 
 // New .
@@ -97,14 +241,12 @@ func New(size int, maxIdleTime time.Duration) *TaskPool {
 		maxIdleTime = time.Second * 60
 	}
 	tp := &TaskPool{
-		wg:          &sync.WaitGroup{},
-		running:     true,
+		size:        int32(size),
 		chTask:      make(chan func(), 1024),
-		chRunner:    make(chan struct{}, size),
-		chClose:     make(chan struct{}),
 		maxIdleTime: maxIdleTime,
+		stats:       newPoolStats(),
 	}
-	tp.wg.Add(1)
+	tp.init(tp.stats.call)
 
 	return tp
 }
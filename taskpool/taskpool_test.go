@@ -1,7 +1,9 @@
 package taskpool
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -30,7 +32,7 @@ func BenchmarkGo(b *testing.B) {
 
 func BenchmarkFixedPoolGo(b *testing.B) {
 	p := NewFixedPool(32, 512)
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -52,7 +54,7 @@ func BenchmarkFixedPoolGo(b *testing.B) {
 
 func BenchmarkFixedPoolGoByIndex(b *testing.B) {
 	p := NewFixedPool(32, 512)
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -74,7 +76,7 @@ func BenchmarkFixedPoolGoByIndex(b *testing.B) {
 
 func BenchmarkFixedNoOrderPool(b *testing.B) {
 	p := NewFixedNoOrderPool(32, 1024)
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -96,7 +98,7 @@ func BenchmarkFixedNoOrderPool(b *testing.B) {
 
 func BenchmarkMixedPool(b *testing.B) {
 	p := NewMixedPool(32, 4, 1024)
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -118,7 +120,7 @@ func BenchmarkMixedPool(b *testing.B) {
 
 func BenchmarkTaskPool(b *testing.B) {
 	p := New(32, time.Second*10)
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -137,3 +139,466 @@ func BenchmarkTaskPool(b *testing.B) {
 		wg.Wait()
 	}
 }
+
+func BenchmarkKeyedPool(b *testing.B) {
+	p := NewKeyedPool(32, 0, 0)
+	defer p.Stop(context.Background())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		wg := sync.WaitGroup{}
+		wg.Add(testLoopNum)
+		for j := 0; j < testLoopNum; j++ {
+			p.Go(j%64, func() {
+				if sleepTime > 0 {
+					time.Sleep(sleepTime)
+				}
+				wg.Done()
+			})
+		}
+		wg.Wait()
+	}
+}
+
+func TestKeyedPool(t *testing.T) {
+	const keys, tasks = 8, 1000
+	p := NewKeyedPool(4, 0, 0)
+
+	mux := sync.Mutex{}
+	results := map[int][]int{}
+	for i := 0; i < tasks; i++ {
+		for key := 0; key < keys; key++ {
+			key, i := key, i
+			p.Go(key, func() {
+				if i%100 == 0 {
+					panic("test panic")
+				}
+				mux.Lock()
+				results[key] = append(results[key], i)
+				mux.Unlock()
+			})
+		}
+	}
+	p.Stop(context.Background())
+	for key := 0; key < keys; key++ {
+		if len(results[key]) != tasks-tasks/100 {
+			t.Fatalf("invalid task count of key %v: %v", key, len(results[key]))
+		}
+		for j := 1; j < len(results[key]); j++ {
+			if results[key][j] <= results[key][j-1] {
+				t.Fatalf("tasks of key %v out of order: %v, %v", key, results[key][j-1], results[key][j])
+			}
+		}
+	}
+	if err := p.Go(0, func() {}); err != ErrStopped {
+		t.Fatalf("invalid error after stop: %v", err)
+	}
+}
+
+func TestKeyedPoolLimit(t *testing.T) {
+	p := NewKeyedPool(2, 2, time.Millisecond*20)
+	defer p.Stop(context.Background())
+
+	chBlock := make(chan struct{})
+	chStarted := make(chan struct{})
+	p.Go("a", func() {
+		close(chStarted)
+		<-chBlock
+	})
+	<-chStarted
+	for i := 0; i < 2; i++ {
+		if err := p.Go("a", func() {}); err != nil {
+			t.Fatalf("push failed: %v", err)
+		}
+	}
+	if err := p.Go("a", func() {}); err != ErrQueueFull {
+		t.Fatalf("invalid error of full queue: %v", err)
+	}
+
+	chDone := make(chan struct{})
+	p.Go("b", func() { close(chDone) })
+	select {
+	case <-chDone:
+	case <-time.After(time.Second):
+		t.Fatalf("key b blocked by key a")
+	}
+
+	close(chBlock)
+	time.Sleep(time.Millisecond * 100)
+	if n := p.Len("a"); n != 0 {
+		t.Fatalf("invalid queue length: %v", n)
+	}
+	p.mux.Lock()
+	n := len(p.queues)
+	p.mux.Unlock()
+	if n != 0 {
+		t.Fatalf("idle keys not evicted: %v", n)
+	}
+}
+
+func TestRejectPolicy(t *testing.T) {
+	chBlock := make(chan struct{})
+	block := func() { <-chBlock }
+	newPool := func(policy RejectPolicy) *FixedNoOrderPool {
+		p := NewFixedNoOrderPool(1, 1)
+		p.SetRejectPolicy(policy)
+		chStarted := make(chan struct{})
+		p.Go(func() {
+			close(chStarted)
+			block()
+		})
+		<-chStarted
+		p.Go(block)
+		return p
+	}
+
+	p := newPool(RejectError)
+	if err := p.TryGo(func() {}); err != ErrPoolFull {
+		t.Fatalf("invalid TryGo error: %v", err)
+	}
+	if err := p.Submit(func() {}); err != ErrPoolFull {
+		t.Fatalf("invalid Submit error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err := p.GoContext(ctx, func() {}); err != context.DeadlineExceeded {
+		t.Fatalf("invalid GoContext error: %v", err)
+	}
+
+	p = newPool(RejectCallerRuns)
+	called := false
+	if err := p.Submit(func() { called = true }); err != nil || !called {
+		t.Fatalf("task not run by the caller: %v, %v", err, called)
+	}
+
+	p = newPool(RejectDropNewest)
+	if err := p.Submit(func() { t.Fatalf("dropped task called") }); err != nil {
+		t.Fatalf("invalid Submit error: %v", err)
+	}
+
+	p = newPool(RejectDropOldest)
+	chNewest := make(chan struct{})
+	if err := p.Submit(func() { close(chNewest) }); err != nil {
+		t.Fatalf("invalid Submit error: %v", err)
+	}
+	if len(p.chTask) != 1 {
+		t.Fatalf("invalid queue length: %v", len(p.chTask))
+	}
+
+	tp := New(1, 0)
+	tp.Go(block)
+	for len(tp.chTask) < cap(tp.chTask) {
+		tp.Go(func() {})
+	}
+	if err := tp.TryGo(func() {}); err != ErrPoolFull {
+		t.Fatalf("invalid TaskPool TryGo error: %v", err)
+	}
+
+	close(chBlock)
+	tp.Stop(context.Background())
+}
+
+var testPools = map[string]func(size int) Pool{
+	"TaskPool":         func(size int) Pool { return New(size, 0) },
+	"FixedPool":        func(size int) Pool { return NewFixedPool(size, 16) },
+	"FixedNoOrderPool": func(size int) Pool { return NewFixedNoOrderPool(size, 16) },
+	"MixedPool":        func(size int) Pool { return NewMixedPool(size-1, 1, 16) },
+}
+
+func TestPoolStopConcurrent(t *testing.T) {
+	for name, newPool := range testPools {
+		p := newPool(4)
+		var accepted, executed int64
+		task := func() { atomic.AddInt64(&executed, 1) }
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					var err error
+					switch (i + j) % 4 {
+					case 0:
+						err = p.Submit(task)
+					case 1:
+						err = p.TryGo(task)
+					case 2:
+						err = p.GoContext(context.Background(), task)
+					case 3:
+						p.GoByIndex(j, task)
+						continue
+					}
+					if err == nil {
+						atomic.AddInt64(&accepted, 1)
+					}
+				}
+			}(i)
+		}
+		time.Sleep(time.Millisecond)
+		abandoned := p.Stop(context.Background())
+		wg.Wait()
+		if abandoned != 0 {
+			t.Fatalf("%v: tasks abandoned without deadline: %v", name, abandoned)
+		}
+		if err := p.Submit(task); err != ErrStopped {
+			t.Fatalf("%v: invalid error after stop: %v", name, err)
+		}
+		p.Go(task)
+
+		// the native goroutines of MixedPool are not waited by Stop.
+		for i := 0; i < 100 && atomic.LoadInt64(&executed) < atomic.LoadInt64(&accepted); i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if n := atomic.LoadInt64(&executed); n < atomic.LoadInt64(&accepted) {
+			t.Fatalf("%v: accepted tasks not executed: %v < %v", name, n, accepted)
+		}
+	}
+}
+
+func TestPoolStopDeadline(t *testing.T) {
+	for name, newPool := range testPools {
+		p := newPool(1)
+		chBlock := make(chan struct{})
+		chStarted := make(chan struct{})
+		p.Go(func() {
+			close(chStarted)
+			<-chBlock
+		})
+		var executed int64
+		for i := 0; i < 10; i++ {
+			p.Go(func() { atomic.AddInt64(&executed, 1) })
+		}
+		<-chStarted
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		abandoned := p.Stop(ctx)
+		cancel()
+		close(chBlock)
+		time.Sleep(time.Millisecond * 20)
+		if n := int(atomic.LoadInt64(&executed)) + abandoned; n != 10 {
+			t.Fatalf("%v: invalid executed %v + abandoned %v", name, executed, abandoned)
+		}
+		if abandoned == 0 {
+			t.Fatalf("%v: no task abandoned", name)
+		}
+	}
+}
+
+func TestMixedPoolStopWaitsNative(t *testing.T) {
+	p := NewMixedPool(2, 1, 8)
+	chBlock := make(chan struct{})
+	chStarted := make(chan struct{})
+	var executed int64
+	p.Go(func() {
+		close(chStarted)
+		<-chBlock
+		atomic.AddInt64(&executed, 1)
+	})
+	<-chStarted
+
+	chStopped := make(chan int, 1)
+	go func() {
+		chStopped <- p.Stop(context.Background())
+	}()
+	select {
+	case <-chStopped:
+		t.Fatalf("Stop returned before the native goroutine is done")
+	case <-time.After(time.Millisecond * 20):
+	}
+	close(chBlock)
+	select {
+	case abandoned := <-chStopped:
+		if abandoned != 0 || atomic.LoadInt64(&executed) != 1 {
+			t.Fatalf("invalid executed %v, abandoned %v", executed, abandoned)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("Stop not returned")
+	}
+}
+
+func TestMixedPoolRunning(t *testing.T) {
+	const nativeSize, fixedSize = 2, 2
+	p := NewMixedPool(nativeSize, fixedSize, 64)
+	defer p.Stop(context.Background())
+
+	var running, maxRunning int64
+	for wave := 0; wave < 4; wave++ {
+		// the queued tasks of a burst are drained by the native goroutines too.
+		wg := sync.WaitGroup{}
+		wg.Add(32)
+		for i := 0; i < 32; i++ {
+			p.Go(func() {
+				defer wg.Done()
+				n := atomic.AddInt64(&running, 1)
+				for {
+					max := atomic.LoadInt64(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt64(&maxRunning, max, n) {
+						break
+					}
+				}
+				if n := p.Stats().Running; n > nativeSize+fixedSize {
+					t.Errorf("invalid Running: %v", n)
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt64(&running, -1)
+			})
+		}
+		wg.Wait()
+	}
+	if n := atomic.LoadInt64(&maxRunning); n > nativeSize+fixedSize {
+		t.Fatalf("%v tasks run at the same time, want at most %v", n, nativeSize+fixedSize)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	for name, newPool := range testPools {
+		// the histograms are not recorded by default.
+		p := newPool(2)
+		done := make(chan struct{})
+		p.Go(func() {
+			close(done)
+		})
+		<-done
+		p.Stop(context.Background())
+		stats := p.Stats()
+		for i := 0; i < 100 && stats.Completed < 1; i++ {
+			time.Sleep(time.Millisecond * 10)
+			stats = p.Stats()
+		}
+		if stats.Completed != 1 || stats.WaitTime.Count != 0 || stats.ExecTime.Count != 0 {
+			t.Fatalf("%v: invalid stats without timing: %v, %v, %v", name, stats.Completed, stats.WaitTime.Count, stats.ExecTime.Count)
+		}
+
+		p = newPool(2)
+		p.SetTiming(true)
+		wg := sync.WaitGroup{}
+		wg.Add(10)
+		for i := 0; i < 10; i++ {
+			i := i
+			p.Go(func() {
+				defer wg.Done()
+				time.Sleep(time.Millisecond)
+				if i == 0 {
+					panic("test")
+				}
+			})
+		}
+		wg.Wait()
+		p.Stop(context.Background())
+
+		stats = p.Stats()
+		for i := 0; i < 100 && stats.Completed < 10; i++ {
+			time.Sleep(time.Millisecond * 10)
+			stats = p.Stats()
+		}
+		if stats.Size != 2 {
+			t.Fatalf("%v: invalid Size: %v", name, stats.Size)
+		}
+		if stats.Completed != 10 || stats.Panicked != 1 {
+			t.Fatalf("%v: invalid Completed %v, Panicked %v", name, stats.Completed, stats.Panicked)
+		}
+		if stats.Running != 0 || stats.Queued != 0 {
+			t.Fatalf("%v: invalid Running %v, Queued %v", name, stats.Running, stats.Queued)
+		}
+		if stats.WaitTime.Count != 10 || stats.ExecTime.Count != 10 {
+			t.Fatalf("%v: invalid histogram count: %v, %v", name, stats.WaitTime.Count, stats.ExecTime.Count)
+		}
+		if stats.ExecTime.Mean() < time.Millisecond || stats.ExecTime.Percentile(0.5) < time.Millisecond {
+			t.Fatalf("%v: invalid ExecTime: %v, %v", name, stats.ExecTime.Mean(), stats.ExecTime.Percentile(0.5))
+		}
+	}
+}
+
+func TestPoolResize(t *testing.T) {
+	for name, newPool := range testPools {
+		p := newPool(2)
+		if err := p.Resize(0); err != ErrInvalidSize && err != ErrNotResizable {
+			t.Fatalf("%v: invalid Resize error: %v", name, err)
+		}
+		err := p.Resize(4)
+		if name == "FixedPool" {
+			if err != ErrNotResizable {
+				t.Fatalf("%v: invalid Resize error: %v", name, err)
+			}
+			p.Stop(context.Background())
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: Resize failed: %v", name, err)
+		}
+		if n := p.Stats().Size; n != 4 {
+			t.Fatalf("%v: invalid Size after grow: %v", name, n)
+		}
+
+		// all the 4 tasks run at the same time after growing.
+		chBlock := make(chan struct{})
+		started := sync.WaitGroup{}
+		started.Add(4)
+		for i := 0; i < 4; i++ {
+			p.Go(func() {
+				started.Done()
+				<-chBlock
+			})
+		}
+		started.Wait()
+		if n := p.Stats().Running; n != 4 {
+			t.Fatalf("%v: invalid Running: %v", name, n)
+		}
+
+		if err := p.Resize(1); err != nil {
+			t.Fatalf("%v: Resize failed: %v", name, err)
+		}
+		if n := p.Stats().Size; n != 1 {
+			t.Fatalf("%v: invalid Size after shrink: %v", name, n)
+		}
+		close(chBlock)
+
+		done := sync.WaitGroup{}
+		done.Add(10)
+		for i := 0; i < 10; i++ {
+			p.Go(done.Done)
+		}
+		done.Wait()
+		p.Stop(context.Background())
+		if err := p.Resize(2); err != ErrStopped {
+			t.Fatalf("%v: invalid Resize error after stop: %v", name, err)
+		}
+	}
+}
+
+func TestKeyedPoolResize(t *testing.T) {
+	kp := NewKeyedPool(1, 0, 0)
+	defer kp.Stop(context.Background())
+
+	if err := kp.Resize(3); err != nil {
+		t.Fatalf("Resize failed: %v", err)
+	}
+	chBlock := make(chan struct{})
+	started := sync.WaitGroup{}
+	started.Add(3)
+	for i := 0; i < 3; i++ {
+		kp.Go(i, func() {
+			started.Done()
+			<-chBlock
+		})
+	}
+	started.Wait()
+	kp.Go(0, func() {})
+	if stats := kp.Stats(); stats.Size != 3 || stats.Running != 3 || stats.Queued != 1 {
+		t.Fatalf("invalid Stats: %+v", stats)
+	}
+
+	if err := kp.Resize(1); err != nil {
+		t.Fatalf("Resize failed: %v", err)
+	}
+	close(chBlock)
+	done := make(chan struct{})
+	kp.Go(1, func() { close(done) })
+	<-done
+	if stats := kp.Stats(); stats.Size != 1 {
+		t.Fatalf("invalid Size: %v", stats.Size)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Schedule decides when a Periodic runs.
+type Schedule interface {
+	// Next returns the next time to run after now, the zero time stops the Periodic.
+	Next(now time.Time) time.Time
+}
+
+// Periodic runs a func by a Schedule on the timer loop of a Gopher,
+// the func should not block as the funcs of AfterFunc.
+type Periodic struct {
+	g *Gopher
+	f func()
+
+	mux      sync.Mutex
+	it       *htimer
+	schedule Schedule
+	next     time.Time
+	stopped  bool
+}
+
+// Next returns the time of the next run, or the zero time if p has been stopped.
+func (p *Periodic) Next() time.Time {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.stopped {
+		return time.Time{}
+	}
+	return p.next
+}
+
+// Stop stops p, the func is not called after Stop returns unless it's running.
+func (p *Periodic) Stop() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if !p.stopped {
+		p.stopped = true
+		p.g.removeTimer(p.it)
+	}
+}
+
+// reset replaces the schedule, it must be called with p.mux held.
+func (p *Periodic) reset(s Schedule) {
+	p.g.removeTimer(p.it)
+	p.schedule = s
+	p.stopped = false
+	p.arm(p.g.clock.Now())
+}
+
+// arm pushes the timer by the next time of the schedule, it must be called with p.mux held.
+func (p *Periodic) arm(now time.Time) {
+	p.next = p.schedule.Next(now)
+	if p.next.IsZero() {
+		p.stopped = true
+		return
+	}
+	p.g.pushTimer(p.it, p.next.Sub(now))
+}
+
+func (p *Periodic) fire() {
+	p.mux.Lock()
+	if p.stopped {
+		p.mux.Unlock()
+		return
+	}
+	// arm before running f, so the time f takes doesn't delay the next run.
+	p.arm(p.g.clock.Now())
+	p.mux.Unlock()
+	p.f()
+}
+
+// Schedule runs f by s on the timer loop until the Periodic is stopped.
+func (g *Gopher) Schedule(s Schedule, f func()) *Periodic {
+	p := &Periodic{g: g, f: f, schedule: s}
+	p.it = &htimer{f: p.fire, parent: g}
+	p.mux.Lock()
+	p.arm(g.clock.Now())
+	p.mux.Unlock()
+	return p
+}
+
+// every runs at start+n*interval plus a random jitter, the jitter and the delays
+// of the timer loop are not accumulated.
+type every struct {
+	interval time.Duration
+	jitter   time.Duration
+	base     time.Time
+}
+
+func newEvery(interval, jitter time.Duration) *every {
+	if interval <= 0 {
+		panic("non-positive interval")
+	}
+	if jitter < 0 {
+		jitter = 0
+	}
+	if jitter >= interval {
+		jitter = interval - 1
+	}
+	return &every{interval: interval, jitter: jitter}
+}
+
+func (e *every) Next(now time.Time) time.Time {
+	if e.base.IsZero() {
+		e.base = now
+	}
+	e.base = e.base.Add(e.interval)
+	// skip the runs missed.
+	if late := now.Sub(e.base); late >= 0 {
+		e.base = e.base.Add(late - late%e.interval + e.interval)
+	}
+	if e.jitter > 0 {
+		return e.base.Add(time.Duration(rand.Int63n(int64(e.jitter))))
+	}
+	return e.base
+}
+
+// Every runs f every interval plus a random delay less than jitter, which spreads the funcs
+// started at the same time such as the heartbeats of the conns.
+// The runs are aligned to the start time, so they don't drift with the delays,
+// and the runs missed when the timer loop is busy are skipped.
+func (g *Gopher) Every(interval, jitter time.Duration, f func()) *Periodic {
+	return g.Schedule(newEvery(interval, jitter), f)
+}
+
+// Ticker is used as time.Ticker, the ticks are sent by the timer loop.
+type Ticker struct {
+	C <-chan time.Time
+	p *Periodic
+}
+
+// Stop .
+func (t *Ticker) Stop() {
+	t.p.Stop()
+}
+
+// Reset stops the ticker and resets its period to d.
+func (t *Ticker) Reset(d time.Duration) {
+	s := newEvery(d, 0)
+	t.p.mux.Lock()
+	t.p.reset(s)
+	t.p.mux.Unlock()
+}
+
+// NewTicker is used as time.NewTicker, the ticks are dropped for a slow receiver.
+func (g *Gopher) NewTicker(d time.Duration) *Ticker {
+	c := make(chan time.Time, 1)
+	p := g.Every(d, 0, func() {
+		select {
+		case c <- g.clock.Now():
+		default:
+		}
+	})
+	return &Ticker{C: c, p: p}
+}
+
+// idleTimer closes a conn that has no read or write for timeout, the activity
+// only records the time and the timer is re-armed by the time left when it fires,
+// so the timer heap is not touched on every read as SetReadDeadline does.
+type idleTimer struct {
+	timeout    int64
+	lastActive int64
+	timer      *htimer
+}
+
+// SetIdleTimeout closes c with an idle timeout error after it has no read or write for timeout,
+// 0 disables it.
+func (c *Conn) SetIdleTimeout(timeout time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.closed {
+		return
+	}
+	if timeout <= 0 {
+		atomic.StoreInt64(&c.idle.timeout, 0)
+		c.stopIdleTimer()
+		return
+	}
+	atomic.StoreInt64(&c.idle.lastActive, c.g.clock.Now().UnixNano())
+	atomic.StoreInt64(&c.idle.timeout, int64(timeout))
+	if c.idle.timer == nil {
+		c.idle.timer = &htimer{f: c.checkIdle, parent: c.g}
+		c.g.pushTimer(c.idle.timer, timeout)
+	} else {
+		c.idle.timer.Reset(timeout)
+	}
+}
+
+// touch records the activity of c for the idle timer.
+func (c *Conn) touch() {
+	if atomic.LoadInt64(&c.idle.timeout) > 0 {
+		atomic.StoreInt64(&c.idle.lastActive, c.g.clock.Now().UnixNano())
+	}
+}
+
+func (c *Conn) checkIdle() {
+	c.mux.Lock()
+	if c.closed || c.idle.timer == nil {
+		c.mux.Unlock()
+		return
+	}
+	now := c.g.clock.Now().UnixNano()
+	left := time.Duration(atomic.LoadInt64(&c.idle.lastActive) + atomic.LoadInt64(&c.idle.timeout) - now)
+	if left > 0 {
+		c.g.pushTimer(c.idle.timer, left)
+		c.mux.Unlock()
+		return
+	}
+	c.idle.timer = nil
+	c.mux.Unlock()
+	c.CloseWithError(errIdleTimeout)
+}
+
+func (c *Conn) stopIdleTimer() {
+	if c.idle.timer != nil {
+		c.idle.timer.Stop()
+		c.idle.timer = nil
+	}
+}
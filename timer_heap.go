@@ -33,7 +33,7 @@ func (it *htimer) Stop() {
 
 // reset timer.
 func (it *htimer) Reset(timeout time.Duration) {
-	it.expire = time.Now().Add(timeout)
+	it.expire = it.parent.clock.Now().Add(timeout)
 	it.parent.resetTimer(it)
 }
 
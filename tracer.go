@@ -0,0 +1,31 @@
+// Copyright 2020 lesismal. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package nbio
+
+// Tracer receives lifecycle events of a Gopher's connections.
+// Handlers are called on the poller goroutines and should not block.
+type Tracer interface {
+	// OnAccept is called when a conn is added to a poller, accepted or dialed.
+	OnAccept(c *Conn)
+
+	// OnFirstByte is called when the first data of a conn has been read.
+	OnFirstByte(c *Conn)
+
+	// OnClose is called when a conn is closed, err is the close reason.
+	OnClose(c *Conn, err error)
+}
+
+// EmptyTracer implements Tracer and does nothing,
+// it can be embedded to implement part of the Tracer interface.
+type EmptyTracer struct{}
+
+// OnAccept .
+func (t EmptyTracer) OnAccept(c *Conn) {}
+
+// OnFirstByte .
+func (t EmptyTracer) OnFirstByte(c *Conn) {}
+
+// OnClose .
+func (t EmptyTracer) OnClose(c *Conn, err error) {}